@@ -0,0 +1,305 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ValuesLayout names the layout of the teleport-kube-agent values in the
+// values ConfigMap: one of the built-in layouts below, or one configured on
+// the operator.
+type ValuesLayout string
+
+const (
+	// ValuesLayoutNested means the values are only nested under the
+	// `teleport-kube-agent` key (chart v0.11.0+).
+	ValuesLayoutNested ValuesLayout = "Nested"
+
+	// ValuesLayoutDual means the values are written both flat at the root
+	// and nested, for charts older than v0.11.0 or of unknown version.
+	ValuesLayoutDual ValuesLayout = "Dual"
+)
+
+// JoinMethod is how the kube agent joins Teleport.
+// +kubebuilder:validation:Enum=token;kubernetes;cloud
+type JoinMethod string
+
+const (
+	// JoinMethodToken joins with a static secret token written to the
+	// agent values and rotated before it expires.
+	JoinMethodToken JoinMethod = "token"
+
+	// JoinMethodKubernetes joins with the agent's service account token,
+	// validated by Teleport against a `kubernetes` join token. No secret
+	// leaves the management cluster and nothing needs rotating.
+	JoinMethodKubernetes JoinMethod = "kubernetes"
+
+	// JoinMethodCloud joins with the cloud provider's identity of the
+	// agent's nodes: `iam` on AWS, `azure` on Azure and `gcp` on GCP,
+	// picked from the kind of the Cluster's infrastructureRef.
+	JoinMethodCloud JoinMethod = "cloud"
+)
+
+// AgentAppKind is the kind of the resource deploying teleport-kube-agent.
+// +kubebuilder:validation:Enum=App;HelmRelease
+type AgentAppKind string
+
+const (
+	// AgentAppKindApp is a Giant Swarm App CR.
+	AgentAppKindApp AgentAppKind = "App"
+
+	// AgentAppKindHelmRelease is a Flux HelmRelease.
+	AgentAppKindHelmRelease AgentAppKind = "HelmRelease"
+)
+
+// TeleportClusterSpec declares how a workload cluster is enrolled in
+// Teleport. Every field is optional; empty fields fall back to the
+// operator-wide defaults.
+type TeleportClusterSpec struct {
+	// Roles are the Teleport roles the kube agent joins with: `kube`,
+	// `app`, `db`, `discovery` or `windowsdesktop`. When empty, the
+	// Cluster's `teleport.giantswarm.io/roles` annotation is used, else the
+	// operator's default roles plus the roles the cluster's
+	// teleport-kube-agent user values configure, each adjusted by a
+	// `role.teleport.giantswarm.io/<role>` Cluster label.
+	// +optional
+	Roles []string `json:"roles,omitempty"`
+
+	// RegisterName is the name the cluster is registered with in Teleport.
+	// Defaults to `<management cluster>-<cluster>`, or the cluster name for
+	// the management cluster itself.
+	// +optional
+	RegisterName string `json:"registerName,omitempty"`
+
+	// TokenTTL is the lifetime of newly generated join tokens, for every
+	// role. Defaults to the per-role lifetime from the operator config.
+	// +optional
+	TokenTTL *metav1.Duration `json:"tokenTTL,omitempty"`
+
+	// TokenRotationPercent is the share of a join token's lifetime after
+	// which it is replaced. Defaults to the operator config, or 100, i.e.
+	// tokens are replaced once they expired.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	TokenRotationPercent *int32 `json:"tokenRotationPercent,omitempty"`
+
+	// Labels are added to the join tokens generated for the cluster, over
+	// the labels propagated from the Cluster. The `cluster` and `roles`
+	// labels are reserved by the operator.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// JoinMethod is how the kube agent joins Teleport. Defaults to the
+	// operator config, or `token`.
+	// +optional
+	JoinMethod JoinMethod `json:"joinMethod,omitempty"`
+
+	// KubernetesJoin configures the `kubernetes` join method.
+	// +optional
+	KubernetesJoin *KubernetesJoinSpec `json:"kubernetesJoin,omitempty"`
+
+	// AgentApp references the App CR or HelmRelease deploying
+	// teleport-kube-agent to the cluster.
+	// +optional
+	AgentApp *AgentAppReference `json:"agentApp,omitempty"`
+
+	// Databases are proxied by the kube agent for Teleport Database Access.
+	// Declaring any adds the `db` role, unless Roles or the Cluster's roles
+	// annotation set the roles explicitly or a role label disables it.
+	// Databases are only rendered into the agent values with the `db` role.
+	// +optional
+	Databases []DatabaseSpec `json:"databases,omitempty"`
+}
+
+// DatabaseProtocol is the wire protocol of a database.
+// +kubebuilder:validation:Enum=postgres;mysql
+type DatabaseProtocol string
+
+const (
+	DatabaseProtocolPostgres DatabaseProtocol = "postgres"
+	DatabaseProtocolMySQL    DatabaseProtocol = "mysql"
+)
+
+// DatabaseSpec declares a database the kube agent proxies.
+type DatabaseSpec struct {
+	// Name of the database in Teleport.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// Protocol of the database.
+	Protocol DatabaseProtocol `json:"protocol"`
+
+	// URI is the address of the database, e.g. `postgres.example.com:5432`.
+	// +kubebuilder:validation:MinLength=1
+	URI string `json:"uri"`
+
+	// Labels are set on the database in Teleport. The `cluster` label is
+	// reserved by the operator and set to the cluster's register name.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// AgentAppReference names the App CR or HelmRelease deploying
+// teleport-kube-agent, in the TeleportCluster's namespace.
+type AgentAppReference struct {
+	// Name of the App CR or HelmRelease. Defaults to
+	// `<cluster>-<appName>`, with appName taken from the operator config.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Kind of the resource the operator creates for the kube agent while
+	// it manages the kube agent's App CR or HelmRelease. Defaults to the
+	// operator config, or `App`.
+	// +optional
+	Kind AgentAppKind `json:"kind,omitempty"`
+}
+
+// KubernetesJoinSpec configures the `kubernetes` join token of a cluster.
+type KubernetesJoinSpec struct {
+	// ServiceAccount the kube agent runs as, as `namespace:name`. Defaults
+	// to `kube-system:teleport-kube-agent`.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?:[a-z0-9]([-.a-z0-9]*[a-z0-9])?$`
+	// +optional
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+
+	// InCluster has Teleport validate the agent's service account token
+	// with a TokenReview in its own cluster. Only possible for the cluster
+	// Teleport's auth service runs in.
+	// +optional
+	InCluster bool `json:"inCluster,omitempty"`
+
+	// JWKS is the JSON Web Key Set the cluster signs service account tokens
+	// with. When empty and InCluster is false, it is fetched from the
+	// cluster's API server through its CAPI kubeconfig Secret.
+	// +optional
+	JWKS string `json:"jwks,omitempty"`
+}
+
+// JoinTokenStatus describes a join token the operator generated.
+type JoinTokenStatus struct {
+	// Name of the token in Teleport.
+	Name string `json:"name"`
+
+	// Roles the token grants.
+	// +optional
+	Roles []string `json:"roles,omitempty"`
+
+	// ExpiresAt is the time the token expires in Teleport.
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+}
+
+// RetiringJoinTokenStatus describes a join token that was replaced by a
+// rotation and is kept valid for a grace period.
+type RetiringJoinTokenStatus struct {
+	JoinTokenStatus `json:",inline"`
+
+	// RotatedAt is the time the token was replaced.
+	RotatedAt metav1.Time `json:"rotatedAt"`
+
+	// RetireAfter is the end of the grace period. The token is deleted once
+	// it has passed and, for the kube join token, the agent has been
+	// observed heartbeating since RotatedAt.
+	RetireAfter metav1.Time `json:"retireAfter"`
+}
+
+// TeleportClusterStatus reports the observed enrollment state.
+type TeleportClusterStatus struct {
+	// ObservedGeneration is the spec generation last reconciled.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// RegisterName is the name the cluster is registered with in Teleport.
+	// +optional
+	RegisterName string `json:"registerName,omitempty"`
+
+	// Roles are the roles the kube agent currently joins with.
+	// +optional
+	Roles []string `json:"roles,omitempty"`
+
+	// KubeJoinToken is the token written to the teleport-kube-agent values.
+	// +optional
+	KubeJoinToken *JoinTokenStatus `json:"kubeJoinToken,omitempty"`
+
+	// NodeJoinToken is the token stored in the cluster's join token Secret.
+	// +optional
+	NodeJoinToken *JoinTokenStatus `json:"nodeJoinToken,omitempty"`
+
+	// RetiringJoinTokens are the previous join tokens still valid after a
+	// rotation.
+	// +optional
+	RetiringJoinTokens []RetiringJoinTokenStatus `json:"retiringJoinTokens,omitempty"`
+
+	// LastRotationRequest is the value of the Cluster's
+	// teleport.giantswarm.io/rotate-token annotation that was last handled.
+	// +optional
+	LastRotationRequest string `json:"lastRotationRequest,omitempty"`
+
+	// ValuesLayout is the name of the layout of the values ConfigMap.
+	// +optional
+	ValuesLayout ValuesLayout `json:"valuesLayout,omitempty"`
+
+	// AgentAppVersion is the deployed teleport-kube-agent chart version,
+	// empty when unknown.
+	// +optional
+	AgentAppVersion string `json:"agentAppVersion,omitempty"`
+
+	// TeleportServerVersion is the version of the Teleport auth server
+	// the kube agent's Teleport version was last checked against, empty
+	// when unknown.
+	// +optional
+	TeleportServerVersion string `json:"teleportServerVersion,omitempty"`
+
+	// BotOutputSecret is the name of the kubeconfig Secret written by tbot,
+	// empty while tbot is disabled or has not produced it yet.
+	// +optional
+	BotOutputSecret string `json:"botOutputSecret,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=tc
+//+kubebuilder:printcolumn:name="Register Name",type=string,JSONPath=`.status.registerName`
+//+kubebuilder:printcolumn:name="Roles",type=string,JSONPath=`.status.roles`
+//+kubebuilder:printcolumn:name="Token Expiry",type=date,JSONPath=`.status.kubeJoinToken.expiresAt`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// TeleportCluster is the Schema for the teleportclusters API. The operator
+// creates one per CAPI Cluster, with the same name and namespace, owned by
+// the Cluster.
+type TeleportCluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TeleportClusterSpec   `json:"spec,omitempty"`
+	Status TeleportClusterStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TeleportClusterList contains a list of TeleportCluster
+type TeleportClusterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TeleportCluster `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TeleportCluster{}, &TeleportClusterList{})
+}
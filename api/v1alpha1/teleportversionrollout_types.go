@@ -0,0 +1,162 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RolloutPhase is the phase of a Teleport version rollout.
+// +kubebuilder:validation:Enum=Progressing;Paused;Failed;Completed
+type RolloutPhase string
+
+const (
+	// RolloutPhaseProgressing means the waves are released one after the
+	// other.
+	RolloutPhaseProgressing RolloutPhase = "Progressing"
+
+	// RolloutPhasePaused means no further wave is released until the
+	// teleport.giantswarm.io/pause-rollout annotation is removed.
+	RolloutPhasePaused RolloutPhase = "Paused"
+
+	// RolloutPhaseFailed means the agents of a wave did not report healthy
+	// in time. No further wave is released until the
+	// teleport.giantswarm.io/resume-rollout annotation is set to a new
+	// value.
+	RolloutPhaseFailed RolloutPhase = "Failed"
+
+	// RolloutPhaseCompleted means every cluster runs the new version.
+	RolloutPhaseCompleted RolloutPhase = "Completed"
+)
+
+// RolloutWavePhase is the phase of a wave of a Teleport version rollout.
+// +kubebuilder:validation:Enum=Pending;Progressing;Healthy;Failed
+type RolloutWavePhase string
+
+const (
+	// RolloutWavePhasePending means the clusters of the wave keep the
+	// previous version.
+	RolloutWavePhasePending RolloutWavePhase = "Pending"
+
+	// RolloutWavePhaseProgressing means the clusters of the wave were
+	// released and their agents are waited for.
+	RolloutWavePhaseProgressing RolloutWavePhase = "Progressing"
+
+	// RolloutWavePhaseHealthy means the agents of every cluster of the wave
+	// report the new version in Teleport.
+	RolloutWavePhaseHealthy RolloutWavePhase = "Healthy"
+
+	// RolloutWavePhaseFailed means the agents of the wave did not report
+	// healthy before the wave timeout.
+	RolloutWavePhaseFailed RolloutWavePhase = "Failed"
+)
+
+// RolloutWaveStatus describes a wave of a Teleport version rollout.
+type RolloutWaveStatus struct {
+	// Name of the wave in the operator's rollout policy.
+	Name string `json:"name"`
+
+	// Phase of the wave.
+	Phase RolloutWavePhase `json:"phase"`
+
+	// Clusters of the wave, as namespace/name.
+	// +optional
+	Clusters []string `json:"clusters,omitempty"`
+
+	// PendingClusters are the clusters of a released wave whose agents do
+	// not report the new version in Teleport yet.
+	// +optional
+	PendingClusters []string `json:"pendingClusters,omitempty"`
+
+	// StartTime is the time the wave was released.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is the time the wave was found healthy or failed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// TeleportVersionRolloutStatus reports the progress of the rollout of the
+// kube agents' Teleport version.
+type TeleportVersionRolloutStatus struct {
+	// FromVersion is the Teleport version rolled out before.
+	// +optional
+	FromVersion string `json:"fromVersion,omitempty"`
+
+	// ToVersion is the Teleport version being rolled out.
+	// +optional
+	ToVersion string `json:"toVersion,omitempty"`
+
+	// Phase of the rollout.
+	// +optional
+	Phase RolloutPhase `json:"phase,omitempty"`
+
+	// Message explains Phase.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// StartTime is the time the rollout started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is the time the last wave was found healthy.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Waves of the rollout, in the order they are released.
+	// +optional
+	Waves []RolloutWaveStatus `json:"waves,omitempty"`
+
+	// LastResumeRequest is the value of the
+	// teleport.giantswarm.io/resume-rollout annotation that was last
+	// handled.
+	// +optional
+	LastResumeRequest string `json:"lastResumeRequest,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=tvr
+//+kubebuilder:printcolumn:name="From",type=string,JSONPath=`.status.fromVersion`
+//+kubebuilder:printcolumn:name="To",type=string,JSONPath=`.status.toVersion`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// TeleportVersionRollout is the Schema for the teleportversionrollouts API.
+// The operator creates a single one, named like its ConfigMap in its
+// namespace, and reports the rollout of Teleport version changes across the
+// clusters in its status.
+type TeleportVersionRollout struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status TeleportVersionRolloutStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TeleportVersionRolloutList contains a list of TeleportVersionRollout
+type TeleportVersionRolloutList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TeleportVersionRollout `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TeleportVersionRollout{}, &TeleportVersionRolloutList{})
+}
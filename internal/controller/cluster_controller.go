@@ -18,47 +18,73 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/giantswarm/microerror"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
 	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
 	ctrl "sigs.k8s.io/controller-runtime"
 
-	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
 	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/metrics"
 	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
-const identityExpirationPeriod = 20 * time.Minute
-
 // ClusterReconciler reconciles a Cluster object
 type ClusterReconciler struct {
-	Client            client.Client
-	Log               logr.Logger
-	Scheme            *runtime.Scheme
-	Teleport          *teleport.Teleport
-	IsBotEnabled      bool
-	Namespace         string
-	lastAssignedRoles []string
+	Client       client.Client
+	Log          logr.Logger
+	Scheme       *runtime.Scheme
+	Teleport     *teleport.Teleport
+	Recorder     events.EventRecorder
+	IsBotEnabled bool
+	Namespace    string
+
+	// ConfigChanges enqueues Clusters after the operator configuration was
+	// reloaded, see ConfigReconciler. Optional.
+	ConfigChanges <-chan event.GenericEvent
+
+	// MaxConcurrentReconciles is the number of Clusters reconciled in
+	// parallel. Reconcile keeps no state between calls, so it is safe to
+	// raise. Defaults to 1.
+	MaxConcurrentReconciles int
 }
 
 //+kubebuilder:rbac:groups=cluster.x-k8s.io.giantswarm.io,resources=clusters,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=cluster.x-k8s.io.giantswarm.io,resources=clusters/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=cluster.x-k8s.io.giantswarm.io,resources=clusters/finalizers,verbs=update
-//+kubebuilder:rbac:groups=helm.toolkit.fluxcd.io,resources=helmreleases,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=helm.toolkit.fluxcd.io,resources=helmreleases,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=teleport.giantswarm.io,resources=teleportclusters,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=teleport.giantswarm.io,resources=teleportclusters/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=teleport.giantswarm.io,resources=teleportversionrollouts,verbs=get;list;watch
+//+kubebuilder:rbac:groups=events.k8s.io,resources=events,verbs=create;patch;update
+//+kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=awsclusters;awsclusterroleidentities;azureclusters;gcpclusters;gcpmanagedclusters,verbs=get
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.4/pkg/reconcile
-func (r *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, reterr error) {
 	log := r.Log.WithValues("cluster", req.NamespacedName)
 
 	cluster := &capi.Cluster{}
@@ -71,257 +97,911 @@ func (r *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 	log.Info("Reconciling cluster")
 
-	appsEnabled, err := r.Teleport.AreTeleportAppsEnabled(ctx, cluster.Name, cluster.Namespace)
-	if err != nil {
-		log.Error(err, "Failed to check if Teleport apps are enabled")
-		return ctrl.Result{}, microerror.Mask(err)
-	}
-
-	roles := []string{key.RoleKube}
-	if appsEnabled {
-		roles = append(roles, key.RoleApp)
-	}
-	r.lastAssignedRoles = roles
-	if r.Teleport.Identity != nil {
-		log.Info("Teleport identity", "last-read-minutes-ago", r.Teleport.Identity.Age(), "hash", r.Teleport.Identity.Hash())
-	}
-
-	if r.Teleport.Identity == nil || time.Since(r.Teleport.Identity.LastRead) > identityExpirationPeriod {
-		log.Info("Retrieving new identity", "secretName", key.TeleportBotSecretName)
-
-		newIdentityConfig, err := config.GetIdentityConfigFromSecret(ctx, r.Client, r.Namespace)
+	// Conditions and the TeleportCluster status are only reported for
+	// clusters that are not being deleted: once the finalizer is gone there
+	// is nothing left to patch.
+	var teleportCluster *v1alpha1.TeleportCluster
+	if cluster.DeletionTimestamp.IsZero() {
+		patchHelper, err := patch.NewHelper(cluster, r.Client)
 		if err != nil {
 			return ctrl.Result{}, microerror.Mask(err)
 		}
+		defer func() {
+			if err := patchClusterConditions(ctx, patchHelper, cluster); err != nil {
+				log.Error(err, "Failed to patch cluster conditions")
+				if reterr == nil {
+					reterr = err
+				}
+			}
+		}()
 
-		if r.Teleport.TeleportClient, err = teleport.NewClient(ctx, r.Teleport.Config.ProxyAddr, newIdentityConfig.IdentityFile); err != nil {
+		teleportCluster, err = teleport.EnsureTeleportCluster(ctx, log, r.Client, r.Scheme, cluster)
+		if err != nil {
 			return ctrl.Result{}, microerror.Mask(err)
 		}
-		if r.Teleport.Identity == nil {
-			log.Info("Connected to teleport cluster", "proxyAddr", r.Teleport.Config.ProxyAddr)
-		} else {
-			log.Info("Re-connected to teleport cluster with new identity", "proxyAddr", r.Teleport.Config.ProxyAddr)
+		statusPatch := client.MergeFrom(teleportCluster.DeepCopy())
+		defer func() {
+			teleportCluster.Status.ObservedGeneration = teleportCluster.Generation
+			if err := r.Client.Status().Patch(ctx, teleportCluster, statusPatch); err != nil {
+				log.Error(err, "Failed to patch TeleportCluster status")
+				if reterr == nil {
+					reterr = microerror.Mask(err)
+				}
+			}
+		}()
+	} else {
+		var err error
+		teleportCluster, err = teleport.GetTeleportCluster(ctx, r.Client, cluster)
+		if err != nil {
+			return ctrl.Result{}, microerror.Mask(err)
 		}
-		r.Teleport.Identity = newIdentityConfig
 	}
 
-	registerName := cluster.Name
-	if cluster.Name != r.Teleport.Config.ManagementClusterName {
-		registerName = key.GetRegisterName(r.Teleport.Config.ManagementClusterName, cluster.Name)
+	settings, err := r.Teleport.ResolveClusterSettings(ctx, cluster, teleportCluster)
+	if err != nil {
+		log.Error(err, "Failed to resolve Teleport settings for the cluster")
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.ClusterSettingsFailedReason, err)
+		return ctrl.Result{}, microerror.Mask(err)
+	}
+	log = log.WithValues("registerName", settings.RegisterName)
+
+	// The connection to Teleport is kept up by the ClientProvider. Until it
+	// has connected there is nothing to do but retry.
+	if _, err := r.Teleport.Clients.Client(); err != nil {
+		r.warningEvent(cluster, key.TeleportUnreachableEventReason, "Connect",
+			"Not connected to Teleport proxy %s: %v", r.Teleport.Config().ProxyAddr, err)
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportConnectionFailedReason, err)
+		return ctrl.Result{}, microerror.Mask(err)
 	}
 
 	// Check if the cluster instance is marked to be deleted, which is indicated by the deletion timestamp being set.
 	// if it is, delete the cluster from teleport
 	if !cluster.DeletionTimestamp.IsZero() {
-		// Delete teleport token for the cluster
-		if err := r.Teleport.DeleteToken(ctx, log, registerName); err != nil {
+		if err := r.reconcileDelete(ctx, log, cluster, settings); err != nil {
 			return ctrl.Result{}, microerror.Mask(err)
 		}
+		return ctrl.Result{}, nil
+	}
 
-		// Delete Secret for the cluster
-		if err := r.Teleport.DeleteSecret(ctx, log, r.Client, cluster.Name, cluster.Namespace); err != nil {
+	// Add finalizer to cluster CR if it's not there
+	if !controllerutil.ContainsFinalizer(cluster, key.TeleportOperatorFinalizer) {
+		if err := teleport.AddFinalizer(ctx, log, cluster, r.Client); err != nil {
 			return ctrl.Result{}, microerror.Mask(err)
 		}
+	}
+
+	teleportCluster.Status.RegisterName = settings.RegisterName
+	teleportCluster.Status.Roles = settings.Roles
+
+	r.reconcileTeleportVersion(ctx, log, cluster, teleportCluster)
 
-		// Delete ConfigMap for the cluster
-		if err := r.Teleport.DeleteConfigMap(ctx, log, r.Client, cluster.Name, cluster.Namespace); err != nil {
+	// A new value of the rotate-token annotation rotates the join tokens
+	// right away. It is only recorded as handled once the previous tokens
+	// are revoked, so a failed rotation is retried.
+	rotationRequest := cluster.GetAnnotations()[key.RotateTokenAnnotation]
+	rotate := rotationRequest != "" && rotationRequest != teleportCluster.Status.LastRotationRequest
+	if rotate {
+		log.Info("Rotating join tokens on request", "rotationRequest", rotationRequest)
+	}
+
+	if err := r.reconcileNodeJoinToken(ctx, log, cluster, teleportCluster, settings, rotate); err != nil {
+		return ctrl.Result{}, microerror.Mask(err)
+	}
+	recordTokenExpiry(cluster, metrics.TokenSourceSecret, teleportCluster.Status.NodeJoinToken)
+
+	if err := r.reconcileAgentValues(ctx, log, cluster, teleportCluster, settings, rotate); err != nil {
+		return ctrl.Result{}, microerror.Mask(err)
+	}
+	recordTokenExpiry(cluster, metrics.TokenSourceConfigMap, teleportCluster.Status.KubeJoinToken)
+
+	if rotate {
+		if err := r.revokeRetiringJoinTokens(ctx, log, cluster, teleportCluster, settings); err != nil {
 			return ctrl.Result{}, microerror.Mask(err)
 		}
+		teleportCluster.Status.LastRotationRequest = rotationRequest
+	}
 
-		if r.IsBotEnabled {
-			botMgr, err := teleport.NewTeleportAppConfigManager(ctx, r.Client,
-				key.TeleportBotAppName,
-				key.TeleportBotNamespace,
-				key.GetTbotConfigmapName(cluster.Name))
-			if err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
+	r.reconcileRetiringJoinTokens(ctx, log, cluster, teleportCluster, settings)
+
+	// The Secret and the values ConfigMap now hold the current join tokens,
+	// any other token of the cluster that is not retiring is superseded.
+	// Failures are left to the janitor's periodic sweep.
+	current := []string{teleportCluster.Status.NodeJoinToken.Name, teleportCluster.Status.KubeJoinToken.Name}
+	for _, token := range teleportCluster.Status.RetiringJoinTokens {
+		current = append(current, token.Name)
+	}
+	deleted, err := r.Teleport.Janitor.DeleteSuperseded(ctx, log, settings.RegisterName, current...)
+	if err != nil {
+		log.Error(err, "Failed to delete superseded join tokens")
+	} else if deleted > 0 {
+		r.normalEvent(cluster, nil, key.JoinTokensDeletedEventReason, "DeleteToken",
+			"Deleted %d superseded join tokens for %s", deleted, settings.RegisterName)
+	}
+
+	if r.IsBotEnabled {
+		if err := r.reconcileBotOutput(ctx, log, cluster, teleportCluster, settings); err != nil {
+			return ctrl.Result{}, microerror.Mask(err)
+		}
+	}
+
+	// We need to requeue to check the teleport token validity
+	// and update secret for the cluster, if it is due for rotation
+	return ctrl.Result{RequeueAfter: r.requeueAfter(settings, teleportCluster.Status)}, nil
+}
+
+// requeueAfter returns when the cluster must be reconciled again: after the
+// configured requeue interval, or earlier if one of its join tokens is due
+// for rotation before then.
+func (r *ClusterReconciler) requeueAfter(settings *teleport.ClusterSettings, status v1alpha1.TeleportClusterStatus) time.Duration {
+	requeueAfter := r.Teleport.Config().GetRequeueInterval()
+	now := time.Now()
+	for _, token := range []*v1alpha1.JoinTokenStatus{status.NodeJoinToken, status.KubeJoinToken} {
+		if token == nil || token.ExpiresAt == nil {
+			continue
+		}
+		if untilRotation := settings.RotateAt(token.Roles, token.ExpiresAt.Time).Sub(now); untilRotation < requeueAfter {
+			requeueAfter = untilRotation
+		}
+	}
+	for _, token := range status.RetiringJoinTokens {
+		if untilRetirement := token.RetireAfter.Sub(now); untilRetirement > 0 && untilRetirement < requeueAfter {
+			requeueAfter = untilRetirement
+		}
+	}
+	return max(requeueAfter, key.MinRequeueInterval)
+}
+
+// reconcileRetiringJoinTokens deletes the join tokens kept valid after a
+// rotation once their grace period is over. A token the kube agent joins
+// with is only retired once the agent has been restarted and heartbeated
+// since the rotation, so it has picked up the new values. Expired tokens are dropped right away.
+// Failures are retried on the next reconcile.
+func (r *ClusterReconciler) reconcileRetiringJoinTokens(ctx context.Context, log logr.Logger, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster, settings *teleport.ClusterSettings) {
+	now := time.Now()
+	var retiring []v1alpha1.RetiringJoinTokenStatus
+	for _, token := range teleportCluster.Status.RetiringJoinTokens {
+		expired := token.ExpiresAt != nil && !now.Before(token.ExpiresAt.Time)
+		if !expired {
+			if now.Before(token.RetireAfter.Time) {
+				retiring = append(retiring, token)
+				continue
 			}
-			if err := botMgr.DeleteConfig(ctx, log); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
+			if slices.Contains(token.Roles, key.RoleKube) {
+				restarted, err := r.Teleport.IsAgentRestartedSince(ctx, cluster, settings, token.RotatedAt.Time)
+				if err != nil {
+					log.Error(err, "Failed to look up the agent restart")
+				}
+				if !restarted {
+					log.Info("Waiting for the agent to restart and heartbeat before retiring the previous join token", "roles", token.Roles, "rotatedAt", token.RotatedAt)
+					retiring = append(retiring, token)
+					continue
+				}
 			}
+		}
 
-			if err := r.Teleport.DeleteTbotConfigMap(ctx, log, r.Client, cluster.Name, key.TeleportBotNamespace); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
-			}
+		if err := r.Teleport.RetireToken(ctx, token.Name); err != nil {
+			log.Error(err, "Failed to retire the previous join token", "roles", token.Roles)
+			retiring = append(retiring, token)
+			continue
+		}
+		log.Info("Retired the previous join token", "roles", token.Roles, "rotatedAt", token.RotatedAt)
+		r.normalEvent(cluster, nil, key.JoinTokenRetiredEventReason, "RetireToken",
+			"Retired previous %s join token for %s", key.RolesToString(token.Roles), settings.RegisterName)
+	}
+	teleportCluster.Status.RetiringJoinTokens = retiring
+}
 
-			if err := r.Teleport.DeleteKubeconfigSecret(ctx, log, r.Client, cluster.Name, key.TeleportBotNamespace); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
-			}
+// revokeRetiringJoinTokens deletes all join tokens kept valid after a
+// rotation right away, without waiting for their grace period or the agent.
+// Tokens that could not be deleted are kept for the next attempt.
+func (r *ClusterReconciler) revokeRetiringJoinTokens(ctx context.Context, log logr.Logger, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster, settings *teleport.ClusterSettings) error {
+	var retiring []v1alpha1.RetiringJoinTokenStatus
+	var revokeErr error
+	for _, token := range teleportCluster.Status.RetiringJoinTokens {
+		if err := r.Teleport.RetireToken(ctx, token.Name); err != nil {
+			log.Error(err, "Failed to revoke the previous join token", "roles", token.Roles)
+			retiring = append(retiring, token)
+			revokeErr = err
+			continue
 		}
+		log.Info("Revoked the previous join token", "roles", token.Roles, "rotatedAt", token.RotatedAt)
+		r.normalEvent(cluster, nil, key.JoinTokenRevokedEventReason, "RevokeToken",
+			"Revoked previous %s join token for %s on request", key.RolesToString(token.Roles), settings.RegisterName)
+	}
+	teleportCluster.Status.RetiringJoinTokens = retiring
+	if revokeErr != nil {
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, revokeErr)
+		return microerror.Mask(revokeErr)
+	}
+	return nil
+}
+
+// reconcileDelete removes the cluster from Teleport and cleans up everything
+// the operator created for it before releasing the finalizer.
+func (r *ClusterReconciler) reconcileDelete(ctx context.Context, log logr.Logger, cluster *capi.Cluster, settings *teleport.ClusterSettings) error {
+	// Delete teleport token for the cluster
+	if err := r.Teleport.DeleteToken(ctx, log, settings.RegisterName); err != nil {
+		return microerror.Mask(err)
+	}
+	metrics.DeleteTokenExpiry(cluster.Namespace, cluster.Name)
+	r.normalEvent(cluster, nil, key.JoinTokensDeletedEventReason, "DeleteToken",
+		"Deleted Teleport join tokens for %s", settings.RegisterName)
+
+	// Delete Secret for the cluster
+	if err := r.Teleport.DeleteSecret(ctx, log, r.Client, cluster.Name, cluster.Namespace); err != nil {
+		return microerror.Mask(err)
+	}
 
-		kubeAgentMgr, err := teleport.NewTeleportAppConfigManager(ctx, r.Client,
-			key.GetAppName(cluster.Name, r.Teleport.Config.AppName),
-			cluster.Namespace,
-			key.GetConfigmapName(cluster.Name, r.Teleport.Config.AppName))
+	// Delete ConfigMap for the cluster
+	if err := r.Teleport.DeleteConfigMap(ctx, log, r.Client, cluster.Name, cluster.Namespace); err != nil {
+		return microerror.Mask(err)
+	}
+	if err := r.Teleport.DeleteAgentTokenSecret(ctx, log, r.Client, cluster.Name, cluster.Namespace); err != nil {
+		return microerror.Mask(err)
+	}
+
+	if r.IsBotEnabled {
+		botMgr, err := teleport.NewTeleportAppConfigManagerWithEvents(ctx, r.Client,
+			key.TeleportBotAppName,
+			key.TeleportBotNamespace,
+			key.GetTbotConfigmapName(cluster.Name),
+			r.Recorder, cluster)
 		if err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+			return microerror.Mask(err)
 		}
-		if err := kubeAgentMgr.DeleteConfig(ctx, log); err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+		if err := botMgr.DeleteConfig(ctx, log); err != nil {
+			return microerror.Mask(err)
+		}
+
+		if err := r.Teleport.DeleteTbotConfigMap(ctx, log, r.Client, cluster.Name, key.TeleportBotNamespace); err != nil {
+			return microerror.Mask(err)
 		}
 
-		// Remove finalizer from the Cluster CR
-		if controllerutil.ContainsFinalizer(cluster, key.TeleportOperatorFinalizer) {
-			if err := teleport.RemoveFinalizer(ctx, log, cluster, r.Client); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
+		if err := r.Teleport.DeleteKubeconfigSecret(ctx, log, r.Client, cluster.Name, key.TeleportBotNamespace); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+
+	// A managed kube agent App CR or HelmRelease is deleted along with the
+	// cluster, any other one only loses the values reference.
+	if settings.ManageAgentApp {
+		for _, kind := range []string{key.AgentAppKindApp, key.AgentAppKindHelmRelease} {
+			if err := r.deleteKubeAgentApp(ctx, log, cluster, settings, kind, "the cluster is deleted"); err != nil {
+				return microerror.Mask(err)
 			}
 		}
+	}
 
-		return ctrl.Result{}, nil
+	kubeAgentMgr, err := teleport.NewTeleportAppConfigManagerWithSecret(ctx, r.Client,
+		settings.AgentAppName,
+		cluster.Namespace,
+		key.GetConfigmapName(cluster.Name, r.Teleport.Config().AppName),
+		key.GetAgentTokenSecretName(cluster.Name, r.Teleport.Config().AppName),
+		false,
+		r.Recorder, cluster)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if err := kubeAgentMgr.DeleteConfig(ctx, log); err != nil {
+		return microerror.Mask(err)
 	}
 
-	// Add finalizer to cluster CR if it's not there
-	if !controllerutil.ContainsFinalizer(cluster, key.TeleportOperatorFinalizer) {
-		if err := teleport.AddFinalizer(ctx, log, cluster, r.Client); err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+	// Remove finalizer from the Cluster CR
+	if controllerutil.ContainsFinalizer(cluster, key.TeleportOperatorFinalizer) {
+		if err := teleport.RemoveFinalizer(ctx, log, cluster, r.Client); err != nil {
+			return microerror.Mask(err)
 		}
 	}
 
+	return nil
+}
+
+// reconcileTeleportVersion checks the Teleport version the kube agent is
+// pinned to against the Teleport server version and reports the result in
+// the TeleportVersionCompatible condition. A version clamped to the server
+// version is reported in a warning event whenever the reason changes.
+func (r *ClusterReconciler) reconcileTeleportVersion(ctx context.Context, log logr.Logger, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster) {
+	version := r.Teleport.AgentTeleportVersion(ctx)
+	teleportCluster.Status.TeleportServerVersion = version.ServerVersion
+	if !version.Clamped() {
+		markConditionTrue(cluster, key.TeleportVersionCompatibleCondition, version.Reason, version.Message)
+		return
+	}
+
+	if c := conditions.Get(cluster, key.TeleportVersionCompatibleCondition); c == nil || c.Reason != version.Reason || c.Message != version.Message {
+		log.Info("Clamped the Teleport version to the server version",
+			"teleportVersion", r.Teleport.Config().TeleportVersion,
+			"serverVersion", version.ServerVersion,
+			"reason", version.Reason)
+		r.warningEvent(cluster, key.TeleportVersionClampedEventReason, "CheckVersion", "%s", version.Message)
+	}
+	markConditionFalseWithMessage(cluster, key.TeleportVersionCompatibleCondition, version.Reason, version.Message)
+}
+
+// reconcileNodeJoinToken makes sure the cluster's join token Secret holds a
+// valid node token, replacing it if rotate is set. It marks
+// TeleportJoinTokenReady False on failure; the True state is only set once
+// the kube token has been checked as well.
+func (r *ClusterReconciler) reconcileNodeJoinToken(ctx context.Context, log logr.Logger, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster, settings *teleport.ClusterSettings, rotate bool) error {
+	nodeRoles := []string{key.RoleNode}
+	tokenOptions := settings.TokenOptions(nodeRoles)
+
 	// Check and update Secret if necessary
 	secret, err := r.Teleport.GetSecret(ctx, log, r.Client, cluster.Name, cluster.Namespace)
 	if err != nil {
-		return ctrl.Result{}, microerror.Mask(err)
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.JoinTokenSecretFailedReason, err)
+		return microerror.Mask(err)
 	}
 	if secret == nil {
-		token, err := r.Teleport.GenerateToken(ctx, registerName, []string{key.RoleNode})
+		token, err := r.Teleport.GenerateTokenWithOptions(ctx, settings.RegisterName, nodeRoles, tokenOptions)
 		if err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+			markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+			return microerror.Mask(err)
 		}
 		if err := r.Teleport.CreateSecret(ctx, log, r.Client, cluster.Name, cluster.Namespace, token); err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+			markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.JoinTokenSecretFailedReason, err)
+			return microerror.Mask(err)
 		}
-	} else {
-		token, err := r.Teleport.GetTokenFromSecret(ctx, secret)
+		r.normalEvent(cluster, nil, key.JoinTokenCreatedEventReason, "CreateToken",
+			"Created node join token for %s in Secret %s/%s", settings.RegisterName, cluster.Namespace, key.GetSecretName(cluster.Name))
+		teleportCluster.Status.NodeJoinToken = teleport.NewJoinTokenStatus(token, nodeRoles, time.Now().Add(tokenOptions.TTL))
+		return nil
+	}
+
+	token, err := r.Teleport.GetTokenFromSecret(ctx, secret)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.JoinTokenSecretFailedReason, err)
+		return microerror.Mask(err)
+	}
+	tokenValid, err := r.Teleport.IsTokenValid(ctx, settings.RegisterName, token, key.RoleNode)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+		return microerror.Mask(err)
+	}
+	var expiry time.Time
+	// A token that is still valid when it is rotated is kept valid for the
+	// grace period.
+	retire := false
+	if tokenValid {
+		expiry, err = r.Teleport.GetTokenExpiry(ctx, token)
 		if err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+			markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+			return microerror.Mask(err)
+		}
+		if rotate || !time.Now().Before(settings.RotateAt(nodeRoles, expiry)) {
+			log.Info("Node join token is due for rotation", "secretName", secret.GetName(), "expiresAt", expiry, "requested", rotate)
+			tokenValid = false
+			retire = true
 		}
-		tokenValid, err := r.Teleport.IsTokenValid(ctx, registerName, token, key.RoleNode)
+	}
+	if !tokenValid {
+		newToken, err := r.Teleport.GenerateTokenWithOptions(ctx, settings.RegisterName, nodeRoles, tokenOptions)
 		if err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+			markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+			return microerror.Mask(err)
 		}
-		if !tokenValid {
-			token, err := r.Teleport.GenerateToken(ctx, registerName, []string{key.RoleNode})
-			if err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
-			}
-			if err := r.Teleport.UpdateSecret(ctx, log, r.Client, cluster.Name, cluster.Namespace, token); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
-			}
-		} else {
-			log.Info("Secret has valid teleport node join token", "secretName", secret.GetName())
+		metrics.TokenRotated(nodeRoles)
+		if err := r.Teleport.UpdateSecret(ctx, log, r.Client, cluster.Name, cluster.Namespace, newToken); err != nil {
+			markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.JoinTokenSecretFailedReason, err)
+			return microerror.Mask(err)
+		}
+		r.normalEvent(cluster, secret, key.JoinTokenRotatedEventReason, "RotateToken",
+			"Rotated node join token for %s in Secret %s/%s", settings.RegisterName, secret.GetNamespace(), secret.GetName())
+		now := time.Now()
+		teleportCluster.Status.NodeJoinToken = teleport.NewJoinTokenStatus(newToken, nodeRoles, now.Add(tokenOptions.TTL))
+		if retire {
+			teleportCluster.Status.RetiringJoinTokens = append(teleportCluster.Status.RetiringJoinTokens,
+				settings.NewRetiringJoinTokenStatus(token, nodeRoles, expiry, now))
+		}
+		return nil
+	}
+
+	if err := r.ensureJoinTokenLabels(ctx, log, cluster, settings, token, nodeRoles); err != nil {
+		return microerror.Mask(err)
+	}
+	log.Info("Secret has valid teleport node join token", "secretName", secret.GetName())
+	teleportCluster.Status.NodeJoinToken = teleport.NewJoinTokenStatus(token, nodeRoles, expiry)
+	return nil
+}
+
+// reconcileAgentValues keeps the teleport-kube-agent values ConfigMap in
+// sync (kube join token, teleport version, values layout) and makes sure the
+// cluster's App CR or HelmRelease references it, creating or upgrading it
+// first if the operator manages it. With rotate, a static kube join token is
+// replaced; delegated join tokens hold no secret and are kept.
+func (r *ClusterReconciler) reconcileAgentValues(ctx context.Context, log logr.Logger, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster, settings *teleport.ClusterSettings, rotate bool) error {
+	registerName := settings.RegisterName
+	roles := settings.Roles
+	tokenOptions := settings.TokenOptions(roles)
+
+	if settings.ManageAgentApp {
+		if err := r.reconcileKubeAgentApp(ctx, log, cluster, settings); err != nil {
+			markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.AgentAppFailedReason, err)
+			return microerror.Mask(err)
 		}
 	}
 
 	// Look up the deployed teleport-kube-agent chart version for this cluster.
 	// The layout of the values ConfigMap we write depends on it: nested-only
 	// for v0.11.0+, dual (flat + nested) for older or unknown versions.
-	tkaResourceName := key.GetAppName(cluster.Name, r.Teleport.Config.AppName)
-	tkaVersion, err := teleport.GetTeleportKubeAgentVersion(ctx, r.Client, tkaResourceName, cluster.Namespace)
+	tkaVersion, err := teleport.GetTeleportKubeAgentVersion(ctx, r.Client, settings.AgentAppName, cluster.Namespace)
 	if err != nil {
-		return ctrl.Result{}, microerror.Mask(err)
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.AgentAppLookupFailedReason, err)
+		return microerror.Mask(err)
 	}
 	log = log.WithValues("tkaVersion", tkaVersion)
+	teleportCluster.Status.AgentAppVersion = tkaVersion
 
 	// Check if the configmap exists in the cluster, if not, generate teleport token and create the config map
 	// if it is, check teleport token validity, and update the configmap if teleport token has expired
 	configMap, err := r.Teleport.GetConfigMap(ctx, log, r.Client, cluster.Name, cluster.Namespace)
 	if err != nil {
-		return ctrl.Result{}, microerror.Mask(err)
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+		return microerror.Mask(err)
 	}
 
-	if configMap == nil {
-		token, err := r.Teleport.GenerateToken(ctx, registerName, roles)
+	// While a change of the Teleport version is rolled out in waves, the
+	// cluster keeps the version in its values until its wave is released.
+	teleportVersion, err := r.Teleport.ClusterTeleportVersion(ctx, r.Client, cluster, configMap)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+		return microerror.Mask(err)
+	}
+
+	tokenSecret, err := r.Teleport.GetAgentTokenSecret(ctx, r.Client, cluster.Name, cluster.Namespace)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.JoinTokenSecretFailedReason, err)
+		return microerror.Mask(err)
+	}
+
+	switch {
+	case settings.JoinMethod != key.JoinMethodToken:
+		if err := r.reconcileDelegatedJoinValues(ctx, log, cluster, teleportCluster, settings, configMap, tokenSecret, teleportVersion, tkaVersion); err != nil {
+			return microerror.Mask(err)
+		}
+	case configMap == nil:
+		token, err := r.Teleport.GenerateTokenWithOptions(ctx, registerName, roles, tokenOptions)
 		if err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+			markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+			return microerror.Mask(err)
 		}
-		if err := r.Teleport.CreateConfigMap(ctx, log, r.Client, cluster.Name, cluster.Namespace, registerName, token, roles, tkaVersion); err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+		configMapToken := token
+		if settings.AgentTokenInSecret {
+			configMapToken = ""
 		}
-		log.Info("Created new config map with teleport join token", "configMapName", key.GetConfigmapName(cluster.Name, r.Teleport.Config.AppName), "roles", roles)
-	} else {
-		token, err := r.Teleport.GetTokenFromConfigMap(ctx, configMap)
+		if err := r.writeAgentTokenValues(ctx, log, cluster, settings, configMap, tokenSecret, token, configMapToken, teleportVersion, tkaVersion); err != nil {
+			return microerror.Mask(err)
+		}
+		log.Info("Created new config map with teleport join token", "configMapName", key.GetConfigmapName(cluster.Name, r.Teleport.Config().AppName), "roles", roles, "tokenInSecret", settings.AgentTokenInSecret)
+		r.normalEvent(cluster, nil, key.JoinTokenCreatedEventReason, "CreateToken",
+			"Created %s join token for %s in %s", key.RolesToString(roles), registerName, r.agentTokenLocation(cluster, settings))
+		teleportCluster.Status.KubeJoinToken = teleport.NewJoinTokenStatus(token, roles, time.Now().Add(tokenOptions.TTL))
+	default:
+		token, err := r.agentToken(ctx, configMap, tokenSecret)
 		if err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+			markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+			return microerror.Mask(err)
 		}
 		tokenValid, err := r.Teleport.IsTokenValid(ctx, registerName, token, key.RolesToString(roles))
 		if err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+			markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+			return microerror.Mask(err)
+		}
+
+		var writeTokenExpiry time.Time
+		retire := false
+		if tokenValid {
+			writeTokenExpiry, err = r.Teleport.GetTokenExpiry(ctx, token)
+			if err != nil {
+				markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+				return microerror.Mask(err)
+			}
+			if rotate || !time.Now().Before(settings.RotateAt(roles, writeTokenExpiry)) {
+				log.Info("Join token is due for rotation", "configMapName", configMap.GetName(), "roles", roles, "expiresAt", writeTokenExpiry, "requested", rotate)
+				tokenValid = false
+				retire = true
+			}
 		}
+		tokenExpiry := writeTokenExpiry
 
 		writeToken := token
-		if !tokenValid {
-			writeToken, err = r.Teleport.GenerateToken(ctx, registerName, roles)
+		if tokenValid {
+			if err := r.ensureJoinTokenLabels(ctx, log, cluster, settings, token, roles); err != nil {
+				return microerror.Mask(err)
+			}
+		} else {
+			writeToken, err = r.Teleport.GenerateTokenWithOptions(ctx, registerName, roles, tokenOptions)
 			if err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
+				markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+				return microerror.Mask(err)
 			}
+			metrics.TokenRotated(roles)
+			writeTokenExpiry = time.Now().Add(tokenOptions.TTL)
+		}
+		teleportCluster.Status.KubeJoinToken = teleport.NewJoinTokenStatus(writeToken, roles, writeTokenExpiry)
+
+		// The token only leaves the ConfigMap once the Secret it moves to
+		// existed, and so was referenced, before this reconcile. Until then
+		// the agent's values carry it from both.
+		configMapToken := writeToken
+		if settings.AgentTokenInSecret && tokenSecret != nil {
+			configMapToken = ""
 		}
 
-		// Single drift check: compare the stored values document to what the
-		// template would produce now. This catches token rotation, teleport
-		// version drift, and layout changes (dual ↔ nested-only) in one shot.
-		desiredValues := r.Teleport.RenderConfigMapValues(registerName, writeToken, roles, tkaVersion)
+		// Single drift check: compare the values the operator manages to what
+		// the template would produce now. This catches token rotation,
+		// teleport version drift, layout changes (dual ↔ nested-only) and
+		// edits of managed values in one shot, while other values are kept.
+		valuesPatch, err := r.Teleport.PatchConfigMapValues(configMap, registerName, configMapToken, key.JoinMethodToken, roles, settings.ClusterLabels, settings.Databases, teleportVersion, tkaVersion)
+		if err != nil {
+			markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+			return microerror.Mask(err)
+		}
+		tokenValues, err := r.Teleport.RenderAgentTokenValues(writeToken, tkaVersion)
+		if err != nil {
+			markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+			return microerror.Mask(err)
+		}
+		secretUpToDate := !settings.AgentTokenInSecret ||
+			(tokenSecret != nil && string(tokenSecret.Data["values"]) == tokenValues)
 
 		switch {
-		case configMap.Data["values"] == desiredValues:
-			log.Info("ConfigMap has valid teleport join token", "configMapName", configMap.GetName(), "roles", roles)
+		case !valuesPatch.Changes(configMap) && secretUpToDate:
+			log.Info("ConfigMap has valid teleport join token", "configMapName", configMap.GetName(), "roles", roles, "tokenInSecret", settings.AgentTokenInSecret)
 		case !tokenValid:
-			if err := r.Teleport.UpdateConfigMap(ctx, log, r.Client, configMap, writeToken, roles, tkaVersion); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
+			if err := r.writeAgentTokenValues(ctx, log, cluster, settings, configMap, tokenSecret, writeToken, configMapToken, teleportVersion, tkaVersion); err != nil {
+				return microerror.Mask(err)
+			}
+			log.Info("Updated config map with new teleport join token", "configMapName", configMap.GetName(), "roles", roles, "tokenInSecret", settings.AgentTokenInSecret)
+			r.normalEvent(cluster, configMap, key.JoinTokenRotatedEventReason, "RotateToken",
+				"Rotated %s join token for %s in %s", key.RolesToString(roles), registerName, r.agentTokenLocation(cluster, settings))
+			if retire {
+				teleportCluster.Status.RetiringJoinTokens = append(teleportCluster.Status.RetiringJoinTokens,
+					settings.NewRetiringJoinTokenStatus(token, roles, tokenExpiry, time.Now()))
+			}
+		case settings.AgentTokenInSecret != (tokenSecret != nil) || (configMapToken == "" && r.Teleport.HasAuthTokenInConfigMap(configMap)):
+			if err := r.writeAgentTokenValues(ctx, log, cluster, settings, configMap, tokenSecret, writeToken, configMapToken, teleportVersion, tkaVersion); err != nil {
+				return microerror.Mask(err)
 			}
-			log.Info("Updated config map with new teleport join token", "configMapName", configMap.GetName(), "roles", roles)
+			log.Info("Moved teleport join token", "configMapName", configMap.GetName(), "roles", roles, "tokenInSecret", settings.AgentTokenInSecret)
+			var note string
+			switch {
+			case !settings.AgentTokenInSecret:
+				note = fmt.Sprintf("Moved %s join token for %s back into ConfigMap %s/%s", key.RolesToString(roles), registerName, configMap.GetNamespace(), configMap.GetName())
+			case tokenSecret == nil:
+				note = fmt.Sprintf("Copied %s join token for %s into %s", key.RolesToString(roles), registerName, r.agentTokenLocation(cluster, settings))
+			default:
+				note = fmt.Sprintf("Removed %s join token for %s from ConfigMap %s/%s, it is kept in %s", key.RolesToString(roles), registerName, configMap.GetNamespace(), configMap.GetName(), r.agentTokenLocation(cluster, settings))
+			}
+			r.normalEvent(cluster, configMap, key.AgentTokenMovedEventReason, "UpdateValues", "%s", note)
 		default:
-			if err := r.Teleport.UpdateConfigMap(ctx, log, r.Client, configMap, writeToken, roles, tkaVersion); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
+			if err := r.writeAgentTokenValues(ctx, log, cluster, settings, configMap, tokenSecret, writeToken, configMapToken, teleportVersion, tkaVersion); err != nil {
+				return microerror.Mask(err)
 			}
-			log.Info("Updated config map to align teleport version and values layout",
-				"configMapName", configMap.GetName(),
-				"teleportVersion", r.Teleport.Config.TeleportVersion,
-				"nestedValuesOnly", key.UsesNestedKubeAgentValues(tkaVersion))
+			r.valuesUpdated(log, cluster, teleportCluster, configMap, teleportVersion, tkaVersion, valuesPatch.DriftedPaths)
 		}
 	}
+	teleportCluster.Status.ValuesLayout = r.Teleport.ValuesLayoutFor(tkaVersion)
+
+	markConditionTrue(cluster, key.TeleportJoinTokenReadyCondition, key.JoinTokenValidReason,
+		fmt.Sprintf("Node and %s join tokens for %s are valid", key.RolesToString(roles), registerName))
 
-	kubeAgentMgr, err := teleport.NewTeleportAppConfigManager(ctx, r.Client,
-		key.GetAppName(cluster.Name, r.Teleport.Config.AppName),
+	kubeAgentMgr, err := teleport.NewTeleportAppConfigManagerWithSecret(ctx, r.Client,
+		settings.AgentAppName,
 		cluster.Namespace,
-		key.GetConfigmapName(cluster.Name, r.Teleport.Config.AppName))
+		key.GetConfigmapName(cluster.Name, r.Teleport.Config().AppName),
+		key.GetAgentTokenSecretName(cluster.Name, r.Teleport.Config().AppName),
+		settings.AgentTokenInSecret,
+		r.Recorder, cluster)
 	if err != nil {
-		return ctrl.Result{}, microerror.Mask(err)
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.AgentAppLookupFailedReason, err)
+		return microerror.Mask(err)
 	}
 	if err := kubeAgentMgr.EnsureConfig(ctx, log); err != nil {
-		return ctrl.Result{}, microerror.Mask(err)
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.AgentAppConfigFailedReason, err)
+		return microerror.Mask(err)
 	}
 
-	if r.IsBotEnabled {
-		secret, err := r.Teleport.GetKubeconfigSecret(ctx, r.Client, cluster.Name, key.TeleportBotNamespace)
-		if err != nil {
-			return ctrl.Result{}, microerror.Mask(err)
+	// A token Secret that is no longer used is only deleted once it is no
+	// longer referenced.
+	if tokenSecret != nil && !settings.AgentTokenInSecret {
+		if err := r.Teleport.DeleteAgentTokenSecret(ctx, log, r.Client, cluster.Name, cluster.Namespace); err != nil {
+			markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.JoinTokenSecretFailedReason, err)
+			return microerror.Mask(err)
 		}
-		if secret == nil {
-			if err := r.Teleport.EnsureTbotConfigMap(ctx, log, r.Client, cluster.Name, key.TeleportBotNamespace, registerName); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
-			}
+	}
 
-			botMgr, err := teleport.NewTeleportAppConfigManager(ctx, r.Client,
-				key.TeleportBotAppName,
-				key.TeleportBotNamespace,
-				key.GetTbotConfigmapName(cluster.Name))
-			if err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
-			}
-			if err := botMgr.EnsureConfig(ctx, log); err != nil {
-				return ctrl.Result{}, microerror.Mask(err)
-			}
+	if teleport.IsNoOpTeleportAppConfigManager(kubeAgentMgr) {
+		markConditionFalseWithMessage(cluster, key.TeleportAgentValuesInjectedCondition, key.AgentAppNotFoundReason,
+			fmt.Sprintf("No HelmRelease or App CR %s/%s found to inject values into", cluster.Namespace, settings.AgentAppName))
+	} else {
+		markConditionTrue(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesInjectedReason,
+			fmt.Sprintf("ConfigMap %s is referenced from %s/%s", key.GetConfigmapName(cluster.Name, r.Teleport.Config().AppName), cluster.Namespace, settings.AgentAppName))
+	}
+	return nil
+}
+
+// reconcileKubeAgentApp creates or upgrades the cluster's managed kube agent
+// App CR or HelmRelease. A managed resource of the other kind, left over from
+// before the kind was changed, is deleted first.
+func (r *ClusterReconciler) reconcileKubeAgentApp(ctx context.Context, log logr.Logger, cluster *capi.Cluster, settings *teleport.ClusterSettings) error {
+	other := key.AgentAppKindHelmRelease
+	if settings.AgentAppKind == key.AgentAppKindHelmRelease {
+		other = key.AgentAppKindApp
+	}
+	if err := r.deleteKubeAgentApp(ctx, log, cluster, settings, other, "it is replaced by a "+settings.AgentAppKind); err != nil {
+		return microerror.Mask(err)
+	}
+
+	change, err := r.Teleport.EnsureKubeAgentApp(ctx, log, r.Client, cluster, settings)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	version := r.Teleport.Config().AppVersion
+	switch {
+	case change.Created:
+		r.normalEvent(cluster, nil, key.AgentAppCreatedEventReason, "Create"+settings.AgentAppKind,
+			"Created %s %s/%s with %s %s", settings.AgentAppKind, cluster.Namespace, settings.AgentAppName, r.Teleport.Config().AppName, version)
+	case change.Upgraded:
+		r.normalEvent(cluster, nil, key.AgentAppUpgradedEventReason, "Update"+settings.AgentAppKind,
+			"Upgraded %s %s/%s from %s to %s", settings.AgentAppKind, cluster.Namespace, settings.AgentAppName, change.PreviousVersion, version)
+	}
+	return nil
+}
+
+// deleteKubeAgentApp deletes the cluster's kube agent resource of the given
+// kind if the operator manages it.
+func (r *ClusterReconciler) deleteKubeAgentApp(ctx context.Context, log logr.Logger, cluster *capi.Cluster, settings *teleport.ClusterSettings, kind, because string) error {
+	deleted, err := r.Teleport.DeleteKubeAgentApp(ctx, log, r.Client, settings.AgentAppName, cluster.Namespace, kind)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if deleted {
+		r.normalEvent(cluster, nil, key.AgentAppDeletedEventReason, "Delete"+kind,
+			"Deleted %s %s/%s as %s", kind, cluster.Namespace, settings.AgentAppName, because)
+	}
+	return nil
+}
+
+// ensureJoinTokenLabels keeps the labels of a static join token of the
+// cluster that is not rotated in sync with the cluster settings, e.g. after
+// the Cluster's labels changed.
+func (r *ClusterReconciler) ensureJoinTokenLabels(ctx context.Context, log logr.Logger, cluster *capi.Cluster, settings *teleport.ClusterSettings, token string, roles []string) error {
+	relabeled, err := r.Teleport.EnsureTokenLabels(ctx, settings.RegisterName, token, roles, settings.TokenLabels)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+		return microerror.Mask(err)
+	}
+	if relabeled {
+		log.Info("Updated join token labels", "roles", roles)
+		r.normalEvent(cluster, nil, key.JoinTokenRelabeledEventReason, "UpdateToken",
+			"Updated labels of %s join token for %s", key.RolesToString(roles), settings.RegisterName)
+	}
+	return nil
+}
+
+// writeAgentTokenValues writes the teleport-kube-agent values for a static
+// join token, creating the ConfigMap if configMap is nil. configMapToken is
+// the token written to the ConfigMap, if any. With settings.AgentTokenInSecret
+// the token is also written to the agent token Secret.
+func (r *ClusterReconciler) writeAgentTokenValues(ctx context.Context, log logr.Logger, cluster *capi.Cluster, settings *teleport.ClusterSettings, configMap *corev1.ConfigMap, tokenSecret *corev1.Secret, token, configMapToken, teleportVersion, tkaVersion string) error {
+	if settings.AgentTokenInSecret {
+		if err := r.Teleport.EnsureAgentTokenSecret(ctx, log, r.Client, tokenSecret, cluster.Name, cluster.Namespace, token, tkaVersion); err != nil {
+			markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.JoinTokenSecretFailedReason, err)
+			return microerror.Mask(err)
 		}
 	}
 
-	// We need to requeue to check the teleport token validity
-	// and update secret for the cluster, if it expires
-	return ctrl.Result{RequeueAfter: 5 * time.Minute}, nil
+	var err error
+	if configMap == nil {
+		err = r.Teleport.CreateConfigMap(ctx, log, r.Client, cluster.Name, cluster.Namespace, settings.RegisterName, configMapToken, key.JoinMethodToken, settings.Roles, settings.ClusterLabels, settings.Databases, teleportVersion, tkaVersion)
+	} else {
+		err = r.Teleport.UpdateConfigMap(ctx, log, r.Client, configMap, settings.RegisterName, configMapToken, key.JoinMethodToken, settings.Roles, settings.ClusterLabels, settings.Databases, teleportVersion, tkaVersion)
+	}
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+		return microerror.Mask(err)
+	}
+	return nil
+}
+
+// agentToken returns the kube agent's current join token, from the agent
+// token Secret if there is one, else from the values ConfigMap.
+func (r *ClusterReconciler) agentToken(ctx context.Context, configMap *corev1.ConfigMap, tokenSecret *corev1.Secret) (string, error) {
+	if tokenSecret != nil {
+		return r.Teleport.GetTokenFromAgentTokenSecret(ctx, tokenSecret)
+	}
+	return r.Teleport.GetTokenFromConfigMap(ctx, configMap)
+}
+
+// agentTokenLocation describes where the kube agent's static join token is
+// stored, for events.
+func (r *ClusterReconciler) agentTokenLocation(cluster *capi.Cluster, settings *teleport.ClusterSettings) string {
+	if settings.AgentTokenInSecret {
+		return fmt.Sprintf("Secret %s/%s", cluster.Namespace, key.GetAgentTokenSecretName(cluster.Name, r.Teleport.Config().AppName))
+	}
+	return fmt.Sprintf("ConfigMap %s/%s", cluster.Namespace, key.GetConfigmapName(cluster.Name, r.Teleport.Config().AppName))
+}
+
+// reconcileDelegatedJoinValues makes sure the cluster's join token for its
+// delegated join method exists in Teleport and is named in the
+// teleport-kube-agent values ConfigMap. A static join token the values held
+// before is kept valid for the grace period, like after a rotation.
+func (r *ClusterReconciler) reconcileDelegatedJoinValues(ctx context.Context, log logr.Logger, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster, settings *teleport.ClusterSettings, configMap *corev1.ConfigMap, tokenSecret *corev1.Secret, teleportVersion, tkaVersion string) error {
+	registerName := settings.RegisterName
+	roles := settings.Roles
+	configMapName := key.GetConfigmapName(cluster.Name, r.Teleport.Config().AppName)
+
+	spec, err := r.Teleport.DelegatedJoinSpec(ctx, cluster, settings)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.JoinRulesFailedReason, err)
+		return microerror.Mask(err)
+	}
+	joinMethod := string(spec.JoinMethod)
+	token, written, err := r.Teleport.EnsureDelegatedJoinToken(ctx, registerName, roles, spec, settings.TokenLabels)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+		return microerror.Mask(err)
+	}
+	if written {
+		log.Info("Wrote delegated join token", "token", token, "joinMethod", joinMethod, "roles", roles)
+		r.normalEvent(cluster, nil, key.JoinTokenCreatedEventReason, "CreateToken",
+			"Wrote %s %s join token %s for %s", key.RolesToString(roles), joinMethod, token, registerName)
+	}
+	teleportCluster.Status.KubeJoinToken = teleport.NewJoinTokenStatus(token, roles, time.Time{})
+
+	if configMap == nil {
+		if err := r.Teleport.CreateConfigMap(ctx, log, r.Client, cluster.Name, cluster.Namespace, registerName, token, joinMethod, roles, settings.ClusterLabels, settings.Databases, teleportVersion, tkaVersion); err != nil {
+			markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+			return microerror.Mask(err)
+		}
+		log.Info("Created config map with delegated join token", "configMapName", configMapName, "joinMethod", joinMethod, "roles", roles)
+		return nil
+	}
+
+	valuesPatch, err := r.Teleport.PatchConfigMapValues(configMap, registerName, token, joinMethod, roles, settings.ClusterLabels, settings.Databases, teleportVersion, tkaVersion)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+		return microerror.Mask(err)
+	}
+	if !valuesPatch.Changes(configMap) {
+		log.Info("ConfigMap has delegated join token", "configMapName", configMap.GetName(), "joinMethod", joinMethod, "roles", roles)
+		return nil
+	}
+
+	previous, err := r.agentToken(ctx, configMap, tokenSecret)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+		return microerror.Mask(err)
+	}
+	var previousExpiry time.Time
+	if previous != token {
+		previousExpiry, err = r.Teleport.GetTokenExpiry(ctx, previous)
+		if err != nil {
+			markConditionFalse(cluster, key.TeleportJoinTokenReadyCondition, key.TeleportRequestFailedReason, err)
+			return microerror.Mask(err)
+		}
+	}
+
+	if err := r.Teleport.UpdateConfigMap(ctx, log, r.Client, configMap, registerName, token, joinMethod, roles, settings.ClusterLabels, settings.Databases, teleportVersion, tkaVersion); err != nil {
+		markConditionFalse(cluster, key.TeleportAgentValuesInjectedCondition, key.ValuesConfigMapFailedReason, err)
+		return microerror.Mask(err)
+	}
+	if previous == token {
+		r.valuesUpdated(log, cluster, teleportCluster, configMap, teleportVersion, tkaVersion, valuesPatch.DriftedPaths)
+		return nil
+	}
+
+	log.Info("Updated config map to the delegated join method", "configMapName", configMap.GetName(), "joinMethod", joinMethod, "roles", roles)
+	r.normalEvent(cluster, configMap, key.JoinTokenRotatedEventReason, "RotateToken",
+		"Replaced %s join token for %s in ConfigMap %s/%s with %s join token %s", key.RolesToString(roles), registerName, configMap.GetNamespace(), configMap.GetName(), joinMethod, token)
+	if now := time.Now(); now.Before(previousExpiry) {
+		teleportCluster.Status.RetiringJoinTokens = append(teleportCluster.Status.RetiringJoinTokens,
+			settings.NewRetiringJoinTokenStatus(previous, roles, previousExpiry, now))
+	}
+	return nil
+}
+
+// valuesUpdated reports an update of the agent values ConfigMap that neither
+// rotated nor moved the join token, e.g. to align the Teleport version or
+// the values layout, or to restore managed values that were edited.
+func (r *ClusterReconciler) valuesUpdated(log logr.Logger, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster, configMap *corev1.ConfigMap, teleportVersion, tkaVersion string, drifted []string) {
+	log.Info("Updated config map to align managed values",
+		"configMapName", configMap.GetName(),
+		"teleportVersion", teleportVersion,
+		"valuesLayout", r.Teleport.ValuesLayoutFor(tkaVersion),
+		"driftedValues", drifted)
+	switch {
+	case teleportCluster.Status.ValuesLayout != "" && teleportCluster.Status.ValuesLayout != r.Teleport.ValuesLayoutFor(tkaVersion):
+		r.normalEvent(cluster, configMap, key.AgentValuesLayoutMigratedEventReason, "UpdateValues",
+			"Updated ConfigMap %s/%s to the %s values layout for teleport-kube-agent %q and Teleport version %s",
+			configMap.GetNamespace(), configMap.GetName(), r.Teleport.ValuesLayoutFor(tkaVersion), tkaVersion, teleportVersion)
+	case len(drifted) > 0:
+		r.normalEvent(cluster, configMap, key.AgentValuesUpdatedEventReason, "UpdateValues",
+			"Updated drifted values %s in ConfigMap %s/%s", strings.Join(drifted, ", "), configMap.GetNamespace(), configMap.GetName())
+	}
+}
+
+// reconcileBotOutput asks tbot to produce a kubeconfig for the cluster until
+// the kubeconfig Secret shows up.
+func (r *ClusterReconciler) reconcileBotOutput(ctx context.Context, log logr.Logger, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster, settings *teleport.ClusterSettings) error {
+	secret, err := r.Teleport.GetKubeconfigSecret(ctx, r.Client, cluster.Name, key.TeleportBotNamespace)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportBotOutputReadyCondition, key.BotConfigFailedReason, err)
+		return microerror.Mask(err)
+	}
+	if secret != nil {
+		teleportCluster.Status.BotOutputSecret = secret.GetName()
+		markConditionTrue(cluster, key.TeleportBotOutputReadyCondition, key.BotOutputReadyReason,
+			fmt.Sprintf("Kubeconfig Secret %s/%s exists", key.TeleportBotNamespace, secret.GetName()))
+		return nil
+	}
+
+	teleportCluster.Status.BotOutputSecret = ""
+	if err := r.Teleport.EnsureTbotConfigMap(ctx, log, r.Client, cluster.Name, key.TeleportBotNamespace, settings.RegisterName); err != nil {
+		markConditionFalse(cluster, key.TeleportBotOutputReadyCondition, key.BotConfigFailedReason, err)
+		return microerror.Mask(err)
+	}
+
+	botMgr, err := teleport.NewTeleportAppConfigManagerWithEvents(ctx, r.Client,
+		key.TeleportBotAppName,
+		key.TeleportBotNamespace,
+		key.GetTbotConfigmapName(cluster.Name),
+		r.Recorder, cluster)
+	if err != nil {
+		markConditionFalse(cluster, key.TeleportBotOutputReadyCondition, key.BotConfigFailedReason, err)
+		return microerror.Mask(err)
+	}
+	if err := botMgr.EnsureConfig(ctx, log); err != nil {
+		markConditionFalse(cluster, key.TeleportBotOutputReadyCondition, key.BotConfigFailedReason, err)
+		return microerror.Mask(err)
+	}
+
+	markConditionFalseWithMessage(cluster, key.TeleportBotOutputReadyCondition, key.WaitingForBotOutputReason,
+		fmt.Sprintf("Waiting for tbot to write kubeconfig Secret %s/%s", key.TeleportBotNamespace, key.GetKubeconfigSecretName(cluster.Name)))
+	return nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&capi.Cluster{}).
-		Complete(r)
+		Owns(&v1alpha1.TeleportCluster{}).
+		Watches(&v1alpha1.TeleportVersionRollout{}, handler.EnqueueRequestsFromMapFunc(r.releasedRolloutClusters)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles})
+	if r.ConfigChanges != nil {
+		b = b.WatchesRawSource(source.Channel(r.ConfigChanges, &handler.EnqueueRequestForObject{}))
+	}
+	return b.Complete(r)
+}
+
+// releasedRolloutClusters returns the Clusters of the released waves of the
+// operator's TeleportVersionRollout that wait for their agents, so that the
+// new Teleport version is written to their values.
+func (r *ClusterReconciler) releasedRolloutClusters(ctx context.Context, object client.Object) []reconcile.Request {
+	rollout, ok := object.(*v1alpha1.TeleportVersionRollout)
+	if !ok || rollout.Name != key.TeleportOperatorConfigName || rollout.Namespace != r.Namespace {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, wave := range rollout.Status.Waves {
+		if wave.Phase != v1alpha1.RolloutWavePhaseProgressing {
+			continue
+		}
+		for _, name := range wave.Clusters {
+			namespace, clusterName, _ := strings.Cut(name, "/")
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: clusterName, Namespace: namespace}})
+		}
+	}
+	return requests
+}
+
+// recordTokenExpiry exports the expiry of a cluster's join token so that
+// alerts can fire before it lapses, even if reconciles keep failing.
+func recordTokenExpiry(cluster *capi.Cluster, source string, tokenStatus *v1alpha1.JoinTokenStatus) {
+	var expiry time.Time
+	if tokenStatus != nil && tokenStatus.ExpiresAt != nil {
+		expiry = tokenStatus.ExpiresAt.Time
+	}
+	metrics.SetTokenExpiry(cluster.Namespace, cluster.Name, source, expiry)
 }
@@ -2,11 +2,15 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	appv1alpha1 "github.com/giantswarm/apiextensions-application/api/v1alpha1"
+	teleportTypes "github.com/gravitational/teleport/api/types"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -51,11 +55,10 @@ func reconcileWithBot(t *testing.T, objects ...client.Object) client.Client {
 		),
 		IsBotEnabled: true,
 	}
-	controller.Teleport.TeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{})
-	controller.Teleport.Identity = &config.IdentityConfig{
+	controller.Teleport.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{}), &config.IdentityConfig{
 		IdentityFile: test.IdentityFileValue,
 		LastRead:     time.Now(),
-	}
+	})
 	controller.Teleport.Client = fakeClient
 
 	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
@@ -100,11 +103,10 @@ func reconcileDeleteWithBot(t *testing.T, objects ...client.Object) client.Clien
 		),
 		IsBotEnabled: true,
 	}
-	controller.Teleport.TeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{})
-	controller.Teleport.Identity = &config.IdentityConfig{
+	controller.Teleport.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{}), &config.IdentityConfig{
 		IdentityFile: test.IdentityFileValue,
 		LastRead:     time.Now(),
-	}
+	})
 	controller.Teleport.Client = fakeClient
 
 	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Now())
@@ -268,11 +270,10 @@ func reconcileWithKubeAgent(t *testing.T, objects ...client.Object) client.Clien
 		),
 		IsBotEnabled: false,
 	}
-	controller.Teleport.TeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{})
-	controller.Teleport.Identity = &config.IdentityConfig{
+	controller.Teleport.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{}), &config.IdentityConfig{
 		IdentityFile: test.IdentityFileValue,
 		LastRead:     time.Now(),
-	}
+	})
 	controller.Teleport.Client = fakeClient
 
 	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
@@ -317,11 +318,10 @@ func reconcileDeleteWithKubeAgent(t *testing.T, objects ...client.Object) client
 		),
 		IsBotEnabled: false,
 	}
-	controller.Teleport.TeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{})
-	controller.Teleport.Identity = &config.IdentityConfig{
+	controller.Teleport.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{}), &config.IdentityConfig{
 		IdentityFile: test.IdentityFileValue,
 		LastRead:     time.Now(),
-	}
+	})
 	controller.Teleport.Client = fakeClient
 
 	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Now())
@@ -432,6 +432,212 @@ func Test_ClusterController_KubeAgent_HelmRelease_DeleteConfig(t *testing.T) {
 	}
 }
 
+// case J: the kube agent's join token moves into a Secret and back, without
+// ever being missing from the values the HelmRelease references.
+func Test_ClusterController_KubeAgent_TokenInSecret_Migration(t *testing.T) {
+	const (
+		nodeTokenName = "node-token"
+		kubeTokenName = "kube-token"
+	)
+	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+	kubeHR := test.NewHelmRelease(kubeAgentAppName(), test.NamespaceName)
+	secret := test.NewSecret(test.ClusterName, test.NamespaceName, nodeTokenName)
+	configMap := test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, kubeTokenName, []string{key.RoleKube})
+
+	fakeClient, err := test.NewFakeK8sClientFromObjects(cluster, kubeHR, secret, configMap)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+	teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+		Tokens: []teleportTypes.ProvisionToken{
+			test.NewToken(nodeTokenName, test.ClusterName, []string{key.RoleNode}),
+			test.NewToken(kubeTokenName, test.ClusterName, []string{key.RoleKube}),
+		},
+	})
+
+	reconcile := func(tokenInSecret bool) {
+		t.Helper()
+		controller := &ClusterReconciler{
+			Client:    fakeClient,
+			Log:       ctrl.Log.WithName("test"),
+			Scheme:    scheme.Scheme,
+			Namespace: test.NamespaceName,
+			Teleport: teleport.New(
+				test.NamespaceName,
+				&config.Config{
+					AppName:                test.AppName,
+					AppCatalog:             test.AppCatalog,
+					AppVersion:             test.AppVersion,
+					ManagementClusterName:  test.ManagementClusterName,
+					ProxyAddr:              test.ProxyAddr,
+					TeleportVersion:        test.TeleportVersion,
+					KubeAgentTokenInSecret: tokenInSecret,
+				},
+				test.NewMockTokenGenerator(test.TokenName),
+			),
+		}
+		controller.Teleport.Clients.SetClient(teleportClient, &config.IdentityConfig{
+			IdentityFile: test.IdentityFileValue,
+			LastRead:     time.Now(),
+		})
+		controller.Teleport.Client = fakeClient
+
+		_, err := controller.Reconcile(context.TODO(), ctrl.Request{
+			NamespacedName: types.NamespacedName{Name: cluster.Name, Namespace: cluster.Namespace},
+		})
+		if err != nil {
+			t.Fatalf("reconcile returned unexpected error: %v", err)
+		}
+	}
+
+	secretName := key.GetAgentTokenSecretName(test.ClusterName, test.AppName)
+	check := func(step string, tokenInConfigMap bool, tokenInSecret bool, referenced []string) {
+		t.Helper()
+		cm := &corev1.ConfigMap{}
+		if err := fakeClient.Get(context.TODO(), client.ObjectKey{Name: key.GetConfigmapName(test.ClusterName, test.AppName), Namespace: test.NamespaceName}, cm); err != nil {
+			t.Fatalf("%s: failed to get ConfigMap: %v", step, err)
+		}
+		if actual := strings.Contains(cm.Data["values"], "authToken"); actual != tokenInConfigMap {
+			t.Fatalf("%s: expected authToken in ConfigMap %t, got values:\n%s", step, tokenInConfigMap, cm.Data["values"])
+		}
+
+		tokenSecret := &corev1.Secret{}
+		err := fakeClient.Get(context.TODO(), client.ObjectKey{Name: secretName, Namespace: test.NamespaceName}, tokenSecret)
+		if tokenInSecret {
+			if err != nil {
+				t.Fatalf("%s: failed to get token Secret: %v", step, err)
+			}
+			if !strings.Contains(string(tokenSecret.Data["values"]), kubeTokenName) {
+				t.Fatalf("%s: expected token in Secret, got values:\n%s", step, tokenSecret.Data["values"])
+			}
+		} else if !apierrors.IsNotFound(err) {
+			t.Fatalf("%s: expected no token Secret, got %v", step, err)
+		}
+
+		updated := test.NewHelmRelease(kubeAgentAppName(), test.NamespaceName)
+		if err := fakeClient.Get(context.TODO(), client.ObjectKey{Name: kubeAgentAppName(), Namespace: test.NamespaceName}, updated); err != nil {
+			t.Fatalf("%s: failed to get kube-agent HelmRelease: %v", step, err)
+		}
+		spec, _ := updated.Object["spec"].(map[string]interface{})
+		valuesFrom, _ := spec["valuesFrom"].([]interface{})
+		var actual []string
+		for _, entry := range valuesFrom {
+			ref, _ := entry.(map[string]interface{})
+			actual = append(actual, fmt.Sprintf("%s/%s", ref["kind"], ref["name"]))
+		}
+		if strings.Join(actual, ",") != strings.Join(referenced, ",") {
+			t.Fatalf("%s: expected ValuesFrom %v, got %v", step, referenced, actual)
+		}
+	}
+
+	configMapRef := "ConfigMap/" + key.GetConfigmapName(test.ClusterName, test.AppName)
+	secretRef := "Secret/" + secretName
+
+	reconcile(true)
+	check("copy the token into the Secret", true, true, []string{configMapRef, secretRef})
+	reconcile(true)
+	check("remove the token from the ConfigMap", false, true, []string{configMapRef, secretRef})
+	reconcile(true)
+	check("keep the token in the Secret", false, true, []string{configMapRef, secretRef})
+	reconcile(false)
+	check("move the token back into the ConfigMap", true, false, []string{configMapRef})
+}
+
+// case K: the operator manages the kube agent App CR, replaces it with a
+// HelmRelease when the kind changes and deletes it along with the cluster.
+func Test_ClusterController_KubeAgent_ManagedApp(t *testing.T) {
+	const (
+		nodeTokenName = "node-token"
+		kubeTokenName = "kube-token"
+	)
+	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+	secret := test.NewSecret(test.ClusterName, test.NamespaceName, nodeTokenName)
+	configMap := test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, kubeTokenName, []string{key.RoleKube})
+
+	fakeClient, err := test.NewFakeK8sClientFromObjects(cluster, secret, configMap)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+	teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+		Tokens: []teleportTypes.ProvisionToken{
+			test.NewToken(nodeTokenName, test.ClusterName, []string{key.RoleNode}),
+			test.NewToken(kubeTokenName, test.ClusterName, []string{key.RoleKube}),
+		},
+	})
+
+	reconcile := func(kind string) {
+		t.Helper()
+		controller := &ClusterReconciler{
+			Client:    fakeClient,
+			Log:       ctrl.Log.WithName("test"),
+			Scheme:    scheme.Scheme,
+			Namespace: test.NamespaceName,
+			Teleport: teleport.New(
+				test.NamespaceName,
+				&config.Config{
+					AppName:               test.AppName,
+					AppCatalog:            test.AppCatalog,
+					AppVersion:            test.AppVersion,
+					ManagementClusterName: test.ManagementClusterName,
+					ProxyAddr:             test.ProxyAddr,
+					TeleportVersion:       test.TeleportVersion,
+					ManageKubeAgentApp:    true,
+					KubeAgentAppKind:      kind,
+				},
+				test.NewMockTokenGenerator(test.TokenName),
+			),
+		}
+		controller.Teleport.Clients.SetClient(teleportClient, &config.IdentityConfig{
+			IdentityFile: test.IdentityFileValue,
+			LastRead:     time.Now(),
+		})
+		controller.Teleport.Client = fakeClient
+
+		_, err := controller.Reconcile(context.TODO(), ctrl.Request{
+			NamespacedName: types.NamespacedName{Name: cluster.Name, Namespace: cluster.Namespace},
+		})
+		if err != nil {
+			t.Fatalf("reconcile returned unexpected error: %v", err)
+		}
+	}
+
+	appKey := client.ObjectKey{Name: kubeAgentAppName(), Namespace: test.NamespaceName}
+	wantCM := key.GetConfigmapName(test.ClusterName, test.AppName)
+
+	reconcile(key.AgentAppKindApp)
+	app := &appv1alpha1.App{}
+	if err := fakeClient.Get(context.TODO(), appKey, app); err != nil {
+		t.Fatalf("failed to get kube-agent App: %v", err)
+	}
+	if app.Spec.Catalog != test.AppCatalog || app.Spec.Version != test.AppVersion || app.Spec.KubeConfig.Secret.Name != key.GetAppSpecKubeConfigSecretName(test.ClusterName) {
+		t.Fatalf("unexpected App spec %+v", app.Spec)
+	}
+	if len(app.Spec.ExtraConfigs) != 1 || app.Spec.ExtraConfigs[0].Name != wantCM {
+		t.Fatalf("expected ExtraConfigs to reference %q, got %+v", wantCM, app.Spec.ExtraConfigs)
+	}
+
+	reconcile(key.AgentAppKindHelmRelease)
+	if err := fakeClient.Get(context.TODO(), appKey, &appv1alpha1.App{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the App to be replaced by a HelmRelease, got %v", err)
+	}
+	hr := test.NewHelmRelease(kubeAgentAppName(), test.NamespaceName)
+	if err := fakeClient.Get(context.TODO(), appKey, hr); err != nil {
+		t.Fatalf("failed to get kube-agent HelmRelease: %v", err)
+	}
+	spec, _ := hr.Object["spec"].(map[string]interface{})
+	if valuesFrom, _ := spec["valuesFrom"].([]interface{}); len(valuesFrom) != 1 {
+		t.Fatalf("expected ValuesFrom to reference %q, got %+v", wantCM, valuesFrom)
+	}
+
+	if err := fakeClient.Delete(context.TODO(), cluster); err != nil {
+		t.Fatalf("failed to delete cluster: %v", err)
+	}
+	reconcile(key.AgentAppKindHelmRelease)
+	if err := fakeClient.Get(context.TODO(), appKey, test.NewHelmRelease(kubeAgentAppName(), test.NamespaceName)); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the HelmRelease to be deleted with the cluster, got %v", err)
+	}
+}
+
 // identitySecretInGiantswarm returns an identity secret in the giantswarm namespace,
 // needed for the tbot path which reads the kubeconfig secret from there.
 func identitySecretInGiantswarm() *corev1.Secret {
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+	"github.com/giantswarm/teleport-operator/internal/pkg/token"
+)
+
+// Test_ClusterController_ConcurrentReconciles reconciles many clusters in
+// parallel through a single ClusterReconciler, as the controller does with
+// MaxConcurrentReconciles > 1. Run with -race to catch shared mutable state.
+func Test_ClusterController_ConcurrentReconciles(t *testing.T) {
+	const clusterCount = 20
+
+	var objects []client.Object
+	for i := 0; i < clusterCount; i++ {
+		name := fmt.Sprintf("cluster-%d", i)
+		objects = append(objects, test.NewCluster(name, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{}))
+	}
+	fakeClient, err := test.NewFakeK8sClientFromObjects(objects...)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{})
+	controller := &ClusterReconciler{
+		Client:    fakeClient,
+		Log:       ctrl.Log.WithName("test"),
+		Scheme:    scheme.Scheme,
+		Namespace: test.NamespaceName,
+		Teleport:  teleport.New(test.NamespaceName, newConfig(), token.NewGenerator()),
+	}
+	controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+	controller.Teleport.Client = fakeClient
+
+	ctx := context.TODO()
+	errs := make(chan error, clusterCount)
+	var wg sync.WaitGroup
+	for _, object := range objects {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_, err := controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: name, Namespace: test.NamespaceName},
+			})
+			if err != nil {
+				errs <- fmt.Errorf("%s: %w", name, err)
+			}
+		}(object.GetName())
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	tokens, err := teleportClient.GetTokens(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tokensByCluster := map[string]int{}
+	for _, token := range tokens {
+		tokensByCluster[token.GetMetadata().Labels["cluster"]]++
+	}
+
+	for _, object := range objects {
+		registerName := key.GetRegisterName(test.ManagementClusterName, object.GetName())
+		// One node token for the Secret and one kube token for the agent.
+		if tokensByCluster[registerName] != 2 {
+			t.Errorf("expected 2 join tokens for %s, actual %d", registerName, tokensByCluster[registerName])
+		}
+
+		secret := &corev1.Secret{}
+		err := fakeClient.Get(ctx, types.NamespacedName{Name: key.GetSecretName(object.GetName()), Namespace: test.NamespaceName}, secret)
+		if err != nil {
+			t.Errorf("expected join token Secret for %s: %v", object.GetName(), err)
+		}
+	}
+}
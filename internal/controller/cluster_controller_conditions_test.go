@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_ClusterController_Conditions(t *testing.T) {
+	testCases := []struct {
+		name               string
+		objects            []client.Object
+		teleportConfig     test.FakeTeleportClientConfig
+		isBotEnabled       bool
+		expectError        bool
+		expectedConditions map[string]metav1.Condition
+	}{
+		{
+			name: "case 0: Report tokens ready and values injected into the App CR",
+			objects: []client.Object{
+				test.NewApp(kubeAgentAppName(), test.NamespaceName),
+			},
+			expectedConditions: map[string]metav1.Condition{
+				key.TeleportJoinTokenReadyCondition:      {Status: metav1.ConditionTrue, Reason: key.JoinTokenValidReason},
+				key.TeleportAgentValuesInjectedCondition: {Status: metav1.ConditionTrue, Reason: key.ValuesInjectedReason},
+			},
+		},
+		{
+			name: "case 1: Report values not injected when no App CR or HelmRelease exists",
+			expectedConditions: map[string]metav1.Condition{
+				key.TeleportJoinTokenReadyCondition:      {Status: metav1.ConditionTrue, Reason: key.JoinTokenValidReason},
+				key.TeleportAgentValuesInjectedCondition: {Status: metav1.ConditionFalse, Reason: key.AgentAppNotFoundReason},
+			},
+		},
+		{
+			name: "case 2: Report Teleport request failure when the token cannot be read",
+			objects: []client.Object{
+				test.NewSecret(test.ClusterName, test.NamespaceName, test.TokenName),
+			},
+			teleportConfig: test.FakeTeleportClientConfig{FailsGet: true},
+			expectError:    true,
+			expectedConditions: map[string]metav1.Condition{
+				key.TeleportJoinTokenReadyCondition: {
+					Status:  metav1.ConditionFalse,
+					Reason:  key.TeleportRequestFailedReason,
+					Message: "mock teleport client failed to get token",
+				},
+			},
+		},
+		{
+			name:         "case 3: Report waiting for tbot output when the kubeconfig Secret does not exist",
+			isBotEnabled: true,
+			expectedConditions: map[string]metav1.Condition{
+				key.TeleportBotOutputReadyCondition: {Status: metav1.ConditionFalse, Reason: key.WaitingForBotOutputReason},
+			},
+		},
+		{
+			name:           "case 4: Report a Teleport version compatible with the server",
+			teleportConfig: test.FakeTeleportClientConfig{ServerVersion: "1.2.0"},
+			expectedConditions: map[string]metav1.Condition{
+				key.TeleportVersionCompatibleCondition: {Status: metav1.ConditionTrue, Reason: key.TeleportVersionCompatibleReason},
+			},
+		},
+		{
+			name:           "case 5: Report a Teleport version newer than the server",
+			teleportConfig: test.FakeTeleportClientConfig{ServerVersion: "0.9.0"},
+			expectedConditions: map[string]metav1.Condition{
+				key.TeleportVersionCompatibleCondition: {
+					Status:  metav1.ConditionFalse,
+					Reason:  key.TeleportVersionNewerThanServerReason,
+					Message: "Teleport version 1.0.0 is newer than the server version 0.9.0, using 0.9.0",
+				},
+			},
+		},
+		{
+			name:           "case 6: Report a Teleport version more than one major version behind the server",
+			teleportConfig: test.FakeTeleportClientConfig{ServerVersion: "3.0.0"},
+			expectedConditions: map[string]metav1.Condition{
+				key.TeleportVersionCompatibleCondition: {Status: metav1.ConditionFalse, Reason: key.TeleportVersionTooOldReason},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+			fakeClient, err := test.NewFakeK8sClientFromObjects(append(tc.objects, cluster)...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			ctx := context.TODO()
+			controller := &ClusterReconciler{
+				Client:       fakeClient,
+				Log:          ctrl.Log.WithName("test"),
+				Scheme:       scheme.Scheme,
+				Namespace:    test.NamespaceName,
+				Teleport:     teleport.New(test.NamespaceName, newConfig(), test.NewMockTokenGenerator(test.TokenName)),
+				IsBotEnabled: tc.isBotEnabled,
+			}
+			controller.Teleport.Clients.SetClient(test.NewTeleportClient(tc.teleportConfig), newIdentity(time.Now()))
+			controller.Teleport.Client = fakeClient
+
+			_, err = controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: cluster.Name, Namespace: cluster.Namespace},
+			})
+			test.CheckError(t, tc.expectError, err)
+
+			updated := &capi.Cluster{}
+			if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(cluster), updated); err != nil {
+				t.Fatalf("failed to get cluster: %v", err)
+			}
+
+			for conditionType, expected := range tc.expectedConditions {
+				actual := conditions.Get(updated, conditionType)
+				if actual == nil {
+					t.Fatalf("expected condition %s to be set, got %+v", conditionType, updated.Status.Conditions)
+				}
+				if actual.Status != expected.Status || actual.Reason != expected.Reason {
+					t.Fatalf("condition %s: expected %s/%s, actual %s/%s (%s)",
+						conditionType, expected.Status, expected.Reason, actual.Status, actual.Reason, actual.Message)
+				}
+				if expected.Message != "" && actual.Message != expected.Message {
+					t.Fatalf("condition %s: expected message %q, actual %q", conditionType, expected.Message, actual.Message)
+				}
+			}
+		})
+	}
+}
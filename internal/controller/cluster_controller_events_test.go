@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	appv1alpha1 "github.com/giantswarm/apiextensions-application/api/v1alpha1"
+	teleportTypes "github.com/gravitational/teleport/api/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_ClusterController_Events(t *testing.T) {
+	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
+	operatorToken := func(name string, roles []string) teleportTypes.ProvisionToken {
+		token := test.NewToken(name, test.ClusterName, roles)
+		token.SetLabels(map[string]string{
+			key.TokenClusterLabel:           registerName,
+			key.TokenRolesLabel:             key.RolesToString(roles),
+			key.TokenManagementClusterLabel: test.ManagementClusterName,
+		})
+		return token
+	}
+	// Values the operator rendered, with the roles edited and a value added
+	// by someone else.
+	editedConfigMap := func() *corev1.ConfigMap {
+		values, err := key.GetConfigmapDataFromTemplate("kube-token", key.JoinMethodToken, test.ProxyAddr, registerName, test.TeleportVersion, []string{key.RoleKube}, nil, nil, key.DefaultValuesLayouts(), "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		patch, err := teleport.PatchValues("", values, nil, key.DefaultValuesLayouts().RootKeys())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		configMap := test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, "kube-token", []string{key.RoleKube})
+		configMap.Annotations = map[string]string{key.ManagedValuesAnnotation: strings.Join(patch.ManagedPaths, ",")}
+		configMap.Data["values"] = "priorityClassName: \"high\"\n" + strings.ReplaceAll(values, `roles: "kube"`, `roles: "kube,app"`)
+		return configMap
+	}
+
+	managedKubeAgentApp := func(version string) *appv1alpha1.App {
+		app := test.NewApp(kubeAgentAppName(), test.NamespaceName)
+		app.Labels = map[string]string{key.ManagedByLabel: key.TeleportOperatorLabelValue}
+		app.Spec.Catalog = test.AppCatalog
+		app.Spec.Version = version
+		return app
+	}
+
+	testCases := []struct {
+		name              string
+		objects           []client.Object
+		tokens            []teleportTypes.ProvisionToken
+		serverVersion     string
+		manageAgentApp    bool
+		identity          *config.IdentityConfig
+		newTeleportClient func(ctx context.Context, proxyAddr, identityFile string) (teleport.Client, error)
+		expectError       bool
+		expectedEvents    []string
+	}{
+		{
+			name: "case 0: Report created join tokens and the patched App CR",
+			objects: []client.Object{
+				test.NewApp(kubeAgentAppName(), test.NamespaceName),
+			},
+			identity: newIdentity(time.Now()),
+			expectedEvents: []string{
+				"Normal " + key.JoinTokenCreatedEventReason + " Created node join token",
+				"Normal " + key.JoinTokenCreatedEventReason + " Created kube join token",
+				"Normal " + key.AppExtraConfigsPatchedEventReason + " Added ConfigMap",
+			},
+		},
+		{
+			name: "case 1: Report rotated join tokens",
+			objects: []client.Object{
+				test.NewSecret(test.ClusterName, test.NamespaceName, test.TokenName),
+				test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{key.RoleKube}),
+			},
+			identity: newIdentity(time.Now()),
+			expectedEvents: []string{
+				"Normal " + key.JoinTokenRotatedEventReason + " Rotated node join token",
+				"Normal " + key.JoinTokenRotatedEventReason + " Rotated kube join token",
+			},
+		},
+		{
+			name: "case 2: Report Teleport as unreachable while the client cannot connect",
+			objects: []client.Object{
+				test.NewIdentitySecret(test.NamespaceName, test.IdentityFileValue),
+			},
+			newTeleportClient: func(ctx context.Context, proxyAddr, identityFile string) (teleport.Client, error) {
+				return nil, errors.New("connection refused")
+			},
+			expectError: true,
+			expectedEvents: []string{
+				"Warning " + key.TeleportUnreachableEventReason + " Not connected to Teleport proxy",
+			},
+		},
+		{
+			name: "case 3: Report drifted agent values",
+			objects: []client.Object{
+				test.NewSecret(test.ClusterName, test.NamespaceName, "node-token"),
+				editedConfigMap(),
+			},
+			tokens: []teleportTypes.ProvisionToken{
+				operatorToken("node-token", []string{key.RoleNode}),
+				operatorToken("kube-token", []string{key.RoleKube}),
+			},
+			identity: newIdentity(time.Now()),
+			expectedEvents: []string{
+				"Normal " + key.AgentValuesUpdatedEventReason + " Updated drifted values roles, teleport-kube-agent.roles in ConfigMap",
+			},
+		},
+		{
+			name: "case 4: Report a Teleport version clamped to the server version",
+			objects: []client.Object{
+				test.NewApp(kubeAgentAppName(), test.NamespaceName),
+			},
+			serverVersion: "0.9.0",
+			identity:      newIdentity(time.Now()),
+			expectedEvents: []string{
+				"Warning " + key.TeleportVersionClampedEventReason + " Teleport version 1.0.0 is newer than the server version 0.9.0",
+				"Normal " + key.JoinTokenCreatedEventReason + " Created node join token",
+				"Normal " + key.JoinTokenCreatedEventReason + " Created kube join token",
+				"Normal " + key.AppExtraConfigsPatchedEventReason + " Added ConfigMap",
+			},
+		},
+		{
+			name:           "case 5: Report the created kube agent App CR",
+			manageAgentApp: true,
+			identity:       newIdentity(time.Now()),
+			expectedEvents: []string{
+				"Normal " + key.JoinTokenCreatedEventReason + " Created node join token",
+				"Normal " + key.AgentAppCreatedEventReason + " Created App " + test.NamespaceName + "/" + kubeAgentAppName(),
+				"Normal " + key.JoinTokenCreatedEventReason + " Created kube join token",
+				"Normal " + key.AppExtraConfigsPatchedEventReason + " Added ConfigMap",
+			},
+		},
+		{
+			name: "case 6: Report the upgraded kube agent App CR",
+			objects: []client.Object{
+				managedKubeAgentApp("0.2.0"),
+			},
+			manageAgentApp: true,
+			identity:       newIdentity(time.Now()),
+			expectedEvents: []string{
+				"Normal " + key.JoinTokenCreatedEventReason + " Created node join token",
+				"Normal " + key.AgentAppUpgradedEventReason + " Upgraded App " + test.NamespaceName + "/" + kubeAgentAppName() + " from 0.2.0 to " + test.AppVersion,
+				"Normal " + key.JoinTokenCreatedEventReason + " Created kube join token",
+				"Normal " + key.AppExtraConfigsPatchedEventReason + " Added ConfigMap",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+			fakeClient, err := test.NewFakeK8sClientFromObjects(append(tc.objects, cluster)...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			newTeleportClient := teleport.NewClient
+			if tc.newTeleportClient != nil {
+				teleport.NewClient = tc.newTeleportClient
+			}
+			defer func() {
+				teleport.NewClient = newTeleportClient
+			}()
+
+			cfg := newConfig()
+			cfg.ManageKubeAgentApp = tc.manageAgentApp
+
+			recorder := events.NewFakeRecorder(10)
+			controller := &ClusterReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Scheme:    scheme.Scheme,
+				Namespace: test.NamespaceName,
+				Teleport:  teleport.New(test.NamespaceName, cfg, test.NewMockTokenGenerator(test.NewTokenName)),
+				Recorder:  recorder,
+			}
+			controller.Teleport.Client = fakeClient
+			if tc.identity != nil {
+				controller.Teleport.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{Tokens: tc.tokens, ServerVersion: tc.serverVersion}), tc.identity)
+			} else if err := controller.Teleport.Clients.Sync(context.TODO()); err == nil {
+				t.Fatalf("expected connecting to Teleport to fail")
+			}
+
+			_, err = controller.Reconcile(context.TODO(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: cluster.Name, Namespace: cluster.Namespace},
+			})
+			test.CheckError(t, tc.expectError, err)
+
+			close(recorder.Events)
+			var actual []string
+			for event := range recorder.Events {
+				actual = append(actual, event)
+			}
+			if len(actual) != len(tc.expectedEvents) {
+				t.Fatalf("expected events %q, actual %q", tc.expectedEvents, actual)
+			}
+			for i, expected := range tc.expectedEvents {
+				if !strings.HasPrefix(actual[i], expected) {
+					t.Fatalf("expected event %d to start with %q, actual %q", i, expected, actual[i])
+				}
+			}
+		})
+	}
+}
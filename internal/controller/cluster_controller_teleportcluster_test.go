@@ -0,0 +1,817 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	teleportTypes "github.com/gravitational/teleport/api/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_ClusterController_TeleportCluster(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		objects              []client.Object
+		expectedRegisterName string
+		expectedRoles        []string
+		expectedTokenTTL     time.Duration
+		expectedValuesLayout v1alpha1.ValuesLayout
+	}{
+		{
+			name:                 "case 0: Create the TeleportCluster and report the defaults in its status",
+			expectedRegisterName: key.GetRegisterName(test.ManagementClusterName, test.ClusterName),
+			expectedRoles:        []string{key.RoleKube},
+			expectedTokenTTL:     key.TeleportKubeTokenValidity,
+			expectedValuesLayout: v1alpha1.ValuesLayoutDual,
+		},
+		{
+			name: "case 1: Use register name, roles and token TTL from the TeleportCluster spec",
+			objects: []client.Object{
+				test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{
+					Roles:        []string{key.RoleKube, key.RoleApp},
+					RegisterName: "custom-name",
+					TokenTTL:     &metav1.Duration{Duration: time.Hour},
+				}),
+				tkaAppWithVersion(test.ClusterName, test.AppName, test.NamespaceName, test.AppVersionNested),
+			},
+			expectedRegisterName: "custom-name",
+			expectedRoles:        []string{key.RoleKube, key.RoleApp},
+			expectedTokenTTL:     time.Hour,
+			expectedValuesLayout: v1alpha1.ValuesLayoutNested,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+			fakeClient, err := test.NewFakeK8sClientFromObjects(append(tc.objects, cluster)...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			ctx := context.TODO()
+			controller := &ClusterReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Scheme:    scheme.Scheme,
+				Namespace: test.NamespaceName,
+				Teleport:  teleport.New(test.NamespaceName, newConfig(), test.NewMockTokenGenerator(test.TokenName)),
+			}
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{})
+			controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+			controller.Teleport.Client = fakeClient
+
+			before := time.Now()
+			_, err = controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: cluster.Name, Namespace: cluster.Namespace},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			actual := &v1alpha1.TeleportCluster{}
+			if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(cluster), actual); err != nil {
+				t.Fatalf("failed to get TeleportCluster: %v", err)
+			}
+			status := actual.Status
+			if status.RegisterName != tc.expectedRegisterName {
+				t.Fatalf("expected register name %q, actual %q", tc.expectedRegisterName, status.RegisterName)
+			}
+			if key.RolesToString(status.Roles) != key.RolesToString(tc.expectedRoles) {
+				t.Fatalf("expected roles %v, actual %v", tc.expectedRoles, status.Roles)
+			}
+			if status.ValuesLayout != tc.expectedValuesLayout {
+				t.Fatalf("expected values layout %q, actual %q", tc.expectedValuesLayout, status.ValuesLayout)
+			}
+			if status.ObservedGeneration != actual.Generation {
+				t.Fatalf("expected observed generation %d, actual %d", actual.Generation, status.ObservedGeneration)
+			}
+			for name, tokenStatus := range map[string]*v1alpha1.JoinTokenStatus{"kube": status.KubeJoinToken, "node": status.NodeJoinToken} {
+				if tokenStatus == nil || tokenStatus.Name != test.TokenName || tokenStatus.ExpiresAt == nil {
+					t.Fatalf("expected %s join token status for %s, actual %+v", name, test.TokenName, tokenStatus)
+				}
+				if tokenStatus.ExpiresAt.Time.Before(before.Add(tc.expectedTokenTTL).Truncate(time.Second)) {
+					t.Fatalf("expected %s join token to expire after %s, actual %s", name, tc.expectedTokenTTL, tokenStatus.ExpiresAt)
+				}
+			}
+
+			tokens, err := teleportClient.GetTokens(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, token := range tokens {
+				if token.GetMetadata().Labels[test.ClusterKey] != tc.expectedRegisterName {
+					t.Fatalf("expected token to be labelled with %q, actual %v", tc.expectedRegisterName, token.GetMetadata().Labels)
+				}
+			}
+		})
+	}
+}
+
+func Test_ClusterController_TokenRotation(t *testing.T) {
+	const (
+		nodeTokenName = "node-token"
+		kubeTokenName = "kube-token"
+	)
+
+	testCases := []struct {
+		name                 string
+		expiresIn            time.Duration
+		expectedToken        string
+		expectedTokenCount   int
+		expectedRetiring     int
+		expectedRequeueAfter time.Duration
+	}{
+		{
+			name:                 "case 0: Rotate join tokens past the rotation threshold and keep the old ones for the grace period",
+			expiresIn:            5 * time.Hour,
+			expectedToken:        test.NewTokenName,
+			expectedTokenCount:   3,
+			expectedRetiring:     2,
+			expectedRequeueAfter: 20 * time.Minute,
+		},
+		{
+			name:                 "case 1: Keep join tokens and requeue in time for their rotation",
+			expiresIn:            6*time.Hour + 30*time.Minute,
+			expectedToken:        nodeTokenName,
+			expectedTokenCount:   2,
+			expectedRequeueAfter: 30 * time.Minute,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient, err := test.NewFakeK8sClientFromObjects(
+				test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{}),
+				test.NewSecret(test.ClusterName, test.NamespaceName, nodeTokenName),
+				test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, kubeTokenName, []string{key.RoleKube}),
+			)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			// Rotate after 75% of a 24h lifetime, i.e. 6h before expiry.
+			cfg := newConfig()
+			cfg.NodeTokenTTL = 24 * time.Hour
+			cfg.KubeTokenTTL = 24 * time.Hour
+			cfg.TokenRotationPercent = 75
+			cfg.RequeueInterval = time.Hour
+			cfg.TokenGracePeriod = 20 * time.Minute
+
+			expiry := time.Now().Add(tc.expiresIn)
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+				Tokens: []teleportTypes.ProvisionToken{
+					test.NewToken(nodeTokenName, test.ClusterName, []string{key.RoleNode}, expiry),
+					test.NewToken(kubeTokenName, test.ClusterName, []string{key.RoleKube}, expiry),
+				},
+			})
+			controller := &ClusterReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Scheme:    scheme.Scheme,
+				Namespace: test.NamespaceName,
+				Teleport:  teleport.New(test.NamespaceName, cfg, test.NewMockTokenGenerator(test.NewTokenName)),
+			}
+			controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+			controller.Teleport.Client = fakeClient
+
+			ctx := context.TODO()
+			result, err := controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: test.ClusterName, Namespace: test.NamespaceName},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if result.RequeueAfter > tc.expectedRequeueAfter || result.RequeueAfter < tc.expectedRequeueAfter-time.Minute {
+				t.Fatalf("expected requeue after %s, actual %s", tc.expectedRequeueAfter, result.RequeueAfter)
+			}
+
+			secret := &corev1.Secret{}
+			if err := fakeClient.Get(ctx, types.NamespacedName{Name: key.GetSecretName(test.ClusterName), Namespace: test.NamespaceName}, secret); err != nil {
+				t.Fatalf("failed to get Secret: %v", err)
+			}
+			if token := secret.StringData[test.JoinTokenKey]; token != tc.expectedToken {
+				t.Fatalf("expected node join token %q, actual %q", tc.expectedToken, token)
+			}
+
+			// The mock generator hands out the same name for the node and the
+			// kube token, so a single new token is added by rotation.
+			tokens, err := teleportClient.GetTokens(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(tokens) != tc.expectedTokenCount {
+				t.Fatalf("expected %d join tokens in Teleport, actual %d", tc.expectedTokenCount, len(tokens))
+			}
+
+			teleportCluster := &v1alpha1.TeleportCluster{}
+			if err := fakeClient.Get(ctx, types.NamespacedName{Name: test.ClusterName, Namespace: test.NamespaceName}, teleportCluster); err != nil {
+				t.Fatalf("failed to get TeleportCluster: %v", err)
+			}
+			if len(teleportCluster.Status.RetiringJoinTokens) != tc.expectedRetiring {
+				t.Fatalf("expected %d retiring join tokens, actual %+v", tc.expectedRetiring, teleportCluster.Status.RetiringJoinTokens)
+			}
+		})
+	}
+}
+
+func Test_ClusterController_TokenRetirement(t *testing.T) {
+	const (
+		nodeTokenName    = "node-token"
+		kubeTokenName    = "kube-token"
+		oldNodeTokenName = "old-node-token"
+		oldKubeTokenName = "old-kube-token"
+	)
+	now := time.Now()
+	rotatedAt := now.Add(-2 * time.Hour)
+
+	testCases := []struct {
+		name             string
+		retireAfter      time.Time
+		oldTokenExpiry   time.Time
+		heartbeat        time.Time
+		agentStartedAt   time.Time
+		expectedRetiring []string
+	}{
+		{
+			name:             "case 0: Keep the previous join tokens during the grace period",
+			retireAfter:      now.Add(time.Hour),
+			oldTokenExpiry:   now.Add(2 * time.Hour),
+			heartbeat:        now,
+			expectedRetiring: []string{oldNodeTokenName, oldKubeTokenName},
+		},
+		{
+			name:             "case 1: Keep the previous kube join token until the restarted agent heartbeats",
+			retireAfter:      now.Add(-time.Hour),
+			oldTokenExpiry:   now.Add(2 * time.Hour),
+			heartbeat:        rotatedAt.Add(-time.Minute),
+			agentStartedAt:   rotatedAt.Add(time.Minute),
+			expectedRetiring: []string{oldKubeTokenName},
+		},
+		{
+			name:             "case 2: Keep the previous kube join token while the agent heartbeats without having restarted",
+			retireAfter:      now.Add(-time.Hour),
+			oldTokenExpiry:   now.Add(2 * time.Hour),
+			heartbeat:        now,
+			agentStartedAt:   rotatedAt.Add(-time.Hour),
+			expectedRetiring: []string{oldKubeTokenName},
+		},
+		{
+			name:           "case 3: Retire the previous join tokens once the agent restarted and heartbeats",
+			retireAfter:    now.Add(-time.Hour),
+			oldTokenExpiry: now.Add(2 * time.Hour),
+			heartbeat:      now,
+			agentStartedAt: rotatedAt.Add(time.Minute),
+		},
+		{
+			name:           "case 4: Drop expired join tokens without waiting for the agent",
+			retireAfter:    now.Add(-2 * time.Hour),
+			oldTokenExpiry: now.Add(-time.Hour),
+			heartbeat:      rotatedAt.Add(-time.Minute),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			retiring := func(name string, roles []string) v1alpha1.RetiringJoinTokenStatus {
+				return v1alpha1.RetiringJoinTokenStatus{
+					JoinTokenStatus: *teleport.NewJoinTokenStatus(name, roles, tc.oldTokenExpiry),
+					RotatedAt:       metav1.NewTime(rotatedAt),
+					RetireAfter:     metav1.NewTime(tc.retireAfter),
+				}
+			}
+			teleportCluster := test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{})
+			teleportCluster.Status.RetiringJoinTokens = []v1alpha1.RetiringJoinTokenStatus{
+				retiring(oldNodeTokenName, []string{key.RoleNode}),
+				retiring(oldKubeTokenName, []string{key.RoleKube}),
+			}
+			fakeClient, err := test.NewFakeK8sClientFromObjects(
+				test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{}),
+				teleportCluster,
+				test.NewSecret(test.ClusterName, test.NamespaceName, nodeTokenName),
+				test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, kubeTokenName, []string{key.RoleKube}),
+			)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			tokens := []teleportTypes.ProvisionToken{
+				test.NewToken(nodeTokenName, test.ClusterName, []string{key.RoleNode}),
+				test.NewToken(kubeTokenName, test.ClusterName, []string{key.RoleKube}),
+			}
+			if tc.oldTokenExpiry.After(now) {
+				tokens = append(tokens,
+					test.NewToken(oldNodeTokenName, test.ClusterName, []string{key.RoleNode}, tc.oldTokenExpiry),
+					test.NewToken(oldKubeTokenName, test.ClusterName, []string{key.RoleKube}, tc.oldTokenExpiry),
+				)
+			}
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+				Tokens:      tokens,
+				KubeServers: []teleportTypes.KubeServer{test.NewKubeServer(test.ClusterName, "host-id", "host-name", tc.heartbeat)},
+			})
+			controller := &ClusterReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Scheme:    scheme.Scheme,
+				Namespace: test.NamespaceName,
+				Teleport:  teleport.New(test.NamespaceName, newConfig(), test.NewMockTokenGenerator(test.NewTokenName)),
+			}
+			controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+			controller.Teleport.Client = fakeClient
+			controller.Teleport.AgentStarts = teleport.AgentStartSourceFunc(func(ctx context.Context, cluster *capi.Cluster, serviceAccount string) (time.Time, error) {
+				return tc.agentStartedAt, nil
+			})
+
+			ctx := context.TODO()
+			_, err = controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: test.ClusterName, Namespace: test.NamespaceName},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			actual := &v1alpha1.TeleportCluster{}
+			if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(teleportCluster), actual); err != nil {
+				t.Fatalf("failed to get TeleportCluster: %v", err)
+			}
+			var actualRetiring []string
+			for _, token := range actual.Status.RetiringJoinTokens {
+				actualRetiring = append(actualRetiring, token.Name)
+			}
+			if fmt.Sprint(actualRetiring) != fmt.Sprint(tc.expectedRetiring) {
+				t.Fatalf("expected retiring join tokens %v, actual %v", tc.expectedRetiring, actualRetiring)
+			}
+
+			// Retiring tokens stay in Teleport next to the current ones,
+			// everything else of the cluster is gone.
+			remaining, err := teleportClient.GetTokens(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(remaining) != 2+len(tc.expectedRetiring) {
+				t.Fatalf("expected %d join tokens in Teleport, actual %d", 2+len(tc.expectedRetiring), len(remaining))
+			}
+			for _, name := range append([]string{nodeTokenName, kubeTokenName}, tc.expectedRetiring...) {
+				if _, err := teleportClient.GetToken(ctx, name); err != nil {
+					t.Fatalf("expected join token %s to be kept: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_ClusterController_RotateTokenAnnotation(t *testing.T) {
+	const (
+		nodeTokenName    = "node-token"
+		kubeTokenName    = "kube-token"
+		oldKubeTokenName = "old-kube-token"
+		rotationRequest  = "2024-01-01T00:00:00Z"
+	)
+	now := time.Now()
+
+	testCases := []struct {
+		name                string
+		lastRotationRequest string
+		expectedTokens      []string
+		expectedRetiring    []string
+	}{
+		{
+			name:           "case 0: Rotate the join tokens and revoke the previous ones on a new request",
+			expectedTokens: []string{test.NewTokenName},
+		},
+		{
+			name:                "case 1: Keep the join tokens once the request was handled",
+			lastRotationRequest: rotationRequest,
+			expectedTokens:      []string{nodeTokenName, kubeTokenName, oldKubeTokenName},
+			expectedRetiring:    []string{oldKubeTokenName},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+			cluster.Annotations = map[string]string{key.RotateTokenAnnotation: rotationRequest}
+			teleportCluster := test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{})
+			teleportCluster.Status.LastRotationRequest = tc.lastRotationRequest
+			teleportCluster.Status.RetiringJoinTokens = []v1alpha1.RetiringJoinTokenStatus{{
+				JoinTokenStatus: *teleport.NewJoinTokenStatus(oldKubeTokenName, []string{key.RoleKube}, now.Add(time.Hour)),
+				RotatedAt:       metav1.NewTime(now.Add(-time.Minute)),
+				RetireAfter:     metav1.NewTime(now.Add(time.Hour)),
+			}}
+			fakeClient, err := test.NewFakeK8sClientFromObjects(
+				cluster,
+				teleportCluster,
+				test.NewSecret(test.ClusterName, test.NamespaceName, nodeTokenName),
+				test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, kubeTokenName, []string{key.RoleKube}),
+			)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+				Tokens: []teleportTypes.ProvisionToken{
+					test.NewToken(nodeTokenName, test.ClusterName, []string{key.RoleNode}),
+					test.NewToken(kubeTokenName, test.ClusterName, []string{key.RoleKube}),
+					test.NewToken(oldKubeTokenName, test.ClusterName, []string{key.RoleKube}, now.Add(time.Hour)),
+				},
+			})
+			controller := &ClusterReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Scheme:    scheme.Scheme,
+				Namespace: test.NamespaceName,
+				Teleport:  teleport.New(test.NamespaceName, newConfig(), test.NewMockTokenGenerator(test.NewTokenName)),
+			}
+			controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+			controller.Teleport.Client = fakeClient
+
+			ctx := context.TODO()
+			_, err = controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: test.ClusterName, Namespace: test.NamespaceName},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			actual := &v1alpha1.TeleportCluster{}
+			if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(teleportCluster), actual); err != nil {
+				t.Fatalf("failed to get TeleportCluster: %v", err)
+			}
+			if actual.Status.LastRotationRequest != rotationRequest {
+				t.Fatalf("expected rotation request %q to be handled, actual %q", rotationRequest, actual.Status.LastRotationRequest)
+			}
+			var actualRetiring []string
+			for _, token := range actual.Status.RetiringJoinTokens {
+				actualRetiring = append(actualRetiring, token.Name)
+			}
+			if fmt.Sprint(actualRetiring) != fmt.Sprint(tc.expectedRetiring) {
+				t.Fatalf("expected retiring join tokens %v, actual %v", tc.expectedRetiring, actualRetiring)
+			}
+
+			remaining, err := teleportClient.GetTokens(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var actualTokens []string
+			for _, token := range remaining {
+				actualTokens = append(actualTokens, token.GetName())
+			}
+			slices.Sort(actualTokens)
+			actualTokens = slices.Compact(actualTokens)
+			expectedTokens := slices.Sorted(slices.Values(tc.expectedTokens))
+			if fmt.Sprint(actualTokens) != fmt.Sprint(expectedTokens) {
+				t.Fatalf("expected join tokens %v in Teleport, actual %v", expectedTokens, actualTokens)
+			}
+		})
+	}
+}
+
+func Test_ClusterController_KubernetesJoinMethod(t *testing.T) {
+	const (
+		kubeTokenName = "kube-token"
+		jwks          = `{"keys":[]}`
+	)
+	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
+	kubernetesTokenName := key.GetJoinTokenName(registerName, key.JoinMethodKubernetes)
+
+	testCases := []struct {
+		name             string
+		kubernetesJoin   *v1alpha1.KubernetesJoinSpec
+		configMap        *corev1.ConfigMap
+		failsJWKS        bool
+		existingJWKS     string
+		expectError      bool
+		expectedType     teleportTypes.KubernetesJoinType
+		expectedJWKS     string
+		expectedRetiring int
+	}{
+		{
+			name:             "case 0: Replace the static kube token with a kubernetes join token validated against the cluster's JWKS",
+			configMap:        test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, kubeTokenName, []string{key.RoleKube}),
+			expectedType:     teleportTypes.KubernetesJoinTypeStaticJWKS,
+			expectedJWKS:     jwks,
+			expectedRetiring: 1,
+		},
+		{
+			name:           "case 1: Create a kubernetes join token validated in-cluster",
+			kubernetesJoin: &v1alpha1.KubernetesJoinSpec{InCluster: true, ServiceAccount: "teleport:agent"},
+			failsJWKS:      true,
+			expectedType:   teleportTypes.KubernetesJoinTypeInCluster,
+		},
+		{
+			name:        "case 2: Fail in case the cluster's JWKS cannot be fetched",
+			failsJWKS:   true,
+			expectError: true,
+		},
+		{
+			name:         "case 3: Keep the JWKS of the existing kubernetes join token in case the cluster's JWKS cannot be fetched",
+			failsJWKS:    true,
+			existingJWKS: `{"keys":[{"kid":"existing"}]}`,
+			expectedType: teleportTypes.KubernetesJoinTypeStaticJWKS,
+			expectedJWKS: `{"keys":[{"kid":"existing"}]}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			objects := []client.Object{
+				test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{}),
+				test.NewSecret(test.ClusterName, test.NamespaceName, test.TokenName),
+				test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{
+					Roles:          []string{key.RoleKube},
+					JoinMethod:     v1alpha1.JoinMethodKubernetes,
+					KubernetesJoin: tc.kubernetesJoin,
+				}),
+			}
+			if tc.configMap != nil {
+				objects = append(objects, tc.configMap)
+			}
+			fakeClient, err := test.NewFakeK8sClientFromObjects(objects...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			expiry := time.Now().Add(24 * time.Hour)
+			tokens := []teleportTypes.ProvisionToken{
+				test.NewToken(test.TokenName, test.ClusterName, []string{key.RoleNode}, expiry),
+				test.NewToken(kubeTokenName, test.ClusterName, []string{key.RoleKube}, expiry),
+			}
+			if tc.existingJWKS != "" {
+				existing, err := teleportTypes.NewProvisionTokenFromSpec(kubernetesTokenName, time.Time{}, teleportTypes.ProvisionTokenSpecV2{
+					Roles:      key.RolesToSystemRoles([]string{key.RoleKube}),
+					JoinMethod: teleportTypes.JoinMethodKubernetes,
+					Kubernetes: &teleportTypes.ProvisionTokenSpecV2Kubernetes{
+						Type:       teleportTypes.KubernetesJoinTypeStaticJWKS,
+						Allow:      []*teleportTypes.ProvisionTokenSpecV2Kubernetes_Rule{{ServiceAccount: key.GetKubeAgentServiceAccount()}},
+						StaticJWKS: &teleportTypes.ProvisionTokenSpecV2Kubernetes_StaticJWKSConfig{JWKS: tc.existingJWKS},
+					},
+				})
+				if err != nil {
+					t.Fatalf("failed to create kubernetes join token: %v", err)
+				}
+				tokens = append(tokens, existing)
+			}
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{Tokens: tokens})
+			controller := &ClusterReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Scheme:    scheme.Scheme,
+				Namespace: test.NamespaceName,
+				Teleport:  teleport.New(test.NamespaceName, newConfig(), test.NewMockTokenGenerator(test.NewTokenName)),
+			}
+			controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+			controller.Teleport.Client = fakeClient
+			controller.Teleport.JWKS = teleport.JWKSSourceFunc(func(ctx context.Context, cluster *capi.Cluster) (string, error) {
+				if tc.failsJWKS {
+					return "", fmt.Errorf("no kubeconfig for %s", cluster.Name)
+				}
+				return jwks, nil
+			})
+
+			ctx := context.TODO()
+			_, err = controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: test.ClusterName, Namespace: test.NamespaceName},
+			})
+			test.CheckError(t, tc.expectError, err)
+			if tc.expectError {
+				return
+			}
+
+			token, err := teleportClient.GetToken(ctx, kubernetesTokenName)
+			if err != nil {
+				t.Fatalf("expected kubernetes join token %s: %v", kubernetesTokenName, err)
+			}
+			if token.GetJoinMethod() != teleportTypes.JoinMethodKubernetes || !token.Expiry().IsZero() {
+				t.Fatalf("expected a non-expiring kubernetes join token, actual join method %q expiring %s", token.GetJoinMethod(), token.Expiry())
+			}
+			spec := token.GetKubernetes()
+			if spec.Type != tc.expectedType {
+				t.Fatalf("expected kubernetes join type %q, actual %q", tc.expectedType, spec.Type)
+			}
+			if actualJWKS := staticJWKS(spec); actualJWKS != tc.expectedJWKS {
+				t.Fatalf("expected JWKS %q, actual %q", tc.expectedJWKS, actualJWKS)
+			}
+			serviceAccount := key.GetKubeAgentServiceAccount()
+			if tc.kubernetesJoin != nil && tc.kubernetesJoin.ServiceAccount != "" {
+				serviceAccount = tc.kubernetesJoin.ServiceAccount
+			}
+			if len(spec.Allow) != 1 || spec.Allow[0].ServiceAccount != serviceAccount {
+				t.Fatalf("expected service account %s to be allowed, actual %+v", serviceAccount, spec.Allow)
+			}
+
+			configMap := &corev1.ConfigMap{}
+			if err := fakeClient.Get(ctx, types.NamespacedName{Name: key.GetConfigmapName(test.ClusterName, test.AppName), Namespace: test.NamespaceName}, configMap); err != nil {
+				t.Fatalf("failed to get ConfigMap: %v", err)
+			}
+			if actualToken, err := controller.Teleport.GetTokenFromConfigMap(ctx, configMap); err != nil || actualToken != kubernetesTokenName {
+				t.Fatalf("expected ConfigMap to name join token %s, actual %q (%v)", kubernetesTokenName, actualToken, err)
+			}
+
+			teleportCluster := &v1alpha1.TeleportCluster{}
+			if err := fakeClient.Get(ctx, types.NamespacedName{Name: test.ClusterName, Namespace: test.NamespaceName}, teleportCluster); err != nil {
+				t.Fatalf("failed to get TeleportCluster: %v", err)
+			}
+			if kubeToken := teleportCluster.Status.KubeJoinToken; kubeToken == nil || kubeToken.Name != kubernetesTokenName || kubeToken.ExpiresAt != nil {
+				t.Fatalf("expected non-expiring kube join token %s in status, actual %+v", kubernetesTokenName, kubeToken)
+			}
+			if len(teleportCluster.Status.RetiringJoinTokens) != tc.expectedRetiring {
+				t.Fatalf("expected %d retiring join tokens, actual %+v", tc.expectedRetiring, teleportCluster.Status.RetiringJoinTokens)
+			}
+			if _, err := teleportClient.GetToken(ctx, kubeTokenName); (err == nil) != (tc.expectedRetiring > 0) {
+				t.Fatalf("expected the static kube token to be kept only while retiring, actual error %v", err)
+			}
+		})
+	}
+}
+
+func staticJWKS(spec *teleportTypes.ProvisionTokenSpecV2Kubernetes) string {
+	if spec.StaticJWKS == nil {
+		return ""
+	}
+	return spec.StaticJWKS.JWKS
+}
+
+func Test_ClusterController_CloudJoinMethod(t *testing.T) {
+	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
+	azureCluster, azureRef := test.NewInfrastructureCluster("AzureCluster", "v1beta1", test.ClusterName, test.NamespaceName, map[string]interface{}{
+		"subscriptionID": "00000000-0000-0000-0000-000000000000",
+	})
+	_, dockerRef := test.NewInfrastructureCluster("DockerCluster", "v1beta1", test.ClusterName, test.NamespaceName, nil)
+
+	testCases := []struct {
+		name               string
+		infraRef           capi.ContractVersionedObjectReference
+		expectError        bool
+		expectedJoinMethod teleportTypes.JoinMethod
+	}{
+		{
+			name:               "case 0: Create an azure join token for a CAPZ cluster",
+			infraRef:           azureRef,
+			expectedJoinMethod: teleportTypes.JoinMethodAzure,
+		},
+		{
+			name:        "case 1: Fail for an infrastructure provider without a cloud join method",
+			infraRef:    dockerRef,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+			cluster.Spec.InfrastructureRef = tc.infraRef
+			fakeClient, err := test.NewFakeK8sClientFromObjects(
+				cluster,
+				azureCluster.DeepCopy(),
+				test.NewSecret(test.ClusterName, test.NamespaceName, test.TokenName),
+				test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{
+					Roles:      []string{key.RoleKube},
+					JoinMethod: v1alpha1.JoinMethodCloud,
+				}),
+			)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+				Tokens: []teleportTypes.ProvisionToken{
+					test.NewToken(test.TokenName, test.ClusterName, []string{key.RoleNode}, time.Now().Add(24*time.Hour)),
+				},
+			})
+			controller := &ClusterReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Scheme:    scheme.Scheme,
+				Namespace: test.NamespaceName,
+				Teleport:  teleport.New(test.NamespaceName, newConfig(), test.NewMockTokenGenerator(test.NewTokenName)),
+			}
+			controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+			controller.Teleport.Client = fakeClient
+
+			ctx := context.TODO()
+			_, err = controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: test.ClusterName, Namespace: test.NamespaceName},
+			})
+			test.CheckError(t, tc.expectError, err)
+			if tc.expectError {
+				return
+			}
+
+			tokenName := key.GetJoinTokenName(registerName, string(tc.expectedJoinMethod))
+			token, err := teleportClient.GetToken(ctx, tokenName)
+			if err != nil {
+				t.Fatalf("expected %s join token %s: %v", tc.expectedJoinMethod, tokenName, err)
+			}
+			if token.GetJoinMethod() != tc.expectedJoinMethod || !token.Expiry().IsZero() {
+				t.Fatalf("expected a non-expiring %s join token, actual join method %q expiring %s", tc.expectedJoinMethod, token.GetJoinMethod(), token.Expiry())
+			}
+
+			configMap := &corev1.ConfigMap{}
+			if err := fakeClient.Get(ctx, types.NamespacedName{Name: key.GetConfigmapName(test.ClusterName, test.AppName), Namespace: test.NamespaceName}, configMap); err != nil {
+				t.Fatalf("failed to get ConfigMap: %v", err)
+			}
+			if !strings.Contains(configMap.Data["values"], fmt.Sprintf("method: %q", tc.expectedJoinMethod)) {
+				t.Fatalf("expected ConfigMap values to carry join method %s, actual %s", tc.expectedJoinMethod, configMap.Data["values"])
+			}
+		})
+	}
+}
+
+func Test_ClusterController_PropagateClusterLabels(t *testing.T) {
+	const (
+		namespace     = "org-acme"
+		nodeTokenName = "node-token"
+		kubeTokenName = "kube-token"
+	)
+
+	cluster := test.NewCluster(test.ClusterName, namespace, []string{key.TeleportOperatorFinalizer}, time.Time{})
+	cluster.Labels = map[string]string{"release.giantswarm.io/version": "30.0.0", "unrelated": "x"}
+	fakeClient, err := test.NewFakeK8sClientFromObjects(
+		cluster,
+		test.NewSecret(test.ClusterName, namespace, nodeTokenName),
+		test.NewConfigMap(test.ClusterName, test.AppName, namespace, kubeTokenName, []string{key.RoleKube}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+		Tokens: []teleportTypes.ProvisionToken{
+			test.NewToken(nodeTokenName, test.ClusterName, []string{key.RoleNode}),
+			test.NewToken(kubeTokenName, test.ClusterName, []string{key.RoleKube}),
+		},
+	})
+	cfg := newConfig()
+	cfg.ClusterLabels = map[string]string{"release.giantswarm.io/version": "release"}
+	cfg.OrganizationLabel = "customer"
+	controller := &ClusterReconciler{
+		Client:    fakeClient,
+		Log:       ctrl.Log.WithName("test"),
+		Scheme:    scheme.Scheme,
+		Namespace: test.NamespaceName,
+		Teleport:  teleport.New(test.NamespaceName, cfg, test.NewMockTokenGenerator(test.NewTokenName)),
+	}
+	controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+	controller.Teleport.Client = fakeClient
+
+	ctx := context.TODO()
+	for _, release := range []string{"30.0.0", "31.0.0"} {
+		if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(cluster), cluster); err != nil {
+			t.Fatalf("failed to get Cluster: %v", err)
+		}
+		cluster.Labels["release.giantswarm.io/version"] = release
+		if err := fakeClient.Update(ctx, cluster); err != nil {
+			t.Fatalf("failed to update Cluster: %v", err)
+		}
+
+		_, err = controller.Reconcile(ctx, ctrl.Request{
+			NamespacedName: types.NamespacedName{Name: test.ClusterName, Namespace: namespace},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		configMap := &corev1.ConfigMap{}
+		if err := fakeClient.Get(ctx, types.NamespacedName{Name: key.GetConfigmapName(test.ClusterName, test.AppName), Namespace: namespace}, configMap); err != nil {
+			t.Fatalf("failed to get ConfigMap: %v", err)
+		}
+		for _, line := range []string{`  customer: "acme"`, fmt.Sprintf(`  release: %q`, release)} {
+			if !strings.Contains(configMap.Data["values"], line+"\n") {
+				t.Fatalf("expected label %s in the agent values, got:\n%s", line, configMap.Data["values"])
+			}
+		}
+		if strings.Contains(configMap.Data["values"], "unrelated") {
+			t.Fatalf("expected only allowed labels in the agent values, got:\n%s", configMap.Data["values"])
+		}
+
+		tokens, err := teleportClient.GetTokens(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, token := range tokens {
+			if name := token.GetName(); name != nodeTokenName && name != kubeTokenName {
+				t.Fatalf("expected the join tokens to be kept, found %s", name)
+			}
+			labels := token.GetMetadata().Labels
+			if labels["customer"] != "acme" || labels["release"] != release {
+				t.Fatalf("expected join token %s to be labelled with release %s, actual %v", token.GetName(), release, labels)
+			}
+		}
+	}
+}
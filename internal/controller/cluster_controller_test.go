@@ -39,7 +39,6 @@ func Test_ClusterController(t *testing.T) {
 		configMap           *corev1.ConfigMap
 		userValuesConfigMap *corev1.ConfigMap
 		tkaApp              *appv1alpha1.App
-		newTeleportClient   func(ctx context.Context, proxyAddr, identityFile string) (teleport.Client, error)
 		expectedCluster     *capi.Cluster
 		expectedSecret      *corev1.Secret
 		expectedConfigMap   *corev1.ConfigMap
@@ -124,42 +123,25 @@ func Test_ClusterController(t *testing.T) {
 			expectedRoles:     []string{key.RoleKube, key.RoleApp},
 		},
 		{
-			name:          "case 4: Deregister cluster and delete resources in case the cluster is deleted",
+			name:      "case 4: Deregister cluster and delete resources in case the cluster is deleted",
+			namespace: test.NamespaceName,
+			token:     test.TokenName,
+			config:    newConfig(),
+			identity:  newIdentity(test.LastReadValue),
+			cluster:   test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Now()),
+			secret:    test.NewSecret(test.ClusterName, test.NamespaceName, test.TokenName),
+			configMap: test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{key.RoleKube}),
+		},
+		{
+			name:          "case 5: Return an error while no connection to Teleport has been established",
 			namespace:     test.NamespaceName,
 			token:         test.TokenName,
 			config:        newConfig(),
-			identity:      newIdentity(test.LastReadValue),
-			cluster:       test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Now()),
+			identity:      nil,
+			cluster:       test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{}),
 			secret:        test.NewSecret(test.ClusterName, test.NamespaceName, test.TokenName),
 			configMap:     test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{key.RoleKube}),
-			expectedRoles: []string{key.RoleKube},
-		},
-		{
-			name:           "case 5: Reconnect to Teleport when credentials are rotated",
-			namespace:      test.NamespaceName,
-			token:          test.NewTokenName,
-			config:         newConfig(),
-			identity:       newIdentity(time.Now().Add(-identityExpirationPeriod - time.Second)),
-			cluster:        test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{}),
-			secret:         test.NewSecret(test.ClusterName, test.NamespaceName, test.TokenName),
-			identitySecret: test.NewIdentitySecret(test.NamespaceName, test.IdentityFileValue),
-			configMap:      test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{key.RoleKube}),
-			userValuesConfigMap: &corev1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      fmt.Sprintf("%s-teleport-kube-agent-user-values", test.ClusterName),
-					Namespace: test.NamespaceName,
-				},
-				Data: map[string]string{
-					"values": "apps:\n- name: test-app\n  uri: http://test-app",
-				},
-			},
-			newTeleportClient: func(ctx context.Context, proxyAddr, identityFile string) (teleport.Client, error) {
-				return test.NewTeleportClient(test.FakeTeleportClientConfig{Tokens: nil}), nil
-			},
-			expectedCluster:   test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{}),
-			expectedSecret:    test.NewSecret(test.ClusterName, test.NamespaceName, test.NewTokenName),
-			expectedConfigMap: test.NewDualBlockConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.NewTokenName, []string{key.RoleKube, key.RoleApp}),
-			expectedRoles:     []string{key.RoleKube, key.RoleApp},
+			expectedError: errors.New("not connected error"),
 		},
 		{
 			name:      "case 6.5: Rewrite configmap when teleportVersionOverride drifts even if token is valid",
@@ -198,21 +180,6 @@ func Test_ClusterController(t *testing.T) {
 			expectedConfigMap: test.NewNestedConfigMapWithoutVersionOverride(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{key.RoleKube}),
 			expectedRoles:     []string{key.RoleKube},
 		},
-		{
-			name:      "case 6: Return an error in case reconnection to Teleport fails after the credentials are rotated",
-			namespace: test.NamespaceName,
-			token:     test.TokenName,
-			config:    newConfig(),
-			identity:  newIdentity(time.Now().Add(-identityExpirationPeriod - time.Second)),
-			cluster:   test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{}),
-			secret:    test.NewSecret(test.ClusterName, test.NamespaceName, test.TokenName),
-			configMap: test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{key.RoleKube}),
-			newTeleportClient: func(ctx context.Context, proxyAddr, identityFile string) (teleport.Client, error) {
-				return nil, errors.New("simulated error")
-			},
-			expectedError: errors.New("secrets \"identity-output\" not found"),
-			expectedRoles: []string{key.RoleKube},
-		},
 	}
 
 	for _, tc := range testCases {
@@ -237,14 +204,6 @@ func Test_ClusterController(t *testing.T) {
 				runtimeObjects = append(runtimeObjects, tc.tkaApp)
 			}
 
-			newTeleportClient := teleport.NewClient
-			if tc.newTeleportClient != nil {
-				teleport.NewClient = tc.newTeleportClient
-			}
-			defer func() {
-				teleport.NewClient = newTeleportClient
-			}()
-
 			ctrlClient, err := test.NewFakeK8sClient(runtimeObjects)
 			if err != nil {
 				t.Fatalf("unexpected error %v", err)
@@ -261,10 +220,11 @@ func Test_ClusterController(t *testing.T) {
 				Teleport:     teleport.New(tc.namespace, tc.config, test.NewMockTokenGenerator(tc.token)),
 				IsBotEnabled: false,
 			}
-			controller.Teleport.TeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{
-				Tokens: tc.tokens,
-			})
-			controller.Teleport.Identity = tc.identity
+			if tc.identity != nil {
+				controller.Teleport.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{
+					Tokens: tc.tokens,
+				}), tc.identity)
+			}
 			controller.Teleport.Client = ctrlClient
 
 			req := ctrl.Request{
@@ -340,8 +300,14 @@ func Test_ClusterController(t *testing.T) {
 			}
 
 			// Check if the roles were set correctly
-			// This assumes you've added a method to expose the last assigned roles for testing
-			assignedRoles := controller.GetLastAssignedRoles()
+			var assignedRoles []string
+			teleportCluster, err := teleport.GetTeleportCluster(ctx, ctrlClient, tc.cluster)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if teleportCluster != nil {
+				assignedRoles = teleportCluster.Status.Roles
+			}
 			if !reflect.DeepEqual(assignedRoles, tc.expectedRoles) {
 				t.Errorf("Expected roles %v, but got %v", tc.expectedRoles, assignedRoles)
 			}
@@ -349,10 +315,6 @@ func Test_ClusterController(t *testing.T) {
 	}
 }
 
-func (r *ClusterReconciler) GetLastAssignedRoles() []string {
-	return r.lastAssignedRoles
-}
-
 func newConfig() *config.Config {
 	return &config.Config{
 		AppCatalog:            test.AppCatalog,
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/giantswarm/microerror"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+func markConditionTrue(cluster *capi.Cluster, conditionType, reason, message string) {
+	conditions.Set(cluster, metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// markConditionFalse records err as the condition message, so the failure
+// that made the reconcile return is visible on the Cluster itself.
+func markConditionFalse(cluster *capi.Cluster, conditionType, reason string, err error) {
+	conditions.Set(cluster, metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: err.Error(),
+	})
+}
+
+func markConditionFalseWithMessage(cluster *capi.Cluster, conditionType, reason, message string) {
+	conditions.Set(cluster, metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// patchClusterConditions writes the operator-owned conditions back to the
+// Cluster status. Conditions owned by CAPI or other controllers are left
+// untouched even if they changed since the Cluster was read.
+func patchClusterConditions(ctx context.Context, patchHelper *patch.Helper, cluster *capi.Cluster) error {
+	if err := patchHelper.Patch(ctx, cluster, patch.WithOwnedConditions{Conditions: key.TeleportConditions}); err != nil {
+		return microerror.Mask(err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+)
+
+// ConfigReconciler reloads the operator configuration whenever the
+// teleport-operator ConfigMap changes, and enqueues every Cluster so that the
+// new settings are rolled out without restarting the operator.
+type ConfigReconciler struct {
+	Client    client.Client
+	Log       logr.Logger
+	Teleport  *teleport.Teleport
+	Namespace string
+
+	// ClusterEvents receives one event per Cluster after the configuration
+	// changed. It is consumed by the ClusterReconciler.
+	ClusterEvents chan<- event.GenericEvent
+}
+
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+
+func (r *ConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("configMap", req.NamespacedName)
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Client.Get(ctx, req.NamespacedName, configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Info("Operator ConfigMap not found, keeping the current configuration")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, microerror.Mask(err)
+	}
+
+	newConfig, err := config.ParseConfigMap(configMap)
+	if err != nil {
+		// An invalid ConfigMap must not take down a working operator: keep
+		// the current configuration until the ConfigMap is fixed.
+		log.Error(err, "Invalid operator ConfigMap, keeping the current configuration")
+		return ctrl.Result{}, nil
+	}
+
+	currentConfig := r.Teleport.Config()
+	if currentConfig != nil && reflect.DeepEqual(currentConfig, newConfig) {
+		return ctrl.Result{}, nil
+	}
+
+	r.Teleport.SetConfig(newConfig)
+	log.Info("Reloaded operator configuration",
+		"proxyAddr", newConfig.ProxyAddr,
+		"teleportVersion", newConfig.TeleportVersion,
+		"appName", newConfig.AppName)
+
+	if err := r.enqueueClusters(ctx); err != nil {
+		return ctrl.Result{}, microerror.Mask(err)
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *ConfigReconciler) enqueueClusters(ctx context.Context) error {
+	if r.ClusterEvents == nil {
+		return nil
+	}
+
+	clusters := &capi.ClusterList{}
+	if err := r.Client.List(ctx, clusters); err != nil {
+		return microerror.Mask(err)
+	}
+	for i := range clusters.Items {
+		select {
+		case r.ClusterEvents <- event.GenericEvent{Object: &clusters.Items[i]}:
+		case <-ctx.Done():
+			return microerror.Mask(ctx.Err())
+		}
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager. Only the
+// operator's own ConfigMap is reconciled.
+func (r *ConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isOperatorConfig := predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetName() == key.TeleportOperatorConfigName && object.GetNamespace() == r.Namespace
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("operatorconfig").
+		For(&corev1.ConfigMap{}, builder.WithPredicates(isOperatorConfig)).
+		Complete(r)
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func newOperatorConfigMap(cfg *config.Config) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.TeleportOperatorConfigName,
+			Namespace: test.NamespaceName,
+		},
+		Data: map[string]string{
+			key.AppCatalog:            cfg.AppCatalog,
+			key.AppName:               cfg.AppName,
+			key.AppVersion:            cfg.AppVersion,
+			key.ManagementClusterName: cfg.ManagementClusterName,
+			key.ProxyAddr:             cfg.ProxyAddr,
+			key.TeleportVersion:       cfg.TeleportVersion,
+		},
+	}
+}
+
+func Test_ConfigController(t *testing.T) {
+	changedProxyAddr := newConfig()
+	changedProxyAddr.ProxyAddr = "teleport.example.com:443"
+
+	invalid := newOperatorConfigMap(newConfig())
+	delete(invalid.Data, key.ProxyAddr)
+
+	testCases := []struct {
+		name                 string
+		configMap            *corev1.ConfigMap
+		expectedConfig       *config.Config
+		expectedEnqueued     int
+		expectReconnectToNew bool
+	}{
+		{
+			name:           "case 0: Keep the configuration when the ConfigMap is unchanged",
+			configMap:      newOperatorConfigMap(newConfig()),
+			expectedConfig: newConfig(),
+		},
+		{
+			name:             "case 1: Swap the configuration and enqueue all clusters when the teleport version changes",
+			configMap:        newOperatorConfigMap(newConfigWithTeleportVersion(test.TeleportVersionNew)),
+			expectedConfig:   newConfigWithTeleportVersion(test.TeleportVersionNew),
+			expectedEnqueued: 2,
+		},
+		{
+			name:                 "case 2: Reconnect to Teleport when the proxy address changes",
+			configMap:            newOperatorConfigMap(changedProxyAddr),
+			expectedConfig:       changedProxyAddr,
+			expectedEnqueued:     2,
+			expectReconnectToNew: true,
+		},
+		{
+			name:           "case 3: Keep the configuration when the ConfigMap is invalid",
+			configMap:      invalid,
+			expectedConfig: newConfig(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+			fakeClient, err := test.NewFakeK8sClientFromObjects(
+				tc.configMap,
+				cluster,
+				test.NewCluster("other-cluster", "other-namespace", nil, time.Time{}),
+				test.NewIdentitySecret(test.NamespaceName, test.IdentityFileValue),
+			)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			tele := teleport.New(test.NamespaceName, newConfig(), test.NewMockTokenGenerator(test.TokenName))
+			tele.Client = fakeClient
+			tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{}), newIdentity(time.Now()))
+
+			clusterEvents := make(chan event.GenericEvent, 10)
+			configController := &ConfigReconciler{
+				Client:        fakeClient,
+				Log:           ctrl.Log.WithName("test"),
+				Teleport:      tele,
+				Namespace:     test.NamespaceName,
+				ClusterEvents: clusterEvents,
+			}
+
+			_, err = configController.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(tc.configMap)})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(tele.Config(), tc.expectedConfig) {
+				t.Fatalf("expected config %+v, actual %+v", tc.expectedConfig, tele.Config())
+			}
+			if len(clusterEvents) != tc.expectedEnqueued {
+				t.Fatalf("expected %d clusters to be enqueued, actual %d", tc.expectedEnqueued, len(clusterEvents))
+			}
+
+			// The ClientProvider must reconnect to the new proxy address, and
+			// only then.
+			var connectedTo string
+			newTeleportClient := teleport.NewClient
+			teleport.NewClient = func(ctx context.Context, proxyAddr, identityFile string) (teleport.Client, error) {
+				connectedTo = proxyAddr
+				return test.NewTeleportClient(test.FakeTeleportClientConfig{}), nil
+			}
+			defer func() {
+				teleport.NewClient = newTeleportClient
+			}()
+
+			if err := tele.Clients.Sync(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.expectReconnectToNew && connectedTo != tc.expectedConfig.ProxyAddr {
+				t.Fatalf("expected reconnect to %q, actual %q", tc.expectedConfig.ProxyAddr, connectedTo)
+			}
+			if !tc.expectReconnectToNew && connectedTo != "" {
+				t.Fatalf("expected no reconnect, actual reconnect to %q", connectedTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+)
+
+// normalEvent records a change the operator made for the cluster, so it shows
+// up in `kubectl describe cluster`. related is the object that was changed,
+// if any. Events are skipped when no recorder is configured.
+func (r *ClusterReconciler) normalEvent(cluster *capi.Cluster, related runtime.Object, reason, action, note string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(cluster, related, corev1.EventTypeNormal, reason, action, note, args...)
+}
+
+func (r *ClusterReconciler) warningEvent(cluster *capi.Cluster, reason, action, note string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(cluster, nil, corev1.EventTypeWarning, reason, action, note, args...)
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+)
+
+// IdentityReconciler watches the identity Secret written by tbot and makes
+// the ClientProvider reconnect as soon as the identity changes, instead of
+// waiting for the old certificate to be rejected.
+type IdentityReconciler struct {
+	Client    client.Client
+	Log       logr.Logger
+	Teleport  *teleport.Teleport
+	Namespace string
+}
+
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+func (r *IdentityReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("secret", req.NamespacedName)
+
+	err := r.Teleport.Clients.Sync(ctx)
+	if apierrors.IsNotFound(err) {
+		log.Info("Identity Secret not found, waiting for tbot to write it")
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, microerror.Mask(err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager. Only the tbot
+// identity Secret in the operator namespace is reconciled.
+func (r *IdentityReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isIdentitySecret := predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetName() == key.TeleportBotSecretName && object.GetNamespace() == r.Namespace
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("identity").
+		For(&corev1.Secret{}, builder.WithPredicates(isIdentitySecret)).
+		Complete(r)
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_IdentityController(t *testing.T) {
+	testCases := []struct {
+		name             string
+		objects          []client.Object
+		identity         *config.IdentityConfig
+		failsConnect     bool
+		expectError      bool
+		expectConnect    bool
+		expectedIdentity string
+	}{
+		{
+			name:             "case 0: Connect when no identity has been loaded yet",
+			objects:          []client.Object{test.NewIdentitySecret(test.NamespaceName, test.IdentityFileValue)},
+			expectConnect:    true,
+			expectedIdentity: test.IdentityFileValue,
+		},
+		{
+			name:             "case 1: Reconnect when tbot renewed the identity",
+			objects:          []client.Object{test.NewIdentitySecret(test.NamespaceName, "renewed-identity")},
+			identity:         newIdentity(time.Now()),
+			expectConnect:    true,
+			expectedIdentity: "renewed-identity",
+		},
+		{
+			name:             "case 2: Keep the client when the identity did not change",
+			objects:          []client.Object{test.NewIdentitySecret(test.NamespaceName, test.IdentityFileValue)},
+			identity:         newIdentity(time.Now()),
+			expectedIdentity: test.IdentityFileValue,
+		},
+		{
+			name:             "case 3: Wait for tbot when the identity Secret does not exist",
+			identity:         newIdentity(time.Now()),
+			expectedIdentity: test.IdentityFileValue,
+		},
+		{
+			name:             "case 4: Keep the old client and retry when connecting fails",
+			objects:          []client.Object{test.NewIdentitySecret(test.NamespaceName, "renewed-identity")},
+			identity:         newIdentity(time.Now()),
+			failsConnect:     true,
+			expectError:      true,
+			expectConnect:    true,
+			expectedIdentity: test.IdentityFileValue,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient, err := test.NewFakeK8sClientFromObjects(tc.objects...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			var connected bool
+			newTeleportClient := teleport.NewClient
+			teleport.NewClient = func(ctx context.Context, proxyAddr, identityFile string) (teleport.Client, error) {
+				connected = true
+				if tc.failsConnect {
+					return nil, errors.New("connection refused")
+				}
+				return test.NewTeleportClient(test.FakeTeleportClientConfig{}), nil
+			}
+			defer func() {
+				teleport.NewClient = newTeleportClient
+			}()
+
+			tele := teleport.New(test.NamespaceName, newConfig(), test.NewMockTokenGenerator(test.TokenName))
+			tele.Client = fakeClient
+			if tc.identity != nil {
+				tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{}), tc.identity)
+			}
+
+			controller := &IdentityReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Teleport:  tele,
+				Namespace: test.NamespaceName,
+			}
+			_, err = controller.Reconcile(context.TODO(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: key.TeleportBotSecretName, Namespace: test.NamespaceName},
+			})
+			test.CheckError(t, tc.expectError, err)
+
+			if connected != tc.expectConnect {
+				t.Fatalf("expected connect %t, actual %t", tc.expectConnect, connected)
+			}
+			identity := tele.Clients.Identity()
+			if tc.expectedIdentity == "" && identity != nil {
+				t.Fatalf("expected no identity, actual %q", identity.IdentityFile)
+			}
+			if tc.expectedIdentity != "" && (identity == nil || identity.IdentityFile != tc.expectedIdentity) {
+				t.Fatalf("expected identity %q, actual %+v", tc.expectedIdentity, identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+)
+
+// rolloutRequeueInterval is how often the rollout is reconciled, to check
+// the health of released waves and to notice Teleport version changes that
+// come from the server rather than the operator ConfigMap.
+const rolloutRequeueInterval = time.Minute
+
+// RolloutReconciler rolls changes of the kube agents' Teleport version out
+// across the clusters in the waves of the operator's rollout policy, and
+// reports the progress in the status of the operator's
+// TeleportVersionRollout. Until its wave is released, a cluster keeps the
+// version in its values, see teleport.RolloutTeleportVersion.
+type RolloutReconciler struct {
+	Client    client.Client
+	Log       logr.Logger
+	Teleport  *teleport.Teleport
+	Recorder  events.EventRecorder
+	Namespace string
+}
+
+//+kubebuilder:rbac:groups=teleport.giantswarm.io,resources=teleportversionrollouts,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=teleport.giantswarm.io,resources=teleportversionrollouts/status,verbs=get;update;patch
+
+func (r *RolloutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("teleportVersionRollout", req.NamespacedName)
+
+	rollout, err := r.Teleport.EnsureVersionRollout(ctx, r.Client)
+	if err != nil {
+		return ctrl.Result{}, microerror.Mask(err)
+	}
+	original := rollout.DeepCopy()
+	now := time.Now()
+	policy := r.Teleport.Config().TeleportVersionRollout
+	version := r.Teleport.LastAgentTeleportVersion()
+	target := version.Version
+
+	// The target is only trusted once it was checked against the server
+	// version, so that a version that is about to be clamped does not
+	// restart the rollout.
+	status := &rollout.Status
+	switch {
+	case status.Phase != "" && status.ToVersion == target && (policy != nil || status.Phase == v1alpha1.RolloutPhaseCompleted):
+	case version.ServerVersionUnknown:
+		log.Info("Waiting for the Teleport server version to start a rollout", "toVersion", target)
+	default:
+		if err := r.startRollout(ctx, log, rollout, policy, target, now); err != nil {
+			return ctrl.Result{}, microerror.Mask(err)
+		}
+	}
+
+	r.reconcileAnnotations(log, rollout, now)
+
+	if status.Phase == v1alpha1.RolloutPhaseProgressing {
+		if err := r.releaseWaves(ctx, log, rollout, policy, now); err != nil {
+			return ctrl.Result{}, microerror.Mask(err)
+		}
+	}
+
+	if !reflect.DeepEqual(original.Status, rollout.Status) {
+		if err := r.Client.Status().Patch(ctx, rollout, client.MergeFrom(original)); err != nil {
+			return ctrl.Result{}, microerror.Mask(fmt.Errorf("failed to patch TeleportVersionRollout status: %w", err))
+		}
+	}
+	return ctrl.Result{RequeueAfter: rolloutRequeueInterval}, nil
+}
+
+// startRollout starts rolling target out, planning the waves of the policy
+// over the current clusters. Without a policy, or when the operator first
+// records the version, the rollout completes right away.
+func (r *RolloutReconciler) startRollout(ctx context.Context, log logr.Logger, rollout *v1alpha1.TeleportVersionRollout, policy *key.VersionRollout, target string, now time.Time) error {
+	status := &rollout.Status
+	first := status.Phase == ""
+	*status = v1alpha1.TeleportVersionRolloutStatus{
+		FromVersion:       status.ToVersion,
+		ToVersion:         target,
+		StartTime:         &metav1.Time{Time: now},
+		LastResumeRequest: status.LastResumeRequest,
+	}
+
+	if policy == nil || first {
+		status.Phase = v1alpha1.RolloutPhaseCompleted
+		status.CompletionTime = &metav1.Time{Time: now}
+		status.Message = fmt.Sprintf("Teleport version %q is rolled out to every cluster at once", target)
+		log.Info("Recorded Teleport version without a rollout", "toVersion", target, "policy", policy != nil)
+		return nil
+	}
+
+	clusters := &capi.ClusterList{}
+	if err := r.Client.List(ctx, clusters); err != nil {
+		return microerror.Mask(err)
+	}
+	waves, err := teleport.PlanRolloutWaves(policy, clusters.Items)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	status.Phase = v1alpha1.RolloutPhaseProgressing
+	status.Waves = waves
+	status.Message = fmt.Sprintf("Rolling out Teleport version %q in %d waves", target, len(waves))
+	log.Info("Started Teleport version rollout", "fromVersion", status.FromVersion, "toVersion", target, "waves", len(waves))
+	r.event(rollout, corev1.EventTypeNormal, key.RolloutStartedEventReason, "StartRollout",
+		"Started rolling out Teleport version %q, previously %q, in %d waves", target, status.FromVersion, len(waves))
+	return nil
+}
+
+// reconcileAnnotations pauses and resumes the rollout as requested by the
+// key.PauseRolloutAnnotation and key.ResumeRolloutAnnotation.
+func (r *RolloutReconciler) reconcileAnnotations(log logr.Logger, rollout *v1alpha1.TeleportVersionRollout, now time.Time) {
+	status := &rollout.Status
+
+	if resume := rollout.Annotations[key.ResumeRolloutAnnotation]; resume != "" && resume != status.LastResumeRequest {
+		status.LastResumeRequest = resume
+		if status.Phase == v1alpha1.RolloutPhaseFailed {
+			var retried []string
+			for i := range status.Waves {
+				wave := &status.Waves[i]
+				if wave.Phase == v1alpha1.RolloutWavePhaseFailed {
+					wave.Phase = v1alpha1.RolloutWavePhaseProgressing
+					wave.StartTime = &metav1.Time{Time: now}
+					wave.CompletionTime = nil
+					retried = append(retried, wave.Name)
+				}
+			}
+			status.Phase = v1alpha1.RolloutPhaseProgressing
+			status.Message = fmt.Sprintf("Retrying wave %s", strings.Join(retried, ", "))
+			log.Info("Resumed failed Teleport version rollout", "waves", retried)
+			r.event(rollout, corev1.EventTypeNormal, key.RolloutResumedEventReason, "ResumeRollout",
+				"Retrying wave %s of Teleport version %q", strings.Join(retried, ", "), status.ToVersion)
+		}
+	}
+
+	paused := rollout.Annotations[key.PauseRolloutAnnotation] == "true"
+	switch {
+	case paused && status.Phase == v1alpha1.RolloutPhaseProgressing:
+		status.Phase = v1alpha1.RolloutPhasePaused
+		status.Message = fmt.Sprintf("Paused by the %s annotation", key.PauseRolloutAnnotation)
+		log.Info("Paused Teleport version rollout")
+		r.event(rollout, corev1.EventTypeNormal, key.RolloutPausedEventReason, "PauseRollout",
+			"Paused rolling out Teleport version %q", status.ToVersion)
+	case !paused && status.Phase == v1alpha1.RolloutPhasePaused:
+		status.Phase = v1alpha1.RolloutPhaseProgressing
+		status.Message = fmt.Sprintf("Resumed rolling out Teleport version %q", status.ToVersion)
+		log.Info("Resumed Teleport version rollout")
+		r.event(rollout, corev1.EventTypeNormal, key.RolloutResumedEventReason, "ResumeRollout",
+			"Resumed rolling out Teleport version %q", status.ToVersion)
+	}
+}
+
+// releaseWaves releases the next wave once the agents of the waves before it
+// report the new version in Teleport. A wave whose agents do not within the
+// policy's wave timeout fails the rollout.
+func (r *RolloutReconciler) releaseWaves(ctx context.Context, log logr.Logger, rollout *v1alpha1.TeleportVersionRollout, policy *key.VersionRollout, now time.Time) error {
+	status := &rollout.Status
+	for i := range status.Waves {
+		wave := &status.Waves[i]
+		switch wave.Phase {
+		case v1alpha1.RolloutWavePhaseHealthy:
+			continue
+		case v1alpha1.RolloutWavePhasePending:
+			wave.StartTime = &metav1.Time{Time: now}
+			if len(wave.Clusters) == 0 {
+				wave.Phase = v1alpha1.RolloutWavePhaseHealthy
+				wave.CompletionTime = &metav1.Time{Time: now}
+				continue
+			}
+			wave.Phase = v1alpha1.RolloutWavePhaseProgressing
+			wave.PendingClusters = slices.Clone(wave.Clusters)
+			status.Message = fmt.Sprintf("Released wave %s", wave.Name)
+			log.Info("Released Teleport version rollout wave", "wave", wave.Name, "clusters", len(wave.Clusters))
+			r.event(rollout, corev1.EventTypeNormal, key.RolloutWaveStartedEventReason, "ReleaseWave",
+				"Released Teleport version %q to the %d clusters of wave %s", status.ToVersion, len(wave.Clusters), wave.Name)
+			return nil
+		case v1alpha1.RolloutWavePhaseProgressing:
+			unhealthy, err := r.Teleport.UnhealthyRolloutClusters(ctx, r.Client, wave.Clusters, status.ToVersion)
+			if err != nil {
+				return microerror.Mask(err)
+			}
+			wave.PendingClusters = unhealthy
+			if len(unhealthy) == 0 {
+				wave.Phase = v1alpha1.RolloutWavePhaseHealthy
+				wave.CompletionTime = &metav1.Time{Time: now}
+				log.Info("Teleport version rollout wave is healthy", "wave", wave.Name)
+				r.event(rollout, corev1.EventTypeNormal, key.RolloutWaveHealthyEventReason, "CheckWave",
+					"Agents of the %d clusters of wave %s report Teleport version %q", len(wave.Clusters), wave.Name, status.ToVersion)
+				continue
+			}
+			if wave.StartTime != nil && now.Sub(wave.StartTime.Time) >= policy.GetWaveTimeout() {
+				wave.Phase = v1alpha1.RolloutWavePhaseFailed
+				wave.CompletionTime = &metav1.Time{Time: now}
+				status.Phase = v1alpha1.RolloutPhaseFailed
+				status.Message = fmt.Sprintf("Agents of %s in wave %s did not report Teleport version %q within %s", strings.Join(unhealthy, ", "), wave.Name, status.ToVersion, policy.GetWaveTimeout())
+				log.Info("Teleport version rollout failed", "wave", wave.Name, "pendingClusters", unhealthy)
+				r.event(rollout, corev1.EventTypeWarning, key.RolloutFailedEventReason, "CheckWave", "%s", status.Message)
+				return nil
+			}
+			status.Message = fmt.Sprintf("Waiting for the agents of %d of %d clusters in wave %s", len(unhealthy), len(wave.Clusters), wave.Name)
+			return nil
+		default:
+			return nil
+		}
+	}
+
+	status.Phase = v1alpha1.RolloutPhaseCompleted
+	status.CompletionTime = &metav1.Time{Time: now}
+	status.Message = fmt.Sprintf("Rolled out Teleport version %q to every cluster", status.ToVersion)
+	log.Info("Completed Teleport version rollout", "toVersion", status.ToVersion)
+	r.event(rollout, corev1.EventTypeNormal, key.RolloutCompletedEventReason, "CompleteRollout", "%s", status.Message)
+	return nil
+}
+
+// event records a change of the rollout on the TeleportVersionRollout.
+// Events are skipped when no recorder is configured.
+func (r *RolloutReconciler) event(rollout *v1alpha1.TeleportVersionRollout, eventType, reason, action, note string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(rollout, nil, eventType, reason, action, note, args...)
+}
+
+// SetupWithManager sets up the controller with the Manager. Only the
+// operator's own TeleportVersionRollout is reconciled, also whenever the
+// operator ConfigMap changes, and created on the first reconcile.
+func (r *RolloutReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isOperatorObject := predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetName() == key.TeleportOperatorConfigName && object.GetNamespace() == r.Namespace
+	})
+	toRollout := handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, object client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: key.TeleportOperatorConfigName, Namespace: r.Namespace}}}
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("teleportversionrollout").
+		For(&v1alpha1.TeleportVersionRollout{}, builder.WithPredicates(isOperatorObject)).
+		Watches(&corev1.ConfigMap{}, toRollout, builder.WithPredicates(isOperatorObject)).
+		Complete(r)
+}
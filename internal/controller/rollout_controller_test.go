@@ -0,0 +1,362 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	teleportTypes "github.com/gravitational/teleport/api/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_RolloutController(t *testing.T) {
+	const (
+		fromVersion = "1.0.0"
+		toVersion   = "1.1.0"
+	)
+	canary := test.NamespaceName + "/canary"
+	rest := test.NamespaceName + "/rest"
+	policy := &key.VersionRollout{
+		Waves: []key.RolloutWave{
+			{Name: "canary", Selector: "stage=canary"},
+			{Name: "rest", Percent: 100},
+		},
+	}
+	agent := func(clusterName, version string) teleportTypes.KubeServer {
+		server := test.NewKubeServer(clusterName, clusterName, clusterName)
+		server.(*teleportTypes.KubernetesServerV3).Spec.Version = version
+		return server
+	}
+	wave := func(name string, phase v1alpha1.RolloutWavePhase, started time.Time, clusters ...string) v1alpha1.RolloutWaveStatus {
+		status := v1alpha1.RolloutWaveStatus{Name: name, Phase: phase, Clusters: clusters}
+		if !started.IsZero() {
+			status.StartTime = &metav1.Time{Time: started}
+		}
+		return status
+	}
+	progressing := func(waves ...v1alpha1.RolloutWaveStatus) v1alpha1.TeleportVersionRolloutStatus {
+		return v1alpha1.TeleportVersionRolloutStatus{FromVersion: fromVersion, ToVersion: toVersion, Phase: v1alpha1.RolloutPhaseProgressing, Waves: waves}
+	}
+
+	testCases := []struct {
+		name                 string
+		policy               *key.VersionRollout
+		annotations          map[string]string
+		status               v1alpha1.TeleportVersionRolloutStatus
+		agents               []teleportTypes.KubeServer
+		nestedClusters       []string
+		serverVersionUnknown bool
+		expectedToVersion    string
+		expectedPhase        v1alpha1.RolloutPhase
+		expectedWavePhases   []v1alpha1.RolloutWavePhase
+		expectedEvents       []string
+	}{
+		{
+			name:          "case 0: Record the first Teleport version without a rollout",
+			policy:        policy,
+			expectedPhase: v1alpha1.RolloutPhaseCompleted,
+		},
+		{
+			name:          "case 1: Complete a version change at once without a policy",
+			status:        v1alpha1.TeleportVersionRolloutStatus{ToVersion: fromVersion, Phase: v1alpha1.RolloutPhaseCompleted},
+			expectedPhase: v1alpha1.RolloutPhaseCompleted,
+		},
+		{
+			name:               "case 2: Start a rollout and release the first wave",
+			policy:             policy,
+			status:             v1alpha1.TeleportVersionRolloutStatus{ToVersion: fromVersion, Phase: v1alpha1.RolloutPhaseCompleted},
+			expectedPhase:      v1alpha1.RolloutPhaseProgressing,
+			expectedWavePhases: []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseProgressing, v1alpha1.RolloutWavePhasePending},
+			expectedEvents: []string{
+				"Normal " + key.RolloutStartedEventReason + ` Started rolling out Teleport version "1.1.0", previously "1.0.0", in 2 waves`,
+				"Normal " + key.RolloutWaveStartedEventReason + ` Released Teleport version "1.1.0" to the 1 clusters of wave canary`,
+			},
+		},
+		{
+			name:               "case 3: Release the next wave once the agents of the previous one are healthy",
+			policy:             policy,
+			status:             progressing(wave("canary", v1alpha1.RolloutWavePhaseProgressing, time.Now(), canary), wave("rest", v1alpha1.RolloutWavePhasePending, time.Time{}, rest)),
+			agents:             []teleportTypes.KubeServer{agent("canary", toVersion), agent("rest", fromVersion)},
+			expectedPhase:      v1alpha1.RolloutPhaseProgressing,
+			expectedWavePhases: []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseHealthy, v1alpha1.RolloutWavePhaseProgressing},
+			expectedEvents: []string{
+				"Normal " + key.RolloutWaveHealthyEventReason,
+				"Normal " + key.RolloutWaveStartedEventReason,
+			},
+		},
+		{
+			name:               "case 4: Wait for the agents of a released wave",
+			policy:             policy,
+			status:             progressing(wave("canary", v1alpha1.RolloutWavePhaseProgressing, time.Now(), canary), wave("rest", v1alpha1.RolloutWavePhasePending, time.Time{}, rest)),
+			agents:             []teleportTypes.KubeServer{agent("canary", fromVersion)},
+			expectedPhase:      v1alpha1.RolloutPhaseProgressing,
+			expectedWavePhases: []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseProgressing, v1alpha1.RolloutWavePhasePending},
+		},
+		{
+			name:               "case 5: Fail the rollout when the agents of a wave are not healthy in time",
+			policy:             policy,
+			status:             progressing(wave("canary", v1alpha1.RolloutWavePhaseProgressing, time.Now().Add(-time.Hour), canary), wave("rest", v1alpha1.RolloutWavePhasePending, time.Time{}, rest)),
+			agents:             []teleportTypes.KubeServer{agent("canary", fromVersion)},
+			expectedPhase:      v1alpha1.RolloutPhaseFailed,
+			expectedWavePhases: []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseFailed, v1alpha1.RolloutWavePhasePending},
+			expectedEvents: []string{
+				"Warning " + key.RolloutFailedEventReason + ` Agents of ` + canary + ` in wave canary did not report Teleport version "1.1.0" within 30m0s`,
+			},
+		},
+		{
+			name:               "case 6: Pause the rollout with the annotation",
+			policy:             policy,
+			annotations:        map[string]string{key.PauseRolloutAnnotation: "true"},
+			status:             progressing(wave("canary", v1alpha1.RolloutWavePhaseHealthy, time.Now(), canary), wave("rest", v1alpha1.RolloutWavePhasePending, time.Time{}, rest)),
+			expectedPhase:      v1alpha1.RolloutPhasePaused,
+			expectedWavePhases: []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseHealthy, v1alpha1.RolloutWavePhasePending},
+			expectedEvents: []string{
+				"Normal " + key.RolloutPausedEventReason,
+			},
+		},
+		{
+			name:   "case 7: Retry the failed wave with the annotation",
+			policy: policy,
+			annotations: map[string]string{
+				key.ResumeRolloutAnnotation: "1",
+			},
+			status: v1alpha1.TeleportVersionRolloutStatus{
+				FromVersion: fromVersion,
+				ToVersion:   toVersion,
+				Phase:       v1alpha1.RolloutPhaseFailed,
+				Waves:       []v1alpha1.RolloutWaveStatus{wave("canary", v1alpha1.RolloutWavePhaseFailed, time.Now().Add(-time.Hour), canary), wave("rest", v1alpha1.RolloutWavePhasePending, time.Time{}, rest)},
+			},
+			agents:             []teleportTypes.KubeServer{agent("canary", fromVersion)},
+			expectedPhase:      v1alpha1.RolloutPhaseProgressing,
+			expectedWavePhases: []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseProgressing, v1alpha1.RolloutWavePhasePending},
+			expectedEvents: []string{
+				"Normal " + key.RolloutResumedEventReason + ` Retrying wave canary of Teleport version "1.1.0"`,
+			},
+		},
+		{
+			name:               "case 8: Complete the rollout once the agents of the last wave are healthy",
+			policy:             policy,
+			status:             progressing(wave("canary", v1alpha1.RolloutWavePhaseHealthy, time.Now(), canary), wave("rest", v1alpha1.RolloutWavePhaseProgressing, time.Now(), rest)),
+			agents:             []teleportTypes.KubeServer{agent("canary", toVersion), agent("rest", "v"+toVersion)},
+			expectedPhase:      v1alpha1.RolloutPhaseCompleted,
+			expectedWavePhases: []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseHealthy, v1alpha1.RolloutWavePhaseHealthy},
+			expectedEvents: []string{
+				"Normal " + key.RolloutWaveHealthyEventReason,
+				"Normal " + key.RolloutCompletedEventReason + ` Rolled out Teleport version "1.1.0" to every cluster`,
+			},
+		},
+		{
+			name:   "case 9: Keep the rollout going while the server version is unknown",
+			policy: policy,
+			status: v1alpha1.TeleportVersionRolloutStatus{
+				FromVersion: fromVersion,
+				ToVersion:   "1.0.5",
+				Phase:       v1alpha1.RolloutPhaseProgressing,
+				Waves:       []v1alpha1.RolloutWaveStatus{wave("canary", v1alpha1.RolloutWavePhaseProgressing, time.Now(), canary), wave("rest", v1alpha1.RolloutWavePhasePending, time.Time{}, rest)},
+			},
+			serverVersionUnknown: true,
+			expectedToVersion:    "1.0.5",
+			expectedPhase:        v1alpha1.RolloutPhaseProgressing,
+			expectedWavePhases:   []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseProgressing, v1alpha1.RolloutWavePhasePending},
+		},
+		{
+			name:               "case 10: Complete the rollout of a version below the bundled one once the agents of Nested clusters report the bundled version",
+			policy:             policy,
+			status:             progressing(wave("canary", v1alpha1.RolloutWavePhaseHealthy, time.Now(), canary), wave("rest", v1alpha1.RolloutWavePhaseProgressing, time.Now(), rest)),
+			agents:             []teleportTypes.KubeServer{agent("canary", toVersion), agent("rest", test.TeleportVersionForNested)},
+			nestedClusters:     []string{"rest"},
+			expectedPhase:      v1alpha1.RolloutPhaseCompleted,
+			expectedWavePhases: []v1alpha1.RolloutWavePhase{v1alpha1.RolloutWavePhaseHealthy, v1alpha1.RolloutWavePhaseHealthy},
+			expectedEvents: []string{
+				"Normal " + key.RolloutWaveHealthyEventReason,
+				"Normal " + key.RolloutCompletedEventReason,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			canaryCluster := test.NewCluster("canary", test.NamespaceName, nil, time.Time{})
+			canaryCluster.Labels = map[string]string{"stage": "canary"}
+			objects := []client.Object{
+				canaryCluster,
+				test.NewCluster("rest", test.NamespaceName, nil, time.Time{}),
+			}
+			for _, name := range []string{"canary", "rest"} {
+				teleportCluster := rolloutTeleportCluster(name)
+				if slices.Contains(tc.nestedClusters, name) {
+					teleportCluster.Status.ValuesLayout = v1alpha1.ValuesLayoutNested
+				}
+				objects = append(objects, teleportCluster)
+			}
+			if tc.status.Phase != "" || tc.annotations != nil {
+				rollout := &v1alpha1.TeleportVersionRollout{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        key.TeleportOperatorConfigName,
+						Namespace:   test.NamespaceName,
+						Annotations: tc.annotations,
+					},
+					Status: tc.status,
+				}
+				objects = append(objects, rollout)
+			}
+			fakeClient, err := test.NewFakeK8sClientFromObjects(objects...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			cfg := newConfigWithTeleportVersion(toVersion)
+			cfg.TeleportVersionRollout = tc.policy
+			recorder := events.NewFakeRecorder(10)
+			controller := &RolloutReconciler{
+				Client:    fakeClient,
+				Log:       ctrl.Log.WithName("test"),
+				Teleport:  teleport.New(test.NamespaceName, cfg, nil),
+				Recorder:  recorder,
+				Namespace: test.NamespaceName,
+			}
+			controller.Teleport.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{
+				KubeServers:   tc.agents,
+				ServerVersion: toVersion,
+				FailsPing:     tc.serverVersionUnknown,
+			}), newIdentity(time.Now()))
+
+			ctx := context.TODO()
+			_, _ = controller.Teleport.Clients.ServerVersion(ctx)
+			_, err = controller.Reconcile(ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: key.TeleportOperatorConfigName, Namespace: test.NamespaceName},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			rollout := &v1alpha1.TeleportVersionRollout{}
+			if err := fakeClient.Get(ctx, client.ObjectKey{Name: key.TeleportOperatorConfigName, Namespace: test.NamespaceName}, rollout); err != nil {
+				t.Fatalf("failed to get TeleportVersionRollout: %v", err)
+			}
+			expectedToVersion := tc.expectedToVersion
+			if expectedToVersion == "" {
+				expectedToVersion = toVersion
+			}
+			if rollout.Status.Phase != tc.expectedPhase || rollout.Status.ToVersion != expectedToVersion {
+				t.Fatalf("expected phase %s of version %s, actual %s of %s (%s)", tc.expectedPhase, expectedToVersion, rollout.Status.Phase, rollout.Status.ToVersion, rollout.Status.Message)
+			}
+			var wavePhases []v1alpha1.RolloutWavePhase
+			for _, wave := range rollout.Status.Waves {
+				wavePhases = append(wavePhases, wave.Phase)
+			}
+			if !reflect.DeepEqual(wavePhases, tc.expectedWavePhases) {
+				t.Fatalf("expected wave phases %v, actual %v", tc.expectedWavePhases, wavePhases)
+			}
+
+			close(recorder.Events)
+			var actual []string
+			for event := range recorder.Events {
+				actual = append(actual, event)
+			}
+			if len(actual) != len(tc.expectedEvents) {
+				t.Fatalf("expected events %q, actual %q", tc.expectedEvents, actual)
+			}
+			for i, expected := range tc.expectedEvents {
+				if !strings.HasPrefix(actual[i], expected) {
+					t.Fatalf("expected event %d to start with %q, actual %q", i, expected, actual[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_ClusterController_TeleportVersionRollout(t *testing.T) {
+	const (
+		nodeTokenName = "node-token"
+		kubeTokenName = "kube-token"
+		toVersion     = "1.1.0"
+	)
+	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Time{})
+	rollout := &v1alpha1.TeleportVersionRollout{
+		ObjectMeta: metav1.ObjectMeta{Name: key.TeleportOperatorConfigName, Namespace: test.NamespaceName},
+		Status: v1alpha1.TeleportVersionRolloutStatus{
+			FromVersion: test.TeleportVersion,
+			ToVersion:   toVersion,
+			Phase:       v1alpha1.RolloutPhaseProgressing,
+			Waves: []v1alpha1.RolloutWaveStatus{
+				{Name: "all", Phase: v1alpha1.RolloutWavePhasePending, Clusters: []string{test.NamespaceName + "/" + test.ClusterName}},
+			},
+		},
+	}
+	fakeClient, err := test.NewFakeK8sClientFromObjects(
+		cluster,
+		rollout,
+		test.NewSecret(test.ClusterName, test.NamespaceName, nodeTokenName),
+		test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, kubeTokenName, []string{key.RoleKube}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+	teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+		Tokens: []teleportTypes.ProvisionToken{
+			test.NewToken(nodeTokenName, test.ClusterName, []string{key.RoleNode}),
+			test.NewToken(kubeTokenName, test.ClusterName, []string{key.RoleKube}),
+		},
+	})
+
+	ctx := context.TODO()
+	reconcile := func() string {
+		t.Helper()
+		cfg := newConfigWithTeleportVersion(toVersion)
+		cfg.TeleportVersionRollout = &key.VersionRollout{Waves: []key.RolloutWave{{Name: "all", Percent: 100}}}
+		controller := &ClusterReconciler{
+			Client:    fakeClient,
+			Log:       ctrl.Log.WithName("test"),
+			Scheme:    scheme.Scheme,
+			Namespace: test.NamespaceName,
+			Teleport:  teleport.New(test.NamespaceName, cfg, test.NewMockTokenGenerator(test.TokenName)),
+		}
+		controller.Teleport.Clients.SetClient(teleportClient, newIdentity(time.Now()))
+		controller.Teleport.Client = fakeClient
+
+		if _, err := controller.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cluster)}); err != nil {
+			t.Fatalf("reconcile returned unexpected error: %v", err)
+		}
+		configMap, err := controller.Teleport.GetConfigMap(ctx, controller.Log, fakeClient, test.ClusterName, test.NamespaceName)
+		if err != nil {
+			t.Fatalf("failed to get ConfigMap: %v", err)
+		}
+		version, err := controller.Teleport.GetTeleportVersionFromConfigMap(configMap)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return version
+	}
+
+	if version := reconcile(); version != test.TeleportVersion {
+		t.Fatalf("expected a cluster of a pending wave to keep Teleport version %q, actual %q", test.TeleportVersion, version)
+	}
+
+	rollout.Status.Waves[0].Phase = v1alpha1.RolloutWavePhaseProgressing
+	if err := fakeClient.Status().Update(ctx, rollout); err != nil {
+		t.Fatalf("failed to update TeleportVersionRollout: %v", err)
+	}
+	if version := reconcile(); version != toVersion {
+		t.Fatalf("expected a cluster of a released wave to get Teleport version %q, actual %q", toVersion, version)
+	}
+}
+
+func rolloutTeleportCluster(name string) *v1alpha1.TeleportCluster {
+	teleportCluster := test.NewTeleportCluster(name, test.NamespaceName, v1alpha1.TeleportClusterSpec{})
+	teleportCluster.Status.RegisterName = key.GetRegisterName(test.ManagementClusterName, name)
+	return teleportCluster
+}
@@ -3,6 +3,10 @@ package config
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/giantswarm/microerror"
 	corev1 "k8s.io/api/core/v1"
@@ -19,6 +23,125 @@ type Config struct {
 	AppName               string
 	AppVersion            string
 	AppCatalog            string
+
+	// Optional. Zero values mean the defaults, see the accessors below.
+	KubeTokenTTL         time.Duration
+	NodeTokenTTL         time.Duration
+	AppTokenTTL          time.Duration
+	TokenRotationPercent int
+	RequeueInterval      time.Duration
+	TokenGracePeriod     time.Duration
+	JoinMethod           string
+	// KubeAgentTokenInSecret keeps the kube agent's static join token in a
+	// Secret rather than the values ConfigMap.
+	KubeAgentTokenInSecret bool
+	// DefaultRoles are the roles every kube agent joins with, before the
+	// roles detected from its values and the Cluster's role labels.
+	DefaultRoles []string
+	// ClusterLabels maps the Cluster labels propagated to Teleport to the
+	// Teleport labels they are set as.
+	ClusterLabels map[string]string
+	// OrganizationLabel is the Teleport label set to the organization of a
+	// Cluster, if any.
+	OrganizationLabel string
+	// ValuesLayouts are the values layouts of the teleport-kube-agent chart
+	// generations: the built-in ones merged with the configured ones.
+	ValuesLayouts *key.ValuesLayouts
+	// TeleportVersionFromServer pins the kube agents to the Teleport auth
+	// server's version when TeleportVersion is empty.
+	TeleportVersionFromServer bool
+	// ManageKubeAgentApp makes the operator create, upgrade and delete the
+	// kube agent App CR or HelmRelease of every cluster, with AppCatalog and
+	// AppVersion.
+	ManageKubeAgentApp bool
+	// KubeAgentAppKind is the kind of the resources deploying the managed
+	// kube agents, key.AgentAppKindApp or key.AgentAppKindHelmRelease.
+	KubeAgentAppKind string
+	// TeleportVersionRollout rolls changes of the Teleport version out in
+	// waves. Nil rolls them out to every cluster at once.
+	TeleportVersionRollout *key.VersionRollout
+}
+
+// GetTokenTTL returns the lifetime of join tokens for role.
+func (c *Config) GetTokenTTL(role string) time.Duration {
+	switch role {
+	case key.RoleNode:
+		if c.NodeTokenTTL > 0 {
+			return c.NodeTokenTTL
+		}
+		return key.TeleportNodeTokenValidity
+	case key.RoleApp:
+		if c.AppTokenTTL > 0 {
+			return c.AppTokenTTL
+		}
+		return key.TeleportAppTokenValidity
+	default:
+		if c.KubeTokenTTL > 0 {
+			return c.KubeTokenTTL
+		}
+		return key.TeleportKubeTokenValidity
+	}
+}
+
+// GetTokenRotationPercent returns the share of a join token's lifetime after
+// which it is replaced.
+func (c *Config) GetTokenRotationPercent() int {
+	if c.TokenRotationPercent > 0 {
+		return c.TokenRotationPercent
+	}
+	return key.DefaultTokenRotationPercent
+}
+
+// GetRequeueInterval returns the longest a Cluster waits before it is
+// reconciled again.
+func (c *Config) GetRequeueInterval() time.Duration {
+	if c.RequeueInterval > 0 {
+		return c.RequeueInterval
+	}
+	return key.DefaultRequeueInterval
+}
+
+// GetTokenGracePeriod returns how long a rotated join token stays valid next
+// to its replacement.
+func (c *Config) GetTokenGracePeriod() time.Duration {
+	if c.TokenGracePeriod > 0 {
+		return c.TokenGracePeriod
+	}
+	return key.DefaultTokenGracePeriod
+}
+
+// GetDefaultRoles returns the roles every kube agent joins with by default.
+func (c *Config) GetDefaultRoles() []string {
+	if len(c.DefaultRoles) > 0 {
+		return c.DefaultRoles
+	}
+	return []string{key.RoleKube}
+}
+
+// GetJoinMethod returns how the kube agents join Teleport by default.
+func (c *Config) GetJoinMethod() string {
+	if c.JoinMethod != "" {
+		return c.JoinMethod
+	}
+	return key.JoinMethodToken
+}
+
+// GetKubeAgentAppKind returns the kind of the resources deploying the
+// managed kube agents.
+func (c *Config) GetKubeAgentAppKind() string {
+	if c.KubeAgentAppKind != "" {
+		return c.KubeAgentAppKind
+	}
+	return key.AgentAppKindApp
+}
+
+// GetValuesLayouts returns the values layouts of the teleport-kube-agent
+// chart generations.
+func (c *Config) GetValuesLayouts() *key.ValuesLayouts {
+	if c.ValuesLayouts != nil {
+		return c.ValuesLayouts
+	}
+	return key.DefaultValuesLayouts()
 }
 
 func GetConfigFromConfigMap(ctx context.Context, ctrlClient client.Client, namespace string) (*Config, error) {
@@ -30,6 +153,14 @@ func GetConfigFromConfigMap(ctx context.Context, ctrlClient client.Client, names
 		return nil, microerror.Mask(err)
 	}
 
+	return ParseConfigMap(configMap)
+}
+
+// ParseConfigMap reads the operator configuration from the teleport-operator
+// ConfigMap. The token lifetime, rotation, grace period, requeue, join method,
+// role, label, values layout and Teleport version derivation keys are
+// optional; every other key is required.
+func ParseConfigMap(configMap *corev1.ConfigMap) (*Config, error) {
 	proxyAddr, err := getConfigMapString(configMap, key.ProxyAddr)
 	if err != nil {
 		return nil, microerror.Mask(err)
@@ -60,14 +191,119 @@ func GetConfigFromConfigMap(ctx context.Context, ctrlClient client.Client, names
 		return nil, microerror.Mask(err)
 	}
 
-	return &Config{
+	cfg := &Config{
 		ProxyAddr:             proxyAddr,
 		TeleportVersion:       teleportVersion,
 		ManagementClusterName: managementClusterName,
 		AppName:               appName,
 		AppVersion:            appVersion,
 		AppCatalog:            appCatalog,
-	}, nil
+	}
+
+	for k, d := range map[string]*time.Duration{
+		key.KubeTokenTTL:     &cfg.KubeTokenTTL,
+		key.NodeTokenTTL:     &cfg.NodeTokenTTL,
+		key.AppTokenTTL:      &cfg.AppTokenTTL,
+		key.RequeueInterval:  &cfg.RequeueInterval,
+		key.TokenGracePeriod: &cfg.TokenGracePeriod,
+	} {
+		if *d, err = getConfigMapDuration(configMap, k); err != nil {
+			return nil, microerror.Mask(err)
+		}
+	}
+
+	if s, err := getConfigMapString(configMap, key.TokenRotationPercent); err == nil && s != "" {
+		percent, err := strconv.Atoi(s)
+		if err != nil || percent < 1 || percent > 100 {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q must be a percentage between 1 and 100, got %q", key.TokenRotationPercent, s))
+		}
+		cfg.TokenRotationPercent = percent
+	}
+
+	if s, err := getConfigMapString(configMap, key.JoinMethod); err == nil && s != "" {
+		if s != key.JoinMethodToken && s != key.JoinMethodKubernetes && s != key.JoinMethodCloud {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q must be %q, %q or %q, got %q", key.JoinMethod, key.JoinMethodToken, key.JoinMethodKubernetes, key.JoinMethodCloud, s))
+		}
+		cfg.JoinMethod = s
+	}
+
+	if s, err := getConfigMapString(configMap, key.KubeAgentTokenInSecret); err == nil && s != "" {
+		if cfg.KubeAgentTokenInSecret, err = strconv.ParseBool(s); err != nil {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q must be a boolean, got %q", key.KubeAgentTokenInSecret, s))
+		}
+	}
+
+	if s, err := getConfigMapString(configMap, key.DefaultRoles); err == nil && s != "" {
+		roles, err := key.ParseRoles(s)
+		if err != nil || slices.Contains(roles, key.RoleNode) {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q must be a comma-separated list of %s, got %q", key.DefaultRoles, key.RolesToString(key.AgentRoles), s))
+		}
+		cfg.DefaultRoles = roles
+	}
+
+	if s, err := getConfigMapString(configMap, key.ClusterLabels); err == nil && s != "" {
+		if cfg.ClusterLabels, err = key.ParseLabelMapping(s); err != nil {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q must be a comma-separated list of <cluster label>[=<teleport label>], got %q", key.ClusterLabels, s))
+		}
+	}
+
+	if s, err := getConfigMapString(configMap, key.OrganizationLabel); err == nil {
+		cfg.OrganizationLabel = strings.TrimSpace(s)
+	}
+
+	if s, err := getConfigMapString(configMap, key.KubeAgentValuesLayouts); err == nil && strings.TrimSpace(s) != "" {
+		layouts, err := key.ParseValuesLayouts(s)
+		if err == nil {
+			layouts, err = key.MergeValuesLayouts(key.DefaultValuesLayouts(), layouts)
+		}
+		if err != nil {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q: %w", key.KubeAgentValuesLayouts, err))
+		}
+		cfg.ValuesLayouts = layouts
+	}
+
+	if s, err := getConfigMapString(configMap, key.TeleportVersionFromServer); err == nil && s != "" {
+		if cfg.TeleportVersionFromServer, err = strconv.ParseBool(s); err != nil {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q must be a boolean, got %q", key.TeleportVersionFromServer, s))
+		}
+	}
+
+	if s, err := getConfigMapString(configMap, key.ManageKubeAgentApp); err == nil && s != "" {
+		if cfg.ManageKubeAgentApp, err = strconv.ParseBool(s); err != nil {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q must be a boolean, got %q", key.ManageKubeAgentApp, s))
+		}
+	}
+
+	if s, err := getConfigMapString(configMap, key.KubeAgentAppKind); err == nil && s != "" {
+		if s != key.AgentAppKindApp && s != key.AgentAppKindHelmRelease {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q must be %q or %q, got %q", key.KubeAgentAppKind, key.AgentAppKindApp, key.AgentAppKindHelmRelease, s))
+		}
+		cfg.KubeAgentAppKind = s
+	}
+
+	if s, err := getConfigMapString(configMap, key.TeleportVersionRollout); err == nil && strings.TrimSpace(s) != "" {
+		rollout, err := key.ParseVersionRollout(s)
+		if err != nil {
+			return nil, microerror.Mask(fmt.Errorf("malformed Config Map: %q: %w", key.TeleportVersionRollout, err))
+		}
+		cfg.TeleportVersionRollout = rollout
+	}
+
+	return cfg, nil
+}
+
+// getConfigMapDuration reads an optional positive duration. A missing or
+// empty key yields zero.
+func getConfigMapDuration(configMap *corev1.ConfigMap, key string) (time.Duration, error) {
+	s, err := getConfigMapString(configMap, key)
+	if err != nil || s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("malformed Config Map: %q must be a positive duration, got %q", key, s)
+	}
+	return d, nil
 }
 
 func getConfigMapString(configMap *corev1.ConfigMap, key string) (string, error) {
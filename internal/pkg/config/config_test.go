@@ -2,7 +2,9 @@ package config
 
 import (
 	"context"
+	"reflect"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -68,6 +70,303 @@ func Test_GetConfigFromSecret(t *testing.T) {
 			testConfigMap: true,
 			expectError:   true,
 		},
+		{
+			name:      "case 3: Return token lifetime, rotation, grace period and requeue settings when they are set",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:                test.AppCatalog,
+					key.AppName:                   test.AppName,
+					key.AppVersion:                test.AppVersion,
+					key.ManagementClusterName:     test.ManagementClusterName,
+					key.ProxyAddr:                 test.ProxyAddr,
+					key.TeleportVersion:           test.TeleportVersion,
+					key.KubeTokenTTL:              "24h",
+					key.NodeTokenTTL:              "12h",
+					key.TokenRotationPercent:      "75",
+					key.RequeueInterval:           "1m",
+					key.TokenGracePeriod:          "30m",
+					key.JoinMethod:                key.JoinMethodKubernetes,
+					key.KubeAgentTokenInSecret:    "true",
+					key.DefaultRoles:              "kube, db",
+					key.ClusterLabels:             "giantswarm.io/organization=customer, release.giantswarm.io/version=release,provider",
+					key.OrganizationLabel:         "customer",
+					key.TeleportVersionFromServer: "true",
+					key.ManageKubeAgentApp:        "true",
+					key.KubeAgentAppKind:          key.AgentAppKindHelmRelease,
+				},
+			},
+			testConfigMap: true,
+			expectedConfig: &Config{
+				AppCatalog:             test.AppCatalog,
+				AppName:                test.AppName,
+				AppVersion:             test.AppVersion,
+				ManagementClusterName:  test.ManagementClusterName,
+				ProxyAddr:              test.ProxyAddr,
+				TeleportVersion:        test.TeleportVersion,
+				KubeTokenTTL:           24 * time.Hour,
+				NodeTokenTTL:           12 * time.Hour,
+				TokenRotationPercent:   75,
+				RequeueInterval:        time.Minute,
+				TokenGracePeriod:       30 * time.Minute,
+				JoinMethod:             key.JoinMethodKubernetes,
+				KubeAgentTokenInSecret: true,
+				DefaultRoles:           []string{key.RoleKube, key.RoleDatabase},
+				ClusterLabels: map[string]string{
+					"giantswarm.io/organization":    "customer",
+					"release.giantswarm.io/version": "release",
+					"provider":                      "provider",
+				},
+				OrganizationLabel:         "customer",
+				TeleportVersionFromServer: true,
+				ManageKubeAgentApp:        true,
+				KubeAgentAppKind:          key.AgentAppKindHelmRelease,
+			},
+		},
+		{
+			name:      "case 4: Fail in case the token rotation percentage is out of range",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:            test.AppCatalog,
+					key.AppName:               test.AppName,
+					key.AppVersion:            test.AppVersion,
+					key.ManagementClusterName: test.ManagementClusterName,
+					key.ProxyAddr:             test.ProxyAddr,
+					key.TeleportVersion:       test.TeleportVersion,
+					key.TokenRotationPercent:  "150",
+				},
+			},
+			testConfigMap: true,
+			expectError:   true,
+		},
+		{
+			name:      "case 5: Fail in case a token lifetime is not a duration",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:            test.AppCatalog,
+					key.AppName:               test.AppName,
+					key.AppVersion:            test.AppVersion,
+					key.ManagementClusterName: test.ManagementClusterName,
+					key.ProxyAddr:             test.ProxyAddr,
+					key.TeleportVersion:       test.TeleportVersion,
+					key.AppTokenTTL:           "one day",
+				},
+			},
+			testConfigMap: true,
+			expectError:   true,
+		},
+		{
+			name:      "case 6: Fail in case the join method is unknown",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:            test.AppCatalog,
+					key.AppName:               test.AppName,
+					key.AppVersion:            test.AppVersion,
+					key.ManagementClusterName: test.ManagementClusterName,
+					key.ProxyAddr:             test.ProxyAddr,
+					key.TeleportVersion:       test.TeleportVersion,
+					key.JoinMethod:            "iam",
+				},
+			},
+			testConfigMap: true,
+			expectError:   true,
+		},
+		{
+			name:      "case 7: Fail in case the default roles include the node role",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:            test.AppCatalog,
+					key.AppName:               test.AppName,
+					key.AppVersion:            test.AppVersion,
+					key.ManagementClusterName: test.ManagementClusterName,
+					key.ProxyAddr:             test.ProxyAddr,
+					key.TeleportVersion:       test.TeleportVersion,
+					key.DefaultRoles:          "kube,node",
+				},
+			},
+			testConfigMap: true,
+			expectError:   true,
+		},
+		{
+			name:      "case 8: Fail in case a cluster label mapping is empty",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:            test.AppCatalog,
+					key.AppName:               test.AppName,
+					key.AppVersion:            test.AppVersion,
+					key.ManagementClusterName: test.ManagementClusterName,
+					key.ProxyAddr:             test.ProxyAddr,
+					key.TeleportVersion:       test.TeleportVersion,
+					key.ClusterLabels:         "provider,release.giantswarm.io/version=",
+				},
+			},
+			testConfigMap: true,
+			expectError:   true,
+		},
+		{
+			name:      "case 9: Return the values layouts merged over the built-in ones",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:             test.AppCatalog,
+					key.AppName:                test.AppName,
+					key.AppVersion:             test.AppVersion,
+					key.ManagementClusterName:  test.ManagementClusterName,
+					key.ProxyAddr:              test.ProxyAddr,
+					key.TeleportVersion:        test.TeleportVersion,
+					key.KubeAgentValuesLayouts: "layouts:\n- name: Agent\n  versions: \">= 1.0.0\"\n  rootKey: agent\n  renamedKeys:\n    authToken: joinToken\n",
+				},
+			},
+			testConfigMap: true,
+			expectedConfig: &Config{
+				AppCatalog:            test.AppCatalog,
+				AppName:               test.AppName,
+				AppVersion:            test.AppVersion,
+				ManagementClusterName: test.ManagementClusterName,
+				ProxyAddr:             test.ProxyAddr,
+				TeleportVersion:       test.TeleportVersion,
+				ValuesLayouts: &key.ValuesLayouts{
+					Default: key.ValuesLayoutDual,
+					Layouts: append([]key.ValuesLayout{{
+						Name:        "Agent",
+						Versions:    ">= 1.0.0",
+						RootKey:     "agent",
+						RenamedKeys: map[string]string{"authToken": "joinToken"},
+					}}, key.DefaultValuesLayouts().Layouts...),
+				},
+			},
+		},
+		{
+			name:      "case 10: Fail in case a values layout upgrades to an unknown layout",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:             test.AppCatalog,
+					key.AppName:                test.AppName,
+					key.AppVersion:             test.AppVersion,
+					key.ManagementClusterName:  test.ManagementClusterName,
+					key.ProxyAddr:              test.ProxyAddr,
+					key.TeleportVersion:        test.TeleportVersion,
+					key.KubeAgentValuesLayouts: "layouts:\n- name: Nested\n  versions: \">= 0.11.0\"\n  rootKey: teleport-kube-agent\n  upgradeTo: Agent\n",
+				},
+			},
+			testConfigMap: true,
+			expectError:   true,
+		},
+		{
+			name:      "case 11: Fail in case the kube agent app kind is unknown",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:            test.AppCatalog,
+					key.AppName:               test.AppName,
+					key.AppVersion:            test.AppVersion,
+					key.ManagementClusterName: test.ManagementClusterName,
+					key.ProxyAddr:             test.ProxyAddr,
+					key.TeleportVersion:       test.TeleportVersion,
+					key.KubeAgentAppKind:      "Deployment",
+				},
+			},
+			testConfigMap: true,
+			expectError:   true,
+		},
+		{
+			name:      "case 12: Return the Teleport version rollout policy",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:             test.AppCatalog,
+					key.AppName:                test.AppName,
+					key.AppVersion:             test.AppVersion,
+					key.ManagementClusterName:  test.ManagementClusterName,
+					key.ProxyAddr:              test.ProxyAddr,
+					key.TeleportVersion:        test.TeleportVersion,
+					key.TeleportVersionRollout: "waves:\n- name: canary\n  selector: stage=canary\n- name: rest\n  percent: 100\nwaveTimeout: 1h\n",
+				},
+			},
+			testConfigMap: true,
+			expectedConfig: &Config{
+				AppCatalog:            test.AppCatalog,
+				AppName:               test.AppName,
+				AppVersion:            test.AppVersion,
+				ManagementClusterName: test.ManagementClusterName,
+				ProxyAddr:             test.ProxyAddr,
+				TeleportVersion:       test.TeleportVersion,
+				TeleportVersionRollout: &key.VersionRollout{
+					Waves: []key.RolloutWave{
+						{Name: "canary", Selector: "stage=canary"},
+						{Name: "rest", Percent: 100},
+					},
+					WaveTimeout: time.Hour,
+				},
+			},
+		},
+		{
+			name:      "case 13: Fail in case a rollout wave has neither a selector nor a percentage",
+			namespace: test.NamespaceName,
+			configMap: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      key.TeleportOperatorConfigName,
+					Namespace: test.NamespaceName,
+				},
+				Data: map[string]string{
+					key.AppCatalog:             test.AppCatalog,
+					key.AppName:                test.AppName,
+					key.AppVersion:             test.AppVersion,
+					key.ManagementClusterName:  test.ManagementClusterName,
+					key.ProxyAddr:              test.ProxyAddr,
+					key.TeleportVersion:        test.TeleportVersion,
+					key.TeleportVersionRollout: "waves:\n- name: canary\n",
+				},
+			},
+			testConfigMap: true,
+			expectError:   true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -101,9 +400,52 @@ func checkConfigs(t *testing.T, expected *Config, actual *Config) {
 		expected.AppCatalog == actual.AppCatalog &&
 		expected.ManagementClusterName == actual.ManagementClusterName &&
 		expected.ProxyAddr == actual.ProxyAddr &&
-		expected.TeleportVersion == actual.TeleportVersion
+		expected.TeleportVersion == actual.TeleportVersion &&
+		expected.KubeTokenTTL == actual.KubeTokenTTL &&
+		expected.NodeTokenTTL == actual.NodeTokenTTL &&
+		expected.AppTokenTTL == actual.AppTokenTTL &&
+		expected.TokenRotationPercent == actual.TokenRotationPercent &&
+		expected.RequeueInterval == actual.RequeueInterval &&
+		expected.TokenGracePeriod == actual.TokenGracePeriod &&
+		expected.JoinMethod == actual.JoinMethod &&
+		expected.KubeAgentTokenInSecret == actual.KubeAgentTokenInSecret &&
+		expected.TeleportVersionFromServer == actual.TeleportVersionFromServer &&
+		expected.ManageKubeAgentApp == actual.ManageKubeAgentApp &&
+		expected.KubeAgentAppKind == actual.KubeAgentAppKind &&
+		key.RolesToString(expected.DefaultRoles) == key.RolesToString(actual.DefaultRoles) &&
+		reflect.DeepEqual(expected.ValuesLayouts, actual.ValuesLayouts) &&
+		reflect.DeepEqual(expected.TeleportVersionRollout, actual.TeleportVersionRollout)
 
 	if !configsMatch {
 		t.Fatalf("configs do not match: expected\n%v,\nactual\n%v", expected, actual)
 	}
 }
+
+func Test_ConfigDefaults(t *testing.T) {
+	cfg := &Config{NodeTokenTTL: 12 * time.Hour}
+
+	if ttl := cfg.GetTokenTTL(key.RoleNode); ttl != 12*time.Hour {
+		t.Fatalf("expected node token TTL 12h, actual %v", ttl)
+	}
+	if ttl := cfg.GetTokenTTL(key.RoleKube); ttl != key.TeleportKubeTokenValidity {
+		t.Fatalf("expected default kube token TTL, actual %v", ttl)
+	}
+	if percent := cfg.GetTokenRotationPercent(); percent != key.DefaultTokenRotationPercent {
+		t.Fatalf("expected default rotation percentage, actual %d", percent)
+	}
+	if interval := cfg.GetRequeueInterval(); interval != key.DefaultRequeueInterval {
+		t.Fatalf("expected default requeue interval, actual %v", interval)
+	}
+	if gracePeriod := cfg.GetTokenGracePeriod(); gracePeriod != key.DefaultTokenGracePeriod {
+		t.Fatalf("expected default token grace period, actual %v", gracePeriod)
+	}
+	if joinMethod := cfg.GetJoinMethod(); joinMethod != key.JoinMethodToken {
+		t.Fatalf("expected default join method %q, actual %q", key.JoinMethodToken, joinMethod)
+	}
+	if layouts := cfg.GetValuesLayouts(); layouts != key.DefaultValuesLayouts() {
+		t.Fatalf("expected the built-in values layouts, actual %v", layouts)
+	}
+	if kind := cfg.GetKubeAgentAppKind(); kind != key.AgentAppKindApp {
+		t.Fatalf("expected default kube agent app kind %q, actual %q", key.AgentAppKindApp, kind)
+	}
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"context"
 	"crypto/sha512"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"time"
 
@@ -33,6 +35,28 @@ func (c *IdentityConfig) Hash() string {
 	return hex.EncodeToString(sum)
 }
 
+// CertificateExpiry returns the expiry of the TLS certificate in the identity
+// file. tbot writes the user certificate as the first CERTIFICATE block,
+// followed by the CA certificates.
+func (c *IdentityConfig) CertificateExpiry() (time.Time, error) {
+	rest := []byte(c.IdentityFile)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return time.Time{}, microerror.Mask(fmt.Errorf("identity file does not contain a TLS certificate"))
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, microerror.Mask(err)
+		}
+		return cert.NotAfter, nil
+	}
+}
+
 func GetIdentityConfigFromSecret(ctx context.Context, ctrlClient client.Client, namespace string) (*IdentityConfig, error) {
 	secret := &corev1.Secret{}
 	if err := ctrlClient.Get(ctx, types.NamespacedName{
@@ -2,10 +2,10 @@ package key
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/Masterminds/semver/v3"
 	"github.com/gravitational/teleport/api/types"
 )
 
@@ -23,48 +23,250 @@ const (
 	TeleportKubeTokenValidity       = 720 * time.Hour
 	TeleportNodeTokenValidity       = 720 * time.Hour
 
-	AppCatalog            = "appCatalog"
-	AppName               = "appName"
-	AppVersion            = "appVersion"
-	IdentityFile          = "identityFile"
-	Identity              = "identity"
-	ManagementClusterName = "managementClusterName"
-	ProxyAddr             = "proxyAddr"
-	TeleportVersion       = "teleportVersion"
-	RoleKube              = "kube"
-	RoleApp               = "app"
-	RoleNode              = "node"
+	// DefaultTokenRotationPercent replaces join tokens only once they have
+	// expired.
+	DefaultTokenRotationPercent = 100
+	// DefaultRequeueInterval is the longest a Cluster waits before it is
+	// reconciled again.
+	DefaultRequeueInterval = 5 * time.Minute
+	// MinRequeueInterval bounds how soon a Cluster is requeued for an
+	// upcoming token rotation.
+	MinRequeueInterval = 10 * time.Second
+	// DefaultTokenGracePeriod is how long a rotated join token stays valid
+	// next to its replacement.
+	DefaultTokenGracePeriod = 1 * time.Hour
+
+	// RotateTokenAnnotation on a Cluster requests an immediate rotation of
+	// its join tokens. Any new value, e.g. a timestamp, triggers one
+	// rotation.
+	RotateTokenAnnotation = "teleport.giantswarm.io/rotate-token"
+	// RolesAnnotation on a Cluster sets the roles its kube agent joins
+	// with, e.g. "kube,db", unless the TeleportCluster spec sets them.
+	RolesAnnotation = "teleport.giantswarm.io/roles"
+	// RoleLabelPrefix followed by a role, e.g.
+	// "role.teleport.giantswarm.io/db", is a Cluster label that enables
+	// ("true") or disables ("false") that role on top of the default and
+	// detected roles.
+	RoleLabelPrefix = "role.teleport.giantswarm.io/"
+
+	// PauseRolloutAnnotation set to "true" on the TeleportVersionRollout
+	// stops releasing further waves of a rollout. Removing it resumes.
+	PauseRolloutAnnotation = "teleport.giantswarm.io/pause-rollout"
+	// ResumeRolloutAnnotation on the TeleportVersionRollout retries the
+	// failed wave of a rollout. Any new value, e.g. a timestamp, triggers
+	// one retry.
+	ResumeRolloutAnnotation = "teleport.giantswarm.io/resume-rollout"
+	// DefaultRolloutWaveTimeout is how long the agents of a wave have to
+	// report the new Teleport version before the rollout fails.
+	DefaultRolloutWaveTimeout = 30 * time.Minute
+
+	// ManagedValuesAnnotation lists the paths of the values the operator
+	// manages in the kube agent's values ConfigMap. Other values are kept.
+	ManagedValuesAnnotation = "teleport.giantswarm.io/managed-values"
+
+	// Labels set on the kube agent App CRs and HelmReleases the operator
+	// manages. Only resources labelled as managed by the operator are
+	// upgraded and deleted.
+	ManagedByLabel          = "giantswarm.io/managed-by"
+	ClusterLabel            = "giantswarm.io/cluster"
+	AppOperatorVersionLabel = "app-operator.giantswarm.io/version"
+
+	// Kinds of resources deploying teleport-kube-agent to a cluster.
+	AgentAppKindApp         = "App"
+	AgentAppKindHelmRelease = "HelmRelease"
+
+	// OrganizationNamespacePrefix prefixes the namespaces of organizations,
+	// which hold their Clusters.
+	OrganizationNamespacePrefix = "org-"
+
+	// DatabaseClusterLabel is set on the databases the kube agent proxies to
+	// the cluster's register name, for Teleport roles to select them by.
+	DatabaseClusterLabel = "cluster"
+
+	// Labels set on the join tokens the operator generates.
+	TokenClusterLabel           = "cluster"
+	TokenRolesLabel             = "roles"
+	TokenManagementClusterLabel = "management-cluster"
+
+	// Join methods the kube agent can join Teleport with. With
+	// JoinMethodCloud, the cloud provider's join method is picked from the
+	// cluster's infrastructure: `iam`, `azure` or `gcp`.
+	JoinMethodToken      = "token"
+	JoinMethodKubernetes = "kubernetes"
+	JoinMethodCloud      = "cloud"
+
+	// TeleportKubeAgentServiceAccount is the service account the kube agent
+	// runs as, which kubernetes join tokens allow by default.
+	TeleportKubeAgentServiceAccount = "teleport-kube-agent"
+
+	AppCatalog                = "appCatalog"
+	AppName                   = "appName"
+	AppVersion                = "appVersion"
+	IdentityFile              = "identityFile"
+	Identity                  = "identity"
+	ManagementClusterName     = "managementClusterName"
+	ProxyAddr                 = "proxyAddr"
+	TeleportVersion           = "teleportVersion"
+	KubeTokenTTL              = "kubeTokenTTL"
+	NodeTokenTTL              = "nodeTokenTTL"
+	AppTokenTTL               = "appTokenTTL"
+	TokenRotationPercent      = "tokenRotationPercent"
+	RequeueInterval           = "requeueInterval"
+	TokenGracePeriod          = "tokenGracePeriod"
+	JoinMethod                = "joinMethod"
+	KubeAgentTokenInSecret    = "kubeAgentTokenInSecret"
+	DefaultRoles              = "defaultRoles"
+	ClusterLabels             = "clusterLabels"
+	OrganizationLabel         = "organizationLabel"
+	KubeAgentValuesLayouts    = "kubeAgentValuesLayouts"
+	TeleportVersionFromServer = "teleportVersionFromServer"
+	ManageKubeAgentApp        = "manageKubeAgentApp"
+	KubeAgentAppKind          = "kubeAgentAppKind"
+	TeleportVersionRollout    = "teleportVersionRollout"
+	RoleKube                  = "kube"
+	RoleApp                   = "app"
+	RoleNode                  = "node"
+	RoleDatabase              = "db"
+	RoleDiscovery             = "discovery"
+	RoleWindowsDesktop        = "windowsdesktop"
 
 	// TeleportKubeAgentValuesKey is the top-level key under which
 	// teleport-kube-agent v0.11.0+ reads its values.
 	TeleportKubeAgentValuesKey = "teleport-kube-agent"
+)
+
+// Condition types the operator owns on the CAPI Cluster status.
+const (
+	// TeleportJoinTokenReadyCondition reports whether the cluster's node and
+	// kube join tokens exist in Teleport and are stored on the management
+	// cluster.
+	TeleportJoinTokenReadyCondition = "TeleportJoinTokenReady"
 
-	// teleportKubeAgentNestedSinceVersion is the lowest chart version that
-	// reads its values nested under TeleportKubeAgentValuesKey.
-	teleportKubeAgentNestedSinceVersion = "0.11.0"
+	// TeleportAgentValuesInjectedCondition reports whether the
+	// teleport-kube-agent values ConfigMap is up to date and referenced from
+	// the cluster's App CR or HelmRelease.
+	TeleportAgentValuesInjectedCondition = "TeleportAgentValuesInjected"
 
-	// teleportKubeAgentBundledTeleportVersion is the Teleport version that
-	// teleport-kube-agent v0.11.0 bundles by default. The nested block
-	// skips teleportVersionOverride when the operator-configured override
-	// would be a downgrade against this bundled version.
-	teleportKubeAgentBundledTeleportVersion = "18.7.6"
+	// TeleportBotOutputReadyCondition reports whether tbot has written the
+	// kubeconfig Secret for the cluster. Only set when tbot is enabled.
+	TeleportBotOutputReadyCondition = "TeleportBotOutputReady"
+
+	// TeleportVersionCompatibleCondition reports whether the Teleport version
+	// written as the kube agent's teleportVersionOverride complies with
+	// Teleport's version skew rules against the auth server.
+	TeleportVersionCompatibleCondition = "TeleportVersionCompatible"
+)
+
+// Condition reasons used with the condition types above.
+const (
+	JoinTokenValidReason           = "JoinTokenValid"
+	TeleportConnectionFailedReason = "TeleportConnectionFailed"
+	TeleportRequestFailedReason    = "TeleportRequestFailed"
+	JoinTokenSecretFailedReason    = "JoinTokenSecretFailed"
+	ValuesInjectedReason           = "ValuesInjected"
+	ValuesConfigMapFailedReason    = "ValuesConfigMapFailed"
+	AgentAppNotFoundReason         = "AgentAppNotFound"
+	AgentAppLookupFailedReason     = "AgentAppLookupFailed"
+	AgentAppConfigFailedReason     = "AgentAppConfigFailed"
+	AgentAppFailedReason           = "AgentAppFailed"
+	BotOutputReadyReason           = "BotOutputReady"
+	WaitingForBotOutputReason      = "WaitingForBotOutput"
+	BotConfigFailedReason          = "BotConfigFailed"
+	ClusterSettingsFailedReason    = "ClusterSettingsFailed"
+	JoinRulesFailedReason          = "JoinRulesFailed"
+
+	TeleportVersionCompatibleReason      = "TeleportVersionCompatible"
+	TeleportVersionFromServerReason      = "TeleportVersionFromServer"
+	TeleportVersionUncheckedReason       = "TeleportVersionUnchecked"
+	TeleportVersionNewerThanServerReason = "TeleportVersionNewerThanServer"
+	TeleportVersionTooOldReason          = "TeleportVersionTooOld"
+)
+
+// Event reasons emitted on the Cluster for every change the operator makes in
+// Teleport or on the management cluster.
+const (
+	JoinTokenCreatedEventReason             = "JoinTokenCreated"
+	JoinTokenRotatedEventReason             = "JoinTokenRotated"
+	JoinTokenRetiredEventReason             = "JoinTokenRetired"
+	JoinTokenRevokedEventReason             = "JoinTokenRevoked"
+	JoinTokensDeletedEventReason            = "JoinTokensDeleted"
+	AgentValuesLayoutMigratedEventReason    = "AgentValuesLayoutMigrated"
+	AgentValuesUpdatedEventReason           = "AgentValuesUpdated"
+	JoinTokenRelabeledEventReason           = "JoinTokenRelabeled"
+	AgentTokenMovedEventReason              = "AgentTokenMoved"
+	HelmReleaseValuesFromPatchedEventReason = "HelmReleaseValuesFromPatched"
+	HelmReleaseValuesFromRemovedEventReason = "HelmReleaseValuesFromRemoved"
+	AppExtraConfigsPatchedEventReason       = "AppExtraConfigsPatched"
+	AppExtraConfigsRemovedEventReason       = "AppExtraConfigsRemoved"
+	TeleportUnreachableEventReason          = "TeleportUnreachable"
+	TeleportVersionClampedEventReason       = "TeleportVersionClamped"
+	AgentAppCreatedEventReason              = "AgentAppCreated"
+	AgentAppUpgradedEventReason             = "AgentAppUpgraded"
+	AgentAppDeletedEventReason              = "AgentAppDeleted"
+)
+
+// Event reasons emitted on the TeleportVersionRollout.
+const (
+	RolloutStartedEventReason     = "RolloutStarted"
+	RolloutPausedEventReason      = "RolloutPaused"
+	RolloutResumedEventReason     = "RolloutResumed"
+	RolloutFailedEventReason      = "RolloutFailed"
+	RolloutCompletedEventReason   = "RolloutCompleted"
+	RolloutWaveStartedEventReason = "RolloutWaveStarted"
+	RolloutWaveHealthyEventReason = "RolloutWaveHealthy"
 )
 
+// TeleportConditions lists every condition type the operator owns, so that
+// patching the Cluster status never clobbers conditions set by CAPI itself.
+var TeleportConditions = []string{
+	TeleportJoinTokenReadyCondition,
+	TeleportAgentValuesInjectedCondition,
+	TeleportBotOutputReadyCondition,
+	TeleportVersionCompatibleCondition,
+}
+
+// AgentRoles are the roles a kube agent can join with, in the order they
+// are rendered.
+var AgentRoles = []string{RoleKube, RoleApp, RoleDatabase, RoleDiscovery, RoleWindowsDesktop}
+
+// IsValidRole reports whether role is a role the operator issues join
+// tokens for.
+func IsValidRole(role string) bool {
+	return role == RoleNode || slices.Contains(AgentRoles, role)
+}
+
 func ParseRoles(s string) ([]string, error) {
 	parts := strings.Split(s, ",")
 	roles := make([]string, 0, len(parts))
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
-		switch part {
-		case RoleKube, RoleApp, RoleNode:
-			roles = append(roles, part)
-		default:
+		if !IsValidRole(part) {
 			return nil, fmt.Errorf("invalid role: %s", part)
 		}
+		roles = append(roles, part)
 	}
 	return roles, nil
 }
 
+// ParseLabelMapping parses a comma-separated list of Cluster labels, each
+// optionally renamed with `=<teleport label>`, into a map from Cluster label
+// to Teleport label.
+func ParseLabelMapping(s string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		from, to, renamed := strings.Cut(strings.TrimSpace(item), "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !renamed {
+			to = from
+		}
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid label mapping: %q", item)
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
 func RolesToString(roles []string) string {
 	return strings.Join(roles, ",")
 }
@@ -79,6 +281,12 @@ func RolesToSystemRoles(roles []string) []types.SystemRole {
 			systemRoles = append(systemRoles, types.RoleApp)
 		case RoleNode:
 			systemRoles = append(systemRoles, types.RoleNode)
+		case RoleDatabase:
+			systemRoles = append(systemRoles, types.RoleDatabase)
+		case RoleDiscovery:
+			systemRoles = append(systemRoles, types.RoleDiscovery)
+		case RoleWindowsDesktop:
+			systemRoles = append(systemRoles, types.RoleWindowsDesktop)
 		}
 	}
 	return systemRoles
@@ -96,6 +304,25 @@ func GetSecretName(clusterName string) string {
 	return fmt.Sprintf("%s-teleport-join-token", clusterName)
 }
 
+// GetAgentTokenSecretName returns the name of the Secret holding the kube
+// agent's static join token, when it is kept out of the values ConfigMap.
+func GetAgentTokenSecretName(clusterName string, appName string) string {
+	return fmt.Sprintf("%s-%s-token", clusterName, appName)
+}
+
+// GetJoinTokenName returns the name of the cluster's join token for a
+// delegated join method, e.g. `kubernetes` or `iam`. Unlike static tokens,
+// its name is not a secret.
+func GetJoinTokenName(registerName string, joinMethod string) string {
+	return fmt.Sprintf("%s-%s-join", registerName, joinMethod)
+}
+
+// GetKubeAgentServiceAccount returns the default service account the kube
+// agent runs as, in the `namespace:name` form of kubernetes join rules.
+func GetKubeAgentServiceAccount() string {
+	return fmt.Sprintf("%s:%s", TeleportKubeAppNamespace, TeleportKubeAgentServiceAccount)
+}
+
 func GetKubeconfigSecretName(clusterName string) string {
 	return fmt.Sprintf("teleport-%s-kubeconfig", clusterName)
 }
@@ -104,6 +331,15 @@ func GetRegisterName(managementClusterName, clusterName string) string {
 	return fmt.Sprintf("%s-%s", managementClusterName, clusterName)
 }
 
+// GetOrganization returns the organization whose namespace holds a cluster,
+// or "" if the namespace is not an organization namespace.
+func GetOrganization(namespace string) string {
+	if org, ok := strings.CutPrefix(namespace, OrganizationNamespacePrefix); ok {
+		return org
+	}
+	return ""
+}
+
 func GetAppSpecKubeConfigSecretName(clusterName string) string {
 	return fmt.Sprintf("%s-kubeconfig", clusterName)
 }
@@ -113,96 +349,17 @@ func GetAppName(clusterName string, appName string) string {
 }
 
 // UsesNestedKubeAgentValues reports whether the teleport-kube-agent chart
-// version expects its values nested under the `teleport-kube-agent` key.
-// Versions at or above v0.11.0 use the nested layout. An unparseable
-// version is treated as the legacy (flat) layout.
+// version expects its values nested under the `teleport-kube-agent` key with
+// the built-in values layouts. An unparseable version is treated as the
+// legacy (flat) layout.
 func UsesNestedKubeAgentValues(appVersion string) bool {
-	v, err := semver.NewVersion(strings.TrimPrefix(appVersion, "v"))
-	if err != nil {
-		return false
-	}
-	threshold := semver.MustParse(teleportKubeAgentNestedSinceVersion)
-	return v.Compare(threshold) >= 0
+	return DefaultValuesLayouts().For(appVersion).RootKey == TeleportKubeAgentValuesKey
 }
 
 // ResolveNestedTeleportVersionOverride returns the value to write as
-// `teleportVersionOverride` inside the nested `teleport-kube-agent:` block,
-// or "" when the override should be omitted. The nested block always
-// targets chart v0.11.0+ consumers (whether emitted alone or alongside a
-// flat block for upgrade safety), so the floor applies unconditionally:
-// any teleportVersion below teleportKubeAgentBundledTeleportVersion — or
-// one that doesn't parse as semver — is dropped to avoid a downgrade
-// against the chart's bundled Teleport.
+// `teleportVersionOverride` inside the nested `teleport-kube-agent:` block of
+// the built-in values layouts, or "" when the override should be omitted,
+// see ValuesLayout.ResolveTeleportVersionOverride.
 func ResolveNestedTeleportVersionOverride(teleportVersion string) string {
-	if teleportVersion == "" {
-		return ""
-	}
-	v, err := semver.NewVersion(strings.TrimPrefix(teleportVersion, "v"))
-	if err != nil {
-		return ""
-	}
-	bundled := semver.MustParse(teleportKubeAgentBundledTeleportVersion)
-	if v.Compare(bundled) < 0 {
-		return ""
-	}
-	return teleportVersion
-}
-
-// GetConfigmapDataFromTemplate renders the teleport-kube-agent values document
-// for a cluster. The layout depends on the cluster's deployed chart version:
-//
-//   - tkaVersion >= v0.11.0: a single nested block under TeleportKubeAgentValuesKey,
-//     because that's the only place the chart looks.
-//   - tkaVersion < v0.11.0 or unknown ("" / unparseable): the legacy flat
-//     layout at the root, PLUS the nested block. The flat block keeps the
-//     chart working today; the nested block is there so an in-place upgrade
-//     past v0.11.0 doesn't lose values in the window before the operator's
-//     next reconcile.
-//
-// teleportVersionOverride is passed through in the flat block when non-empty,
-// but the nested block applies a floor (see ResolveTeleportVersionOverride):
-// the override is dropped if it would be a downgrade against the v0.11.0
-// chart's bundled Teleport version.
-func GetConfigmapDataFromTemplate(authToken, proxyAddr, kubeClusterName, teleportVersion string, roles []string, tkaVersion string) string {
-	flat := renderFlatValuesBlock(authToken, proxyAddr, kubeClusterName, teleportVersion, roles)
-	nestedOverride := ResolveNestedTeleportVersionOverride(teleportVersion)
-	nested := renderNestedValuesBlock(authToken, proxyAddr, kubeClusterName, nestedOverride, roles)
-
-	if UsesNestedKubeAgentValues(tkaVersion) {
-		return nested
-	}
-	return flat + nested
-}
-
-func renderFlatValuesBlock(authToken, proxyAddr, kubeClusterName, teleportVersion string, roles []string) string {
-	body := fmt.Sprintf(`roles: "%s"
-authToken: "%s"
-proxyAddr: "%s"
-kubeClusterName: "%s"
-`, RolesToString(roles), authToken, proxyAddr, kubeClusterName)
-	if teleportVersion != "" {
-		body += fmt.Sprintf("teleportVersionOverride: %q\n", teleportVersion)
-	}
-	return body
-}
-
-func renderNestedValuesBlock(authToken, proxyAddr, kubeClusterName, teleportVersion string, roles []string) string {
-	body := fmt.Sprintf(`%s:
-  roles: "%s"
-  authToken: "%s"
-  proxyAddr: "%s"
-  kubeClusterName: "%s"
-`, TeleportKubeAgentValuesKey, RolesToString(roles), authToken, proxyAddr, kubeClusterName)
-	if teleportVersion != "" {
-		body += fmt.Sprintf("  teleportVersionOverride: %q\n", teleportVersion)
-	}
-	return body
-}
-
-func GetTbotConfigmapDataFromTemplate(kubeClusterName string, clusterName string) string {
-	dataTpl := `outputs:
-  %s: "%s"
-`
-
-	return fmt.Sprintf(dataTpl, kubeClusterName, clusterName)
+	return DefaultValuesLayouts().Get(ValuesLayoutNested).ResolveTeleportVersionOverride(teleportVersion)
 }
@@ -1,6 +1,9 @@
 package key
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestUsesNestedKubeAgentValues(t *testing.T) {
 	cases := []struct {
@@ -13,8 +16,11 @@ func TestUsesNestedKubeAgentValues(t *testing.T) {
 		{"0.10.8", false},
 		{"v0.10.8", false},
 		{"0.10.9", false},
+		{"0.11.0-rc.1", false},
 		{"0.11.0", true},
 		{"v0.11.0", true},
+		{"0.12.0-rc.1", true},
+		{"1.0.0-beta", true},
 		{"1.0.0", true},
 	}
 	for _, c := range cases {
@@ -27,7 +33,10 @@ func TestUsesNestedKubeAgentValues(t *testing.T) {
 }
 
 func TestGetConfigmapDataFromTemplate_NestedOnlyAtOrAbove0_11_0(t *testing.T) {
-	data := GetConfigmapDataFromTemplate("tok", "proxy:443", "kube", "18.7.6", []string{"kube", "app"}, "0.11.0")
+	data, err := GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "18.7.6", []string{"kube", "app"}, nil, nil, DefaultValuesLayouts(), "0.11.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	if want := "teleport-kube-agent:\n"; data[:len(want)] != want {
 		t.Fatalf("expected nested-only layout, got:\n%s", data)
 	}
@@ -37,7 +46,10 @@ func TestGetConfigmapDataFromTemplate_DualBlockBelow0_11_0(t *testing.T) {
 	cases := []string{"", "0.10.8", "not-a-version"}
 	for _, tkaVersion := range cases {
 		t.Run(tkaVersion, func(t *testing.T) {
-			data := GetConfigmapDataFromTemplate("tok", "proxy:443", "kube", "18.7.6", []string{"kube", "app"}, tkaVersion)
+			data, err := GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "18.7.6", []string{"kube", "app"}, nil, nil, DefaultValuesLayouts(), tkaVersion)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 			if !startsWith(data, "roles:") {
 				t.Fatalf("expected flat root keys first, got:\n%s", data)
 			}
@@ -49,14 +61,20 @@ func TestGetConfigmapDataFromTemplate_DualBlockBelow0_11_0(t *testing.T) {
 }
 
 func TestGetConfigmapDataFromTemplate_NestedFloorDropsDowngrade(t *testing.T) {
-	data := GetConfigmapDataFromTemplate("tok", "proxy:443", "kube", "17.5.4", []string{"kube"}, "0.11.0")
+	data, err := GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "17.5.4", []string{"kube"}, nil, nil, DefaultValuesLayouts(), "0.11.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	if containsLine(data, `  teleportVersionOverride: "17.5.4"`) {
 		t.Fatalf("expected nested block to omit downgrade override, got:\n%s", data)
 	}
 }
 
 func TestGetConfigmapDataFromTemplate_DualBlockFlatPassesOverride(t *testing.T) {
-	data := GetConfigmapDataFromTemplate("tok", "proxy:443", "kube", "1.0.0", []string{"kube"}, "")
+	data, err := GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "1.0.0", []string{"kube"}, nil, nil, DefaultValuesLayouts(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	if !containsLine(data, `teleportVersionOverride: "1.0.0"`) {
 		t.Fatalf("expected flat block to keep passthrough override, got:\n%s", data)
 	}
@@ -65,6 +83,107 @@ func TestGetConfigmapDataFromTemplate_DualBlockFlatPassesOverride(t *testing.T)
 	}
 }
 
+func TestGetConfigmapDataFromTemplate_DelegatedJoinMethod(t *testing.T) {
+	for _, joinMethod := range []string{JoinMethodKubernetes, "iam", "azure", "gcp"} {
+		t.Run(joinMethod, func(t *testing.T) {
+			tokenName := GetJoinTokenName("mc-kube", joinMethod)
+			data, err := GetConfigmapDataFromTemplate(tokenName, joinMethod, "proxy:443", "kube", "18.7.6", []string{"kube"}, nil, nil, DefaultValuesLayouts(), "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, line := range []string{
+				`joinParams:`,
+				`  method: "` + joinMethod + `"`,
+				`  tokenName: "` + tokenName + `"`,
+				`  joinParams:`,
+				`    method: "` + joinMethod + `"`,
+				`    tokenName: "` + tokenName + `"`,
+			} {
+				if !containsLine(data, line) {
+					t.Fatalf("expected line %q, got:\n%s", line, data)
+				}
+			}
+			if strings.Contains(data, "authToken") {
+				t.Fatalf("expected no authToken with the %s join method, got:\n%s", joinMethod, data)
+			}
+		})
+	}
+}
+
+func TestGetTokenValuesFromTemplate_SplitsTokenFromValues(t *testing.T) {
+	for _, tkaVersion := range []string{"", "0.11.0"} {
+		t.Run(tkaVersion, func(t *testing.T) {
+			data, err := GetConfigmapDataFromTemplate("", JoinMethodToken, "proxy:443", "kube", "18.7.6", []string{"kube"}, nil, nil, DefaultValuesLayouts(), tkaVersion)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Contains(data, "authToken") {
+				t.Fatalf("expected no authToken without a token, got:\n%s", data)
+			}
+
+			tokenValues, err := GetTokenValuesFromTemplate("tok", DefaultValuesLayouts(), tkaVersion)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := "teleport-kube-agent:\n  authToken: \"tok\"\n"
+			if !UsesNestedKubeAgentValues(tkaVersion) {
+				expected = "authToken: \"tok\"\n" + expected
+			}
+			if tokenValues != expected {
+				t.Fatalf("expected token values:\n%s\ngot:\n%s", expected, tokenValues)
+			}
+		})
+	}
+}
+
+func TestParseRoles_AgentRoles(t *testing.T) {
+	roles, err := ParseRoles("kube, app,db,discovery,windowsdesktop")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := RolesToString(roles); got != "kube,app,db,discovery,windowsdesktop" {
+		t.Fatalf("unexpected roles %q", got)
+	}
+
+	var systemRoles []string
+	for _, role := range RolesToSystemRoles(roles) {
+		systemRoles = append(systemRoles, string(role))
+	}
+	if got := strings.Join(systemRoles, ","); got != "Kube,App,Db,Discovery,WindowsDesktop" {
+		t.Fatalf("unexpected system roles %q", got)
+	}
+
+	if _, err := ParseRoles("kube,proxy"); err == nil {
+		t.Fatal("expected an error for an unknown role")
+	}
+}
+
+func TestGetConfigmapDataFromTemplate_AgentRoles(t *testing.T) {
+	data, err := GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "18.7.6", []string{RoleKube, RoleDatabase, RoleDiscovery}, nil, nil, DefaultValuesLayouts(), "0.11.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !containsLine(data, `  roles: "kube,db,discovery"`) {
+		t.Fatalf("expected the agent roles in the values, got:\n%s", data)
+	}
+}
+
+func TestParseLabelMapping(t *testing.T) {
+	mapping, err := ParseLabelMapping("giantswarm.io/organization=customer, provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mapping) != 2 || mapping["giantswarm.io/organization"] != "customer" || mapping["provider"] != "provider" {
+		t.Fatalf("unexpected mapping %v", mapping)
+	}
+
+	for _, s := range []string{"", "provider,", "=customer", "provider="} {
+		if _, err := ParseLabelMapping(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
 func TestResolveNestedTeleportVersionOverride(t *testing.T) {
 	cases := []struct {
 		name            string
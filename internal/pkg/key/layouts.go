@@ -0,0 +1,262 @@
+package key
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Names of the built-in values layouts, see layouts.yaml.
+const (
+	ValuesLayoutDual   = "Dual"
+	ValuesLayoutNested = "Nested"
+)
+
+// ValuesFields are the teleport-kube-agent values the operator renders, in
+// the order they are rendered.
+var ValuesFields = []string{"roles", "authToken", "joinParams", "proxyAddr", "kubeClusterName", "teleportVersionOverride", "labels", "databases"}
+
+//go:embed layouts.yaml
+var builtinValuesLayouts []byte
+
+// ValuesLayout describes where a generation of the teleport-kube-agent chart
+// reads the values the operator renders.
+type ValuesLayout struct {
+	// Name identifies the layout, e.g. in the TeleportCluster status.
+	Name string `yaml:"name"`
+	// Versions is the semver constraint of the chart versions using the
+	// layout, e.g. `>= 0.11.0`.
+	Versions string `yaml:"versions"`
+	// RootKey is the key the chart reads its values under, empty for the
+	// root of the values.
+	RootKey string `yaml:"rootKey,omitempty"`
+	// Fields are the values the chart supports, out of ValuesFields. Other
+	// values are not rendered. Empty means all of them.
+	Fields []string `yaml:"fields,omitempty"`
+	// RenamedKeys maps values to the keys the chart reads them as.
+	RenamedKeys map[string]string `yaml:"renamedKeys,omitempty"`
+	// BundledTeleportVersion is the Teleport version the chart bundles. A
+	// lower or unparseable teleportVersionOverride would be a downgrade and
+	// is left out.
+	BundledTeleportVersion string `yaml:"bundledTeleportVersion,omitempty"`
+	// UpgradeTo names the layout charts of this layout are upgraded to. Its
+	// values are rendered as well, so that an in-place upgrade of the chart
+	// doesn't lose values before the operator's next reconcile.
+	UpgradeTo string `yaml:"upgradeTo,omitempty"`
+}
+
+// ValuesLayouts is a registry of values layouts.
+type ValuesLayouts struct {
+	// Default names the layout of charts whose version is unknown or matches
+	// no layout.
+	Default string `yaml:"default,omitempty"`
+	// Layouts are matched against the chart version in order.
+	Layouts []ValuesLayout `yaml:"layouts,omitempty"`
+}
+
+var defaultValuesLayouts = sync.OnceValue(func() *ValuesLayouts {
+	layouts, err := ParseValuesLayouts(string(builtinValuesLayouts))
+	if err == nil {
+		err = layouts.Validate()
+	}
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in values layouts: %v", err))
+	}
+	return layouts
+})
+
+// DefaultValuesLayouts returns the built-in values layouts, embedded from
+// layouts.yaml. The registry is shared and must not be modified.
+func DefaultValuesLayouts() *ValuesLayouts {
+	return defaultValuesLayouts()
+}
+
+// ParseValuesLayouts parses a YAML values layouts registry. Unknown keys are
+// rejected. The registry is not validated, as it may refer to the layouts it
+// is merged with, see MergeValuesLayouts.
+func ParseValuesLayouts(s string) (*ValuesLayouts, error) {
+	layouts := &ValuesLayouts{}
+	dec := yaml.NewDecoder(bytes.NewBufferString(s))
+	dec.KnownFields(true)
+	if err := dec.Decode(layouts); err != nil {
+		return nil, fmt.Errorf("invalid values layouts: %w", err)
+	}
+	return layouts, nil
+}
+
+// MergeValuesLayouts returns the layouts of override followed by the ones of
+// base it doesn't replace by name, and override's default if set, else
+// base's. The result is validated.
+func MergeValuesLayouts(base, override *ValuesLayouts) (*ValuesLayouts, error) {
+	merged := &ValuesLayouts{Default: base.Default}
+	if override.Default != "" {
+		merged.Default = override.Default
+	}
+	merged.Layouts = append(merged.Layouts, override.Layouts...)
+	for _, layout := range base.Layouts {
+		if override.Get(layout.Name) == nil {
+			merged.Layouts = append(merged.Layouts, layout)
+		}
+	}
+	if err := merged.Validate(); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// Validate checks that the layouts are well-formed and that the default and
+// upgrade layouts exist.
+func (l *ValuesLayouts) Validate() error {
+	if l.Get(l.Default) == nil {
+		return fmt.Errorf("invalid values layouts: default layout %q not found", l.Default)
+	}
+	for i, layout := range l.Layouts {
+		if layout.Name == "" {
+			return fmt.Errorf("invalid values layouts: layout %d has no name", i)
+		}
+		if l.Get(layout.Name) != &l.Layouts[i] {
+			return fmt.Errorf("invalid values layouts: duplicate layout %q", layout.Name)
+		}
+		if _, err := semver.NewConstraint(layout.Versions); err != nil {
+			return fmt.Errorf("invalid values layout %q: versions: %w", layout.Name, err)
+		}
+		for _, field := range layout.Fields {
+			if !slices.Contains(ValuesFields, field) {
+				return fmt.Errorf("invalid values layout %q: unknown field %q", layout.Name, field)
+			}
+		}
+		for field, renamed := range layout.RenamedKeys {
+			if !slices.Contains(ValuesFields, field) || renamed == "" {
+				return fmt.Errorf("invalid values layout %q: invalid renamed key %q: %q", layout.Name, field, renamed)
+			}
+		}
+		if layout.BundledTeleportVersion != "" {
+			if _, err := semver.NewVersion(strings.TrimPrefix(layout.BundledTeleportVersion, "v")); err != nil {
+				return fmt.Errorf("invalid values layout %q: bundledTeleportVersion: %w", layout.Name, err)
+			}
+		}
+		if layout.UpgradeTo != "" {
+			upgrade := l.Get(layout.UpgradeTo)
+			if upgrade == nil {
+				return fmt.Errorf("invalid values layout %q: upgrade layout %q not found", layout.Name, layout.UpgradeTo)
+			}
+			if upgrade.RootKey == layout.RootKey {
+				return fmt.Errorf("invalid values layout %q: upgrade layout %q has the same root key", layout.Name, layout.UpgradeTo)
+			}
+		}
+	}
+	return nil
+}
+
+// Get returns the layout with the given name, or nil.
+func (l *ValuesLayouts) Get(name string) *ValuesLayout {
+	for i := range l.Layouts {
+		if l.Layouts[i].Name == name {
+			return &l.Layouts[i]
+		}
+	}
+	return nil
+}
+
+// For returns the layout of the teleport-kube-agent chart version: the first
+// layout whose versions match, else the default one. Pre-release versions
+// match by semver precedence, so 0.12.0-rc.1 is within ">= 0.11.0".
+func (l *ValuesLayouts) For(tkaVersion string) *ValuesLayout {
+	if v, err := semver.NewVersion(strings.TrimPrefix(tkaVersion, "v")); err == nil {
+		for i := range l.Layouts {
+			c, err := semver.NewConstraint(l.Layouts[i].Versions)
+			if err != nil {
+				continue
+			}
+			c.IncludePrerelease = true
+			if c.Check(v) {
+				return &l.Layouts[i]
+			}
+		}
+	}
+	return l.Get(l.Default)
+}
+
+// Blocks returns the layouts whose values are rendered for a chart of the
+// layout: the layout itself, and the one it upgrades to, if any.
+func (l *ValuesLayouts) Blocks(layout *ValuesLayout) []*ValuesLayout {
+	blocks := []*ValuesLayout{layout}
+	if upgrade := l.Get(layout.UpgradeTo); upgrade != nil {
+		blocks = append(blocks, upgrade)
+	}
+	return blocks
+}
+
+// RootKeys returns the root keys of the layouts that nest their values, in
+// order.
+func (l *ValuesLayouts) RootKeys() []string {
+	var keys []string
+	for _, layout := range l.Layouts {
+		if layout.RootKey != "" && !slices.Contains(keys, layout.RootKey) {
+			keys = append(keys, layout.RootKey)
+		}
+	}
+	return keys
+}
+
+// ValuesPaths returns the paths of every value the operator renders in any
+// of the layouts, sorted: the keys of the layouts at the root, and the keys
+// of the nested layouts prefixed with their root key.
+func (l *ValuesLayouts) ValuesPaths() []string {
+	var paths []string
+	for i := range l.Layouts {
+		layout := &l.Layouts[i]
+		for _, field := range ValuesFields {
+			if !layout.Supports(field) {
+				continue
+			}
+			path := layout.Key(field)
+			if layout.RootKey != "" {
+				path = layout.RootKey + "." + path
+			}
+			if !slices.Contains(paths, path) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// Supports reports whether the chart reads the value.
+func (l *ValuesLayout) Supports(field string) bool {
+	return len(l.Fields) == 0 || slices.Contains(l.Fields, field)
+}
+
+// Key returns the key the chart reads the value as.
+func (l *ValuesLayout) Key(field string) string {
+	if renamed, ok := l.RenamedKeys[field]; ok {
+		return renamed
+	}
+	return field
+}
+
+// ResolveTeleportVersionOverride returns the value to write as
+// `teleportVersionOverride`, or "" when the override should be omitted:
+// with a bundled Teleport version, any teleportVersion below it — or one
+// that doesn't parse as semver — is dropped to avoid a downgrade.
+func (l *ValuesLayout) ResolveTeleportVersionOverride(teleportVersion string) string {
+	if teleportVersion == "" || l.BundledTeleportVersion == "" {
+		return teleportVersion
+	}
+	v, err := semver.NewVersion(strings.TrimPrefix(teleportVersion, "v"))
+	if err != nil {
+		return ""
+	}
+	bundled, err := semver.NewVersion(strings.TrimPrefix(l.BundledTeleportVersion, "v"))
+	if err != nil || v.Compare(bundled) < 0 {
+		return ""
+	}
+	return teleportVersion
+}
@@ -0,0 +1,134 @@
+package key
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestValuesLayouts_For(t *testing.T) {
+	override, err := ParseValuesLayouts("layouts:\n- name: Agent\n  versions: \">= 1.0.0\"\n  rootKey: agent\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	layouts, err := MergeValuesLayouts(DefaultValuesLayouts(), override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		version string
+		layout  string
+	}{
+		{"", ValuesLayoutDual},
+		{"not-a-version", ValuesLayoutDual},
+		{"0.10.8", ValuesLayoutDual},
+		{"0.11.0-rc.1", ValuesLayoutDual},
+		{"0.11.0", ValuesLayoutNested},
+		{"v0.12.1", ValuesLayoutNested},
+		{"0.12.0-rc.1", ValuesLayoutNested},
+		{"1.0.0-beta", ValuesLayoutNested},
+		{"1.0.0", "Agent"},
+		{"1.1.0-rc.1", "Agent"},
+	}
+	for _, c := range cases {
+		t.Run(c.version, func(t *testing.T) {
+			if got := layouts.For(c.version).Name; got != c.layout {
+				t.Fatalf("For(%q) = %q, want %q", c.version, got, c.layout)
+			}
+		})
+	}
+}
+
+func TestMergeValuesLayouts_Invalid(t *testing.T) {
+	cases := []struct {
+		name     string
+		override string
+	}{
+		{"unknown default", "default: Agent\n"},
+		{"unnamed layout", "layouts:\n- versions: \">= 1.0.0\"\n"},
+		{"duplicate layout", "layouts:\n- name: Agent\n  versions: \">= 1.0.0\"\n- name: Agent\n  versions: \">= 2.0.0\"\n"},
+		{"invalid versions", "layouts:\n- name: Agent\n  versions: \"1.x.y\"\n"},
+		{"unknown field", "layouts:\n- name: Agent\n  versions: \">= 1.0.0\"\n  fields: [replicaCount]\n"},
+		{"empty renamed key", "layouts:\n- name: Agent\n  versions: \">= 1.0.0\"\n  renamedKeys:\n    authToken: \"\"\n"},
+		{"invalid bundled version", "layouts:\n- name: Agent\n  versions: \">= 1.0.0\"\n  bundledTeleportVersion: latest\n"},
+		{"unknown upgrade layout", "layouts:\n- name: Agent\n  versions: \">= 1.0.0\"\n  upgradeTo: Next\n"},
+		{"upgrade layout with the same root key", "layouts:\n- name: Agent\n  versions: \">= 1.0.0\"\n  upgradeTo: Dual\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			override, err := ParseValuesLayouts(c.override)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := MergeValuesLayouts(DefaultValuesLayouts(), override); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+
+	if _, err := ParseValuesLayouts("layouts:\n- name: Agent\n  rootkey: agent\n"); err == nil {
+		t.Fatal("expected an error for an unknown key")
+	}
+}
+
+func TestGetConfigmapDataFromTemplate_ConfiguredLayout(t *testing.T) {
+	override, err := ParseValuesLayouts(`
+layouts:
+- name: Agent
+  versions: ">= 1.0.0"
+  rootKey: agent
+  fields: [roles, authToken, teleportVersionOverride]
+  renamedKeys:
+    authToken: joinToken
+  bundledTeleportVersion: 19.0.0
+- name: Nested
+  versions: ">= 0.11.0"
+  rootKey: teleport-kube-agent
+  bundledTeleportVersion: 18.7.6
+  upgradeTo: Agent
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	layouts, err := MergeValuesLayouts(DefaultValuesLayouts(), override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "18.8.0", []string{RoleKube}, nil, nil, layouts, "0.11.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "teleport-kube-agent:\n" +
+		"  roles: \"kube\"\n" +
+		"  authToken: \"tok\"\n" +
+		"  proxyAddr: \"proxy:443\"\n" +
+		"  kubeClusterName: \"kube\"\n" +
+		"  teleportVersionOverride: \"18.8.0\"\n" +
+		"agent:\n" +
+		"  roles: \"kube\"\n" +
+		"  joinToken: \"tok\"\n"
+	if data != expected {
+		t.Fatalf("expected values:\n%s\nactual:\n%s", expected, data)
+	}
+
+	data, err = GetTokenValuesFromTemplate("tok", layouts, "1.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "agent:\n  joinToken: \"tok\"\n"; data != expected {
+		t.Fatalf("expected values:\n%s\nactual:\n%s", expected, data)
+	}
+}
+
+func TestValuesLayouts_ValuesPaths(t *testing.T) {
+	paths := DefaultValuesLayouts().ValuesPaths()
+	for _, path := range []string{"authToken", "teleportVersionOverride", "teleport-kube-agent.authToken", "teleport-kube-agent.roles"} {
+		if !slices.Contains(paths, path) {
+			t.Fatalf("expected path %s in %v", path, paths)
+		}
+	}
+	if !slices.IsSorted(paths) {
+		t.Fatalf("expected sorted paths, actual %v", paths)
+	}
+}
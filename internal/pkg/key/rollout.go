@@ -0,0 +1,90 @@
+package key
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// VersionRollout is the policy changes of the kube agents' Teleport version
+// are rolled out across the clusters with: wave after wave, each released
+// once the agents of the previous one report the new version in Teleport.
+type VersionRollout struct {
+	// Waves are released in order. Clusters no wave selects join the last
+	// one.
+	Waves []RolloutWave `yaml:"waves"`
+	// WaveTimeout is how long the agents of a wave have to report the new
+	// version before the rollout fails. Defaults to
+	// DefaultRolloutWaveTimeout.
+	WaveTimeout time.Duration `yaml:"waveTimeout,omitempty"`
+}
+
+// RolloutWave selects the clusters of a wave, either by a label selector or
+// as a percentage of all clusters.
+type RolloutWave struct {
+	Name string `yaml:"name"`
+	// Selector is a label selector, e.g. `stage=canary`, matched against
+	// the Cluster labels. Clusters selected by an earlier wave are skipped.
+	Selector string `yaml:"selector,omitempty"`
+	// Percent of all clusters released once this wave is, counting the
+	// clusters of the earlier waves, rounded up.
+	Percent int `yaml:"percent,omitempty"`
+}
+
+// ParseVersionRollout parses and validates a YAML rollout policy. Unknown
+// keys are rejected.
+func ParseVersionRollout(s string) (*VersionRollout, error) {
+	rollout := &VersionRollout{}
+	dec := yaml.NewDecoder(bytes.NewBufferString(s))
+	dec.KnownFields(true)
+	if err := dec.Decode(rollout); err != nil {
+		return nil, fmt.Errorf("invalid rollout policy: %w", err)
+	}
+	if err := rollout.Validate(); err != nil {
+		return nil, err
+	}
+	return rollout, nil
+}
+
+// Validate checks that the policy has waves with unique names, each with
+// either a valid selector or a percentage.
+func (r *VersionRollout) Validate() error {
+	if len(r.Waves) == 0 {
+		return fmt.Errorf("invalid rollout policy: no waves")
+	}
+	if r.WaveTimeout < 0 {
+		return fmt.Errorf("invalid rollout policy: waveTimeout must not be negative")
+	}
+	names := map[string]bool{}
+	for i, wave := range r.Waves {
+		switch {
+		case wave.Name == "":
+			return fmt.Errorf("invalid rollout policy: wave %d has no name", i)
+		case names[wave.Name]:
+			return fmt.Errorf("invalid rollout policy: duplicate wave %q", wave.Name)
+		case (wave.Selector == "") == (wave.Percent == 0):
+			return fmt.Errorf("invalid rollout policy: wave %q must have either a selector or a percent", wave.Name)
+		case wave.Percent < 0 || wave.Percent > 100:
+			return fmt.Errorf("invalid rollout policy: wave %q: percent must be between 1 and 100, got %d", wave.Name, wave.Percent)
+		}
+		if wave.Selector != "" {
+			if _, err := labels.Parse(wave.Selector); err != nil {
+				return fmt.Errorf("invalid rollout policy: wave %q: %w", wave.Name, err)
+			}
+		}
+		names[wave.Name] = true
+	}
+	return nil
+}
+
+// GetWaveTimeout returns how long the agents of a wave have to report the
+// new version.
+func (r *VersionRollout) GetWaveTimeout() time.Duration {
+	if r.WaveTimeout > 0 {
+		return r.WaveTimeout
+	}
+	return DefaultRolloutWaveTimeout
+}
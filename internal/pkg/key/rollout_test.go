@@ -0,0 +1,46 @@
+package key
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseVersionRollout(t *testing.T) {
+	rollout, err := ParseVersionRollout("waves:\n- name: canary\n  selector: stage=canary\n- name: half\n  percent: 50\n- name: rest\n  percent: 100\nwaveTimeout: 1h\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rollout.Waves) != 3 || rollout.Waves[0].Selector != "stage=canary" || rollout.Waves[1].Percent != 50 {
+		t.Fatalf("unexpected waves %+v", rollout.Waves)
+	}
+	if rollout.GetWaveTimeout() != time.Hour {
+		t.Fatalf("expected wave timeout 1h, got %s", rollout.GetWaveTimeout())
+	}
+	if (&VersionRollout{}).GetWaveTimeout() != DefaultRolloutWaveTimeout {
+		t.Fatalf("expected the default wave timeout")
+	}
+}
+
+func TestParseVersionRollout_Invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy string
+	}{
+		{"no waves", "waveTimeout: 1h\n"},
+		{"unnamed wave", "waves:\n- percent: 10\n"},
+		{"duplicate wave", "waves:\n- name: a\n  percent: 10\n- name: a\n  percent: 20\n"},
+		{"selector and percent", "waves:\n- name: a\n  selector: stage=canary\n  percent: 10\n"},
+		{"neither selector nor percent", "waves:\n- name: a\n"},
+		{"percent above 100", "waves:\n- name: a\n  percent: 101\n"},
+		{"invalid selector", "waves:\n- name: a\n  selector: \"stage in canary\"\n"},
+		{"unknown key", "waves:\n- name: a\n  percent: 10\n  clusters: [a]\n"},
+		{"invalid timeout", "waves:\n- name: a\n  percent: 10\nwaveTimeout: soon\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ParseVersionRollout(c.policy); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
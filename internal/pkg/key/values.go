@@ -0,0 +1,193 @@
+package key
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Database is a database the kube agent proxies for Teleport Database
+// Access.
+type Database struct {
+	Name     string
+	Protocol string
+	URI      string
+	Labels   map[string]string
+}
+
+// quoted is a string rendered as a double-quoted YAML scalar, so that the
+// values read back as strings whatever they contain.
+type quoted string
+
+func (q quoted) MarshalYAML() (interface{}, error) {
+	return &yaml.Node{Kind: yaml.ScalarNode, Style: yaml.DoubleQuotedStyle, Value: string(q)}, nil
+}
+
+// kubeAgentValues are the teleport-kube-agent values the operator manages.
+// Keys are rendered in field order and maps sorted by key, so that the same
+// values always render the same document.
+type kubeAgentValues struct {
+	Roles                   quoted            `yaml:"roles,omitempty"`
+	AuthToken               quoted            `yaml:"authToken,omitempty"`
+	JoinParams              *joinParamsValues `yaml:"joinParams,omitempty"`
+	ProxyAddr               quoted            `yaml:"proxyAddr,omitempty"`
+	KubeClusterName         quoted            `yaml:"kubeClusterName,omitempty"`
+	TeleportVersionOverride quoted            `yaml:"teleportVersionOverride,omitempty"`
+	Labels                  map[string]quoted `yaml:"labels,omitempty"`
+	Databases               []databaseValues  `yaml:"databases,omitempty"`
+}
+
+type joinParamsValues struct {
+	Method    quoted `yaml:"method"`
+	TokenName quoted `yaml:"tokenName"`
+}
+
+type databaseValues struct {
+	Name     quoted            `yaml:"name"`
+	Protocol quoted            `yaml:"protocol"`
+	URI      quoted            `yaml:"uri"`
+	Labels   map[string]quoted `yaml:"labels"`
+}
+
+// GetConfigmapDataFromTemplate renders the teleport-kube-agent values document
+// for a cluster, in the values layout of the cluster's deployed chart version,
+// see ValuesLayouts.For. The values are rendered where the layout's chart
+// reads them, followed by the values of the layout it upgrades to, if any,
+// see ValuesLayout.UpgradeTo. With the built-in layouts:
+//
+//   - tkaVersion >= v0.11.0: a single nested block under TeleportKubeAgentValuesKey,
+//     because that's the only place the chart looks.
+//   - tkaVersion < v0.11.0 or unknown ("" / unparseable): the legacy flat
+//     layout at the root, PLUS the nested block. The flat block keeps the
+//     chart working today; the nested block is there so an in-place upgrade
+//     past v0.11.0 doesn't lose values in the window before the operator's
+//     next reconcile.
+//
+// Each block only carries the values its layout supports, under the keys the
+// chart reads them as. teleportVersionOverride is dropped from a block if it
+// would be a downgrade against the layout's bundled Teleport version, see
+// ValuesLayout.ResolveTeleportVersionOverride.
+//
+// With a delegated join method, e.g. `kubernetes` or `iam`, the agent proves
+// its identity instead of presenting a secret: the values name the join token
+// and method under `joinParams` rather than carrying it as `authToken`. With
+// an empty token, the join values are left out, e.g. because they are kept
+// in a Secret, see GetTokenValuesFromTemplate.
+//
+// Labels are rendered as the kube cluster's `labels` in Teleport.
+// Databases are rendered as static `databases` entries, labelled with
+// DatabaseClusterLabel set to kubeClusterName.
+func GetConfigmapDataFromTemplate(token, joinMethod, proxyAddr, kubeClusterName, teleportVersion string, roles []string, labels map[string]string, databases []Database, layouts *ValuesLayouts, tkaVersion string) (string, error) {
+	values := kubeAgentValues{
+		Roles:           quoted(RolesToString(roles)),
+		ProxyAddr:       quoted(proxyAddr),
+		KubeClusterName: quoted(kubeClusterName),
+		Labels:          quotedMap(labels),
+	}
+	setJoinValues(&values, token, joinMethod)
+	for _, db := range databases {
+		dbLabels := maps.Clone(db.Labels)
+		if dbLabels == nil {
+			dbLabels = map[string]string{}
+		}
+		dbLabels[DatabaseClusterLabel] = kubeClusterName
+		values.Databases = append(values.Databases, databaseValues{
+			Name:     quoted(db.Name),
+			Protocol: quoted(db.Protocol),
+			URI:      quoted(db.URI),
+			Labels:   quotedMap(dbLabels),
+		})
+	}
+	return renderLayoutValues(values, teleportVersion, layouts, tkaVersion)
+}
+
+// GetTokenValuesFromTemplate renders the teleport-kube-agent values that only
+// carry the static join token, in the same layout as
+// GetConfigmapDataFromTemplate, to be merged over the values without it.
+func GetTokenValuesFromTemplate(token string, layouts *ValuesLayouts, tkaVersion string) (string, error) {
+	var values kubeAgentValues
+	setJoinValues(&values, token, JoinMethodToken)
+	return renderLayoutValues(values, "", layouts, tkaVersion)
+}
+
+// renderLayoutValues renders the values in the layout of the chart version.
+func renderLayoutValues(values kubeAgentValues, teleportVersion string, layouts *ValuesLayouts, tkaVersion string) (string, error) {
+	doc := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, layout := range layouts.Blocks(layouts.For(tkaVersion)) {
+		values.TeleportVersionOverride = quoted(layout.ResolveTeleportVersionOverride(teleportVersion))
+		block, err := layoutValues(values, layout)
+		if err != nil {
+			return "", err
+		}
+		if layout.RootKey == "" {
+			doc.Content = append(doc.Content, block.Content...)
+			continue
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: layout.RootKey}, block)
+	}
+	return renderValues(doc)
+}
+
+// layoutValues returns the values the layout supports as a mapping, under
+// the keys the layout's chart reads them as.
+func layoutValues(values kubeAgentValues, layout *ValuesLayout) (*yaml.Node, error) {
+	var node yaml.Node
+	if err := node.Encode(values); err != nil {
+		return nil, fmt.Errorf("failed to encode values: %w", err)
+	}
+	block := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if !layout.Supports(k.Value) {
+			continue
+		}
+		k.Value = layout.Key(k.Value)
+		block.Content = append(block.Content, k, v)
+	}
+	return block, nil
+}
+
+// setJoinValues sets how the agent joins Teleport. Nothing is set without a
+// token.
+func setJoinValues(values *kubeAgentValues, token, joinMethod string) {
+	switch {
+	case token == "":
+	case joinMethod != "" && joinMethod != JoinMethodToken:
+		values.JoinParams = &joinParamsValues{Method: quoted(joinMethod), TokenName: quoted(token)}
+	default:
+		values.AuthToken = quoted(token)
+	}
+}
+
+func GetTbotConfigmapDataFromTemplate(kubeClusterName string, clusterName string) (string, error) {
+	return renderValues(map[string]map[string]quoted{
+		"outputs": {kubeClusterName: quoted(clusterName)},
+	})
+}
+
+func quotedMap(m map[string]string) map[string]quoted {
+	if len(m) == 0 {
+		return nil
+	}
+	out := make(map[string]quoted, len(m))
+	for k, v := range m {
+		out[k] = quoted(v)
+	}
+	return out
+}
+
+// renderValues marshals a values document with two-space indentation.
+func renderValues(v interface{}) (string, error) {
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return "", fmt.Errorf("failed to render values: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return "", fmt.Errorf("failed to render values: %w", err)
+	}
+	return b.String(), nil
+}
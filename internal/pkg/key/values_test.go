@@ -0,0 +1,96 @@
+package key
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestGetConfigmapDataFromTemplate_Golden(t *testing.T) {
+	labels := map[string]string{"release": "30.0.0", "customer": "acme"}
+	databases := []Database{
+		{Name: "orders", Protocol: "postgres", URI: "orders.db.svc:5432", Labels: map[string]string{"team": "shop", "env": "prod"}},
+		{Name: "users", Protocol: "mysql", URI: "users.db.svc:3306"},
+	}
+
+	render := func(data string, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return data
+	}
+
+	cases := []struct {
+		name string
+		data string
+	}{
+		{"dual-token", render(GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "1.0.0", []string{RoleKube, RoleApp}, nil, nil, DefaultValuesLayouts(), ""))},
+		{"nested-token", render(GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "18.7.6", []string{RoleKube, RoleApp}, nil, nil, DefaultValuesLayouts(), "0.11.0"))},
+		{"dual-without-token", render(GetConfigmapDataFromTemplate("", JoinMethodToken, "proxy:443", "kube", "18.7.6", []string{RoleKube}, nil, nil, DefaultValuesLayouts(), "0.10.8"))},
+		{"nested-kubernetes", render(GetConfigmapDataFromTemplate("mc-kube-kubernetes", JoinMethodKubernetes, "proxy:443", "kube", "", []string{RoleKube}, nil, nil, DefaultValuesLayouts(), "0.11.0"))},
+		{"dual-labels-databases", render(GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "18.7.6", []string{RoleKube, RoleDatabase}, labels, databases, DefaultValuesLayouts(), ""))},
+		{"nested-labels-databases", render(GetConfigmapDataFromTemplate("tok", JoinMethodToken, "proxy:443", "kube", "18.7.6", []string{RoleKube, RoleDatabase}, labels, databases, DefaultValuesLayouts(), "0.11.0"))},
+		{"dual-token-values", render(GetTokenValuesFromTemplate("tok", DefaultValuesLayouts(), ""))},
+		{"nested-token-values", render(GetTokenValuesFromTemplate("tok", DefaultValuesLayouts(), "0.11.0"))},
+		{"tbot", render(GetTbotConfigmapDataFromTemplate("mc-kube", "kube"))},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			golden := filepath.Join("testdata", c.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(c.data), 0o644); err != nil {
+					t.Fatalf("failed to update %s: %v", golden, err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", golden, err)
+			}
+			if c.data != string(expected) {
+				t.Fatalf("values do not match %s, want:\n%s\ngot:\n%s", golden, expected, c.data)
+			}
+		})
+	}
+}
+
+func TestGetConfigmapDataFromTemplate_Escaping(t *testing.T) {
+	const (
+		token     = "tok\"en: \\\n# not a comment"
+		proxyAddr = "proxy: 443"
+		label     = "yes"
+	)
+	for _, tkaVersion := range []string{"", "0.11.0"} {
+		t.Run(tkaVersion, func(t *testing.T) {
+			data, err := GetConfigmapDataFromTemplate(token, JoinMethodToken, proxyAddr, "kube", "", []string{RoleKube}, map[string]string{"a: b": label}, nil, DefaultValuesLayouts(), tkaVersion)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var values struct {
+				AuthToken string            `yaml:"authToken"`
+				ProxyAddr string            `yaml:"proxyAddr"`
+				Labels    map[string]string `yaml:"labels"`
+				Nested    struct {
+					AuthToken string            `yaml:"authToken"`
+					ProxyAddr string            `yaml:"proxyAddr"`
+					Labels    map[string]string `yaml:"labels"`
+				} `yaml:"teleport-kube-agent"`
+			}
+			if err := yaml.Unmarshal([]byte(data), &values); err != nil {
+				t.Fatalf("failed to parse values: %v\n%s", err, data)
+			}
+			if values.Nested.AuthToken != token || values.Nested.ProxyAddr != proxyAddr || values.Nested.Labels["a: b"] != label {
+				t.Fatalf("expected the nested values to read back unchanged, got:\n%s", data)
+			}
+			if !UsesNestedKubeAgentValues(tkaVersion) && (values.AuthToken != token || values.ProxyAddr != proxyAddr || values.Labels["a: b"] != label) {
+				t.Fatalf("expected the flat values to read back unchanged, got:\n%s", data)
+			}
+		})
+	}
+}
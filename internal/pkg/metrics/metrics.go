@@ -0,0 +1,240 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	namespace = "teleport_operator"
+
+	// TokenSourceSecret is the join token stored in the cluster's Secret.
+	TokenSourceSecret = "secret"
+	// TokenSourceConfigMap is the join token written to the
+	// teleport-kube-agent values ConfigMap.
+	TokenSourceConfigMap = "configmap"
+
+	// TokenReasonSuperseded is a join token replaced by a newer one for the
+	// same cluster.
+	TokenReasonSuperseded = "superseded"
+	// TokenReasonOrphaned is a join token of a cluster that no longer exists.
+	TokenReasonOrphaned = "orphaned"
+)
+
+var (
+	tokensGenerated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "join_tokens_generated_total",
+			Help:      "Number of Teleport join tokens generated, per role.",
+		},
+		[]string{"role"},
+	)
+	tokensRotated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "join_tokens_rotated_total",
+			Help:      "Number of expired or invalid Teleport join tokens replaced with a new one, per role.",
+		},
+		[]string{"role"},
+	)
+	tokensDeleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "join_tokens_deleted_total",
+			Help:      "Number of Teleport join tokens deleted, per role.",
+		},
+		[]string{"role"},
+	)
+	tokensCollected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "join_tokens_garbage_collected_total",
+			Help:      "Number of superseded or orphaned Teleport join tokens deleted by the token janitor, per reason. In dry-run mode, the tokens that would have been deleted.",
+		},
+		[]string{"reason", "dry_run"},
+	)
+
+	teleportRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "teleport_api_request_duration_seconds",
+			Help:      "Latency of Teleport API requests, per client method.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"method"},
+	)
+	teleportRequestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "teleport_api_request_errors_total",
+			Help:      "Number of failed Teleport API requests, per client method.",
+		},
+		[]string{"method"},
+	)
+
+	identityReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "teleport_identity_reconnects_total",
+			Help:      "Number of times the operator (re)connected to Teleport with the tbot identity, by result.",
+		},
+		[]string{"result"},
+	)
+
+	identityCertificateExpiry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "teleport_identity_certificate_expiry_timestamp_seconds",
+			Help:      "Unix time at which the TLS certificate of the current tbot identity expires.",
+		},
+	)
+
+	tokenExpiry = newTokenExpiryCollector()
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(
+		tokensGenerated,
+		tokensRotated,
+		tokensDeleted,
+		tokensCollected,
+		teleportRequestDuration,
+		teleportRequestErrors,
+		identityReconnects,
+		identityCertificateExpiry,
+		tokenExpiry,
+	)
+}
+
+// TokenGenerated counts a newly generated join token once for each of its
+// roles.
+func TokenGenerated(roles []string) {
+	for _, role := range roles {
+		tokensGenerated.WithLabelValues(strings.ToLower(role)).Inc()
+	}
+}
+
+// TokenRotated counts a join token that replaced an expired or invalid one.
+func TokenRotated(roles []string) {
+	for _, role := range roles {
+		tokensRotated.WithLabelValues(strings.ToLower(role)).Inc()
+	}
+}
+
+// TokenDeleted counts a join token deleted from Teleport.
+func TokenDeleted(roles []string) {
+	for _, role := range roles {
+		tokensDeleted.WithLabelValues(strings.ToLower(role)).Inc()
+	}
+}
+
+// TokenCollected counts a join token the token janitor deleted, or would
+// have deleted in dry-run mode, for the given reason.
+func TokenCollected(reason string, dryRun bool) {
+	tokensCollected.WithLabelValues(reason, strconv.FormatBool(dryRun)).Inc()
+}
+
+// ObserveTeleportRequest records the latency and outcome of a Teleport API
+// request started at start.
+func ObserveTeleportRequest(method string, start time.Time, err error) {
+	teleportRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		teleportRequestErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// IdentityReconnected counts an attempt to connect to Teleport with a freshly
+// read identity.
+func IdentityReconnected(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	identityReconnects.WithLabelValues(result).Inc()
+}
+
+// SetIdentityCertificateExpiry records when the certificate of the identity
+// the operator is connected with expires.
+func SetIdentityCertificateExpiry(expiry time.Time) {
+	identityCertificateExpiry.Set(float64(expiry.Unix()))
+}
+
+// SetTokenExpiry records when the join token of the given source for a
+// cluster expires. A zero expiry removes the series.
+func SetTokenExpiry(clusterNamespace, clusterName, source string, expiry time.Time) {
+	tokenExpiry.set(tokenExpiryKey{namespace: clusterNamespace, cluster: clusterName, source: source}, expiry)
+}
+
+// DeleteTokenExpiry removes all join token expiry series of a cluster.
+func DeleteTokenExpiry(clusterNamespace, clusterName string) {
+	tokenExpiry.deleteCluster(clusterNamespace, clusterName)
+}
+
+type tokenExpiryKey struct {
+	namespace string
+	cluster   string
+	source    string
+}
+
+// tokenExpiryCollector reports the seconds until each cluster's join tokens
+// expire. The value is computed at scrape time rather than on reconcile, so
+// it keeps counting down when reconciles for a cluster stop succeeding.
+type tokenExpiryCollector struct {
+	desc *prometheus.Desc
+	now  func() time.Time
+
+	mu      sync.RWMutex
+	expires map[tokenExpiryKey]time.Time
+}
+
+func newTokenExpiryCollector() *tokenExpiryCollector {
+	return &tokenExpiryCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "join_token_expiry_seconds"),
+			"Seconds until the current join token of a cluster expires, per token source (secret or configmap).",
+			[]string{"cluster_namespace", "cluster", "source"},
+			nil,
+		),
+		now:     time.Now,
+		expires: map[tokenExpiryKey]time.Time{},
+	}
+}
+
+func (c *tokenExpiryCollector) set(k tokenExpiryKey, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if expiry.IsZero() {
+		delete(c.expires, k)
+		return
+	}
+	c.expires[k] = expiry
+}
+
+func (c *tokenExpiryCollector) deleteCluster(clusterNamespace, clusterName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.expires {
+		if k.namespace == clusterNamespace && k.cluster == clusterName {
+			delete(c.expires, k)
+		}
+	}
+}
+
+func (c *tokenExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *tokenExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := c.now()
+	for k, expiry := range c.expires {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, expiry.Sub(now).Seconds(), k.namespace, k.cluster, k.source)
+	}
+}
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func collect(t *testing.T, c prometheus.Collector) []*dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 16)
+	c.Collect(ch)
+	close(ch)
+
+	var result []*dto.Metric
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatalf("failed to write metric: %v", err)
+		}
+		result = append(result, pb)
+	}
+	return result
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func Test_TokenExpiryCollector(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newTokenExpiryCollector()
+	c.now = func() time.Time { return now }
+
+	c.set(tokenExpiryKey{namespace: "org-a", cluster: "one", source: TokenSourceSecret}, now.Add(time.Hour))
+	c.set(tokenExpiryKey{namespace: "org-a", cluster: "one", source: TokenSourceConfigMap}, now.Add(-time.Minute))
+	c.set(tokenExpiryKey{namespace: "org-a", cluster: "two", source: TokenSourceSecret}, now.Add(time.Hour))
+
+	values := map[string]float64{}
+	for _, m := range collect(t, c) {
+		values[labelValue(m, "cluster")+"/"+labelValue(m, "source")] = m.GetGauge().GetValue()
+	}
+	expected := map[string]float64{
+		"one/secret":    3600,
+		"one/configmap": -60,
+		"two/secret":    3600,
+	}
+	if len(values) != len(expected) {
+		t.Fatalf("expected %v, actual %v", expected, values)
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Fatalf("expected %s to be %v, actual %v", k, v, values[k])
+		}
+	}
+
+	// The gauge counts down between scrapes without any further updates.
+	now = now.Add(30 * time.Minute)
+	c.deleteCluster("org-a", "one")
+	metrics := collect(t, c)
+	if len(metrics) != 1 || metrics[0].GetGauge().GetValue() != 1800 {
+		t.Fatalf("expected only cluster two with 1800s left, actual %v", metrics)
+	}
+
+	c.set(tokenExpiryKey{namespace: "org-a", cluster: "two", source: TokenSourceSecret}, time.Time{})
+	if metrics := collect(t, c); len(metrics) != 0 {
+		t.Fatalf("expected zero expiry to remove the series, actual %v", metrics)
+	}
+}
+
+func Test_ObserveTeleportRequest(t *testing.T) {
+	errorsBefore := counterValue(t, teleportRequestErrors.WithLabelValues("TestMethod"))
+
+	ObserveTeleportRequest("TestMethod", time.Now(), nil)
+	ObserveTeleportRequest("TestMethod", time.Now(), errors.New("failed"))
+
+	if actual := counterValue(t, teleportRequestErrors.WithLabelValues("TestMethod")) - errorsBefore; actual != 1 {
+		t.Fatalf("expected 1 error to be counted, actual %v", actual)
+	}
+
+	histogram := &dto.Metric{}
+	if err := teleportRequestDuration.WithLabelValues("TestMethod").(prometheus.Metric).Write(histogram); err != nil {
+		t.Fatalf("failed to write metric: %v", err)
+	}
+	if histogram.GetHistogram().GetSampleCount() != 2 {
+		t.Fatalf("expected 2 observations, actual %d", histogram.GetHistogram().GetSampleCount())
+	}
+}
+
+func Test_TokenGenerated(t *testing.T) {
+	kubeBefore := counterValue(t, tokensGenerated.WithLabelValues("kube"))
+	appBefore := counterValue(t, tokensGenerated.WithLabelValues("app"))
+
+	TokenGenerated([]string{"kube", "app"})
+
+	if actual := counterValue(t, tokensGenerated.WithLabelValues("kube")) - kubeBefore; actual != 1 {
+		t.Fatalf("expected kube token to be counted once, actual %v", actual)
+	}
+	if actual := counterValue(t, tokensGenerated.WithLabelValues("app")) - appBefore; actual != 1 {
+		t.Fatalf("expected app token to be counted once, actual %v", actual)
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatalf("failed to write metric: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
@@ -1 +1,210 @@
 package teleport
+
+import (
+	"context"
+
+	"github.com/giantswarm/apiextensions-application/api/v1alpha1"
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+// helmReleaseInterval is how often Flux reconciles a managed HelmRelease.
+const helmReleaseInterval = "10m"
+
+// KubeAgentAppChange describes what EnsureKubeAgentApp changed.
+type KubeAgentAppChange struct {
+	// Created is set if the resource was created.
+	Created bool
+	// Upgraded is set if the catalog or version of the resource changed.
+	Upgraded bool
+	// PreviousVersion is the version an upgraded resource had before.
+	PreviousVersion string
+}
+
+// EnsureKubeAgentApp creates the App CR or HelmRelease deploying
+// teleport-kube-agent to the cluster, of the kind and with the name in
+// settings, from the configured catalog and version. A resource the operator
+// created is upgraded when the configured catalog or version changes, any
+// other resource of that name is left alone. Values are referenced
+// separately, see NewTeleportAppConfigManager.
+func (t *Teleport) EnsureKubeAgentApp(ctx context.Context, log logr.Logger, ctrlClient client.Client, cluster *capi.Cluster, settings *ClusterSettings) (*KubeAgentAppChange, error) {
+	cfg := t.Config()
+	if cfg.AppCatalog == "" || cfg.AppVersion == "" {
+		return nil, microerror.Maskf(invalidConfigError, "%q and %q must be set to manage the kube agent app", key.AppCatalog, key.AppVersion)
+	}
+
+	if settings.AgentAppKind == key.AgentAppKindHelmRelease {
+		return t.ensureKubeAgentHelmRelease(ctx, log, ctrlClient, cluster, settings)
+	}
+	return t.ensureKubeAgentAppCR(ctx, log, ctrlClient, cluster, settings)
+}
+
+func (t *Teleport) ensureKubeAgentAppCR(ctx context.Context, log logr.Logger, ctrlClient client.Client, cluster *capi.Cluster, settings *ClusterSettings) (*KubeAgentAppChange, error) {
+	cfg := t.Config()
+
+	app := &v1alpha1.App{}
+	err := ctrlClient.Get(ctx, client.ObjectKey{Name: settings.AgentAppName, Namespace: cluster.Namespace}, app)
+	if apierrors.IsNotFound(err) {
+		app = &v1alpha1.App{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      settings.AgentAppName,
+				Namespace: cluster.Namespace,
+				Labels:    kubeAgentAppLabels(cluster, key.AgentAppKindApp),
+			},
+			Spec: v1alpha1.AppSpec{
+				Catalog:   cfg.AppCatalog,
+				Name:      cfg.AppName,
+				Namespace: key.TeleportKubeAppNamespace,
+				Version:   cfg.AppVersion,
+				KubeConfig: v1alpha1.AppSpecKubeConfig{
+					InCluster: false,
+					Secret: v1alpha1.AppSpecKubeConfigSecret{
+						Name:      key.GetAppSpecKubeConfigSecretName(cluster.Name),
+						Namespace: cluster.Namespace,
+					},
+				},
+			},
+		}
+		if err := ctrlClient.Create(ctx, app); err != nil {
+			return nil, microerror.Mask(err)
+		}
+		log.Info("Created kube agent App", "app", app.Name, "version", cfg.AppVersion)
+		return &KubeAgentAppChange{Created: true}, nil
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	if !isManagedKubeAgentApp(app) {
+		log.Info("Kube agent App is not managed by the operator, skipping upgrade", "app", app.Name)
+		return &KubeAgentAppChange{}, nil
+	}
+	if app.Spec.Catalog == cfg.AppCatalog && app.Spec.Version == cfg.AppVersion {
+		return &KubeAgentAppChange{}, nil
+	}
+
+	change := &KubeAgentAppChange{Upgraded: true, PreviousVersion: app.Spec.Version}
+	app.Spec.Catalog = cfg.AppCatalog
+	app.Spec.Version = cfg.AppVersion
+	if err := ctrlClient.Update(ctx, app); err != nil {
+		return nil, microerror.Mask(err)
+	}
+	log.Info("Upgraded kube agent App", "app", app.Name, "from", change.PreviousVersion, "to", cfg.AppVersion)
+	return change, nil
+}
+
+func (t *Teleport) ensureKubeAgentHelmRelease(ctx context.Context, log logr.Logger, ctrlClient client.Client, cluster *capi.Cluster, settings *ClusterSettings) (*KubeAgentAppChange, error) {
+	cfg := t.Config()
+
+	hr := newHelmReleaseUnstructured()
+	err := ctrlClient.Get(ctx, client.ObjectKey{Name: settings.AgentAppName, Namespace: cluster.Namespace}, hr)
+	if apierrors.IsNotFound(err) {
+		hr = newHelmReleaseUnstructured()
+		hr.SetName(settings.AgentAppName)
+		hr.SetNamespace(cluster.Namespace)
+		hr.SetLabels(kubeAgentAppLabels(cluster, key.AgentAppKindHelmRelease))
+		hr.Object["spec"] = map[string]interface{}{
+			"interval":         helmReleaseInterval,
+			"releaseName":      cfg.AppName,
+			"targetNamespace":  key.TeleportKubeAppNamespace,
+			"storageNamespace": key.TeleportKubeAppNamespace,
+			"kubeConfig": map[string]interface{}{
+				"secretRef": map[string]interface{}{
+					"name": key.GetAppSpecKubeConfigSecretName(cluster.Name),
+					"key":  "value",
+				},
+			},
+			"chart": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"chart":   cfg.AppName,
+					"version": cfg.AppVersion,
+					"sourceRef": map[string]interface{}{
+						"kind": "HelmRepository",
+						"name": cfg.AppCatalog,
+					},
+				},
+			},
+		}
+		if err := ctrlClient.Create(ctx, hr); err != nil {
+			return nil, microerror.Mask(err)
+		}
+		log.Info("Created kube agent HelmRelease", "helmrelease", hr.GetName(), "version", cfg.AppVersion)
+		return &KubeAgentAppChange{Created: true}, nil
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	if !isManagedKubeAgentApp(hr) {
+		log.Info("Kube agent HelmRelease is not managed by the operator, skipping upgrade", "helmrelease", hr.GetName())
+		return &KubeAgentAppChange{}, nil
+	}
+	version := helmReleaseSpecChartVersion(hr)
+	catalog, _, _ := unstructured.NestedString(hr.Object, "spec", "chart", "spec", "sourceRef", "name")
+	if catalog == cfg.AppCatalog && version == cfg.AppVersion {
+		return &KubeAgentAppChange{}, nil
+	}
+
+	change := &KubeAgentAppChange{Upgraded: true, PreviousVersion: version}
+	if err := unstructured.SetNestedField(hr.Object, cfg.AppVersion, "spec", "chart", "spec", "version"); err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if err := unstructured.SetNestedField(hr.Object, cfg.AppCatalog, "spec", "chart", "spec", "sourceRef", "name"); err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if err := ctrlClient.Update(ctx, hr); err != nil {
+		return nil, microerror.Mask(err)
+	}
+	log.Info("Upgraded kube agent HelmRelease", "helmrelease", hr.GetName(), "from", version, "to", cfg.AppVersion)
+	return change, nil
+}
+
+// DeleteKubeAgentApp deletes the App CR or HelmRelease of the given kind
+// deploying teleport-kube-agent, if the operator created it. It reports
+// whether a resource was deleted.
+func (t *Teleport) DeleteKubeAgentApp(ctx context.Context, log logr.Logger, ctrlClient client.Client, name, namespace, kind string) (bool, error) {
+	var obj client.Object = &v1alpha1.App{}
+	if kind == key.AgentAppKindHelmRelease {
+		obj = newHelmReleaseUnstructured()
+	}
+
+	if err := ctrlClient.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, obj); apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, microerror.Mask(err)
+	}
+	if !isManagedKubeAgentApp(obj) {
+		return false, nil
+	}
+
+	if err := ctrlClient.Delete(ctx, obj); apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, microerror.Mask(err)
+	}
+	log.Info("Deleted kube agent "+kind, "name", name)
+	return true, nil
+}
+
+// kubeAgentAppLabels returns the labels of a kube agent resource the operator
+// creates. App CRs of workload clusters are reconciled by the management
+// cluster's app-operator.
+func kubeAgentAppLabels(cluster *capi.Cluster, kind string) map[string]string {
+	labels := map[string]string{
+		key.ManagedByLabel: key.TeleportOperatorLabelValue,
+		key.ClusterLabel:   cluster.Name,
+	}
+	if kind == key.AgentAppKindApp {
+		labels[key.AppOperatorVersionLabel] = key.AppOperatorVersion
+	}
+	return labels
+}
+
+func isManagedKubeAgentApp(obj client.Object) bool {
+	return obj.GetLabels()[key.ManagedByLabel] == key.TeleportOperatorLabelValue
+}
@@ -7,10 +7,15 @@ import (
 	"github.com/giantswarm/apiextensions-application/api/v1alpha1"
 	"github.com/giantswarm/microerror"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/events"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
 )
 
 var helmReleaseGVK = schema.GroupVersionKind{
@@ -118,14 +123,55 @@ func NewTeleportAppConfigManager(
 	namespace string,
 	configMapName string,
 ) (TeleportAppConfigManager, error) {
+	return NewTeleportAppConfigManagerWithEvents(ctx, ctrlClient, resourceName, namespace, configMapName, nil, nil)
+}
+
+// NewTeleportAppConfigManagerWithEvents is NewTeleportAppConfigManager with
+// an event emitted on regarding (usually the CAPI Cluster) whenever the
+// manager changes the HelmRelease or App CR. A nil recorder disables events.
+func NewTeleportAppConfigManagerWithEvents(
+	ctx context.Context,
+	ctrlClient client.Client,
+	resourceName string,
+	namespace string,
+	configMapName string,
+	recorder events.EventRecorder,
+	regarding runtime.Object,
+) (TeleportAppConfigManager, error) {
+	return NewTeleportAppConfigManagerWithSecret(ctx, ctrlClient, resourceName, namespace, configMapName, "", false, recorder, regarding)
+}
+
+// NewTeleportAppConfigManagerWithSecret is NewTeleportAppConfigManagerWithEvents
+// for values split between a ConfigMap and a Secret holding the sensitive
+// ones, which is referenced after the ConfigMap while referenceSecret is set,
+// and no longer referenced otherwise.
+func NewTeleportAppConfigManagerWithSecret(
+	ctx context.Context,
+	ctrlClient client.Client,
+	resourceName string,
+	namespace string,
+	configMapName string,
+	secretName string,
+	referenceSecret bool,
+	recorder events.EventRecorder,
+	regarding runtime.Object,
+) (TeleportAppConfigManager, error) {
+	eventer := appConfigEventer{recorder: recorder, regarding: regarding}
+	sources := valuesSources{
+		configMapName:   configMapName,
+		secretName:      secretName,
+		referenceSecret: referenceSecret,
+	}
+
 	hr := newHelmReleaseUnstructured()
 	err := ctrlClient.Get(ctx, client.ObjectKey{Name: resourceName, Namespace: namespace}, hr)
 	if err == nil {
 		return &helmReleaseTeleportAppConfigManager{
-			client:        ctrlClient,
-			resourceName:  resourceName,
-			namespace:     namespace,
-			configMapName: configMapName,
+			appConfigEventer: eventer,
+			valuesSources:    sources,
+			client:           ctrlClient,
+			resourceName:     resourceName,
+			namespace:        namespace,
 		}, nil
 	}
 	if !apierrors.IsNotFound(err) {
@@ -136,10 +182,11 @@ func NewTeleportAppConfigManager(
 	err = ctrlClient.Get(ctx, client.ObjectKey{Name: resourceName, Namespace: namespace}, app)
 	if err == nil {
 		return &appCRTeleportAppConfigManager{
-			client:        ctrlClient,
-			resourceName:  resourceName,
-			namespace:     namespace,
-			configMapName: configMapName,
+			appConfigEventer: eventer,
+			valuesSources:    sources,
+			client:           ctrlClient,
+			resourceName:     resourceName,
+			namespace:        namespace,
 		}, nil
 	}
 	if !apierrors.IsNotFound(err) {
@@ -152,13 +199,63 @@ func NewTeleportAppConfigManager(
 	}, nil
 }
 
+// IsNoOpTeleportAppConfigManager reports whether m was returned because
+// neither a HelmRelease nor an App CR exists for the resource, i.e. no
+// values reference can be injected yet.
+func IsNoOpTeleportAppConfigManager(m TeleportAppConfigManager) bool {
+	_, ok := m.(*noOpTeleportAppConfigManager)
+	return ok
+}
+
+// appConfigEventer emits events for the changes a TeleportAppConfigManager
+// makes. The zero value emits nothing.
+type appConfigEventer struct {
+	recorder  events.EventRecorder
+	regarding runtime.Object
+}
+
+func (e appConfigEventer) event(related runtime.Object, reason, action, note string, args ...interface{}) {
+	if e.recorder == nil || e.regarding == nil {
+		return
+	}
+	e.recorder.Eventf(e.regarding, related, corev1.EventTypeNormal, reason, action, note, args...)
+}
+
+// valuesSource is an object the values are read from.
+type valuesSource struct {
+	// kind is "ConfigMap" or "Secret".
+	kind string
+	name string
+	// referenced is whether the source must be referenced, or must not.
+	referenced bool
+}
+
+// valuesSources names the ConfigMap and, optionally, the Secret a
+// TeleportAppConfigManager references.
+type valuesSources struct {
+	configMapName   string
+	secretName      string
+	referenceSecret bool
+}
+
+// list returns the sources in the order they are referenced in, later ones
+// overriding earlier ones.
+func (s valuesSources) list() []valuesSource {
+	sources := []valuesSource{{kind: "ConfigMap", name: s.configMapName, referenced: true}}
+	if s.secretName != "" {
+		sources = append(sources, valuesSource{kind: "Secret", name: s.secretName, referenced: s.referenceSecret})
+	}
+	return sources
+}
+
 // --- HelmRelease implementation ---
 
 type helmReleaseTeleportAppConfigManager struct {
-	client        client.Client
-	resourceName  string
-	namespace     string
-	configMapName string
+	appConfigEventer
+	valuesSources
+	client       client.Client
+	resourceName string
+	namespace    string
 }
 
 func (m *helmReleaseTeleportAppConfigManager) EnsureConfig(ctx context.Context, log logr.Logger) error {
@@ -167,14 +264,15 @@ func (m *helmReleaseTeleportAppConfigManager) EnsureConfig(ctx context.Context,
 		return microerror.Mask(err)
 	}
 
-	desired := map[string]interface{}{
-		"kind":      "ConfigMap",
-		"name":      m.configMapName,
-		"valuesKey": "values",
-	}
-
 	before := getValuesFrom(hr)
-	updated := appendValuesReference(before, desired)
+	updated := before
+	for _, source := range m.list() {
+		if source.referenced {
+			updated = appendValuesReference(updated, helmReleaseValuesReference(source))
+		} else {
+			updated = removeValuesReference(updated, helmReleaseValuesReference(source))
+		}
+	}
 	if reflect.DeepEqual(before, updated) {
 		return nil
 	}
@@ -188,6 +286,7 @@ func (m *helmReleaseTeleportAppConfigManager) EnsureConfig(ctx context.Context,
 		}
 		return microerror.Mask(err)
 	}
+	m.changed(hr, before, updated)
 	return nil
 }
 
@@ -200,14 +299,11 @@ func (m *helmReleaseTeleportAppConfigManager) DeleteConfig(ctx context.Context,
 		return microerror.Mask(err)
 	}
 
-	desired := map[string]interface{}{
-		"kind":      "ConfigMap",
-		"name":      m.configMapName,
-		"valuesKey": "values",
-	}
-
 	before := getValuesFrom(hr)
-	updated := removeValuesReference(before, desired)
+	updated := before
+	for _, source := range m.list() {
+		updated = removeValuesReference(updated, helmReleaseValuesReference(source))
+	}
 	if reflect.DeepEqual(before, updated) {
 		return nil
 	}
@@ -221,9 +317,35 @@ func (m *helmReleaseTeleportAppConfigManager) DeleteConfig(ctx context.Context,
 		}
 		return microerror.Mask(err)
 	}
+	m.changed(hr, before, updated)
 	return nil
 }
 
+// changed emits an event for every source added to or removed from the
+// HelmRelease's valuesFrom.
+func (m *helmReleaseTeleportAppConfigManager) changed(hr *unstructured.Unstructured, before, after []interface{}) {
+	for _, source := range m.list() {
+		ref := helmReleaseValuesReference(source)
+		had, has := containsValuesReference(before, ref), containsValuesReference(after, ref)
+		switch {
+		case has && !had:
+			m.event(hr, key.HelmReleaseValuesFromPatchedEventReason, "PatchHelmRelease",
+				"Added %s %s to valuesFrom of HelmRelease %s/%s", source.kind, source.name, m.namespace, m.resourceName)
+		case had && !has:
+			m.event(hr, key.HelmReleaseValuesFromRemovedEventReason, "PatchHelmRelease",
+				"Removed %s %s from valuesFrom of HelmRelease %s/%s", source.kind, source.name, m.namespace, m.resourceName)
+		}
+	}
+}
+
+func helmReleaseValuesReference(source valuesSource) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":      source.kind,
+		"name":      source.name,
+		"valuesKey": "values",
+	}
+}
+
 func getValuesFrom(hr *unstructured.Unstructured) []interface{} {
 	spec, ok := hr.Object["spec"].(map[string]interface{})
 	if !ok {
@@ -245,12 +367,19 @@ func setValuesFrom(hr *unstructured.Unstructured, valuesFrom []interface{}) {
 	spec["valuesFrom"] = valuesFrom
 }
 
-func appendValuesReference(refs []interface{}, ref map[string]interface{}) []interface{} {
+func containsValuesReference(refs []interface{}, ref map[string]interface{}) bool {
 	for _, existing := range refs {
 		if reflect.DeepEqual(existing, ref) {
-			return refs
+			return true
 		}
 	}
+	return false
+}
+
+func appendValuesReference(refs []interface{}, ref map[string]interface{}) []interface{} {
+	if containsValuesReference(refs, ref) {
+		return refs
+	}
 	return append(refs, ref)
 }
 
@@ -266,11 +395,19 @@ func removeValuesReference(refs []interface{}, ref map[string]interface{}) []int
 
 // --- App CR implementation ---
 
+// appExtraConfigKinds maps the kinds of values sources to the kinds App
+// extraConfigs name them by.
+var appExtraConfigKinds = map[string]string{
+	"ConfigMap": "configMap",
+	"Secret":    "secret",
+}
+
 type appCRTeleportAppConfigManager struct {
-	client        client.Client
-	resourceName  string
-	namespace     string
-	configMapName string
+	appConfigEventer
+	valuesSources
+	client       client.Client
+	resourceName string
+	namespace    string
 }
 
 func (m *appCRTeleportAppConfigManager) EnsureConfig(ctx context.Context, log logr.Logger) error {
@@ -279,18 +416,19 @@ func (m *appCRTeleportAppConfigManager) EnsureConfig(ctx context.Context, log lo
 		return microerror.Mask(err)
 	}
 
-	desired := v1alpha1.AppExtraConfig{
-		Kind:      "configMap",
-		Name:      m.configMapName,
-		Namespace: m.namespace,
-		Priority:  25,
-	}
-
 	before := app.Spec.ExtraConfigs
-	app.Spec.ExtraConfigs = appendExtraConfig(before, desired)
-	if reflect.DeepEqual(before, app.Spec.ExtraConfigs) {
+	updated := before
+	for _, source := range m.list() {
+		if source.referenced {
+			updated = appendExtraConfig(updated, m.extraConfig(source))
+		} else {
+			updated = removeExtraConfig(updated, m.extraConfig(source))
+		}
+	}
+	if reflect.DeepEqual(before, updated) {
 		return nil
 	}
+	app.Spec.ExtraConfigs = updated
 
 	log.Info("Updating App ExtraConfigs", "app", m.resourceName, "configMap", m.configMapName)
 	if err := m.client.Update(ctx, app); err != nil {
@@ -299,6 +437,7 @@ func (m *appCRTeleportAppConfigManager) EnsureConfig(ctx context.Context, log lo
 		}
 		return microerror.Mask(err)
 	}
+	m.changed(app, before, updated)
 	return nil
 }
 
@@ -315,18 +454,15 @@ func (m *appCRTeleportAppConfigManager) DeleteConfig(ctx context.Context, log lo
 		return nil
 	}
 
-	desired := v1alpha1.AppExtraConfig{
-		Kind:      "configMap",
-		Name:      m.configMapName,
-		Namespace: m.namespace,
-		Priority:  25,
-	}
-
 	before := app.Spec.ExtraConfigs
-	app.Spec.ExtraConfigs = removeExtraConfig(before, desired)
-	if reflect.DeepEqual(before, app.Spec.ExtraConfigs) {
+	updated := before
+	for _, source := range m.list() {
+		updated = removeExtraConfig(updated, m.extraConfig(source))
+	}
+	if reflect.DeepEqual(before, updated) {
 		return nil
 	}
+	app.Spec.ExtraConfigs = updated
 
 	log.Info("Removing App ExtraConfigs entry", "app", m.resourceName, "configMap", m.configMapName)
 	if err := m.client.Update(ctx, app); err != nil {
@@ -335,15 +471,49 @@ func (m *appCRTeleportAppConfigManager) DeleteConfig(ctx context.Context, log lo
 		}
 		return microerror.Mask(err)
 	}
+	m.changed(app, before, updated)
 	return nil
 }
 
-func appendExtraConfig(configs []v1alpha1.AppExtraConfig, config v1alpha1.AppExtraConfig) []v1alpha1.AppExtraConfig {
+func (m *appCRTeleportAppConfigManager) extraConfig(source valuesSource) v1alpha1.AppExtraConfig {
+	return v1alpha1.AppExtraConfig{
+		Kind:      appExtraConfigKinds[source.kind],
+		Name:      source.name,
+		Namespace: m.namespace,
+		Priority:  25,
+	}
+}
+
+// changed emits an event for every source added to or removed from the App's
+// extraConfigs.
+func (m *appCRTeleportAppConfigManager) changed(app *v1alpha1.App, before, after []v1alpha1.AppExtraConfig) {
+	for _, source := range m.list() {
+		config := m.extraConfig(source)
+		had, has := containsExtraConfig(before, config), containsExtraConfig(after, config)
+		switch {
+		case has && !had:
+			m.event(app, key.AppExtraConfigsPatchedEventReason, "PatchApp",
+				"Added %s %s to extraConfigs of App %s/%s", source.kind, source.name, m.namespace, m.resourceName)
+		case had && !has:
+			m.event(app, key.AppExtraConfigsRemovedEventReason, "PatchApp",
+				"Removed %s %s from extraConfigs of App %s/%s", source.kind, source.name, m.namespace, m.resourceName)
+		}
+	}
+}
+
+func containsExtraConfig(configs []v1alpha1.AppExtraConfig, config v1alpha1.AppExtraConfig) bool {
 	for _, existing := range configs {
 		if reflect.DeepEqual(existing, config) {
-			return configs
+			return true
 		}
 	}
+	return false
+}
+
+func appendExtraConfig(configs []v1alpha1.AppExtraConfig, config v1alpha1.AppExtraConfig) []v1alpha1.AppExtraConfig {
+	if containsExtraConfig(configs, config) {
+		return configs
+	}
 	return append(configs, config)
 }
 
@@ -2,10 +2,14 @@ package teleport
 
 import (
 	"context"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	appv1alpha1 "github.com/giantswarm/apiextensions-application/api/v1alpha1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/events"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -16,6 +20,7 @@ const (
 	testResourceName  = "test-resource"
 	testNamespace     = "test-namespace"
 	testConfigMapName = "test-configmap"
+	testSecretName    = "test-secret"
 )
 
 func Test_NewTeleportAppConfigManager_NoResource(t *testing.T) {
@@ -173,6 +178,38 @@ func Test_HelmRelease_EnsureConfig_Idempotent(t *testing.T) {
 	}
 }
 
+func Test_HelmRelease_EnsureConfig_EmitsEventOnlyOnChange(t *testing.T) {
+	hr := test.NewHelmRelease(testResourceName, testNamespace)
+	fakeClient, err := test.NewFakeK8sClientFromObjects(hr)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	recorder := events.NewFakeRecorder(10)
+	cluster := test.NewCluster(test.ClusterName, testNamespace, nil, time.Time{})
+	mgr, err := NewTeleportAppConfigManagerWithEvents(context.Background(), fakeClient, testResourceName, testNamespace, testConfigMapName, recorder, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	log := ctrl.Log.WithName("test")
+	for i := 0; i < 2; i++ {
+		if err := mgr.EnsureConfig(context.Background(), log); err != nil {
+			t.Fatalf("EnsureConfig returned error: %v", err)
+		}
+	}
+
+	close(recorder.Events)
+	var actual []string
+	for event := range recorder.Events {
+		actual = append(actual, event)
+	}
+	expected := "Normal HelmReleaseValuesFromPatched Added ConfigMap test-configmap to valuesFrom of HelmRelease test-namespace/test-resource"
+	if len(actual) != 1 || actual[0] != expected {
+		t.Fatalf("expected single event %q, got %q", expected, actual)
+	}
+}
+
 func Test_HelmRelease_DeleteConfig_RemovesEntry(t *testing.T) {
 	hr := test.NewHelmRelease(testResourceName, testNamespace)
 	hr.Object["spec"] = map[string]interface{}{
@@ -356,6 +393,91 @@ func Test_AppCR_DeleteConfig_NoOp_WhenEntryAbsent(t *testing.T) {
 	}
 }
 
+func Test_HelmRelease_EnsureConfig_ReferencesSecretWhileRequested(t *testing.T) {
+	hr := test.NewHelmRelease(testResourceName, testNamespace)
+	fakeClient, err := test.NewFakeK8sClientFromObjects(hr)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	recorder := events.NewFakeRecorder(10)
+	cluster := test.NewCluster(test.ClusterName, testNamespace, nil, time.Time{})
+	log := ctrl.Log.WithName("test")
+	for _, referenceSecret := range []bool{true, false} {
+		mgr, err := NewTeleportAppConfigManagerWithSecret(context.Background(), fakeClient, testResourceName, testNamespace, testConfigMapName, testSecretName, referenceSecret, recorder, cluster)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := mgr.EnsureConfig(context.Background(), log); err != nil {
+			t.Fatalf("EnsureConfig returned error: %v", err)
+		}
+
+		updated := newHelmReleaseUnstructured()
+		if err := fakeClient.Get(context.Background(), client.ObjectKey{Name: testResourceName, Namespace: testNamespace}, updated); err != nil {
+			t.Fatalf("failed to get HelmRelease: %v", err)
+		}
+		var kinds []string
+		for _, entry := range getValuesFrom(updated) {
+			ref := entry.(map[string]interface{})
+			kinds = append(kinds, ref["kind"].(string)+"/"+ref["name"].(string))
+		}
+		expected := []string{"ConfigMap/" + testConfigMapName}
+		if referenceSecret {
+			expected = append(expected, "Secret/"+testSecretName)
+		}
+		if strings.Join(kinds, ",") != strings.Join(expected, ",") {
+			t.Fatalf("referenceSecret %t: expected ValuesFrom %v, got %v", referenceSecret, expected, kinds)
+		}
+	}
+
+	close(recorder.Events)
+	var actual []string
+	for event := range recorder.Events {
+		actual = append(actual, event)
+	}
+	expected := []string{
+		"Normal HelmReleaseValuesFromPatched Added ConfigMap test-configmap to valuesFrom of HelmRelease test-namespace/test-resource",
+		"Normal HelmReleaseValuesFromPatched Added Secret test-secret to valuesFrom of HelmRelease test-namespace/test-resource",
+		"Normal HelmReleaseValuesFromRemoved Removed Secret test-secret from valuesFrom of HelmRelease test-namespace/test-resource",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected events %q, got %q", expected, actual)
+	}
+}
+
+func Test_AppCR_EnsureConfig_ReferencesSecretWhileRequested(t *testing.T) {
+	app := test.NewApp(testResourceName, testNamespace)
+	fakeClient, err := test.NewFakeK8sClientFromObjects(app)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	log := ctrl.Log.WithName("test")
+	for _, referenceSecret := range []bool{true, false} {
+		mgr, err := NewTeleportAppConfigManagerWithSecret(context.Background(), fakeClient, testResourceName, testNamespace, testConfigMapName, testSecretName, referenceSecret, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := mgr.EnsureConfig(context.Background(), log); err != nil {
+			t.Fatalf("EnsureConfig returned error: %v", err)
+		}
+
+		updated := &appv1alpha1.App{}
+		if err := fakeClient.Get(context.Background(), client.ObjectKey{Name: testResourceName, Namespace: testNamespace}, updated); err != nil {
+			t.Fatalf("failed to get App: %v", err)
+		}
+		expected := []appv1alpha1.AppExtraConfig{
+			{Kind: "configMap", Name: testConfigMapName, Namespace: testNamespace, Priority: 25},
+		}
+		if referenceSecret {
+			expected = append(expected, appv1alpha1.AppExtraConfig{Kind: "secret", Name: testSecretName, Namespace: testNamespace, Priority: 25})
+		}
+		if !reflect.DeepEqual(updated.Spec.ExtraConfigs, expected) {
+			t.Fatalf("referenceSecret %t: expected ExtraConfigs %+v, got %+v", referenceSecret, expected, updated.Spec.ExtraConfigs)
+		}
+	}
+}
+
 func Test_GetTeleportKubeAgentVersion_NoResource(t *testing.T) {
 	fakeClient, err := test.NewFakeK8sClientFromObjects()
 	if err != nil {
@@ -0,0 +1,157 @@
+package teleport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appv1alpha1 "github.com/giantswarm/apiextensions-application/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_EnsureKubeAgentApp(t *testing.T) {
+	appName := key.GetAppName(test.ClusterName, test.AppName)
+	managedApp := func(version string) *appv1alpha1.App {
+		app := test.NewApp(appName, test.NamespaceName)
+		app.Labels = map[string]string{key.ManagedByLabel: key.TeleportOperatorLabelValue}
+		app.Spec.Catalog = test.AppCatalog
+		app.Spec.Version = version
+		return app
+	}
+
+	testCases := []struct {
+		name            string
+		objects         []client.Object
+		kind            string
+		expectedChange  KubeAgentAppChange
+		expectedVersion string
+	}{
+		{
+			name:            "case 0: Create the App CR",
+			kind:            key.AgentAppKindApp,
+			expectedChange:  KubeAgentAppChange{Created: true},
+			expectedVersion: "1.2.0",
+		},
+		{
+			name:            "case 1: Upgrade a managed App CR",
+			objects:         []client.Object{managedApp("1.1.0")},
+			kind:            key.AgentAppKindApp,
+			expectedChange:  KubeAgentAppChange{Upgraded: true, PreviousVersion: "1.1.0"},
+			expectedVersion: "1.2.0",
+		},
+		{
+			name:            "case 2: Keep an App CR at the configured version",
+			objects:         []client.Object{managedApp("1.2.0")},
+			kind:            key.AgentAppKindApp,
+			expectedVersion: "1.2.0",
+		},
+		{
+			name:            "case 3: Leave an App CR not managed by the operator alone",
+			objects:         []client.Object{tkaApp(appName, "1.1.0")},
+			kind:            key.AgentAppKindApp,
+			expectedVersion: "1.1.0",
+		},
+		{
+			name:            "case 4: Create the HelmRelease",
+			kind:            key.AgentAppKindHelmRelease,
+			expectedChange:  KubeAgentAppChange{Created: true},
+			expectedVersion: "1.2.0",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient, err := test.NewFakeK8sClientFromObjects(tc.objects...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			ctx := context.TODO()
+			tele := New(test.NamespaceName, &config.Config{AppCatalog: test.AppCatalog, AppName: test.AppName, AppVersion: "1.2.0"}, nil)
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, nil, time.Time{})
+			settings := &ClusterSettings{AgentAppName: appName, AgentAppKind: tc.kind}
+
+			change, err := tele.EnsureKubeAgentApp(ctx, ctrl.Log.WithName("test"), fakeClient, cluster, settings)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *change != tc.expectedChange {
+				t.Fatalf("expected change %+v, actual %+v", tc.expectedChange, *change)
+			}
+
+			version, err := GetTeleportKubeAgentVersion(ctx, fakeClient, appName, test.NamespaceName)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if version != tc.expectedVersion {
+				t.Fatalf("expected version %q, actual %q", tc.expectedVersion, version)
+			}
+		})
+	}
+}
+
+func Test_EnsureKubeAgentApp_HelmReleaseSpec(t *testing.T) {
+	fakeClient, err := test.NewFakeK8sClientFromObjects()
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	ctx := context.TODO()
+	tele := New(test.NamespaceName, &config.Config{AppCatalog: test.AppCatalog, AppName: test.AppName, AppVersion: "1.2.0"}, nil)
+	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, nil, time.Time{})
+	settings := &ClusterSettings{AgentAppName: testResourceName, AgentAppKind: key.AgentAppKindHelmRelease}
+	if _, err := tele.EnsureKubeAgentApp(ctx, ctrl.Log.WithName("test"), fakeClient, cluster, settings); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	hr := newHelmReleaseUnstructured()
+	if err := fakeClient.Get(ctx, client.ObjectKey{Name: testResourceName, Namespace: test.NamespaceName}, hr); err != nil {
+		t.Fatalf("failed to get HelmRelease: %v", err)
+	}
+	for expected, fields := range map[string][]string{
+		test.AppCatalog: {"spec", "chart", "spec", "sourceRef", "name"},
+		test.AppName:    {"spec", "chart", "spec", "chart"},
+		key.GetAppSpecKubeConfigSecretName(test.ClusterName): {"spec", "kubeConfig", "secretRef", "name"},
+	} {
+		if actual, _, _ := unstructured.NestedString(hr.Object, fields...); actual != expected {
+			t.Fatalf("expected %v to be %q, actual %q", fields, expected, actual)
+		}
+	}
+	if hr.GetLabels()[key.ManagedByLabel] != key.TeleportOperatorLabelValue {
+		t.Fatalf("expected the HelmRelease to be labelled as managed, actual labels %v", hr.GetLabels())
+	}
+}
+
+func Test_DeleteKubeAgentApp(t *testing.T) {
+	managed := test.NewApp("managed", test.NamespaceName)
+	managed.Labels = map[string]string{key.ManagedByLabel: key.TeleportOperatorLabelValue}
+	fakeClient, err := test.NewFakeK8sClientFromObjects(managed, test.NewApp("unmanaged", test.NamespaceName))
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	ctx := context.TODO()
+	log := ctrl.Log.WithName("test")
+	tele := New(test.NamespaceName, &config.Config{}, nil)
+	for name, expected := range map[string]bool{"managed": true, "unmanaged": false, "missing": false} {
+		deleted, err := tele.DeleteKubeAgentApp(ctx, log, fakeClient, name, test.NamespaceName, key.AgentAppKindApp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if deleted != expected {
+			t.Fatalf("expected App %s deleted to be %t, actual %t", name, expected, deleted)
+		}
+	}
+}
+
+func tkaApp(name, version string) *appv1alpha1.App {
+	app := test.NewApp(name, test.NamespaceName)
+	app.Spec.Version = version
+	return app
+}
@@ -18,6 +18,7 @@ type Client interface {
 	CreateToken(ctx context.Context, token types.ProvisionToken) error
 	UpsertToken(ctx context.Context, token types.ProvisionToken) error
 	DeleteToken(ctx context.Context, name string) error
+	GetKubernetesServers(ctx context.Context) ([]types.KubeServer, error)
 }
 
 var NewClient = func(ctx context.Context, proxyAddr, identityFile string) (Client, error) {
@@ -36,10 +37,12 @@ var NewClient = func(ctx context.Context, proxyAddr, identityFile string) (Clien
 		return nil, microerror.Mask(err)
 	}
 
-	_, err = teleportClient.Ping(ctx)
+	client := NewInstrumentedClient(teleportClient)
+	_, err = client.Ping(ctx)
 	if err != nil {
+		_ = teleportClient.Close()
 		return nil, microerror.Mask(err)
 	}
 
-	return teleportClient, nil
+	return client, nil
 }
@@ -0,0 +1,290 @@
+package teleport
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/metrics"
+)
+
+const (
+	DefaultPingInterval = 1 * time.Minute
+	DefaultMinBackoff   = 1 * time.Second
+	DefaultMaxBackoff   = 2 * time.Minute
+	// DefaultCloseGracePeriod is how long a replaced client stays open for
+	// the reconcilers that got it from Client before it was replaced.
+	DefaultCloseGracePeriod = 1 * time.Minute
+)
+
+// ClientProvider owns the connection to Teleport. It is a manager Runnable:
+// Start keeps the client connected with the current tbot identity and proxy
+// address, pings it periodically and reconnects with exponential backoff when
+// that fails. Reconcilers only ever read the client through Client, so any
+// number of them may run concurrently while the connection is replaced: a
+// replaced client is only closed after CloseGracePeriod, once the calls of
+// the reconcilers still holding it are done.
+type ClientProvider struct {
+	Log              logr.Logger
+	PingInterval     time.Duration
+	MinBackoff       time.Duration
+	MaxBackoff       time.Duration
+	CloseGracePeriod time.Duration
+
+	loadIdentity func(ctx context.Context) (*config.IdentityConfig, error)
+	proxyAddr    func() string
+	refresh      chan struct{}
+
+	// syncMu serializes Sync so the periodic loop and explicit triggers
+	// never connect concurrently.
+	syncMu sync.Mutex
+
+	mu        sync.RWMutex
+	client    Client
+	identity  *config.IdentityConfig
+	connected string
+	// serverVersion is kept across reconnects to the same proxy address;
+	// pinged is the client that reported it.
+	serverVersion      string
+	serverVersionKnown bool
+	pinged             Client
+	lastErr            error
+}
+
+// NewClientProvider returns a ClientProvider that connects to the proxy
+// address returned by proxyAddr with the identity returned by loadIdentity.
+func NewClientProvider(loadIdentity func(ctx context.Context) (*config.IdentityConfig, error), proxyAddr func() string) *ClientProvider {
+	return &ClientProvider{
+		Log:              logr.Discard(),
+		PingInterval:     DefaultPingInterval,
+		MinBackoff:       DefaultMinBackoff,
+		MaxBackoff:       DefaultMaxBackoff,
+		CloseGracePeriod: DefaultCloseGracePeriod,
+		loadIdentity:     loadIdentity,
+		proxyAddr:        proxyAddr,
+		refresh:          make(chan struct{}, 1),
+	}
+}
+
+// Start implements manager.Runnable. It returns once ctx is cancelled,
+// closing the current client.
+func (p *ClientProvider) Start(ctx context.Context) error {
+	backoff := p.MinBackoff
+	for {
+		wait := p.PingInterval
+		if err := p.Sync(ctx); err != nil {
+			p.Log.Error(err, "Failed to connect to Teleport", "retryIn", backoff)
+			wait = backoff
+			backoff = min(2*backoff, p.MaxBackoff)
+		} else {
+			backoff = p.MinBackoff
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			closeClient(p.replaceClient(nil, nil, ""))
+			return nil
+		case <-p.refresh:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Every replica
+// needs a client to serve its reconcilers.
+func (p *ClientProvider) NeedLeaderElection() bool {
+	return false
+}
+
+// Refresh makes Start check the connection right away instead of waiting for
+// the next ping. It never blocks.
+func (p *ClientProvider) Refresh() {
+	select {
+	case p.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Sync brings the connection up to date: it connects when there is no client
+// yet, when the tbot identity or the proxy address changed, or when the
+// current client no longer answers pings. On failure the previous client is
+// kept, so reconcilers can go on using it until it is replaced.
+func (p *ClientProvider) Sync(ctx context.Context) error {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+
+	proxyAddr := p.proxyAddr()
+	identity, err := p.loadIdentity(ctx)
+	if err != nil {
+		p.setError(err)
+		return microerror.Mask(err)
+	}
+
+	current, currentIdentity, connected := p.current()
+	if current != nil && currentIdentity != nil && currentIdentity.Hash() == identity.Hash() && connected == proxyAddr {
+		resp, err := current.Ping(ctx)
+		if err == nil {
+			p.setServerVersion(current, resp.ServerVersion)
+			return nil
+		}
+		p.Log.Error(err, "Teleport client failed to ping, reconnecting", "proxyAddr", proxyAddr)
+	}
+
+	c, err := NewClient(ctx, proxyAddr, identity.IdentityFile)
+	metrics.IdentityReconnected(err)
+	if err != nil {
+		p.setError(err)
+		return microerror.Mask(err)
+	}
+	p.setClient(c, identity, proxyAddr)
+
+	serverVersion, err := p.ServerVersion(ctx)
+	if err != nil {
+		p.Log.Error(err, "Failed to read the Teleport server version")
+	}
+
+	certificateExpiry, err := identity.CertificateExpiry()
+	if err != nil {
+		p.Log.Error(err, "Failed to read the identity certificate expiry")
+	} else {
+		metrics.SetIdentityCertificateExpiry(certificateExpiry)
+	}
+	p.Log.Info("Connected to teleport cluster",
+		"proxyAddr", proxyAddr,
+		"hash", identity.Hash(),
+		"serverVersion", serverVersion,
+		"certificateExpiry", certificateExpiry)
+
+	return nil
+}
+
+// Client returns the current Teleport client. It fails with
+// notConnectedError until a connection has been established.
+func (p *ClientProvider) Client() (Client, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.client == nil {
+		if p.lastErr != nil {
+			return nil, microerror.Maskf(notConnectedError, "%v", p.lastErr)
+		}
+		return nil, microerror.Mask(notConnectedError)
+	}
+	return p.client, nil
+}
+
+// ServerVersion returns the version of the Teleport auth server as reported
+// by the last ping of the current client, pinging it if it has not been
+// pinged since it was connected.
+func (p *ClientProvider) ServerVersion(ctx context.Context) (string, error) {
+	p.mu.RLock()
+	c, version, pinged := p.client, p.serverVersion, p.pinged
+	p.mu.RUnlock()
+	if c != nil && pinged == c {
+		return version, nil
+	}
+	if c == nil {
+		return "", microerror.Mask(notConnectedError)
+	}
+	resp, err := c.Ping(ctx)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	p.setServerVersion(c, resp.ServerVersion)
+	return resp.ServerVersion, nil
+}
+
+// LastServerVersion returns the version of the Teleport auth server as
+// reported by the last successful ping, and whether there was one. It is
+// kept while the client reconnects to the same proxy address, so that a
+// reconnect or a short outage of Teleport does not make it unknown.
+func (p *ClientProvider) LastServerVersion() (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.serverVersion, p.serverVersionKnown
+}
+
+// Identity returns the identity the current client was created with, or nil
+// if there is no client yet.
+func (p *ClientProvider) Identity() *config.IdentityConfig {
+	_, identity, _ := p.current()
+	return identity
+}
+
+// SetClient replaces the Teleport client and the identity it was created
+// with, as if it had been connected to the current proxy address. The
+// previous client's connection is closed after CloseGracePeriod.
+func (p *ClientProvider) SetClient(c Client, identity *config.IdentityConfig) {
+	p.setClient(c, identity, p.proxyAddr())
+}
+
+func (p *ClientProvider) setClient(c Client, identity *config.IdentityConfig, proxyAddr string) {
+	previous := p.replaceClient(c, identity, proxyAddr)
+	if previous == nil {
+		return
+	}
+	if p.CloseGracePeriod <= 0 {
+		closeClient(previous)
+		return
+	}
+	time.AfterFunc(p.CloseGracePeriod, func() {
+		closeClient(previous)
+	})
+}
+
+// replaceClient swaps in c and returns the previous client, or nil if it is
+// c itself.
+func (p *ClientProvider) replaceClient(c Client, identity *config.IdentityConfig, proxyAddr string) Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.client
+	p.client = c
+	p.identity = identity
+	if p.connected != proxyAddr {
+		p.serverVersion = ""
+		p.serverVersionKnown = false
+	}
+	p.connected = proxyAddr
+	p.lastErr = nil
+	if previous == c {
+		return nil
+	}
+	return previous
+}
+
+func closeClient(c Client) {
+	if closer, ok := c.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// setServerVersion records the server version reported by c, unless c has
+// been replaced in the meantime.
+func (p *ClientProvider) setServerVersion(c Client, version string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == c {
+		p.serverVersion = version
+		p.serverVersionKnown = true
+		p.pinged = c
+	}
+}
+
+func (p *ClientProvider) setError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+}
+
+func (p *ClientProvider) current() (Client, *config.IdentityConfig, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.client, p.identity, p.connected
+}
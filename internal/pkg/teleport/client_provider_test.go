@@ -0,0 +1,287 @@
+package teleport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/api/client/proto"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+type closableClient struct {
+	*test.FakeTeleportClient
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *closableClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Ping fails once the client is closed, like a real client whose connection
+// was torn down.
+func (c *closableClient) Ping(ctx context.Context) (proto.PingResponse, error) {
+	if c.isClosed() {
+		return proto.PingResponse{}, errors.New("client is closed")
+	}
+	return c.FakeTeleportClient.Ping(ctx)
+}
+
+func (c *closableClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func newStaticClientProvider(identity *config.IdentityConfig, proxyAddr string) *ClientProvider {
+	return NewClientProvider(
+		func(ctx context.Context) (*config.IdentityConfig, error) {
+			return identity, nil
+		},
+		func() string {
+			return proxyAddr
+		},
+	)
+}
+
+func Test_ClientProvider_SetClient_ClosesPreviousClient(t *testing.T) {
+	provider := newStaticClientProvider(nil, test.ProxyAddr)
+	provider.CloseGracePeriod = 50 * time.Millisecond
+
+	first := &closableClient{FakeTeleportClient: test.NewTeleportClient(test.FakeTeleportClientConfig{})}
+	firstIdentity := &config.IdentityConfig{IdentityFile: "first", LastRead: time.Now()}
+	provider.SetClient(first, firstIdentity)
+
+	// Setting the same client again must not close it.
+	provider.SetClient(first, firstIdentity)
+	if first.isClosed() {
+		t.Fatalf("expected client to stay open when set again")
+	}
+
+	second := &closableClient{FakeTeleportClient: test.NewTeleportClient(test.FakeTeleportClientConfig{})}
+	secondIdentity := &config.IdentityConfig{IdentityFile: "second", LastRead: time.Now()}
+	provider.SetClient(second, secondIdentity)
+
+	if first.isClosed() {
+		t.Fatalf("expected previous client to stay open during the grace period")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !first.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected previous client to be closed after the grace period")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if second.isClosed() {
+		t.Fatalf("expected current client to stay open")
+	}
+	if provider.Identity() != secondIdentity {
+		t.Fatalf("expected identity %q, actual %q", secondIdentity.IdentityFile, provider.Identity().IdentityFile)
+	}
+}
+
+func Test_ClientProvider_SetClient_Concurrent(t *testing.T) {
+	provider := newStaticClientProvider(nil, test.ProxyAddr)
+	provider.SetClient(&closableClient{FakeTeleportClient: test.NewTeleportClient(test.FakeTeleportClientConfig{})}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				c, err := provider.Client()
+				if err != nil {
+					errs <- err
+					return
+				}
+				// Keep using the client for a while, as a reconciler does.
+				for j := 0; j < 10; j++ {
+					if _, err := c.Ping(ctx); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+		provider.SetClient(&closableClient{FakeTeleportClient: test.NewTeleportClient(test.FakeTeleportClientConfig{})}, nil)
+		time.Sleep(100 * time.Microsecond)
+	}
+	cancel()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("expected a client handed out before it was replaced to keep working, actual error %v", err)
+	}
+}
+
+func Test_ClientProvider_Sync(t *testing.T) {
+	identity := &config.IdentityConfig{IdentityFile: test.IdentityFileValue, LastRead: time.Now()}
+
+	testCases := []struct {
+		name             string
+		current          Client
+		currentIdentity  *config.IdentityConfig
+		currentProxyAddr string
+		failsConnect     bool
+		expectError      bool
+		expectConnect    bool
+		expectConnected  bool
+	}{
+		{
+			name:            "case 0: Connect when there is no client yet",
+			expectConnect:   true,
+			expectConnected: true,
+		},
+		{
+			name:             "case 1: Keep a healthy client when nothing changed",
+			current:          test.NewTeleportClient(test.FakeTeleportClientConfig{}),
+			currentIdentity:  identity,
+			currentProxyAddr: test.ProxyAddr,
+			expectConnected:  true,
+		},
+		{
+			name:             "case 2: Reconnect when the client fails to ping",
+			current:          test.NewTeleportClient(test.FakeTeleportClientConfig{FailsPing: true}),
+			currentIdentity:  identity,
+			currentProxyAddr: test.ProxyAddr,
+			expectConnect:    true,
+			expectConnected:  true,
+		},
+		{
+			name:             "case 3: Reconnect when the identity was renewed",
+			current:          test.NewTeleportClient(test.FakeTeleportClientConfig{}),
+			currentIdentity:  &config.IdentityConfig{IdentityFile: "expired-identity", LastRead: time.Now()},
+			currentProxyAddr: test.ProxyAddr,
+			expectConnect:    true,
+			expectConnected:  true,
+		},
+		{
+			name:             "case 4: Reconnect when the proxy address changed",
+			current:          test.NewTeleportClient(test.FakeTeleportClientConfig{}),
+			currentIdentity:  identity,
+			currentProxyAddr: "teleport.example.com:443",
+			expectConnect:    true,
+			expectConnected:  true,
+		},
+		{
+			name:          "case 5: Report not connected when the first connection fails",
+			failsConnect:  true,
+			expectError:   true,
+			expectConnect: true,
+		},
+		{
+			name:             "case 6: Keep the old client when reconnecting fails",
+			current:          test.NewTeleportClient(test.FakeTeleportClientConfig{FailsPing: true}),
+			currentIdentity:  identity,
+			currentProxyAddr: test.ProxyAddr,
+			failsConnect:     true,
+			expectError:      true,
+			expectConnect:    true,
+			expectConnected:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var connected bool
+			newTeleportClient := NewClient
+			NewClient = func(ctx context.Context, proxyAddr, identityFile string) (Client, error) {
+				connected = true
+				if tc.failsConnect {
+					return nil, errors.New("connection refused")
+				}
+				return test.NewTeleportClient(test.FakeTeleportClientConfig{}), nil
+			}
+			defer func() {
+				NewClient = newTeleportClient
+			}()
+
+			provider := newStaticClientProvider(identity, test.ProxyAddr)
+			if tc.current != nil {
+				provider.setClient(tc.current, tc.currentIdentity, tc.currentProxyAddr)
+			}
+
+			err := provider.Sync(context.TODO())
+			test.CheckError(t, tc.expectError, err)
+
+			if connected != tc.expectConnect {
+				t.Fatalf("expected connect %t, actual %t", tc.expectConnect, connected)
+			}
+			_, err = provider.Client()
+			if tc.expectConnected && err != nil {
+				t.Fatalf("expected a client, actual error %v", err)
+			}
+			if !tc.expectConnected && !IsNotConnected(err) {
+				t.Fatalf("expected not connected error, actual %v", err)
+			}
+		})
+	}
+}
+
+func Test_ClientProvider_Start(t *testing.T) {
+	identity := &config.IdentityConfig{IdentityFile: test.IdentityFileValue, LastRead: time.Now()}
+	client := &closableClient{FakeTeleportClient: test.NewTeleportClient(test.FakeTeleportClientConfig{})}
+
+	// Fail the first attempts to check that Start keeps retrying.
+	var mu sync.Mutex
+	attempts := 0
+	newTeleportClient := NewClient
+	NewClient = func(ctx context.Context, proxyAddr, identityFile string) (Client, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return client, nil
+	}
+	defer func() {
+		NewClient = newTeleportClient
+	}()
+
+	provider := newStaticClientProvider(identity, test.ProxyAddr)
+	provider.MinBackoff = time.Millisecond
+	provider.MaxBackoff = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- provider.Start(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := provider.Client(); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("provider did not connect in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !client.isClosed() {
+		t.Fatalf("expected client to be closed once the provider stopped")
+	}
+	if _, err := provider.Client(); !IsNotConnected(err) {
+		t.Fatalf("expected not connected error after stop, actual %v", err)
+	}
+}
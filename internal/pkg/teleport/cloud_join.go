@@ -0,0 +1,122 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/giantswarm/microerror"
+	"github.com/gravitational/teleport/api/types"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const infrastructureGroup = "infrastructure.cluster.x-k8s.io"
+
+// cloudJoinProvider builds a join token spec from a CAPI infrastructure
+// cluster object.
+type cloudJoinProvider struct {
+	// version the infrastructure cluster object is read with.
+	version string
+	spec    func(ctx context.Context, ctrlClient client.Client, infraCluster *unstructured.Unstructured) (types.ProvisionTokenSpecV2, error)
+}
+
+// cloudJoinProviders maps the kinds of the CAPI infrastructure clusters the
+// operator knows the cloud join method of: CAPA, CAPZ and CAPG.
+var cloudJoinProviders = map[string]cloudJoinProvider{
+	"AWSCluster":        {version: "v1beta2", spec: iamJoinSpec},
+	"AzureCluster":      {version: "v1beta1", spec: azureJoinSpec},
+	"GCPCluster":        {version: "v1beta1", spec: gcpJoinSpec},
+	"GCPManagedCluster": {version: "v1beta1", spec: gcpJoinSpec},
+}
+
+var awsAccountPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// CloudJoinSpec returns the spec of the cluster's join token for the join
+// method of its cloud provider, picked from the kind of its
+// infrastructure cluster. The rules allow the cloud account, subscription or
+// project the infrastructure cluster runs in.
+func (t *Teleport) CloudJoinSpec(ctx context.Context, cluster *capi.Cluster) (types.ProvisionTokenSpecV2, error) {
+	ref := cluster.Spec.InfrastructureRef
+	provider, ok := cloudJoinProviders[ref.Kind]
+	if !ok || ref.APIGroup != infrastructureGroup {
+		return types.ProvisionTokenSpecV2{}, microerror.Maskf(unsupportedInfrastructureError, "cluster %s/%s has infrastructure %s.%s", cluster.Namespace, cluster.Name, ref.Kind, ref.APIGroup)
+	}
+
+	infraCluster := &unstructured.Unstructured{}
+	infraCluster.SetGroupVersionKind(schema.GroupVersionKind{Group: infrastructureGroup, Version: provider.version, Kind: ref.Kind})
+	if err := t.Client.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: cluster.Namespace}, infraCluster); err != nil {
+		return types.ProvisionTokenSpecV2{}, microerror.Mask(fmt.Errorf("failed to get %s %s/%s: %w", ref.Kind, cluster.Namespace, ref.Name, err))
+	}
+	spec, err := provider.spec(ctx, t.Client, infraCluster)
+	if err != nil {
+		return types.ProvisionTokenSpecV2{}, microerror.Mask(err)
+	}
+	return spec, nil
+}
+
+// iamJoinSpec allows the AWS account of the role CAPA assumes for the
+// cluster, read from its AWSClusterRoleIdentity.
+func iamJoinSpec(ctx context.Context, ctrlClient client.Client, awsCluster *unstructured.Unstructured) (types.ProvisionTokenSpecV2, error) {
+	identityKind, _, _ := unstructured.NestedString(awsCluster.Object, "spec", "identityRef", "kind")
+	identityName, _, _ := unstructured.NestedString(awsCluster.Object, "spec", "identityRef", "name")
+	if identityKind != "AWSClusterRoleIdentity" || identityName == "" {
+		return types.ProvisionTokenSpecV2{}, microerror.Mask(fmt.Errorf("AWSCluster %s/%s does not reference an AWSClusterRoleIdentity to read the AWS account from", awsCluster.GetNamespace(), awsCluster.GetName()))
+	}
+
+	identity := &unstructured.Unstructured{}
+	identity.SetGroupVersionKind(schema.GroupVersionKind{Group: infrastructureGroup, Version: "v1beta2", Kind: identityKind})
+	if err := ctrlClient.Get(ctx, client.ObjectKey{Name: identityName}, identity); err != nil {
+		return types.ProvisionTokenSpecV2{}, microerror.Mask(fmt.Errorf("failed to get AWSClusterRoleIdentity %s: %w", identityName, err))
+	}
+	roleARN, _, _ := unstructured.NestedString(identity.Object, "spec", "roleARN")
+	// arn:<partition>:iam::<account>:role/<name>
+	parts := strings.Split(roleARN, ":")
+	if len(parts) < 6 || parts[0] != "arn" || !awsAccountPattern.MatchString(parts[4]) {
+		return types.ProvisionTokenSpecV2{}, microerror.Mask(fmt.Errorf("AWSClusterRoleIdentity %s has no valid role ARN, got %q", identityName, roleARN))
+	}
+
+	return types.ProvisionTokenSpecV2{
+		JoinMethod: types.JoinMethodIAM,
+		Allow:      []*types.TokenRule{{AWSAccount: parts[4]}},
+	}, nil
+}
+
+// azureJoinSpec allows the subscription and resource group of an
+// AzureCluster.
+func azureJoinSpec(ctx context.Context, ctrlClient client.Client, azureCluster *unstructured.Unstructured) (types.ProvisionTokenSpecV2, error) {
+	subscription, _, _ := unstructured.NestedString(azureCluster.Object, "spec", "subscriptionID")
+	if subscription == "" {
+		return types.ProvisionTokenSpecV2{}, microerror.Mask(fmt.Errorf("AzureCluster %s/%s has no subscriptionID", azureCluster.GetNamespace(), azureCluster.GetName()))
+	}
+	rule := &types.ProvisionTokenSpecV2Azure_Rule{Subscription: subscription}
+	if resourceGroup, _, _ := unstructured.NestedString(azureCluster.Object, "spec", "resourceGroup"); resourceGroup != "" {
+		rule.ResourceGroups = []string{resourceGroup}
+	}
+
+	return types.ProvisionTokenSpecV2{
+		JoinMethod: types.JoinMethodAzure,
+		Azure:      &types.ProvisionTokenSpecV2Azure{Allow: []*types.ProvisionTokenSpecV2Azure_Rule{rule}},
+	}, nil
+}
+
+// gcpJoinSpec allows the project and region of a GCPCluster or
+// GCPManagedCluster.
+func gcpJoinSpec(ctx context.Context, ctrlClient client.Client, gcpCluster *unstructured.Unstructured) (types.ProvisionTokenSpecV2, error) {
+	project, _, _ := unstructured.NestedString(gcpCluster.Object, "spec", "project")
+	if project == "" {
+		return types.ProvisionTokenSpecV2{}, microerror.Mask(fmt.Errorf("%s %s/%s has no project", gcpCluster.GetKind(), gcpCluster.GetNamespace(), gcpCluster.GetName()))
+	}
+	rule := &types.ProvisionTokenSpecV2GCP_Rule{ProjectIDs: []string{project}}
+	if region, _, _ := unstructured.NestedString(gcpCluster.Object, "spec", "region"); region != "" {
+		rule.Locations = []string{region}
+	}
+
+	return types.ProvisionTokenSpecV2{
+		JoinMethod: types.JoinMethodGCP,
+		GCP:        &types.ProvisionTokenSpecV2GCP{Allow: []*types.ProvisionTokenSpecV2GCP_Rule{rule}},
+	}, nil
+}
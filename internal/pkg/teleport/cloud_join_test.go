@@ -0,0 +1,129 @@
+package teleport
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/api/types"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_CloudJoinSpec(t *testing.T) {
+	awsCluster, awsRef := test.NewInfrastructureCluster("AWSCluster", "v1beta2", test.ClusterName, test.NamespaceName, map[string]interface{}{
+		"identityRef": map[string]interface{}{"kind": "AWSClusterRoleIdentity", "name": "default"},
+	})
+	staticAWSCluster, staticAWSRef := test.NewInfrastructureCluster("AWSCluster", "v1beta2", "static-credentials", test.NamespaceName, map[string]interface{}{
+		"identityRef": map[string]interface{}{"kind": "AWSClusterStaticIdentity", "name": "default"},
+	})
+	azureCluster, azureRef := test.NewInfrastructureCluster("AzureCluster", "v1beta1", test.ClusterName, test.NamespaceName, map[string]interface{}{
+		"subscriptionID": "00000000-0000-0000-0000-000000000000",
+		"resourceGroup":  test.ClusterName,
+	})
+	gcpCluster, gcpRef := test.NewInfrastructureCluster("GCPCluster", "v1beta1", test.ClusterName, test.NamespaceName, map[string]interface{}{
+		"project": "test-project",
+		"region":  "europe-west3",
+	})
+	gcpManagedCluster, gcpManagedRef := test.NewInfrastructureCluster("GCPManagedCluster", "v1beta1", test.ClusterName, test.NamespaceName, map[string]interface{}{
+		"project": "test-project",
+	})
+	_, dockerRef := test.NewInfrastructureCluster("DockerCluster", "v1beta1", test.ClusterName, test.NamespaceName, nil)
+
+	testCases := []struct {
+		name                   string
+		objects                []client.Object
+		infraRef               capi.ContractVersionedObjectReference
+		expectedSpec           types.ProvisionTokenSpecV2
+		expectError            bool
+		expectUnsupportedInfra bool
+	}{
+		{
+			name:     "case 0: Allow the AWS account of the cluster's role identity",
+			objects:  []client.Object{awsCluster, test.NewAWSClusterRoleIdentity("default", "arn:aws:iam::123456789012:role/capa-controller")},
+			infraRef: awsRef,
+			expectedSpec: types.ProvisionTokenSpecV2{
+				JoinMethod: types.JoinMethodIAM,
+				Allow:      []*types.TokenRule{{AWSAccount: "123456789012"}},
+			},
+		},
+		{
+			name:        "case 1: Fail for an AWS cluster without a role identity",
+			objects:     []client.Object{staticAWSCluster},
+			infraRef:    staticAWSRef,
+			expectError: true,
+		},
+		{
+			name:     "case 2: Allow the Azure subscription and resource group",
+			objects:  []client.Object{azureCluster},
+			infraRef: azureRef,
+			expectedSpec: types.ProvisionTokenSpecV2{
+				JoinMethod: types.JoinMethodAzure,
+				Azure: &types.ProvisionTokenSpecV2Azure{Allow: []*types.ProvisionTokenSpecV2Azure_Rule{
+					{Subscription: "00000000-0000-0000-0000-000000000000", ResourceGroups: []string{test.ClusterName}},
+				}},
+			},
+		},
+		{
+			name:     "case 3: Allow the GCP project and region",
+			objects:  []client.Object{gcpCluster},
+			infraRef: gcpRef,
+			expectedSpec: types.ProvisionTokenSpecV2{
+				JoinMethod: types.JoinMethodGCP,
+				GCP: &types.ProvisionTokenSpecV2GCP{Allow: []*types.ProvisionTokenSpecV2GCP_Rule{
+					{ProjectIDs: []string{"test-project"}, Locations: []string{"europe-west3"}},
+				}},
+			},
+		},
+		{
+			name:     "case 4: Allow the GCP project of a managed cluster",
+			objects:  []client.Object{gcpManagedCluster},
+			infraRef: gcpManagedRef,
+			expectedSpec: types.ProvisionTokenSpecV2{
+				JoinMethod: types.JoinMethodGCP,
+				GCP: &types.ProvisionTokenSpecV2GCP{Allow: []*types.ProvisionTokenSpecV2GCP_Rule{
+					{ProjectIDs: []string{"test-project"}},
+				}},
+			},
+		},
+		{
+			name:                   "case 5: Fail for an infrastructure provider without a cloud join method",
+			infraRef:               dockerRef,
+			expectError:            true,
+			expectUnsupportedInfra: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient, err := test.NewFakeK8sClientFromObjects(tc.objects...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+			tele := New(test.NamespaceName, &config.Config{ManagementClusterName: test.ManagementClusterName}, test.NewMockTokenGenerator(test.NewTokenName))
+			tele.Client = fakeClient
+
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, nil, time.Time{})
+			cluster.Spec.InfrastructureRef = tc.infraRef
+
+			spec, err := tele.CloudJoinSpec(context.TODO(), cluster)
+			test.CheckError(t, tc.expectError, err)
+			if tc.expectUnsupportedInfra != IsUnsupportedInfrastructure(err) {
+				t.Fatalf("expected unsupported infrastructure error %t, actual %v", tc.expectUnsupportedInfra, err)
+			}
+			if tc.expectError {
+				return
+			}
+
+			actual, _ := json.Marshal(spec)
+			expected, _ := json.Marshal(tc.expectedSpec)
+			if string(actual) != string(expected) {
+				t.Fatalf("expected spec %s, actual %s", expected, actual)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package teleport
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/giantswarm/microerror"
 	"github.com/go-logr/logr"
@@ -18,7 +19,7 @@ import (
 
 func (t *Teleport) GetConfigMap(ctx context.Context, log logr.Logger, ctrlClient client.Client, clusterName string, clusterNamespace string) (*corev1.ConfigMap, error) {
 	var (
-		configMapName = key.GetConfigmapName(clusterName, t.Config.AppName)
+		configMapName = key.GetConfigmapName(clusterName, t.Config().AppName)
 		configMap     = &corev1.ConfigMap{}
 	)
 
@@ -50,37 +51,70 @@ func (t *Teleport) GetTbotConfigMap(ctx context.Context, ctrlClient client.Clien
 }
 
 func (t *Teleport) GetTokenFromConfigMap(ctx context.Context, configMap *corev1.ConfigMap) (string, error) {
-	valuesYaml, err := parseConfigMapValues(configMap)
+	valuesYaml, layout, err := t.parseConfigMapValues(configMap)
 	if err != nil {
 		return "", err
 	}
 
-	token, ok := valuesYaml["authToken"].(string)
-	if !ok {
-		return "", microerror.Mask(fmt.Errorf("malformed ConfigMap: key `authToken` not found"))
+	if token, ok := valuesYaml[layout.Key("authToken")].(string); ok {
+		return token, nil
+	}
+	// With the kubernetes join method, the values only name the join token.
+	if joinParams, ok := valuesYaml[layout.Key("joinParams")].(map[string]interface{}); ok {
+		if token, ok := joinParams["tokenName"].(string); ok {
+			return token, nil
+		}
 	}
 
-	return token, nil
+	return "", microerror.Mask(fmt.Errorf("malformed ConfigMap: neither key `authToken` nor `joinParams.tokenName` found"))
+}
+
+// HasAuthTokenInConfigMap reports whether the ConfigMap's values carry a
+// static join token.
+func (t *Teleport) HasAuthTokenInConfigMap(configMap *corev1.ConfigMap) bool {
+	valuesYaml, layout, err := t.parseConfigMapValues(configMap)
+	if err != nil {
+		return false
+	}
+	_, ok := valuesYaml[layout.Key("authToken")].(string)
+	return ok
 }
 
 // GetTeleportVersionFromConfigMap returns the teleportVersionOverride
-// currently stored in the ConfigMap, or an empty string if not set.
+// currently stored in the ConfigMap, or an empty string if not set. With
+// several layout blocks, the first block carrying one wins, since a block
+// leaves the override out below its chart's bundled Teleport version.
 func (t *Teleport) GetTeleportVersionFromConfigMap(configMap *corev1.ConfigMap) (string, error) {
-	valuesYaml, err := parseConfigMapValues(configMap)
-	if err != nil {
-		return "", err
+	valuesBytes, ok := configMap.Data["values"]
+	if !ok {
+		return "", microerror.Mask(fmt.Errorf("malformed ConfigMap: key `values` not found"))
+	}
+	var root map[string]interface{}
+	if err := yaml.Unmarshal([]byte(valuesBytes), &root); err != nil {
+		return "", microerror.Mask(fmt.Errorf("failed to parse YAML: %w", err))
 	}
 
-	version, _ := valuesYaml["teleportVersionOverride"].(string)
-	return version, nil
+	for _, layout := range t.Config().GetValuesLayouts().Layouts {
+		block := root
+		if layout.RootKey != "" {
+			block, _ = root[layout.RootKey].(map[string]interface{})
+		}
+		if version, _ := block[layout.Key("teleportVersionOverride")].(string); version != "" {
+			return version, nil
+		}
+	}
+	return "", nil
 }
 
 // IsConfigMapLayoutUpToDate reports whether the ConfigMap's top-level shape
-// matches what the cluster's deployed teleport-kube-agent chart version
-// expects:
+// matches the values layout of the cluster's deployed teleport-kube-agent
+// chart version, see key.ValuesLayouts.For: the blocks of the layout and of
+// the layout it upgrades to must be present, and the blocks of every other
+// layout absent. A nested block is detected by its root key, the root block
+// by its proxyAddr. With the built-in layouts:
 //
 //   - tkaVersion >= v0.11.0: nested-only — the `teleport-kube-agent:` block
-//     must exist and the flat block must be absent (root has no authToken).
+//     must exist and the flat block must be absent (root has no proxyAddr).
 //   - tkaVersion < v0.11.0 or unknown: dual — both the nested block AND
 //     the flat root keys must be present.
 func (t *Teleport) IsConfigMapLayoutUpToDate(configMap *corev1.ConfigMap, tkaVersion string) (bool, error) {
@@ -94,37 +128,73 @@ func (t *Teleport) IsConfigMapLayoutUpToDate(configMap *corev1.ConfigMap, tkaVer
 		return false, microerror.Mask(fmt.Errorf("failed to parse YAML: %w", err))
 	}
 
-	_, hasNested := root[key.TeleportKubeAgentValuesKey].(map[string]interface{})
-	_, hasFlat := root["authToken"].(string)
-
-	if key.UsesNestedKubeAgentValues(tkaVersion) {
-		return hasNested && !hasFlat, nil
+	layouts := t.Config().GetValuesLayouts()
+	expected := map[string]bool{}
+	for _, layout := range layouts.Blocks(layouts.For(tkaVersion)) {
+		expected[layout.RootKey] = true
+	}
+	present := map[string]bool{}
+	for _, layout := range layouts.Layouts {
+		if layout.RootKey != "" {
+			_, present[layout.RootKey] = root[layout.RootKey].(map[string]interface{})
+		} else if _, ok := root[layout.Key("proxyAddr")].(string); ok {
+			present[""] = true
+		}
+	}
+	for _, layout := range layouts.Layouts {
+		if expected[layout.RootKey] != present[layout.RootKey] {
+			return false, nil
+		}
 	}
-	return hasNested && hasFlat, nil
+	return true, nil
 }
 
-func parseConfigMapValues(configMap *corev1.ConfigMap) (map[string]interface{}, error) {
+func (t *Teleport) parseConfigMapValues(configMap *corev1.ConfigMap) (map[string]interface{}, *key.ValuesLayout, error) {
 	valuesBytes, ok := configMap.Data["values"]
 	if !ok {
-		return nil, microerror.Mask(fmt.Errorf("malformed ConfigMap: key `values` not found"))
+		return nil, nil, microerror.Mask(fmt.Errorf("malformed ConfigMap: key `values` not found"))
 	}
+	return parseValues(valuesBytes, t.Config().GetValuesLayouts())
+}
 
+// parseValues parses a teleport-kube-agent values document and returns the
+// values the chart reads with their layout: the block of the first layout
+// that nests its values, if present, else the root.
+func parseValues(valuesBytes string, layouts *key.ValuesLayouts) (map[string]interface{}, *key.ValuesLayout, error) {
 	var root map[string]interface{}
 	if err := yaml.Unmarshal([]byte(valuesBytes), &root); err != nil {
-		return nil, microerror.Mask(fmt.Errorf("failed to parse YAML: %w", err))
+		return nil, nil, microerror.Mask(fmt.Errorf("failed to parse YAML: %w", err))
 	}
 
-	if nested, ok := root[key.TeleportKubeAgentValuesKey].(map[string]interface{}); ok {
-		return nested, nil
+	rootLayout := layouts.Get(layouts.Default)
+	for i := range layouts.Layouts {
+		layout := &layouts.Layouts[i]
+		if layout.RootKey == "" {
+			if rootLayout.RootKey != "" {
+				rootLayout = layout
+			}
+			continue
+		}
+		if nested, ok := root[layout.RootKey].(map[string]interface{}); ok {
+			return nested, layout, nil
+		}
 	}
-	return root, nil
+	return root, rootLayout, nil
 }
 
-func (t *Teleport) CreateConfigMap(ctx context.Context, log logr.Logger, ctrlClient client.Client, clusterName string, clusterNamespace string, registerName string, token string, roles []string, tkaVersion string) error {
-	configMapName := key.GetConfigmapName(clusterName, t.Config.AppName)
+func (t *Teleport) CreateConfigMap(ctx context.Context, log logr.Logger, ctrlClient client.Client, clusterName string, clusterNamespace string, registerName string, token string, joinMethod string, roles []string, labels map[string]string, databases []key.Database, teleportVersion, tkaVersion string) error {
+	configMapName := key.GetConfigmapName(clusterName, t.Config().AppName)
 
+	desired, err := t.getConfigMapData(registerName, token, joinMethod, roles, labels, databases, teleportVersion, tkaVersion)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	patch, err := PatchValues("", desired, nil, t.Config().GetValuesLayouts().RootKeys())
+	if err != nil {
+		return microerror.Mask(err)
+	}
 	configMapData := map[string]string{
-		"values": t.getConfigMapData(registerName, token, roles, tkaVersion),
+		"values": patch.Values,
 	}
 
 	cm := corev1.ConfigMap{}
@@ -134,6 +204,9 @@ func (t *Teleport) CreateConfigMap(ctx context.Context, log logr.Logger, ctrlCli
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      configMapName,
 					Namespace: clusterNamespace,
+					Annotations: map[string]string{
+						key.ManagedValuesAnnotation: strings.Join(patch.ManagedPaths, ","),
+					},
 				},
 				Data: configMapData,
 			}
@@ -154,8 +227,12 @@ func (t *Teleport) CreateConfigMap(ctx context.Context, log logr.Logger, ctrlCli
 
 func (t *Teleport) CreateTbotConfigMap(ctx context.Context, ctrlClient client.Client, clusterName string, registerName string) (*corev1.ConfigMap, error) {
 	configMapName := key.GetTbotConfigmapName(clusterName)
+	values, err := t.getTbotConfigMapData(registerName, clusterName)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
 	data := map[string]string{
-		"values": t.getTbotConfigMapData(registerName, clusterName),
+		"values": values,
 	}
 	cm := corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -189,44 +266,56 @@ func (t *Teleport) EnsureTbotConfigMap(ctx context.Context, log logr.Logger, ctr
 	return nil
 }
 
-// UpdateConfigMap rewrites the ConfigMap's `values` from the template so the
-// produced YAML matches what GetConfigmapDataFromTemplate would emit for the
-// given tkaVersion. This means the controller can do a single string compare
-// to detect drift, and a tkaVersion crossing 0.11.0 actually drops the flat
-// block from the stored ConfigMap.
-func (t *Teleport) UpdateConfigMap(ctx context.Context, log logr.Logger, ctrlClient client.Client, configMap *corev1.ConfigMap, token string, roles []string, tkaVersion string) error {
-	registerName, err := registerNameFromConfigMap(configMap)
+// UpdateConfigMap patches the values the operator manages into the
+// ConfigMap's `values`, see PatchConfigMapValues, and records their paths in
+// the key.ManagedValuesAnnotation. Values the operator does not manage are
+// kept, while managed values that are no longer rendered, e.g. the flat
+// block once tkaVersion crosses 0.11.0, are removed.
+func (t *Teleport) UpdateConfigMap(ctx context.Context, log logr.Logger, ctrlClient client.Client, configMap *corev1.ConfigMap, registerName string, token string, joinMethod string, roles []string, labels map[string]string, databases []key.Database, teleportVersion, tkaVersion string) error {
+	patch, err := t.PatchConfigMapValues(configMap, registerName, token, joinMethod, roles, labels, databases, teleportVersion, tkaVersion)
 	if err != nil {
-		return err
+		return microerror.Mask(err)
 	}
-
 	if configMap.Data == nil {
 		configMap.Data = map[string]string{}
 	}
-	configMap.Data["values"] = t.getConfigMapData(registerName, token, roles, tkaVersion)
+	configMap.Data["values"] = patch.Values
+	if configMap.Annotations == nil {
+		configMap.Annotations = map[string]string{}
+	}
+	configMap.Annotations[key.ManagedValuesAnnotation] = strings.Join(patch.ManagedPaths, ",")
 	if err := ctrlClient.Update(ctx, configMap); err != nil {
 		return microerror.Mask(fmt.Errorf("failed to update ConfigMap: %w", err))
 	}
-	log.Info("Updated config map with new teleport kube join token", "configMap", configMap.GetName())
+	log.Info("Updated config map with new teleport kube join token", "configMap", configMap.GetName(), "driftedValues", patch.DriftedPaths)
 	return nil
 }
 
-// registerNameFromConfigMap extracts the kubeClusterName from the stored
-// values — it's the register name and doesn't change between reconciles.
-func registerNameFromConfigMap(configMap *corev1.ConfigMap) (string, error) {
-	values, err := parseConfigMapValues(configMap)
+// PatchConfigMapValues compares the values the operator manages in the
+// ConfigMap's `values` with the ones it renders, pinned to teleportVersion,
+// and returns the values patched accordingly together with the paths that
+// drifted. A ConfigMap without the key.ManagedValuesAnnotation is migrated:
+// only the values the operator renders in any layout are taken as managed,
+// so values added by others are kept.
+func (t *Teleport) PatchConfigMapValues(configMap *corev1.ConfigMap, registerName, token, joinMethod string, roles []string, labels map[string]string, databases []key.Database, teleportVersion, tkaVersion string) (*ValuesPatch, error) {
+	desired, err := t.getConfigMapData(registerName, token, joinMethod, roles, labels, databases, teleportVersion, tkaVersion)
 	if err != nil {
-		return "", err
+		return nil, microerror.Mask(err)
 	}
-	name, ok := values["kubeClusterName"].(string)
-	if !ok || name == "" {
-		return "", microerror.Mask(fmt.Errorf("malformed ConfigMap: key `kubeClusterName` not found"))
+	layouts := t.Config().GetValuesLayouts()
+	managed := GetManagedValuesPaths(configMap)
+	if managed == nil {
+		managed = layouts.ValuesPaths()
+	}
+	patch, err := PatchValues(configMap.Data["values"], desired, managed, layouts.RootKeys())
+	if err != nil {
+		return nil, microerror.Mask(err)
 	}
-	return name, nil
+	return patch, nil
 }
 
 func (t *Teleport) DeleteConfigMap(ctx context.Context, log logr.Logger, ctrlClient client.Client, clusterName string, clusterNamespace string) error {
-	configMapName := key.GetConfigmapName(clusterName, t.Config.AppName)
+	configMapName := key.GetConfigmapName(clusterName, t.Config().AppName)
 	cm := corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      configMapName,
@@ -265,18 +354,29 @@ func (t *Teleport) DeleteTbotConfigMap(ctx context.Context, log logr.Logger, ctr
 	return nil
 }
 
-// RenderConfigMapValues returns the deterministic YAML the operator wants
-// the cluster's teleport-kube-agent values ConfigMap to contain. The
-// controller uses it both for the initial write and for byte-compare
-// drift detection on subsequent reconciles.
-func (t *Teleport) RenderConfigMapValues(registerName, token string, roles []string, tkaVersion string) string {
-	return t.getConfigMapData(registerName, token, roles, tkaVersion)
+// RenderConfigMapValues returns the deterministic YAML the operator writes
+// to a new teleport-kube-agent values ConfigMap of the cluster, pinned to
+// teleportVersion, see ClusterTeleportVersion.
+func (t *Teleport) RenderConfigMapValues(registerName, token, joinMethod string, roles []string, labels map[string]string, databases []key.Database, teleportVersion, tkaVersion string) (string, error) {
+	values, err := t.getConfigMapData(registerName, token, joinMethod, roles, labels, databases, teleportVersion, tkaVersion)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	return values, nil
 }
 
-func (t *Teleport) getConfigMapData(registerName, token string, roles []string, tkaVersion string) string {
-	return key.GetConfigmapDataFromTemplate(token, t.Config.ProxyAddr, registerName, t.Config.TeleportVersion, roles, tkaVersion)
+func (t *Teleport) getConfigMapData(registerName, token, joinMethod string, roles []string, labels map[string]string, databases []key.Database, teleportVersion, tkaVersion string) (string, error) {
+	values, err := key.GetConfigmapDataFromTemplate(token, joinMethod, t.Config().ProxyAddr, registerName, teleportVersion, roles, labels, databases, t.Config().GetValuesLayouts(), tkaVersion)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	return values, nil
 }
 
-func (t *Teleport) getTbotConfigMapData(registerName string, clusterName string) string {
-	return key.GetTbotConfigmapDataFromTemplate(registerName, clusterName)
+func (t *Teleport) getTbotConfigMapData(registerName string, clusterName string) (string, error) {
+	values, err := key.GetTbotConfigmapDataFromTemplate(registerName, clusterName)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	return values, nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"testing"
 
+	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -201,7 +202,7 @@ func Test_ConfigMapCRUD(t *testing.T) {
 			}
 
 			if tc.configMapToCreate != nil {
-				err = teleport.CreateConfigMap(ctx, log, ctrlClient, tc.clusterName, tc.namespace, tc.registerName, tc.token, []string{"kube", "app"}, "")
+				err = teleport.CreateConfigMap(ctx, log, ctrlClient, tc.clusterName, tc.namespace, tc.registerName, tc.token, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), "")
 				test.CheckError(t, tc.expectError, err)
 				if err != nil {
 					actualConfigMap, err = loadConfigMap(ctx, ctrlClient, tc.configMapToCreate)
@@ -213,7 +214,7 @@ func Test_ConfigMapCRUD(t *testing.T) {
 			}
 
 			if tc.configMapToUpdate != nil {
-				err = teleport.UpdateConfigMap(ctx, log, ctrlClient, tc.configMap, tc.token, []string{"kube", "app"}, "")
+				err = teleport.UpdateConfigMap(ctx, log, ctrlClient, tc.configMap, tc.registerName, tc.token, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), "")
 				test.CheckError(t, tc.expectError, err)
 				if err != nil {
 					actualConfigMap, err = loadConfigMap(ctx, ctrlClient, tc.configMapToUpdate)
@@ -266,7 +267,7 @@ func Test_CreateConfigMap_NestedOnlyFor0_11_0(t *testing.T) {
 	}, token.NewGenerator())
 
 	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
-	if err := teleport.CreateConfigMap(ctx, log, ctrlClient, test.ClusterName, test.NamespaceName, registerName, test.TokenName, []string{"kube", "app"}, test.AppVersionNested); err != nil {
+	if err := teleport.CreateConfigMap(ctx, log, ctrlClient, test.ClusterName, test.NamespaceName, registerName, test.TokenName, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), test.AppVersionNested); err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
 
@@ -294,7 +295,7 @@ func Test_CreateConfigMap_NestedSkipsDowngradeOverride(t *testing.T) {
 	}, token.NewGenerator())
 
 	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
-	if err := teleport.CreateConfigMap(ctx, log, ctrlClient, test.ClusterName, test.NamespaceName, registerName, test.TokenName, []string{"kube", "app"}, test.AppVersionNested); err != nil {
+	if err := teleport.CreateConfigMap(ctx, log, ctrlClient, test.ClusterName, test.NamespaceName, registerName, test.TokenName, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), test.AppVersionNested); err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
 
@@ -322,7 +323,7 @@ func Test_CreateConfigMap_DualBlockWhenTKAUnknown(t *testing.T) {
 	}, token.NewGenerator())
 
 	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
-	if err := teleport.CreateConfigMap(ctx, log, ctrlClient, test.ClusterName, test.NamespaceName, registerName, test.TokenName, []string{"kube", "app"}, ""); err != nil {
+	if err := teleport.CreateConfigMap(ctx, log, ctrlClient, test.ClusterName, test.NamespaceName, registerName, test.TokenName, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), ""); err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
 
@@ -350,7 +351,7 @@ func Test_UpdateConfigMap_MigratesFlatToNested(t *testing.T) {
 		TeleportVersion: test.TeleportVersionForNested,
 	}, token.NewGenerator())
 
-	if err := teleport.UpdateConfigMap(ctx, log, ctrlClient, existing, test.NewTokenName, []string{"kube", "app"}, test.AppVersionNested); err != nil {
+	if err := teleport.UpdateConfigMap(ctx, log, ctrlClient, existing, key.GetRegisterName(test.ManagementClusterName, test.ClusterName), test.NewTokenName, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), test.AppVersionNested); err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
 
@@ -362,6 +363,54 @@ func Test_UpdateConfigMap_MigratesFlatToNested(t *testing.T) {
 	test.CheckConfigMap(t, expected, actual)
 }
 
+func Test_UpdateConfigMap_MigrationKeepsForeignValues(t *testing.T) {
+	ctx := context.TODO()
+	log := ctrl.Log.WithName("test")
+
+	// A ConfigMap written before the managed values were recorded, with
+	// values added by someone else.
+	existing := test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{"kube", "app"})
+	existing.Data["values"] = "priorityClassName: \"high\"\n" + existing.Data["values"] + "\nteleport-kube-agent:\n  highAvailability:\n    replicaCount: 2\n"
+	ctrlClient, err := test.NewFakeK8sClient([]runtime.Object{existing})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	teleport := New(test.NamespaceName, &config.Config{
+		AppName:         test.AppName,
+		ProxyAddr:       test.ProxyAddr,
+		TeleportVersion: test.TeleportVersionForNested,
+	}, token.NewGenerator())
+
+	if err := teleport.UpdateConfigMap(ctx, log, ctrlClient, existing, key.GetRegisterName(test.ManagementClusterName, test.ClusterName), test.NewTokenName, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), test.AppVersionNested); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	actual, err := loadConfigMap(ctx, ctrlClient, existing)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal([]byte(actual.Data["values"]), &values); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if values["priorityClassName"] != "high" {
+		t.Fatalf("expected the foreign root value to be kept, actual values:\n%s", actual.Data["values"])
+	}
+	for _, flatKey := range []string{"roles", "authToken", "proxyAddr", "kubeClusterName", "teleportVersionOverride"} {
+		if _, ok := values[flatKey]; ok {
+			t.Fatalf("expected the legacy flat key %s to be removed, actual values:\n%s", flatKey, actual.Data["values"])
+		}
+	}
+	nested, _ := values[key.TeleportKubeAgentValuesKey].(map[string]interface{})
+	if nested["authToken"] != test.NewTokenName || nested["highAvailability"] == nil {
+		t.Fatalf("expected the new token next to the foreign nested value, actual values:\n%s", actual.Data["values"])
+	}
+	if actual.Annotations[key.ManagedValuesAnnotation] == "" {
+		t.Fatalf("expected the managed values to be recorded")
+	}
+}
+
 func Test_UpdateConfigMap_NestedDropsDowngradeOverride(t *testing.T) {
 	ctx := context.TODO()
 	log := ctrl.Log.WithName("test")
@@ -378,7 +427,7 @@ func Test_UpdateConfigMap_NestedDropsDowngradeOverride(t *testing.T) {
 		TeleportVersion: test.TeleportVersion, // downgrade vs bundled 18.7.6
 	}, token.NewGenerator())
 
-	if err := teleport.UpdateConfigMap(ctx, log, ctrlClient, existing, test.TokenName, []string{"kube", "app"}, test.AppVersionNested); err != nil {
+	if err := teleport.UpdateConfigMap(ctx, log, ctrlClient, existing, key.GetRegisterName(test.ManagementClusterName, test.ClusterName), test.TokenName, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), test.AppVersionNested); err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
 
@@ -406,7 +455,7 @@ func Test_UpdateConfigMap_DualBlockForUnknownTKA(t *testing.T) {
 		TeleportVersion: test.TeleportVersion, // 1.0.0 - matches NewDualBlockConfigMap fixture
 	}, token.NewGenerator())
 
-	if err := teleport.UpdateConfigMap(ctx, log, ctrlClient, existing, test.TokenName, []string{"kube", "app"}, ""); err != nil {
+	if err := teleport.UpdateConfigMap(ctx, log, ctrlClient, existing, key.GetRegisterName(test.ManagementClusterName, test.ClusterName), test.TokenName, key.JoinMethodToken, []string{"kube", "app"}, nil, nil, teleport.TeleportVersionOverride(), ""); err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
 
@@ -468,3 +517,155 @@ func Test_IsConfigMapLayoutUpToDate(t *testing.T) {
 		})
 	}
 }
+
+func Test_GetTokenFromConfigMap_KubernetesJoinMethod(t *testing.T) {
+	ctx := context.TODO()
+	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
+	tokenName := key.GetJoinTokenName(registerName, key.JoinMethodKubernetes)
+
+	teleport := New(test.NamespaceName, &config.Config{
+		AppName:   test.AppName,
+		ProxyAddr: test.ProxyAddr,
+	}, token.NewGenerator())
+	values, err := teleport.RenderConfigMapValues(registerName, tokenName, key.JoinMethodKubernetes, []string{"kube"}, nil, nil, teleport.TeleportVersionOverride(), test.AppVersionNested)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	configMap := &corev1.ConfigMap{
+		Data: map[string]string{
+			"values": values,
+		},
+	}
+
+	got, err := teleport.GetTokenFromConfigMap(ctx, configMap)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got != tokenName {
+		t.Fatalf("unexpected token: expected %s, actual %s", tokenName, got)
+	}
+}
+
+func Test_ConfigMapValues_ConfiguredLayout(t *testing.T) {
+	ctx := context.TODO()
+	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
+
+	override, err := key.ParseValuesLayouts(`
+layouts:
+- name: Agent
+  versions: ">= 1.0.0"
+  rootKey: agent
+  fields: [roles, authToken, proxyAddr, kubeClusterName]
+  renamedKeys:
+    authToken: joinToken
+- name: Nested
+  versions: ">= 0.11.0"
+  rootKey: teleport-kube-agent
+  upgradeTo: Agent
+`)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	layouts, err := key.MergeValuesLayouts(key.DefaultValuesLayouts(), override)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	teleport := New(test.NamespaceName, &config.Config{
+		AppName:         test.AppName,
+		ProxyAddr:       test.ProxyAddr,
+		TeleportVersion: test.TeleportVersion,
+		ValuesLayouts:   layouts,
+	}, token.NewGenerator())
+
+	values, err := teleport.RenderConfigMapValues(registerName, test.TokenName, key.JoinMethodToken, []string{"kube"}, nil, nil, teleport.TeleportVersionOverride(), "1.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	agent := &corev1.ConfigMap{Data: map[string]string{
+		"values": values,
+	}}
+	expected := "agent:\n" +
+		"  roles: \"kube\"\n" +
+		"  joinToken: \"" + test.TokenName + "\"\n" +
+		"  proxyAddr: \"" + test.ProxyAddr + "\"\n" +
+		"  kubeClusterName: \"" + registerName + "\"\n"
+	if agent.Data["values"] != expected {
+		t.Fatalf("expected values:\n%s\nactual:\n%s", expected, agent.Data["values"])
+	}
+	if layout := teleport.ValuesLayoutFor("1.0.0"); layout != "Agent" {
+		t.Fatalf("expected the Agent layout, actual %q", layout)
+	}
+	if got, err := teleport.GetTokenFromConfigMap(ctx, agent); err != nil || got != test.TokenName {
+		t.Fatalf("expected token %s, actual %q, error %v", test.TokenName, got, err)
+	}
+
+	// Charts of the Nested layout get the Agent block as well, to be upgraded
+	// in place.
+	values, err = teleport.RenderConfigMapValues(registerName, test.TokenName, key.JoinMethodToken, []string{"kube"}, nil, nil, teleport.TeleportVersionOverride(), test.AppVersionNested)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	nested := &corev1.ConfigMap{Data: map[string]string{
+		"values": values,
+	}}
+
+	cases := []struct {
+		name       string
+		cm         *corev1.ConfigMap
+		tkaVersion string
+		wantOk     bool
+	}{
+		{"agent-ok", agent, "1.0.0", true},
+		{"agent-needs-nested-block", agent, test.AppVersionNested, false},
+		{"nested-with-agent-block-ok", nested, test.AppVersionNested, true},
+		{"nested-still-has-nested-block", nested, "1.0.0", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ok, err := teleport.IsConfigMapLayoutUpToDate(c.cm, c.tkaVersion)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if ok != c.wantOk {
+				t.Fatalf("got %v, want %v", ok, c.wantOk)
+			}
+		})
+	}
+}
+
+func Test_GetTeleportVersionFromConfigMap(t *testing.T) {
+	teleport := New(test.NamespaceName, &config.Config{}, token.NewGenerator())
+
+	testCases := []struct {
+		name      string
+		configMap *corev1.ConfigMap
+		expected  string
+	}{
+		{
+			name:      "case 0: Read the version of the nested block",
+			configMap: test.NewNestedConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{"kube"}),
+			expected:  test.TeleportVersionForNested,
+		},
+		{
+			name:      "case 1: Read the version of the flat block the nested block leaves out",
+			configMap: test.NewDualBlockConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{"kube"}),
+			expected:  test.TeleportVersion,
+		},
+		{
+			name:      "case 2: Return no version without an override",
+			configMap: test.NewNestedConfigMapWithoutVersionOverride(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{"kube"}),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			version, err := teleport.GetTeleportVersionFromConfigMap(tc.configMap)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if version != tc.expected {
+				t.Fatalf("expected version %q, actual %q", tc.expected, version)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package teleport
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/trace"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/metrics"
+)
+
+// DelegatedJoinSpec returns the spec of the cluster's join token for its
+// delegated join method: the method and the rules an agent must match to
+// join, without roles.
+func (t *Teleport) DelegatedJoinSpec(ctx context.Context, cluster *capi.Cluster, settings *ClusterSettings) (types.ProvisionTokenSpecV2, error) {
+	switch settings.JoinMethod {
+	case key.JoinMethodKubernetes:
+		return t.KubernetesJoinSpec(ctx, cluster, settings)
+	case key.JoinMethodCloud:
+		return t.CloudJoinSpec(ctx, cluster)
+	default:
+		return types.ProvisionTokenSpecV2{}, microerror.Maskf(invalidConfigError, "join method %q is not delegated", settings.JoinMethod)
+	}
+}
+
+// EnsureDelegatedJoinToken creates or updates the cluster's join token for a
+// delegated join method and returns its name, which is not a secret. The
+// token never expires. It reports whether the token had to be written.
+func (t *Teleport) EnsureDelegatedJoinToken(ctx context.Context, registerName string, roles []string, spec types.ProvisionTokenSpecV2, labels map[string]string) (string, bool, error) {
+	teleportClient, err := t.Clients.Client()
+	if err != nil {
+		return "", false, microerror.Mask(err)
+	}
+
+	spec.Roles = key.RolesToSystemRoles(roles)
+	token, err := types.NewProvisionTokenFromSpec(key.GetJoinTokenName(registerName, string(spec.JoinMethod)), time.Time{}, spec)
+	if err != nil {
+		return "", false, microerror.Mask(err)
+	}
+	m := token.GetMetadata()
+	m.Expires = nil
+	m.Labels = t.tokenLabels(registerName, roles, labels)
+	token.SetMetadata(m)
+
+	existing, err := t.Tokens.Get(ctx, token.GetName())
+	if err != nil && !trace.IsNotFound(err) {
+		return "", false, microerror.Mask(err)
+	}
+	if existing != nil && isDelegatedJoinTokenUpToDate(existing, token) {
+		return token.GetName(), false, nil
+	}
+
+	if err := teleportClient.UpsertToken(ctx, token); err != nil {
+		return "", false, microerror.Mask(err)
+	}
+	t.Tokens.Upsert(token)
+	if existing == nil {
+		metrics.TokenGenerated(roles)
+	}
+	return token.GetName(), true, nil
+}
+
+// isDelegatedJoinTokenUpToDate reports whether the token in Teleport grants
+// the desired roles, with the desired join rules and labels.
+func isDelegatedJoinTokenUpToDate(existing, desired types.ProvisionToken) bool {
+	if existing.GetJoinMethod() != desired.GetJoinMethod() || rolesKey(existing) != rolesKey(desired) {
+		return false
+	}
+	if !existing.Expiry().IsZero() || !maps.Equal(existing.GetMetadata().Labels, desired.GetMetadata().Labels) {
+		return false
+	}
+	have, err := json.Marshal(joinRules(existing))
+	if err != nil {
+		return false
+	}
+	want, err := json.Marshal(joinRules(desired))
+	if err != nil {
+		return false
+	}
+	return string(have) == string(want)
+}
+
+// joinRules returns the rules an agent must match to join with the token.
+func joinRules(token types.ProvisionToken) any {
+	switch token.GetJoinMethod() {
+	case types.JoinMethodKubernetes:
+		return token.GetKubernetes()
+	case types.JoinMethodAzure:
+		return token.GetAzure()
+	case types.JoinMethodGCP:
+		return token.GetGCPRules()
+	default:
+		return token.GetAllowRules()
+	}
+}
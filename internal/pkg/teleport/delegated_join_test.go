@@ -0,0 +1,124 @@
+package teleport
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/gravitational/teleport/api/types"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_EnsureDelegatedJoinToken(t *testing.T) {
+	ctx := context.TODO()
+	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
+	roles := []string{key.RoleKube, key.RoleApp}
+
+	teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{})
+	tele := New(test.NamespaceName, &config.Config{ManagementClusterName: test.ManagementClusterName}, test.NewMockTokenGenerator(test.NewTokenName))
+	tele.Clients.SetClient(teleportClient, nil)
+
+	kubernetesSpec := func(jwks string) types.ProvisionTokenSpecV2 {
+		spec := types.ProvisionTokenSpecV2{
+			JoinMethod: types.JoinMethodKubernetes,
+			Kubernetes: &types.ProvisionTokenSpecV2Kubernetes{
+				Type:  types.KubernetesJoinTypeInCluster,
+				Allow: []*types.ProvisionTokenSpecV2Kubernetes_Rule{{ServiceAccount: key.GetKubeAgentServiceAccount()}},
+			},
+		}
+		if jwks != "" {
+			spec.Kubernetes.Type = types.KubernetesJoinTypeStaticJWKS
+			spec.Kubernetes.StaticJWKS = &types.ProvisionTokenSpecV2Kubernetes_StaticJWKSConfig{JWKS: jwks}
+		}
+		return spec
+	}
+	iamSpec := func(account string) types.ProvisionTokenSpecV2 {
+		return types.ProvisionTokenSpecV2{
+			JoinMethod: types.JoinMethodIAM,
+			Allow:      []*types.TokenRule{{AWSAccount: account}},
+		}
+	}
+
+	steps := []struct {
+		name            string
+		spec            types.ProvisionTokenSpecV2
+		labels          map[string]string
+		expectedWritten bool
+	}{
+		{
+			name:            "create the token",
+			spec:            kubernetesSpec(`{"keys":[]}`),
+			expectedWritten: true,
+		},
+		{
+			name:            "keep the token while it is up to date",
+			spec:            kubernetesSpec(`{"keys":[]}`),
+			expectedWritten: false,
+		},
+		{
+			name:            "update the token once the cluster's JWKS changed",
+			spec:            kubernetesSpec(`{"keys":[{"kid":"new"}]}`),
+			expectedWritten: true,
+		},
+		{
+			name:            "update the token once the labels changed",
+			spec:            kubernetesSpec(`{"keys":[{"kid":"new"}]}`),
+			labels:          map[string]string{"team": "platform"},
+			expectedWritten: true,
+		},
+		{
+			name:            "switch the token to in-cluster validation",
+			spec:            kubernetesSpec(""),
+			labels:          map[string]string{"team": "platform"},
+			expectedWritten: true,
+		},
+		{
+			name:            "create an iam token next to it",
+			spec:            iamSpec("123456789012"),
+			expectedWritten: true,
+		},
+		{
+			name:            "keep the iam token while it is up to date",
+			spec:            iamSpec("123456789012"),
+			expectedWritten: false,
+		},
+		{
+			name:            "update the iam token once the account changed",
+			spec:            iamSpec("210987654321"),
+			expectedWritten: true,
+		},
+	}
+
+	for _, step := range steps {
+		name, written, err := tele.EnsureDelegatedJoinToken(ctx, registerName, roles, step.spec, step.labels)
+		test.CheckError(t, false, err)
+		if written != step.expectedWritten {
+			t.Fatalf("%s: expected written %t, actual %t", step.name, step.expectedWritten, written)
+		}
+		if name != key.GetJoinTokenName(registerName, string(step.spec.JoinMethod)) {
+			t.Fatalf("%s: unexpected token name %s", step.name, name)
+		}
+
+		token, err := teleportClient.GetToken(ctx, name)
+		test.CheckError(t, false, err)
+		if token.GetJoinMethod() != step.spec.JoinMethod || !token.Expiry().IsZero() {
+			t.Fatalf("%s: expected a non-expiring %s join token, actual join method %q expiring %s", step.name, step.spec.JoinMethod, token.GetJoinMethod(), token.Expiry())
+		}
+		desiredSpec := step.spec
+		desiredSpec.Roles = key.RolesToSystemRoles(roles)
+		desired, err := types.NewProvisionTokenFromSpec(name, token.Expiry(), desiredSpec)
+		test.CheckError(t, false, err)
+		actualRules, _ := json.Marshal(joinRules(token))
+		expectedRules, _ := json.Marshal(joinRules(desired))
+		if string(actualRules) != string(expectedRules) {
+			t.Fatalf("%s: expected join rules %s, actual %s", step.name, expectedRules, actualRules)
+		}
+		labels := token.GetMetadata().Labels
+		if labels[key.TokenClusterLabel] != registerName || labels[key.TokenRolesLabel] != key.RolesToString(roles) || labels[key.TokenManagementClusterLabel] != test.ManagementClusterName {
+			t.Fatalf("%s: unexpected token labels %v", step.name, labels)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package teleport
+
+import (
+	"errors"
+
+	"github.com/giantswarm/microerror"
+)
+
+var notConnectedError = &microerror.Error{
+	Kind: "notConnectedError",
+	Desc: "no connection to Teleport has been established yet",
+}
+
+// IsNotConnected asserts notConnectedError.
+func IsNotConnected(err error) bool {
+	return errors.Is(err, notConnectedError)
+}
+
+var invalidConfigError = &microerror.Error{
+	Kind: "invalidConfigError",
+}
+
+// IsInvalidConfig asserts invalidConfigError.
+func IsInvalidConfig(err error) bool {
+	return errors.Is(err, invalidConfigError)
+}
+
+var unsupportedInfrastructureError = &microerror.Error{
+	Kind: "unsupportedInfrastructureError",
+	Desc: "no cloud join method is known for the cluster's infrastructure",
+}
+
+// IsUnsupportedInfrastructure asserts unsupportedInfrastructureError.
+func IsUnsupportedInfrastructure(err error) bool {
+	return errors.Is(err, unsupportedInfrastructureError)
+}
@@ -0,0 +1,81 @@
+package teleport
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/gravitational/teleport/api/client/proto"
+	"github.com/gravitational/teleport/api/types"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/metrics"
+)
+
+// instrumentedClient records latency and errors of every Teleport API call
+// made through the wrapped Client.
+type instrumentedClient struct {
+	client Client
+}
+
+// NewInstrumentedClient wraps c so that every call is reported to the
+// Teleport API metrics.
+func NewInstrumentedClient(c Client) Client {
+	return &instrumentedClient{client: c}
+}
+
+// Close closes the wrapped client's connection, if it has one.
+func (c *instrumentedClient) Close() error {
+	if closer, ok := c.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *instrumentedClient) Ping(ctx context.Context) (proto.PingResponse, error) {
+	start := time.Now()
+	resp, err := c.client.Ping(ctx)
+	metrics.ObserveTeleportRequest("Ping", start, err)
+	return resp, err
+}
+
+func (c *instrumentedClient) GetToken(ctx context.Context, name string) (types.ProvisionToken, error) {
+	start := time.Now()
+	token, err := c.client.GetToken(ctx, name)
+	metrics.ObserveTeleportRequest("GetToken", start, err)
+	return token, err
+}
+
+func (c *instrumentedClient) GetTokens(ctx context.Context) ([]types.ProvisionToken, error) {
+	start := time.Now()
+	tokens, err := c.client.GetTokens(ctx)
+	metrics.ObserveTeleportRequest("GetTokens", start, err)
+	return tokens, err
+}
+
+func (c *instrumentedClient) CreateToken(ctx context.Context, token types.ProvisionToken) error {
+	start := time.Now()
+	err := c.client.CreateToken(ctx, token)
+	metrics.ObserveTeleportRequest("CreateToken", start, err)
+	return err
+}
+
+func (c *instrumentedClient) UpsertToken(ctx context.Context, token types.ProvisionToken) error {
+	start := time.Now()
+	err := c.client.UpsertToken(ctx, token)
+	metrics.ObserveTeleportRequest("UpsertToken", start, err)
+	return err
+}
+
+func (c *instrumentedClient) DeleteToken(ctx context.Context, name string) error {
+	start := time.Now()
+	err := c.client.DeleteToken(ctx, name)
+	metrics.ObserveTeleportRequest("DeleteToken", start, err)
+	return err
+}
+
+func (c *instrumentedClient) GetKubernetesServers(ctx context.Context) ([]types.KubeServer, error) {
+	start := time.Now()
+	servers, err := c.client.GetKubernetesServers(ctx)
+	metrics.ObserveTeleportRequest("GetKubernetesServers", start, err)
+	return servers, err
+}
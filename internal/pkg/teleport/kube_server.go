@@ -0,0 +1,204 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+	apidefaults "github.com/gravitational/teleport/api/defaults"
+	"github.com/gravitational/teleport/api/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const DefaultKubeServerResyncInterval = 1 * time.Minute
+
+// KubeServerCache keeps the Kubernetes servers registered in Teleport in
+// memory, indexed by the name of the Kubernetes cluster they serve, so that
+// heartbeat checks do not list every server on the auth server for every
+// cluster. It is a manager Runnable that relists the servers every
+// ResyncInterval, so heartbeats are seen at most that late.
+type KubeServerCache struct {
+	Log            logr.Logger
+	ResyncInterval time.Duration
+
+	clients *ClientProvider
+
+	mu        sync.RWMutex
+	synced    bool
+	byCluster map[string][]types.KubeServer
+}
+
+func NewKubeServerCache(clients *ClientProvider) *KubeServerCache {
+	c := &KubeServerCache{
+		Log:            logr.Discard(),
+		ResyncInterval: DefaultKubeServerResyncInterval,
+		clients:        clients,
+	}
+	c.reset()
+	return c
+}
+
+// Start implements manager.Runnable.
+func (c *KubeServerCache) Start(ctx context.Context) error {
+	for {
+		if err := c.Resync(ctx); err != nil && !IsNotConnected(err) {
+			c.Log.Error(err, "Failed to resync the Teleport Kubernetes server cache")
+		}
+
+		timer := time.NewTimer(c.ResyncInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+func (c *KubeServerCache) NeedLeaderElection() bool {
+	return false
+}
+
+// Resync replaces the cache content with the servers currently in Teleport.
+func (c *KubeServerCache) Resync(ctx context.Context) error {
+	teleportClient, err := c.clients.Client()
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	servers, err := teleportClient.GetKubernetesServers(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+	for _, server := range servers {
+		if server.GetCluster() == nil {
+			continue
+		}
+		name := server.GetCluster().GetName()
+		c.byCluster[name] = append(c.byCluster[name], server)
+	}
+	c.synced = true
+	return nil
+}
+
+// Invalidate drops all cached servers. The next lookup relists them from
+// Teleport.
+func (c *KubeServerCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+}
+
+// ForCluster returns the servers of the Kubernetes cluster registered with
+// the given name. The cache is synced first if it has not been yet.
+func (c *KubeServerCache) ForCluster(ctx context.Context, registerName string) ([]types.KubeServer, error) {
+	c.mu.RLock()
+	synced := c.synced
+	c.mu.RUnlock()
+	if !synced {
+		if err := c.Resync(ctx); err != nil {
+			return nil, microerror.Mask(err)
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.byCluster[registerName], nil
+}
+
+func (c *KubeServerCache) reset() {
+	c.synced = false
+	c.byCluster = map[string][]types.KubeServer{}
+}
+
+// IsAgentHeartbeatingSince reports whether a teleport-kube-agent serving the
+// cluster has sent a heartbeat after since. Agents announce their presence
+// with an expiry one announce TTL ahead of each heartbeat.
+func (t *Teleport) IsAgentHeartbeatingSince(ctx context.Context, registerName string, since time.Time) (bool, error) {
+	servers, err := t.KubeServers.ForCluster(ctx, registerName)
+	if err != nil {
+		return false, microerror.Mask(err)
+	}
+	for _, server := range servers {
+		if server.Expiry().Add(-apidefaults.ServerAnnounceTTL).After(since) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AgentStartSource returns when the oldest running kube agent pod of a
+// workload cluster started, or the zero time if none is running. Agent pods
+// are the ones running with the given `<namespace>:<name>` service account.
+type AgentStartSource interface {
+	GetAgentStartTime(ctx context.Context, cluster *capi.Cluster, serviceAccount string) (time.Time, error)
+}
+
+// AgentStartSourceFunc adapts a function to an AgentStartSource.
+type AgentStartSourceFunc func(ctx context.Context, cluster *capi.Cluster, serviceAccount string) (time.Time, error)
+
+func (f AgentStartSourceFunc) GetAgentStartTime(ctx context.Context, cluster *capi.Cluster, serviceAccount string) (time.Time, error) {
+	return f(ctx, cluster, serviceAccount)
+}
+
+// GetClusterAgentStartTime lists the agent pods on the cluster's API server
+// and returns the start time of the oldest running one.
+func GetClusterAgentStartTime(ctx context.Context, ctrlClient client.Reader, cluster *capi.Cluster, serviceAccount string) (time.Time, error) {
+	namespace, name, ok := strings.Cut(serviceAccount, ":")
+	if !ok {
+		return time.Time{}, microerror.Mask(fmt.Errorf("invalid agent service account %q, expected <namespace>:<name>", serviceAccount))
+	}
+	clientset, err := getClusterClientset(ctx, ctrlClient, cluster)
+	if err != nil {
+		return time.Time{}, microerror.Mask(err)
+	}
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.serviceAccountName", name).String(),
+	})
+	if err != nil {
+		return time.Time{}, microerror.Mask(fmt.Errorf("failed to list agent pods of cluster %s: %w", cluster.Name, err))
+	}
+
+	var startedAt time.Time
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.StartTime == nil {
+			continue
+		}
+		if startedAt.IsZero() || pod.Status.StartTime.Time.Before(startedAt) {
+			startedAt = pod.Status.StartTime.Time
+		}
+	}
+	return startedAt, nil
+}
+
+// IsAgentRestartedSince reports whether the cluster's teleport-kube-agent was
+// restarted after since and has heartbeated since, so that it runs with the
+// values written at that time. A heartbeat alone is no proof: an agent that
+// kept running still uses the values it was started with. Every running
+// agent pod must have started after since.
+func (t *Teleport) IsAgentRestartedSince(ctx context.Context, cluster *capi.Cluster, settings *ClusterSettings, since time.Time) (bool, error) {
+	startedAt, err := t.AgentStarts.GetAgentStartTime(ctx, cluster, settings.KubernetesJoin.ServiceAccount)
+	if err != nil {
+		return false, microerror.Mask(err)
+	}
+	if !startedAt.After(since) {
+		return false, nil
+	}
+	heartbeating, err := t.IsAgentHeartbeatingSince(ctx, settings.RegisterName, startedAt)
+	if err != nil {
+		return false, microerror.Mask(err)
+	}
+	return heartbeating, nil
+}
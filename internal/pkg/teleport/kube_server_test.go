@@ -0,0 +1,136 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/api/types"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+// kubeServerCountingClient counts the Kubernetes server lists that reach
+// Teleport.
+type kubeServerCountingClient struct {
+	*test.FakeTeleportClient
+	lists atomic.Int32
+}
+
+func (c *kubeServerCountingClient) GetKubernetesServers(ctx context.Context) ([]types.KubeServer, error) {
+	c.lists.Add(1)
+	return c.FakeTeleportClient.GetKubernetesServers(ctx)
+}
+
+func Test_IsAgentHeartbeatingSince(t *testing.T) {
+	ctx := context.TODO()
+	rotatedAt := time.Now().Add(-time.Hour)
+
+	var servers []types.KubeServer
+	for i := 0; i < 10; i++ {
+		servers = append(servers, test.NewKubeServer(fmt.Sprintf("cluster-%d", i), "host", "host"))
+	}
+	servers = append(servers, test.NewKubeServer("stale", "host", "host", rotatedAt.Add(-time.Minute)))
+	teleportClient := &kubeServerCountingClient{FakeTeleportClient: test.NewTeleportClient(test.FakeTeleportClientConfig{KubeServers: servers})}
+	tele := New(test.NamespaceName, &config.Config{}, nil)
+	tele.Clients.SetClient(teleportClient, nil)
+
+	// Checking every cluster lists the servers only once.
+	for i := 0; i < 10; i++ {
+		heartbeating, err := tele.IsAgentHeartbeatingSince(ctx, key.GetRegisterName(test.ManagementClusterName, fmt.Sprintf("cluster-%d", i)), rotatedAt)
+		test.CheckError(t, false, err)
+		if !heartbeating {
+			t.Fatalf("expected the agent of cluster-%d to be heartbeating", i)
+		}
+	}
+	if lists := teleportClient.lists.Load(); lists != 1 {
+		t.Fatalf("expected 1 list of Kubernetes servers, actual %d", lists)
+	}
+
+	for _, clusterName := range []string{"stale", "unknown"} {
+		heartbeating, err := tele.IsAgentHeartbeatingSince(ctx, key.GetRegisterName(test.ManagementClusterName, clusterName), rotatedAt)
+		test.CheckError(t, false, err)
+		if heartbeating {
+			t.Fatalf("expected the agent of %s not to be heartbeating", clusterName)
+		}
+	}
+
+	// Servers registered after the last resync are seen once it relists.
+	teleportClient.FakeTeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{KubeServers: append(servers, test.NewKubeServer("new", "host", "host"))})
+	registerName := key.GetRegisterName(test.ManagementClusterName, "new")
+	if heartbeating, _ := tele.IsAgentHeartbeatingSince(ctx, registerName, rotatedAt); heartbeating {
+		t.Fatalf("expected the cached servers to be served until the next resync")
+	}
+	test.CheckError(t, false, tele.KubeServers.Resync(ctx))
+	heartbeating, err := tele.IsAgentHeartbeatingSince(ctx, registerName, rotatedAt)
+	test.CheckError(t, false, err)
+	if !heartbeating {
+		t.Fatalf("expected the agent of the new cluster to be heartbeating after a resync")
+	}
+}
+
+func Test_IsAgentRestartedSince(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Now()
+	rotatedAt := now.Add(-time.Hour)
+
+	testCases := []struct {
+		name              string
+		agentStartedAt    time.Time
+		heartbeat         time.Time
+		expectedRestarted bool
+	}{
+		{
+			name:              "case 0: Restarted agent heartbeating since its start",
+			agentStartedAt:    rotatedAt.Add(time.Minute),
+			heartbeat:         now,
+			expectedRestarted: true,
+		},
+		{
+			name:           "case 1: Agent heartbeating without having been restarted",
+			agentStartedAt: rotatedAt.Add(-time.Hour),
+			heartbeat:      now,
+		},
+		{
+			name:           "case 2: Restarted agent not heartbeating since its start",
+			agentStartedAt: rotatedAt.Add(time.Minute),
+			heartbeat:      rotatedAt.Add(time.Second),
+		},
+		{
+			name:      "case 3: No running agent",
+			heartbeat: now,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, nil, time.Time{})
+			settings := &ClusterSettings{
+				RegisterName: key.GetRegisterName(test.ManagementClusterName, test.ClusterName),
+			}
+			settings.KubernetesJoin.ServiceAccount = key.GetKubeAgentServiceAccount()
+
+			tele := New(test.NamespaceName, &config.Config{}, nil)
+			tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{
+				KubeServers: []types.KubeServer{test.NewKubeServer(test.ClusterName, "host", "host", tc.heartbeat)},
+			}), nil)
+			tele.AgentStarts = AgentStartSourceFunc(func(ctx context.Context, cluster *capi.Cluster, serviceAccount string) (time.Time, error) {
+				if serviceAccount != key.GetKubeAgentServiceAccount() {
+					t.Fatalf("unexpected agent service account %s", serviceAccount)
+				}
+				return tc.agentStartedAt, nil
+			})
+
+			restarted, err := tele.IsAgentRestartedSince(ctx, cluster, settings, rotatedAt)
+			test.CheckError(t, false, err)
+			if restarted != tc.expectedRestarted {
+				t.Fatalf("expected restarted %t, actual %t", tc.expectedRestarted, restarted)
+			}
+		})
+	}
+}
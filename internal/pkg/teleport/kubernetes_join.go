@@ -0,0 +1,155 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/gravitational/teleport/api/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/cluster-api/util/kubeconfig"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+const (
+	workloadRequestTimeout = 10 * time.Second
+
+	DefaultJWKSRefreshInterval = 10 * time.Minute
+)
+
+// JWKSSource returns the JSON Web Key Set a workload cluster signs its
+// service account tokens with.
+type JWKSSource interface {
+	GetJWKS(ctx context.Context, cluster *capi.Cluster) (string, error)
+}
+
+// JWKSSourceFunc adapts a function to a JWKSSource.
+type JWKSSourceFunc func(ctx context.Context, cluster *capi.Cluster) (string, error)
+
+func (f JWKSSourceFunc) GetJWKS(ctx context.Context, cluster *capi.Cluster) (string, error) {
+	return f(ctx, cluster)
+}
+
+// GetClusterJWKS fetches the JWKS from the cluster's API server.
+func GetClusterJWKS(ctx context.Context, ctrlClient client.Reader, cluster *capi.Cluster) (string, error) {
+	clientset, err := getClusterClientset(ctx, ctrlClient, cluster)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	jwks, err := clientset.RESTClient().Get().AbsPath("/openid/v1/jwks").DoRaw(ctx)
+	if err != nil {
+		return "", microerror.Mask(fmt.Errorf("failed to get JWKS of cluster %s: %w", cluster.Name, err))
+	}
+	return string(jwks), nil
+}
+
+// getClusterClientset returns a client of the cluster's API server, with the
+// kubeconfig CAPI stores in the `<cluster>-kubeconfig` Secret.
+func getClusterClientset(ctx context.Context, ctrlClient client.Reader, cluster *capi.Cluster) (*kubernetes.Clientset, error) {
+	kubeconfigData, err := kubeconfig.FromSecret(ctx, ctrlClient, client.ObjectKeyFromObject(cluster))
+	if err != nil {
+		return nil, microerror.Mask(fmt.Errorf("failed to get kubeconfig of cluster %s: %w", cluster.Name, err))
+	}
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfigData)
+	if err != nil {
+		return nil, microerror.Mask(fmt.Errorf("failed to parse kubeconfig of cluster %s: %w", cluster.Name, err))
+	}
+	restConfig.Timeout = workloadRequestTimeout
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	return clientset, nil
+}
+
+// jwksCache keeps the JWKS fetched from each workload cluster, with the time
+// it was fetched.
+type jwksCache struct {
+	mu      sync.Mutex
+	entries map[client.ObjectKey]jwksCacheEntry
+}
+
+type jwksCacheEntry struct {
+	jwks      string
+	fetchedAt time.Time
+}
+
+func (c *jwksCache) get(key client.ObjectKey) (jwksCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+func (c *jwksCache) set(key client.ObjectKey, jwks string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[client.ObjectKey]jwksCacheEntry{}
+	}
+	c.entries[key] = jwksCacheEntry{jwks: jwks, fetchedAt: time.Now()}
+}
+
+// KubernetesJoinSpec returns the spec of the cluster's kubernetes join token,
+// allowing the agent's service account. Its tokens are validated against the
+// cluster's JWKS, fetched unless it is set, or in Teleport's own cluster.
+func (t *Teleport) KubernetesJoinSpec(ctx context.Context, cluster *capi.Cluster, settings *ClusterSettings) (types.ProvisionTokenSpecV2, error) {
+	kubernetesJoin := settings.KubernetesJoin
+	spec := types.ProvisionTokenSpecV2{
+		JoinMethod: types.JoinMethodKubernetes,
+		Kubernetes: &types.ProvisionTokenSpecV2Kubernetes{
+			Type: types.KubernetesJoinTypeInCluster,
+			Allow: []*types.ProvisionTokenSpecV2Kubernetes_Rule{
+				{ServiceAccount: kubernetesJoin.ServiceAccount},
+			},
+		},
+	}
+	if kubernetesJoin.InCluster {
+		return spec, nil
+	}
+
+	jwks := kubernetesJoin.JWKS
+	if jwks == "" {
+		var err error
+		jwks, err = t.clusterJWKS(ctx, cluster, settings.RegisterName)
+		if err != nil {
+			return types.ProvisionTokenSpecV2{}, microerror.Mask(err)
+		}
+	}
+	spec.Kubernetes.Type = types.KubernetesJoinTypeStaticJWKS
+	spec.Kubernetes.StaticJWKS = &types.ProvisionTokenSpecV2Kubernetes_StaticJWKSConfig{JWKS: jwks}
+	return spec, nil
+}
+
+// clusterJWKS returns the cluster's JWKS. It is fetched at most every
+// JWKSRefreshInterval, so rotated keys are picked up that late. If it cannot
+// be fetched, the JWKS of the cluster's existing kubernetes join token is
+// kept, so that a short outage of the workload cluster's API server does not
+// fail the reconcile.
+func (t *Teleport) clusterJWKS(ctx context.Context, cluster *capi.Cluster, registerName string) (string, error) {
+	cacheKey := client.ObjectKeyFromObject(cluster)
+	cached, ok := t.jwks.get(cacheKey)
+	if ok && time.Since(cached.fetchedAt) < t.JWKSRefreshInterval {
+		return cached.jwks, nil
+	}
+
+	jwks, err := t.JWKS.GetJWKS(ctx, cluster)
+	if err != nil {
+		if ok {
+			return cached.jwks, nil
+		}
+		existing, getErr := t.Tokens.Get(ctx, key.GetJoinTokenName(registerName, key.JoinMethodKubernetes))
+		if getErr == nil && existing.GetKubernetes() != nil && existing.GetKubernetes().StaticJWKS != nil {
+			return existing.GetKubernetes().StaticJWKS.JWKS, nil
+		}
+		return "", microerror.Mask(err)
+	}
+	t.jwks.set(cacheKey, jwks)
+	return jwks, nil
+}
@@ -0,0 +1,53 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_KubernetesJoinSpec_JWKSRefresh(t *testing.T) {
+	ctx := context.TODO()
+	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, nil, time.Time{})
+	settings := &ClusterSettings{RegisterName: key.GetRegisterName(test.ManagementClusterName, test.ClusterName)}
+	settings.KubernetesJoin.ServiceAccount = key.GetKubeAgentServiceAccount()
+
+	fetches := 0
+	jwks := `{"keys":[{"kid":"1"}]}`
+	var fetchErr error
+	tele := New(test.NamespaceName, &config.Config{}, nil)
+	tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{}), nil)
+	tele.JWKS = JWKSSourceFunc(func(ctx context.Context, cluster *capi.Cluster) (string, error) {
+		fetches++
+		return jwks, fetchErr
+	})
+	expectJWKS := func(expected string, expectedFetches int) {
+		t.Helper()
+		spec, err := tele.KubernetesJoinSpec(ctx, cluster, settings)
+		test.CheckError(t, false, err)
+		if actual := spec.Kubernetes.StaticJWKS.JWKS; actual != expected {
+			t.Fatalf("expected JWKS %q, actual %q", expected, actual)
+		}
+		if fetches != expectedFetches {
+			t.Fatalf("expected %d JWKS fetches, actual %d", expectedFetches, fetches)
+		}
+	}
+
+	// The JWKS is only fetched again once the refresh interval is over.
+	expectJWKS(`{"keys":[{"kid":"1"}]}`, 1)
+	jwks = `{"keys":[{"kid":"2"}]}`
+	expectJWKS(`{"keys":[{"kid":"1"}]}`, 1)
+	tele.JWKSRefreshInterval = 0
+	expectJWKS(`{"keys":[{"kid":"2"}]}`, 2)
+
+	// A failed fetch keeps the last JWKS.
+	fetchErr = fmt.Errorf("workload cluster unreachable")
+	expectJWKS(`{"keys":[{"kid":"2"}]}`, 3)
+}
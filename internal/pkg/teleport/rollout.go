@@ -0,0 +1,232 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+// GetVersionRollout returns the operator's TeleportVersionRollout, or nil if
+// it does not exist.
+func (t *Teleport) GetVersionRollout(ctx context.Context, ctrlClient client.Client) (*v1alpha1.TeleportVersionRollout, error) {
+	rollout := &v1alpha1.TeleportVersionRollout{}
+	if err := ctrlClient.Get(ctx, client.ObjectKey{Name: key.TeleportOperatorConfigName, Namespace: t.Namespace}, rollout); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, microerror.Mask(fmt.Errorf("failed to get TeleportVersionRollout: %w", err))
+	}
+	return rollout, nil
+}
+
+// EnsureVersionRollout returns the operator's TeleportVersionRollout,
+// creating it with an empty status if it is missing.
+func (t *Teleport) EnsureVersionRollout(ctx context.Context, ctrlClient client.Client) (*v1alpha1.TeleportVersionRollout, error) {
+	rollout, err := t.GetVersionRollout(ctx, ctrlClient)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if rollout != nil {
+		return rollout, nil
+	}
+
+	rollout = &v1alpha1.TeleportVersionRollout{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.TeleportOperatorConfigName,
+			Namespace: t.Namespace,
+		},
+	}
+	if err := ctrlClient.Create(ctx, rollout); err != nil {
+		return nil, microerror.Mask(fmt.Errorf("failed to create TeleportVersionRollout: %w", err))
+	}
+	return rollout, nil
+}
+
+// ClusterTeleportVersion returns the Teleport version to render into the
+// cluster's values ConfigMap, see RolloutTeleportVersion. Without a rollout
+// policy every cluster gets the configured version at once. While the
+// server version the configured one is checked against is unknown, the
+// cluster keeps the version in its values.
+func (t *Teleport) ClusterTeleportVersion(ctx context.Context, ctrlClient client.Client, cluster *capi.Cluster, configMap *corev1.ConfigMap) (string, error) {
+	if configMap == nil {
+		return t.TeleportVersionOverride(), nil
+	}
+	current, err := t.GetTeleportVersionFromConfigMap(configMap)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	version := t.LastAgentTeleportVersion()
+	if version.ServerVersionUnknown {
+		return current, nil
+	}
+	target := version.Version
+	if t.Config().TeleportVersionRollout == nil {
+		return target, nil
+	}
+
+	rollout, err := t.GetVersionRollout(ctx, ctrlClient)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	var status *v1alpha1.TeleportVersionRolloutStatus
+	if rollout != nil {
+		status = &rollout.Status
+	}
+	return RolloutTeleportVersion(status, target, client.ObjectKeyFromObject(cluster).String(), current), nil
+}
+
+// RolloutTeleportVersion returns the Teleport version a cluster, named
+// namespace/name, with current in its values is pinned to while target is
+// rolled out: target once the cluster's wave was released, current until
+// then. Until the rollout of target started, every cluster keeps current.
+// Clusters that are not part of the rollout, e.g. created after it started,
+// get target.
+func RolloutTeleportVersion(status *v1alpha1.TeleportVersionRolloutStatus, target, cluster, current string) string {
+	if status == nil || status.Phase == "" || status.ToVersion != target {
+		return current
+	}
+	for _, wave := range status.Waves {
+		if slices.Contains(wave.Clusters, cluster) {
+			if wave.Phase == v1alpha1.RolloutWavePhasePending {
+				return current
+			}
+			return target
+		}
+	}
+	return target
+}
+
+// PlanRolloutWaves assigns the clusters, named namespace/name, to the waves
+// of the policy, in order. A selector wave takes the clusters it selects
+// that no earlier wave took, a percent wave takes clusters until that
+// percentage of all clusters, rounded up, is released. Clusters no wave
+// takes join the last one. Clusters being deleted are left out.
+func PlanRolloutWaves(policy *key.VersionRollout, clusters []capi.Cluster) ([]v1alpha1.RolloutWaveStatus, error) {
+	var candidates []capi.Cluster
+	for _, cluster := range clusters {
+		if cluster.DeletionTimestamp.IsZero() {
+			candidates = append(candidates, cluster)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b capi.Cluster) int {
+		return strings.Compare(client.ObjectKeyFromObject(&a).String(), client.ObjectKeyFromObject(&b).String())
+	})
+
+	assigned := map[string]bool{}
+	waves := make([]v1alpha1.RolloutWaveStatus, 0, len(policy.Waves))
+	for _, wave := range policy.Waves {
+		status := v1alpha1.RolloutWaveStatus{Name: wave.Name, Phase: v1alpha1.RolloutWavePhasePending}
+
+		var selector labels.Selector
+		if wave.Selector != "" {
+			var err error
+			if selector, err = labels.Parse(wave.Selector); err != nil {
+				return nil, microerror.Mask(err)
+			}
+		}
+		released := (wave.Percent*len(candidates) + 99) / 100
+		for i := range candidates {
+			name := client.ObjectKeyFromObject(&candidates[i]).String()
+			if assigned[name] {
+				continue
+			}
+			if selector != nil && !selector.Matches(labels.Set(candidates[i].Labels)) {
+				continue
+			}
+			if selector == nil && len(assigned) >= released {
+				break
+			}
+			assigned[name] = true
+			status.Clusters = append(status.Clusters, name)
+		}
+		waves = append(waves, status)
+	}
+
+	for i := range candidates {
+		if name := client.ObjectKeyFromObject(&candidates[i]).String(); !assigned[name] {
+			waves[len(waves)-1].Clusters = append(waves[len(waves)-1].Clusters, name)
+		}
+	}
+	return waves, nil
+}
+
+// UnhealthyRolloutClusters returns the clusters, named namespace/name, whose
+// kube agents do not report the Teleport version in Teleport: no agent of
+// the cluster heartbeats with it. The version is expected the way it is
+// rendered for the cluster's values layout: a version below the layout's
+// bundled one is dropped, so its agents report the bundled version. An
+// empty version is the chart's bundled one, any heartbeating agent is
+// healthy then. Clusters that were deleted are left out.
+func (t *Teleport) UnhealthyRolloutClusters(ctx context.Context, ctrlClient client.Client, clusters []string, version string) ([]string, error) {
+	if len(clusters) == 0 {
+		return nil, nil
+	}
+
+	teleportClient, err := t.Clients.Client()
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	servers, err := teleportClient.GetKubernetesServers(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	reported := map[string][]string{}
+	now := time.Now()
+	for _, server := range servers {
+		if server.GetCluster() == nil || !server.Expiry().After(now) {
+			continue
+		}
+		name := server.GetCluster().GetName()
+		reported[name] = append(reported[name], strings.TrimPrefix(server.GetTeleportVersion(), "v"))
+	}
+
+	layouts := t.Config().GetValuesLayouts()
+	var unhealthy []string
+	for _, name := range clusters {
+		namespace, clusterName, _ := strings.Cut(name, "/")
+		teleportCluster := &v1alpha1.TeleportCluster{}
+		if err := ctrlClient.Get(ctx, types.NamespacedName{Name: clusterName, Namespace: namespace}, teleportCluster); apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, microerror.Mask(fmt.Errorf("failed to get TeleportCluster: %w", err))
+		}
+
+		expected := strings.TrimPrefix(renderedTeleportVersion(layouts, teleportCluster.Status.ValuesLayout, version), "v")
+		versions := reported[teleportCluster.Status.RegisterName]
+		if len(versions) == 0 || (expected != "" && !slices.Contains(versions, expected)) {
+			unhealthy = append(unhealthy, name)
+		}
+	}
+	return unhealthy, nil
+}
+
+// renderedTeleportVersion returns the Teleport version the agents of a
+// cluster with the named values layout run once version is rolled out, or
+// "" if it is the chart's bundled one and not known.
+func renderedTeleportVersion(layouts *key.ValuesLayouts, layoutName v1alpha1.ValuesLayout, version string) string {
+	layout := layouts.Get(string(layoutName))
+	if layout == nil {
+		layout = layouts.Get(layouts.Default)
+	}
+	if layout == nil || version == "" {
+		return version
+	}
+	if override := layout.ResolveTeleportVersionOverride(version); override != "" {
+		return override
+	}
+	return layout.BundledTeleportVersion
+}
@@ -0,0 +1,177 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	teleportTypes "github.com/gravitational/teleport/api/types"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_PlanRolloutWaves(t *testing.T) {
+	var clusters []capi.Cluster
+	for i := 0; i < 5; i++ {
+		cluster := test.NewCluster(fmt.Sprintf("c%d", i), test.NamespaceName, nil, time.Time{})
+		if i == 3 {
+			cluster.Labels = map[string]string{"stage": "canary"}
+		}
+		clusters = append(clusters, *cluster)
+	}
+	clusters = append(clusters, *test.NewCluster("deleted", test.NamespaceName, []string{key.TeleportOperatorFinalizer}, time.Now()))
+	name := func(cluster string) string {
+		return test.NamespaceName + "/" + cluster
+	}
+
+	testCases := []struct {
+		name     string
+		waves    []key.RolloutWave
+		expected [][]string
+	}{
+		{
+			name: "case 0: Release selected clusters first, then percentages of all clusters",
+			waves: []key.RolloutWave{
+				{Name: "canary", Selector: "stage=canary"},
+				{Name: "half", Percent: 50},
+				{Name: "rest", Percent: 100},
+			},
+			expected: [][]string{{name("c3")}, {name("c0"), name("c1")}, {name("c2"), name("c4")}},
+		},
+		{
+			name: "case 1: Add clusters no wave selects to the last wave",
+			waves: []key.RolloutWave{
+				{Name: "canary", Selector: "stage=canary"},
+				{Name: "some", Percent: 20},
+			},
+			expected: [][]string{{name("c3")}, {name("c0"), name("c1"), name("c2"), name("c4")}},
+		},
+		{
+			name: "case 2: Leave a wave empty if earlier waves released its percentage",
+			waves: []key.RolloutWave{
+				{Name: "first", Percent: 60},
+				{Name: "second", Percent: 40},
+				{Name: "rest", Percent: 100},
+			},
+			expected: [][]string{{name("c0"), name("c1"), name("c2")}, nil, {name("c3"), name("c4")}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			waves, err := PlanRolloutWaves(&key.VersionRollout{Waves: tc.waves}, clusters)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var actual [][]string
+			for i, wave := range waves {
+				if wave.Name != tc.waves[i].Name || wave.Phase != v1alpha1.RolloutWavePhasePending {
+					t.Fatalf("unexpected wave %+v", wave)
+				}
+				actual = append(actual, wave.Clusters)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("expected waves %v, actual %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_RolloutTeleportVersion(t *testing.T) {
+	status := &v1alpha1.TeleportVersionRolloutStatus{
+		FromVersion: "1.0.0",
+		ToVersion:   "1.1.0",
+		Phase:       v1alpha1.RolloutPhaseProgressing,
+		Waves: []v1alpha1.RolloutWaveStatus{
+			{Name: "canary", Phase: v1alpha1.RolloutWavePhaseHealthy, Clusters: []string{"org-a/canary"}},
+			{Name: "rest", Phase: v1alpha1.RolloutWavePhasePending, Clusters: []string{"org-a/rest"}},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		status   *v1alpha1.TeleportVersionRolloutStatus
+		target   string
+		cluster  string
+		expected string
+	}{
+		{name: "case 0: Roll out to a released wave", status: status, target: "1.1.0", cluster: "org-a/canary", expected: "1.1.0"},
+		{name: "case 1: Keep the version of a pending wave", status: status, target: "1.1.0", cluster: "org-a/rest", expected: "1.0.0"},
+		{name: "case 2: Roll out to a cluster created after the rollout started", status: status, target: "1.1.0", cluster: "org-a/new", expected: "1.1.0"},
+		{name: "case 3: Keep the version until the rollout of the target started", status: status, target: "1.2.0", cluster: "org-a/canary", expected: "1.0.0"},
+		{name: "case 4: Keep the version without a rollout", target: "1.1.0", cluster: "org-a/canary", expected: "1.0.0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := RolloutTeleportVersion(tc.status, tc.target, tc.cluster, "1.0.0"); actual != tc.expected {
+				t.Fatalf("expected version %q, actual %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_UnhealthyRolloutClusters(t *testing.T) {
+	kubeServer := func(clusterName, version string, heartbeat time.Time) teleportTypes.KubeServer {
+		server := test.NewKubeServer(clusterName, "host", "host", heartbeat)
+		server.(*teleportTypes.KubernetesServerV3).Spec.Version = version
+		return server
+	}
+	teleportCluster := func(name string, layout v1alpha1.ValuesLayout) client.Object {
+		teleportCluster := test.NewTeleportCluster(name, test.NamespaceName, v1alpha1.TeleportClusterSpec{})
+		teleportCluster.Status.RegisterName = key.GetRegisterName(test.ManagementClusterName, name)
+		teleportCluster.Status.ValuesLayout = layout
+		return teleportCluster
+	}
+
+	// Versions below the bundled one are dropped from the values of Nested
+	// clusters, whose agents keep reporting the bundled version.
+	fakeClient, err := test.NewFakeK8sClientFromObjects(
+		teleportCluster("upgraded", v1alpha1.ValuesLayoutDual),
+		teleportCluster("outdated", ""),
+		teleportCluster("gone", v1alpha1.ValuesLayoutDual),
+		teleportCluster("bundled", v1alpha1.ValuesLayoutNested),
+		teleportCluster("downgraded", v1alpha1.ValuesLayoutNested),
+	)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+	tele := New(test.NamespaceName, &config.Config{}, nil)
+	tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{
+		KubeServers: []teleportTypes.KubeServer{
+			kubeServer("upgraded", "v1.1.0", time.Now()),
+			kubeServer("outdated", "1.0.0", time.Now()),
+			kubeServer("gone", "1.1.0", time.Now().Add(-time.Hour)),
+			kubeServer("bundled", test.TeleportVersionForNested, time.Now()),
+			kubeServer("downgraded", "1.1.0", time.Now()),
+		},
+	}), &config.IdentityConfig{IdentityFile: test.IdentityFileValue, LastRead: time.Now()})
+
+	var clusters []string
+	for _, name := range []string{"upgraded", "outdated", "gone", "deleted", "bundled", "downgraded"} {
+		clusters = append(clusters, test.NamespaceName+"/"+name)
+	}
+	unhealthy, err := tele.UnhealthyRolloutClusters(context.TODO(), fakeClient, clusters, "1.1.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{test.NamespaceName + "/outdated", test.NamespaceName + "/gone", test.NamespaceName + "/downgraded"}
+	if !reflect.DeepEqual(unhealthy, expected) {
+		t.Fatalf("expected unhealthy clusters %v, actual %v", expected, unhealthy)
+	}
+
+	unhealthy, err = tele.UnhealthyRolloutClusters(context.TODO(), fakeClient, clusters, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(unhealthy, []string{test.NamespaceName + "/gone"}) {
+		t.Fatalf("expected only the cluster without heartbeat to be unhealthy, actual %v", unhealthy)
+	}
+}
@@ -140,3 +140,94 @@ func (t *Teleport) GetKubeconfigSecret(ctx context.Context, ctrlClient client.Cl
 
 	return secret, nil
 }
+
+// GetAgentTokenSecret returns the Secret holding the kube agent's static join
+// token, or nil if it does not exist, i.e. the token is kept in the values
+// ConfigMap.
+func (t *Teleport) GetAgentTokenSecret(ctx context.Context, ctrlClient client.Client, clusterName string, clusterNamespace string) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	secretName := key.GetAgentTokenSecretName(clusterName, t.Config().AppName) //#nosec G101
+	if err := ctrlClient.Get(ctx, types.NamespacedName{Name: secretName, Namespace: clusterNamespace}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, microerror.Mask(fmt.Errorf("failed to get Secret: %w", err))
+	}
+	return secret, nil
+}
+
+// GetTokenFromAgentTokenSecret returns the static join token from the values
+// in the kube agent's token Secret.
+func (t *Teleport) GetTokenFromAgentTokenSecret(ctx context.Context, secret *corev1.Secret) (string, error) {
+	valuesYaml, layout, err := parseValues(string(secret.Data["values"]), t.Config().GetValuesLayouts())
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	token, ok := valuesYaml[layout.Key("authToken")].(string)
+	if !ok {
+		return "", microerror.Mask(fmt.Errorf("malformed Secret: key `authToken` not found"))
+	}
+	return token, nil
+}
+
+// RenderAgentTokenValues returns the values the operator wants the kube
+// agent's token Secret to contain.
+func (t *Teleport) RenderAgentTokenValues(token string, tkaVersion string) (string, error) {
+	values, err := key.GetTokenValuesFromTemplate(token, t.Config().GetValuesLayouts(), tkaVersion)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	return values, nil
+}
+
+// EnsureAgentTokenSecret writes the static join token into the kube agent's
+// token Secret, creating it unless secret, its current state, is given.
+func (t *Teleport) EnsureAgentTokenSecret(ctx context.Context, log logr.Logger, ctrlClient client.Client, secret *corev1.Secret, clusterName string, clusterNamespace string, token string, tkaVersion string) error {
+	values, err := t.RenderAgentTokenValues(token, tkaVersion)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	data := map[string][]byte{
+		"values": []byte(values),
+	}
+	if secret == nil {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      key.GetAgentTokenSecretName(clusterName, t.Config().AppName),
+				Namespace: clusterNamespace,
+			},
+			Data: data,
+		}
+		if err := ctrlClient.Create(ctx, secret); err != nil {
+			return microerror.Mask(fmt.Errorf("failed to create Secret: %w", err))
+		}
+		log.Info("Created secret with teleport kube join token", "secretName", secret.GetName())
+		return nil
+	}
+
+	secret.Data = data
+	if err := ctrlClient.Update(ctx, secret); err != nil {
+		return microerror.Mask(fmt.Errorf("failed to update Secret: %w", err))
+	}
+	log.Info("Updated secret with teleport kube join token", "secretName", secret.GetName())
+	return nil
+}
+
+// DeleteAgentTokenSecret deletes the kube agent's token Secret, if any.
+func (t *Teleport) DeleteAgentTokenSecret(ctx context.Context, log logr.Logger, ctrlClient client.Client, clusterName string, clusterNamespace string) error {
+	secretName := key.GetAgentTokenSecretName(clusterName, t.Config().AppName) //#nosec G101
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: clusterNamespace,
+		},
+	}
+	if err := ctrlClient.Delete(ctx, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return microerror.Mask(fmt.Errorf("failed to delete Secret: %w", err))
+	}
+	log.Info("Deleted secret", "secretName", secretName)
+	return nil
+}
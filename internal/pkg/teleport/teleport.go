@@ -3,35 +3,112 @@ package teleport
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/giantswarm/microerror"
 	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
 	"github.com/giantswarm/teleport-operator/internal/pkg/token"
 )
 
 type Teleport struct {
-	Config         *config.Config
-	Identity       *config.IdentityConfig
-	TeleportClient Client
+	// Clients provides the connection to Teleport. It must be added to the
+	// manager for the connection to be established and kept alive.
+	Clients *ClientProvider
+	// Tokens caches the join tokens. It must be added to the manager to be
+	// resynced periodically.
+	Tokens *TokenCache
+	// KubeServers caches the Kubernetes servers agents register with. It
+	// must be added to the manager to be resynced periodically.
+	KubeServers *KubeServerCache
+	// Janitor deletes superseded and orphaned join tokens. It must be added
+	// to the manager for the periodic sweep to run.
+	Janitor *TokenJanitor
+	// JWKS provides the key sets workload clusters sign service account
+	// tokens with, for kubernetes join tokens. Defaults to fetching them
+	// through the clusters' CAPI kubeconfig.
+	JWKS JWKSSource
+	// JWKSRefreshInterval is how long a fetched JWKS is used before it is
+	// fetched again.
+	JWKSRefreshInterval time.Duration
+	// AgentStarts provides when the kube agents of workload clusters were
+	// started, to tell whether they picked up new values. Defaults to
+	// listing their pods through the clusters' CAPI kubeconfig.
+	AgentStarts    AgentStartSource
 	Namespace      string
 	TokenGenerator token.Generator
 	Client         client.Client
+
+	config atomic.Pointer[config.Config]
+	jwks   jwksCache
 }
 
 func New(namespace string, cfg *config.Config, tokenGenerator token.Generator) *Teleport {
-	return &Teleport{
-		Config:         cfg,
-		Namespace:      namespace,
-		TokenGenerator: tokenGenerator,
+	t := &Teleport{
+		JWKSRefreshInterval: DefaultJWKSRefreshInterval,
+		Namespace:           namespace,
+		TokenGenerator:      tokenGenerator,
 	}
+	t.config.Store(cfg)
+	t.Clients = NewClientProvider(
+		func(ctx context.Context) (*config.IdentityConfig, error) {
+			return config.GetIdentityConfigFromSecret(ctx, t.Client, t.Namespace)
+		},
+		func() string {
+			return t.Config().ProxyAddr
+		},
+	)
+	t.Tokens = NewTokenCache(t.Clients)
+	t.KubeServers = NewKubeServerCache(t.Clients)
+	t.Janitor = NewTokenJanitor(t)
+	t.JWKS = JWKSSourceFunc(func(ctx context.Context, cluster *capi.Cluster) (string, error) {
+		return GetClusterJWKS(ctx, t.Client, cluster)
+	})
+	t.AgentStarts = AgentStartSourceFunc(func(ctx context.Context, cluster *capi.Cluster, serviceAccount string) (time.Time, error) {
+		return GetClusterAgentStartTime(ctx, t.Client, cluster, serviceAccount)
+	})
+	return t
+}
+
+// Config returns the current operator configuration. It may be swapped at
+// any time by SetConfig, so callers needing several values consistently
+// should read it once.
+func (t *Teleport) Config() *config.Config {
+	return t.config.Load()
 }
 
-func (t *Teleport) AreTeleportAppsEnabled(ctx context.Context, clusterName, namespace string) (bool, error) {
+// SetConfig atomically replaces the operator configuration. If the proxy
+// address changed, the Teleport client is reconnected right away and the
+// cached tokens and Kubernetes servers of the previous cluster are dropped.
+func (t *Teleport) SetConfig(cfg *config.Config) {
+	previous := t.config.Swap(cfg)
+	if previous != nil && previous.ProxyAddr != cfg.ProxyAddr {
+		t.Tokens.Invalidate()
+		t.KubeServers.Invalidate()
+		t.Clients.Refresh()
+	}
+}
+
+// roleValuesKeys are the teleport-kube-agent values that enable a role when
+// they are not empty.
+var roleValuesKeys = map[string][]string{
+	key.RoleApp:            {"apps", "appResources"},
+	key.RoleDatabase:       {"databases", "databaseResources", "awsDatabases", "azureDatabases"},
+	key.RoleDiscovery:      {"kubernetesDiscovery"},
+	key.RoleWindowsDesktop: {"windowsDesktop"},
+}
+
+// DetectRoles returns the roles the cluster's teleport-kube-agent user values
+// configure: `app` for apps, `db` for databases, `discovery` for kubernetes
+// discovery and `windowsdesktop` for windows desktops.
+func (t *Teleport) DetectRoles(ctx context.Context, clusterName, namespace string) ([]string, error) {
 	configMap := &corev1.ConfigMap{}
 	err := t.Client.Get(ctx, types.NamespacedName{
 		Name:      fmt.Sprintf("%s-teleport-kube-agent-user-values", clusterName),
@@ -40,22 +117,43 @@ func (t *Teleport) AreTeleportAppsEnabled(ctx context.Context, clusterName, name
 
 	if err != nil {
 		if client.IgnoreNotFound(err) != nil {
-			return false, microerror.Mask(err)
+			return nil, microerror.Mask(err)
 		}
-		return false, nil // ConfigMap not found, return false without error
+		return nil, nil // ConfigMap not found, no roles configured
 	}
 
 	valuesYaml, ok := configMap.Data["values"]
 	if !ok {
-		return false, nil // No values key, apps are not enabled
+		return nil, nil // No values key, no roles configured
 	}
 
 	var values map[string]interface{}
 	err = yaml.Unmarshal([]byte(valuesYaml), &values)
 	if err != nil {
-		return false, microerror.Mask(err)
+		return nil, microerror.Mask(err)
+	}
+
+	var roles []string
+	for _, role := range key.AgentRoles {
+		for _, valuesKey := range roleValuesKeys[role] {
+			if !isEmptyValue(values[valuesKey]) {
+				roles = append(roles, role)
+				break
+			}
+		}
 	}
+	return roles, nil
+}
 
-	apps, ok := values["apps"].([]interface{})
-	return ok && len(apps) > 0, nil
+// isEmptyValue reports whether a values entry is missing or an empty list or
+// map.
+func isEmptyValue(v interface{}) bool {
+	switch v := v.(type) {
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	default:
+		return v == nil
+	}
 }
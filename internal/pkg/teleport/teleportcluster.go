@@ -0,0 +1,341 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+// ClusterSettings is the effective enrollment configuration of a cluster:
+// its TeleportCluster spec with the operator defaults filled in.
+type ClusterSettings struct {
+	RegisterName string
+	Roles        []string
+	// TokenTTLs is the lifetime of join tokens per role.
+	TokenTTLs map[string]time.Duration
+	// TokenRotationPercent is the share of a join token's lifetime after
+	// which it is replaced.
+	TokenRotationPercent int
+	// TokenGracePeriod is how long a replaced join token stays valid next
+	// to the new one.
+	TokenGracePeriod time.Duration
+	// TokenLabels are added to every join token of the cluster: the
+	// ClusterLabels, overridden by the TeleportCluster spec's labels.
+	TokenLabels map[string]string
+	// ClusterLabels are the Teleport labels propagated from the Cluster's
+	// labels and organization. They are set on the kube cluster in Teleport.
+	ClusterLabels map[string]string
+	// JoinMethod is how the kube agent joins Teleport, key.JoinMethodToken,
+	// key.JoinMethodKubernetes or key.JoinMethodCloud.
+	JoinMethod string
+	// AgentTokenInSecret is whether the kube agent's static join token is
+	// kept in a Secret rather than the values ConfigMap. Only set with
+	// key.JoinMethodToken.
+	AgentTokenInSecret bool
+	// KubernetesJoin configures the kubernetes join token, with the
+	// service account defaulted.
+	KubernetesJoin v1alpha1.KubernetesJoinSpec
+	// Databases are proxied by the kube agent. Only set with the `db` role.
+	Databases    []key.Database
+	AgentAppName string
+	// ManageAgentApp is whether the operator creates, upgrades and deletes
+	// the kube agent's App CR or HelmRelease.
+	ManageAgentApp bool
+	// AgentAppKind is the kind of the managed kube agent resource,
+	// key.AgentAppKindApp or key.AgentAppKindHelmRelease.
+	AgentAppKind string
+}
+
+// TokenOptions returns the options for a join token with the given roles. The
+// token lives as long as the shortest-lived of its roles.
+func (s *ClusterSettings) TokenOptions(roles []string) TokenOptions {
+	var ttl time.Duration
+	for _, role := range roles {
+		if roleTTL := s.TokenTTLs[role]; roleTTL > 0 && (ttl == 0 || roleTTL < ttl) {
+			ttl = roleTTL
+		}
+	}
+	return TokenOptions{TTL: ttl, Labels: s.TokenLabels}
+}
+
+// RotateAt returns when a join token with the given roles expiring at expiry
+// is due to be replaced. The replacement is minted at least one grace period
+// before expiry, so that both tokens overlap for the whole grace period.
+func (s *ClusterSettings) RotateAt(roles []string, expiry time.Time) time.Time {
+	ttl := s.TokenOptions(roles).TTL
+	rotateAt := expiry.Add(-ttl * time.Duration(100-s.TokenRotationPercent) / 100)
+	if graceStart := expiry.Add(-s.TokenGracePeriod); graceStart.Before(rotateAt) {
+		return graceStart
+	}
+	return rotateAt
+}
+
+// RetireAfter returns the end of the grace period of a join token replaced
+// at rotatedAt. It never extends past the token's expiry.
+func (s *ClusterSettings) RetireAfter(rotatedAt, expiry time.Time) time.Time {
+	retireAfter := rotatedAt.Add(s.TokenGracePeriod)
+	if !expiry.IsZero() && expiry.Before(retireAfter) {
+		return expiry
+	}
+	return retireAfter
+}
+
+// GetTeleportCluster returns the TeleportCluster for a CAPI Cluster, or nil
+// if it does not exist.
+func GetTeleportCluster(ctx context.Context, ctrlClient client.Client, cluster *capi.Cluster) (*v1alpha1.TeleportCluster, error) {
+	teleportCluster := &v1alpha1.TeleportCluster{}
+	if err := ctrlClient.Get(ctx, client.ObjectKeyFromObject(cluster), teleportCluster); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, microerror.Mask(fmt.Errorf("failed to get TeleportCluster: %w", err))
+	}
+	return teleportCluster, nil
+}
+
+// EnsureTeleportCluster returns the TeleportCluster for a CAPI Cluster,
+// creating it with an empty spec, owned by the Cluster, if it is missing.
+func EnsureTeleportCluster(ctx context.Context, log logr.Logger, ctrlClient client.Client, scheme *runtime.Scheme, cluster *capi.Cluster) (*v1alpha1.TeleportCluster, error) {
+	teleportCluster, err := GetTeleportCluster(ctx, ctrlClient, cluster)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if teleportCluster != nil {
+		return teleportCluster, nil
+	}
+
+	teleportCluster = &v1alpha1.TeleportCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cluster.Name,
+			Namespace: cluster.Namespace,
+		},
+	}
+	if err := controllerutil.SetControllerReference(cluster, teleportCluster, scheme); err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if err := ctrlClient.Create(ctx, teleportCluster); err != nil {
+		return nil, microerror.Mask(fmt.Errorf("failed to create TeleportCluster: %w", err))
+	}
+	log.Info("Created TeleportCluster", "teleportCluster", teleportCluster.Name)
+	return teleportCluster, nil
+}
+
+// ResolveClusterSettings merges the TeleportCluster spec (which may be nil,
+// e.g. while the cluster is being deleted) with the operator defaults.
+func (t *Teleport) ResolveClusterSettings(ctx context.Context, cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster) (*ClusterSettings, error) {
+	var spec v1alpha1.TeleportClusterSpec
+	if teleportCluster != nil {
+		spec = teleportCluster.Spec
+	}
+
+	cfg := t.Config()
+	settings := &ClusterSettings{
+		RegisterName:         t.registerName(cluster, teleportCluster),
+		AgentAppName:         key.GetAppName(cluster.Name, cfg.AppName),
+		TokenTTLs:            map[string]time.Duration{key.RoleNode: cfg.GetTokenTTL(key.RoleNode)},
+		TokenRotationPercent: cfg.GetTokenRotationPercent(),
+		TokenGracePeriod:     cfg.GetTokenGracePeriod(),
+		ClusterLabels:        ClusterLabels(cfg, cluster),
+		JoinMethod:           cfg.GetJoinMethod(),
+		ManageAgentApp:       cfg.ManageKubeAgentApp,
+		AgentAppKind:         cfg.GetKubeAgentAppKind(),
+	}
+
+	for _, role := range key.AgentRoles {
+		settings.TokenTTLs[role] = cfg.GetTokenTTL(role)
+	}
+
+	if len(settings.ClusterLabels) > 0 || len(spec.Labels) > 0 {
+		settings.TokenLabels = maps.Clone(settings.ClusterLabels)
+		if settings.TokenLabels == nil {
+			settings.TokenLabels = map[string]string{}
+		}
+		maps.Copy(settings.TokenLabels, spec.Labels)
+	}
+
+	if spec.AgentApp != nil && spec.AgentApp.Name != "" {
+		settings.AgentAppName = spec.AgentApp.Name
+	}
+	if spec.AgentApp != nil && spec.AgentApp.Kind != "" {
+		settings.AgentAppKind = string(spec.AgentApp.Kind)
+	}
+
+	if spec.TokenTTL != nil && spec.TokenTTL.Duration > 0 {
+		for role := range settings.TokenTTLs {
+			settings.TokenTTLs[role] = spec.TokenTTL.Duration
+		}
+	}
+
+	if spec.JoinMethod != "" {
+		settings.JoinMethod = string(spec.JoinMethod)
+	}
+	settings.AgentTokenInSecret = cfg.KubeAgentTokenInSecret && settings.JoinMethod == key.JoinMethodToken
+	if spec.KubernetesJoin != nil {
+		settings.KubernetesJoin = *spec.KubernetesJoin
+	}
+	if settings.KubernetesJoin.ServiceAccount == "" {
+		settings.KubernetesJoin.ServiceAccount = key.GetKubeAgentServiceAccount()
+	}
+
+	if spec.TokenRotationPercent != nil {
+		settings.TokenRotationPercent = int(*spec.TokenRotationPercent)
+	}
+
+	roles, err := t.resolveRoles(ctx, cluster, spec.Roles, len(spec.Databases) > 0)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	settings.Roles = roles
+
+	if slices.Contains(roles, key.RoleDatabase) {
+		for _, db := range spec.Databases {
+			settings.Databases = append(settings.Databases, key.Database{
+				Name:     db.Name,
+				Protocol: string(db.Protocol),
+				URI:      db.URI,
+				Labels:   db.Labels,
+			})
+		}
+	}
+
+	return settings, nil
+}
+
+// registerName returns the name the cluster registers with in Teleport: the
+// TeleportCluster spec's override (which may be nil), the plain name of the
+// management cluster, or the name prefixed with the management cluster's.
+func (t *Teleport) registerName(cluster *capi.Cluster, teleportCluster *v1alpha1.TeleportCluster) string {
+	if teleportCluster != nil && teleportCluster.Spec.RegisterName != "" {
+		return teleportCluster.Spec.RegisterName
+	}
+	managementClusterName := t.Config().ManagementClusterName
+	if cluster.Name == managementClusterName {
+		return cluster.Name
+	}
+	return key.GetRegisterName(managementClusterName, cluster.Name)
+}
+
+// ClusterLabels returns the Teleport labels the operator configuration
+// propagates from the cluster: its labels in cfg.ClusterLabels, renamed, and
+// its organization as cfg.OrganizationLabel. It returns nil without any.
+func ClusterLabels(cfg *config.Config, cluster *capi.Cluster) map[string]string {
+	var labels map[string]string
+	set := func(name, value string) {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[name] = value
+	}
+	if org := key.GetOrganization(cluster.Namespace); cfg.OrganizationLabel != "" && org != "" {
+		set(cfg.OrganizationLabel, org)
+	}
+	for from, to := range cfg.ClusterLabels {
+		if value, ok := cluster.GetLabels()[from]; ok {
+			set(to, value)
+		}
+	}
+	return labels
+}
+
+// resolveRoles returns the roles the kube agent of cluster joins with: the
+// TeleportCluster spec's roles, else the Cluster's roles annotation, else
+// the operator's default roles and those detected from the agent's user
+// values or, for `db`, declared databases, each enabled or disabled by the
+// Cluster's role labels.
+func (t *Teleport) resolveRoles(ctx context.Context, cluster *capi.Cluster, specRoles []string, hasDatabases bool) ([]string, error) {
+	if len(specRoles) > 0 {
+		roles, err := key.ParseRoles(key.RolesToString(specRoles))
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		return roles, nil
+	}
+	if s := cluster.GetAnnotations()[key.RolesAnnotation]; s != "" {
+		roles, err := key.ParseRoles(s)
+		if err != nil {
+			return nil, microerror.Maskf(invalidConfigError, "annotation %s: %v", key.RolesAnnotation, err)
+		}
+		return roles, nil
+	}
+
+	detected, err := t.DetectRoles(ctx, cluster.Name, cluster.Namespace)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	enabled := map[string]bool{key.RoleDatabase: hasDatabases}
+	for _, role := range append(slices.Clone(t.Config().GetDefaultRoles()), detected...) {
+		enabled[role] = true
+	}
+	for label, value := range cluster.GetLabels() {
+		role, ok := strings.CutPrefix(label, key.RoleLabelPrefix)
+		if !ok {
+			continue
+		}
+		if !slices.Contains(key.AgentRoles, role) {
+			return nil, microerror.Maskf(invalidConfigError, "label %s: invalid role: %s", label, role)
+		}
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, microerror.Maskf(invalidConfigError, "label %s must be a boolean, got %q", label, value)
+		}
+		enabled[role] = on
+	}
+
+	var roles []string
+	for _, role := range key.AgentRoles {
+		if enabled[role] {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		return nil, microerror.Maskf(invalidConfigError, "no roles left for the kube agent of cluster %s/%s", cluster.Namespace, cluster.Name)
+	}
+	return roles, nil
+}
+
+// NewJoinTokenStatus describes a join token for the TeleportCluster status.
+func NewJoinTokenStatus(name string, roles []string, expiry time.Time) *v1alpha1.JoinTokenStatus {
+	status := &v1alpha1.JoinTokenStatus{
+		Name:  name,
+		Roles: roles,
+	}
+	if !expiry.IsZero() {
+		expiresAt := metav1.NewTime(expiry)
+		status.ExpiresAt = &expiresAt
+	}
+	return status
+}
+
+// NewRetiringJoinTokenStatus returns the status of a join token with the
+// given roles and expiry that was replaced at rotatedAt, keeping it valid
+// for the cluster's grace period.
+func (s *ClusterSettings) NewRetiringJoinTokenStatus(name string, roles []string, expiry, rotatedAt time.Time) v1alpha1.RetiringJoinTokenStatus {
+	return v1alpha1.RetiringJoinTokenStatus{
+		JoinTokenStatus: *NewJoinTokenStatus(name, roles, expiry),
+		RotatedAt:       metav1.NewTime(rotatedAt),
+		RetireAfter:     metav1.NewTime(s.RetireAfter(rotatedAt, expiry)),
+	}
+}
+
+// ValuesLayoutFor returns the name of the values ConfigMap layout the
+// operator writes for the given teleport-kube-agent chart version.
+func (t *Teleport) ValuesLayoutFor(tkaVersion string) v1alpha1.ValuesLayout {
+	return v1alpha1.ValuesLayout(t.Config().GetValuesLayouts().For(tkaVersion).Name)
+}
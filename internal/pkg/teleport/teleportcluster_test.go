@@ -0,0 +1,449 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_ResolveClusterSettings(t *testing.T) {
+	testCases := []struct {
+		name             string
+		clusterName      string
+		teleportCluster  *v1alpha1.TeleportCluster
+		config           *config.Config
+		expectError      bool
+		expectedSettings *ClusterSettings
+	}{
+		{
+			name:        "case 0: Fall back to operator defaults without a TeleportCluster",
+			clusterName: test.ClusterName,
+			expectedSettings: &ClusterSettings{
+				RegisterName: key.GetRegisterName(test.ManagementClusterName, test.ClusterName),
+				Roles:        []string{key.RoleKube},
+				TokenTTLs: map[string]time.Duration{
+					key.RoleKube:           key.TeleportKubeTokenValidity,
+					key.RoleNode:           key.TeleportNodeTokenValidity,
+					key.RoleApp:            key.TeleportAppTokenValidity,
+					key.RoleDatabase:       key.TeleportKubeTokenValidity,
+					key.RoleDiscovery:      key.TeleportKubeTokenValidity,
+					key.RoleWindowsDesktop: key.TeleportKubeTokenValidity,
+				},
+				TokenRotationPercent: key.DefaultTokenRotationPercent,
+				TokenGracePeriod:     key.DefaultTokenGracePeriod,
+				JoinMethod:           key.JoinMethodToken,
+				KubernetesJoin:       v1alpha1.KubernetesJoinSpec{ServiceAccount: key.GetKubeAgentServiceAccount()},
+				AgentAppName:         key.GetAppName(test.ClusterName, test.AppName),
+				AgentAppKind:         key.AgentAppKindApp,
+			},
+		},
+		{
+			name:        "case 1: Register the management cluster under its own name",
+			clusterName: test.ManagementClusterName,
+			expectedSettings: &ClusterSettings{
+				RegisterName: test.ManagementClusterName,
+				Roles:        []string{key.RoleKube},
+				TokenTTLs: map[string]time.Duration{
+					key.RoleKube:           key.TeleportKubeTokenValidity,
+					key.RoleNode:           key.TeleportNodeTokenValidity,
+					key.RoleApp:            key.TeleportAppTokenValidity,
+					key.RoleDatabase:       key.TeleportKubeTokenValidity,
+					key.RoleDiscovery:      key.TeleportKubeTokenValidity,
+					key.RoleWindowsDesktop: key.TeleportKubeTokenValidity,
+				},
+				TokenRotationPercent: key.DefaultTokenRotationPercent,
+				TokenGracePeriod:     key.DefaultTokenGracePeriod,
+				JoinMethod:           key.JoinMethodToken,
+				KubernetesJoin:       v1alpha1.KubernetesJoinSpec{ServiceAccount: key.GetKubeAgentServiceAccount()},
+				AgentAppName:         key.GetAppName(test.ManagementClusterName, test.AppName),
+				AgentAppKind:         key.AgentAppKindApp,
+			},
+		},
+		{
+			name:        "case 2: Use the TeleportCluster spec over the defaults",
+			clusterName: test.ClusterName,
+			teleportCluster: test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{
+				Roles:                []string{key.RoleKube, key.RoleApp},
+				RegisterName:         "custom-name",
+				TokenTTL:             &metav1.Duration{Duration: time.Hour},
+				TokenRotationPercent: ptr.To[int32](75),
+				Labels:               map[string]string{"team": "rocket"},
+				JoinMethod:           v1alpha1.JoinMethodKubernetes,
+				KubernetesJoin:       &v1alpha1.KubernetesJoinSpec{JWKS: `{"keys":[]}`},
+				AgentApp:             &v1alpha1.AgentAppReference{Name: "custom-agent", Kind: v1alpha1.AgentAppKindHelmRelease},
+			}),
+			expectedSettings: &ClusterSettings{
+				RegisterName: "custom-name",
+				Roles:        []string{key.RoleKube, key.RoleApp},
+				TokenTTLs: map[string]time.Duration{
+					key.RoleKube:           time.Hour,
+					key.RoleNode:           time.Hour,
+					key.RoleApp:            time.Hour,
+					key.RoleDatabase:       time.Hour,
+					key.RoleDiscovery:      time.Hour,
+					key.RoleWindowsDesktop: time.Hour,
+				},
+				TokenRotationPercent: 75,
+				TokenGracePeriod:     key.DefaultTokenGracePeriod,
+				TokenLabels:          map[string]string{"team": "rocket"},
+				JoinMethod:           key.JoinMethodKubernetes,
+				KubernetesJoin:       v1alpha1.KubernetesJoinSpec{ServiceAccount: key.GetKubeAgentServiceAccount(), JWKS: `{"keys":[]}`},
+				AgentAppName:         "custom-agent",
+				AgentAppKind:         key.AgentAppKindHelmRelease,
+			},
+		},
+		{
+			name:        "case 3: Use per-role token lifetimes, rotation, grace period and join method from the operator config",
+			clusterName: test.ClusterName,
+			config: &config.Config{
+				AppName:               test.AppName,
+				ManagementClusterName: test.ManagementClusterName,
+				KubeTokenTTL:          24 * time.Hour,
+				NodeTokenTTL:          12 * time.Hour,
+				TokenRotationPercent:  75,
+				TokenGracePeriod:      30 * time.Minute,
+				JoinMethod:            key.JoinMethodKubernetes,
+			},
+			expectedSettings: &ClusterSettings{
+				RegisterName: key.GetRegisterName(test.ManagementClusterName, test.ClusterName),
+				Roles:        []string{key.RoleKube},
+				TokenTTLs: map[string]time.Duration{
+					key.RoleKube:           24 * time.Hour,
+					key.RoleNode:           12 * time.Hour,
+					key.RoleApp:            key.TeleportAppTokenValidity,
+					key.RoleDatabase:       24 * time.Hour,
+					key.RoleDiscovery:      24 * time.Hour,
+					key.RoleWindowsDesktop: 24 * time.Hour,
+				},
+				TokenRotationPercent: 75,
+				TokenGracePeriod:     30 * time.Minute,
+				JoinMethod:           key.JoinMethodKubernetes,
+				KubernetesJoin:       v1alpha1.KubernetesJoinSpec{ServiceAccount: key.GetKubeAgentServiceAccount()},
+				AgentAppName:         key.GetAppName(test.ClusterName, test.AppName),
+				AgentAppKind:         key.AgentAppKindApp,
+			},
+		},
+		{
+			name:        "case 4: Keep the static join token in a Secret with the token join method only",
+			clusterName: test.ClusterName,
+			config: &config.Config{
+				AppName:                test.AppName,
+				ManagementClusterName:  test.ManagementClusterName,
+				KubeAgentTokenInSecret: true,
+			},
+			expectedSettings: &ClusterSettings{
+				RegisterName: key.GetRegisterName(test.ManagementClusterName, test.ClusterName),
+				Roles:        []string{key.RoleKube},
+				TokenTTLs: map[string]time.Duration{
+					key.RoleKube:           key.TeleportKubeTokenValidity,
+					key.RoleNode:           key.TeleportNodeTokenValidity,
+					key.RoleApp:            key.TeleportAppTokenValidity,
+					key.RoleDatabase:       key.TeleportKubeTokenValidity,
+					key.RoleDiscovery:      key.TeleportKubeTokenValidity,
+					key.RoleWindowsDesktop: key.TeleportKubeTokenValidity,
+				},
+				TokenRotationPercent: key.DefaultTokenRotationPercent,
+				TokenGracePeriod:     key.DefaultTokenGracePeriod,
+				JoinMethod:           key.JoinMethodToken,
+				AgentTokenInSecret:   true,
+				KubernetesJoin:       v1alpha1.KubernetesJoinSpec{ServiceAccount: key.GetKubeAgentServiceAccount()},
+				AgentAppName:         key.GetAppName(test.ClusterName, test.AppName),
+				AgentAppKind:         key.AgentAppKindApp,
+			},
+		},
+		{
+			name:        "case 5: Reject unknown roles in the TeleportCluster spec",
+			clusterName: test.ClusterName,
+			teleportCluster: test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{
+				Roles: []string{"unknown"},
+			}),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			fakeClient, err := test.NewFakeK8sClientFromObjects()
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			cfg := tc.config
+			if cfg == nil {
+				cfg = &config.Config{
+					AppName:               test.AppName,
+					ManagementClusterName: test.ManagementClusterName,
+				}
+			}
+			teleport := New(test.NamespaceName, cfg, test.NewMockTokenGenerator(test.TokenName))
+			teleport.Client = fakeClient
+
+			cluster := test.NewCluster(tc.clusterName, test.NamespaceName, []string{}, time.Time{})
+			settings, err := teleport.ResolveClusterSettings(ctx, cluster, tc.teleportCluster)
+			test.CheckError(t, tc.expectError, err)
+			if tc.expectError {
+				return
+			}
+
+			if !reflect.DeepEqual(settings, tc.expectedSettings) {
+				t.Fatalf("expected settings %+v, actual %+v", tc.expectedSettings, settings)
+			}
+		})
+	}
+}
+
+func Test_ResolveRoles(t *testing.T) {
+	userValues := func(values string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-teleport-kube-agent-user-values", test.ClusterName),
+				Namespace: test.NamespaceName,
+			},
+			Data: map[string]string{"values": values},
+		}
+	}
+
+	testCases := []struct {
+		name              string
+		specRoles         []string
+		annotations       map[string]string
+		labels            map[string]string
+		defaultRoles      []string
+		userValues        *corev1.ConfigMap
+		databases         []v1alpha1.DatabaseSpec
+		expectedRoles     []string
+		expectedDatabases []key.Database
+		expectError       bool
+	}{
+		{
+			name:          "case 0: Default to the kube role",
+			expectedRoles: []string{key.RoleKube},
+		},
+		{
+			name:          "case 1: Detect roles from the agent's user values",
+			userValues:    userValues("apps:\n- name: grafana\ndatabases: []\nawsDatabases:\n- name: rds\nkubernetesDiscovery:\n- types: [eks]\n"),
+			expectedRoles: []string{key.RoleKube, key.RoleApp, key.RoleDatabase, key.RoleDiscovery},
+		},
+		{
+			name:          "case 2: Use the operator's default roles",
+			defaultRoles:  []string{key.RoleKube, key.RoleWindowsDesktop},
+			expectedRoles: []string{key.RoleKube, key.RoleWindowsDesktop},
+		},
+		{
+			name:          "case 3: Enable and disable roles with Cluster labels",
+			labels:        map[string]string{key.RoleLabelPrefix + key.RoleDatabase: "true", key.RoleLabelPrefix + key.RoleApp: "false"},
+			userValues:    userValues("apps:\n- name: grafana\n"),
+			expectedRoles: []string{key.RoleKube, key.RoleDatabase},
+		},
+		{
+			name:          "case 4: Use the roles annotation over detection and labels",
+			annotations:   map[string]string{key.RolesAnnotation: "kube, discovery"},
+			labels:        map[string]string{key.RoleLabelPrefix + key.RoleDatabase: "true"},
+			userValues:    userValues("apps:\n- name: grafana\n"),
+			expectedRoles: []string{key.RoleKube, key.RoleDiscovery},
+		},
+		{
+			name:          "case 5: Use the TeleportCluster spec over the roles annotation",
+			specRoles:     []string{key.RoleKube, key.RoleApp},
+			annotations:   map[string]string{key.RolesAnnotation: "db"},
+			expectedRoles: []string{key.RoleKube, key.RoleApp},
+		},
+		{
+			name:        "case 6: Reject unknown roles in the roles annotation",
+			annotations: map[string]string{key.RolesAnnotation: "kube,unknown"},
+			expectError: true,
+		},
+		{
+			name:        "case 7: Reject role labels that are not booleans",
+			labels:      map[string]string{key.RoleLabelPrefix + key.RoleDatabase: "yes"},
+			expectError: true,
+		},
+		{
+			name:        "case 8: Reject disabling every role",
+			labels:      map[string]string{key.RoleLabelPrefix + key.RoleKube: "false"},
+			expectError: true,
+		},
+		{
+			name: "case 9: Enable the db role for declared databases",
+			databases: []v1alpha1.DatabaseSpec{
+				{Name: "orders", Protocol: v1alpha1.DatabaseProtocolPostgres, URI: "orders.db.svc:5432", Labels: map[string]string{"team": "shop"}},
+			},
+			expectedRoles: []string{key.RoleKube, key.RoleDatabase},
+			expectedDatabases: []key.Database{
+				{Name: "orders", Protocol: "postgres", URI: "orders.db.svc:5432", Labels: map[string]string{"team": "shop"}},
+			},
+		},
+		{
+			name:   "case 10: Drop declared databases when the db role is disabled",
+			labels: map[string]string{key.RoleLabelPrefix + key.RoleDatabase: "false"},
+			databases: []v1alpha1.DatabaseSpec{
+				{Name: "orders", Protocol: v1alpha1.DatabaseProtocolMySQL, URI: "orders.db.svc:3306"},
+			},
+			expectedRoles: []string{key.RoleKube},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var objects []client.Object
+			if tc.userValues != nil {
+				objects = append(objects, tc.userValues)
+			}
+			fakeClient, err := test.NewFakeK8sClientFromObjects(objects...)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+			teleport := New(test.NamespaceName, &config.Config{
+				AppName:               test.AppName,
+				ManagementClusterName: test.ManagementClusterName,
+				DefaultRoles:          tc.defaultRoles,
+			}, test.NewMockTokenGenerator(test.TokenName))
+			teleport.Client = fakeClient
+
+			cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{}, time.Time{})
+			cluster.Annotations = tc.annotations
+			cluster.Labels = tc.labels
+			teleportCluster := test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{Roles: tc.specRoles, Databases: tc.databases})
+
+			settings, err := teleport.ResolveClusterSettings(context.TODO(), cluster, teleportCluster)
+			test.CheckError(t, tc.expectError, err)
+			if tc.expectError {
+				if !IsInvalidConfig(err) {
+					t.Fatalf("expected invalid config error, actual %v", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(settings.Roles, tc.expectedRoles) {
+				t.Fatalf("expected roles %v, actual %v", tc.expectedRoles, settings.Roles)
+			}
+			if !reflect.DeepEqual(settings.Databases, tc.expectedDatabases) {
+				t.Fatalf("expected databases %v, actual %v", tc.expectedDatabases, settings.Databases)
+			}
+		})
+	}
+}
+
+func Test_ResolveClusterSettings_Labels(t *testing.T) {
+	fakeClient, err := test.NewFakeK8sClientFromObjects()
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+	teleport := New(test.NamespaceName, &config.Config{
+		AppName:               test.AppName,
+		ManagementClusterName: test.ManagementClusterName,
+		ClusterLabels:         map[string]string{"release.giantswarm.io/version": "release", "provider": "provider"},
+		OrganizationLabel:     "customer",
+	}, test.NewMockTokenGenerator(test.TokenName))
+	teleport.Client = fakeClient
+
+	cluster := test.NewCluster(test.ClusterName, "org-acme", []string{}, time.Time{})
+	cluster.Labels = map[string]string{"release.giantswarm.io/version": "30.0.0", "unrelated": "x"}
+	teleportCluster := test.NewTeleportCluster(test.ClusterName, "org-acme", v1alpha1.TeleportClusterSpec{
+		Labels: map[string]string{"release": "override", "team": "shop"},
+	})
+
+	settings, err := teleport.ResolveClusterSettings(context.TODO(), cluster, teleportCluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]string{"customer": "acme", "release": "30.0.0"}; !reflect.DeepEqual(settings.ClusterLabels, expected) {
+		t.Fatalf("expected cluster labels %v, actual %v", expected, settings.ClusterLabels)
+	}
+	if expected := map[string]string{"customer": "acme", "release": "override", "team": "shop"}; !reflect.DeepEqual(settings.TokenLabels, expected) {
+		t.Fatalf("expected token labels %v, actual %v", expected, settings.TokenLabels)
+	}
+
+	cluster.Namespace = "default"
+	if labels := ClusterLabels(teleport.Config(), cluster); labels["customer"] != "" {
+		t.Fatalf("expected no organization label outside organization namespaces, actual %v", labels)
+	}
+}
+
+func Test_ClusterSettings_Rotation(t *testing.T) {
+	settings := &ClusterSettings{
+		TokenTTLs: map[string]time.Duration{
+			key.RoleKube: 24 * time.Hour,
+			key.RoleApp:  8 * time.Hour,
+		},
+		TokenRotationPercent: 75,
+	}
+
+	// A token with several roles lives as long as its shortest-lived role.
+	if ttl := settings.TokenOptions([]string{key.RoleKube, key.RoleApp}).TTL; ttl != 8*time.Hour {
+		t.Fatalf("expected TTL 8h, actual %v", ttl)
+	}
+
+	expiry := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	if rotateAt := settings.RotateAt([]string{key.RoleKube}, expiry); !rotateAt.Equal(expiry.Add(-6 * time.Hour)) {
+		t.Fatalf("expected rotation 6h before expiry, actual %v", expiry.Sub(rotateAt))
+	}
+
+	settings.TokenRotationPercent = 100
+	if rotateAt := settings.RotateAt([]string{key.RoleKube}, expiry); !rotateAt.Equal(expiry) {
+		t.Fatalf("expected rotation at expiry, actual %v before", expiry.Sub(rotateAt))
+	}
+
+	// The replacement is minted early enough for both tokens to overlap for
+	// the whole grace period, which never extends past the old token's expiry.
+	settings.TokenGracePeriod = time.Hour
+	if rotateAt := settings.RotateAt([]string{key.RoleKube}, expiry); !rotateAt.Equal(expiry.Add(-time.Hour)) {
+		t.Fatalf("expected rotation 1h before expiry, actual %v", expiry.Sub(rotateAt))
+	}
+	rotatedAt := expiry.Add(-2 * time.Hour)
+	if retireAfter := settings.RetireAfter(rotatedAt, expiry); !retireAfter.Equal(rotatedAt.Add(time.Hour)) {
+		t.Fatalf("expected retirement 1h after rotation, actual %v", retireAfter.Sub(rotatedAt))
+	}
+	if retireAfter := settings.RetireAfter(expiry.Add(-time.Minute), expiry); !retireAfter.Equal(expiry) {
+		t.Fatalf("expected retirement at expiry, actual %v", retireAfter)
+	}
+}
+
+func Test_EnsureTeleportCluster(t *testing.T) {
+	ctx := context.TODO()
+	log := ctrl.Log.WithName("test")
+	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, []string{}, time.Time{})
+
+	fakeClient, err := test.NewFakeK8sClientFromObjects(cluster)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	created, err := EnsureTeleportCluster(ctx, log, fakeClient, scheme.Scheme, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actual := &v1alpha1.TeleportCluster{}
+	if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(cluster), actual); err != nil {
+		t.Fatalf("failed to get TeleportCluster: %v", err)
+	}
+	owner := metav1.GetControllerOf(actual)
+	if owner == nil || owner.Kind != "Cluster" || owner.Name != cluster.Name {
+		t.Fatalf("expected TeleportCluster to be controlled by cluster %s, actual owner %+v", cluster.Name, owner)
+	}
+
+	// A second call must return the existing object rather than create one.
+	existing, err := EnsureTeleportCluster(ctx, log, fakeClient, scheme.Scheme, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if existing.UID != created.UID || existing.ResourceVersion != created.ResourceVersion {
+		t.Fatalf("expected existing TeleportCluster to be returned, got %+v", existing.ObjectMeta)
+	}
+}
@@ -2,51 +2,64 @@ package teleport
 
 import (
 	"context"
+	"maps"
 	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/trace"
 
 	"github.com/giantswarm/microerror"
 
 	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/metrics"
 )
 
+// IsTokenValid reports whether token is an unexpired join token of the
+// cluster with exactly the roles in tokenType. It is served from the token
+// cache.
 func (t *Teleport) IsTokenValid(ctx context.Context, registerName string, token string, tokenType string) (bool, error) {
-	tokens, err := t.TeleportClient.GetTokens(ctx)
+	expectedRoles, err := key.ParseRoles(tokenType)
 	if err != nil {
 		return false, microerror.Mask(err)
 	}
 
-	expectedRoles, err := key.ParseRoles(tokenType)
-	if err != nil {
+	storedToken, err := t.Tokens.Get(ctx, token)
+	if trace.IsNotFound(err) {
+		// If we didn't find a matching token, it's not valid
+		return false, nil
+	} else if err != nil {
 		return false, microerror.Mask(err)
 	}
+	if storedToken.GetMetadata().Labels[key.TokenClusterLabel] != registerName {
+		return false, nil
+	}
 
-	for _, t := range tokens {
-		if t.GetName() == token &&
-			t.GetMetadata().Labels["cluster"] == registerName {
-			// Check if the token has expired
-			if !t.Expiry().IsZero() && t.Expiry().After(time.Now()) {
-				// Check if the token has all the expected roles
-				tokenRoles := t.GetRoles()
-				if len(tokenRoles) != len(expectedRoles) {
-					return false, nil
-				}
-				for _, role := range expectedRoles {
-					if !containsRole(tokenRoles, role) {
-						return false, nil
-					}
-				}
-				return true, nil
-			}
+	// Check if the token has expired
+	if storedToken.Expiry().IsZero() || !storedToken.Expiry().After(time.Now()) {
+		return false, nil
+	}
+
+	// Check if the token has all the expected roles
+	tokenRoles := storedToken.GetRoles()
+	if len(tokenRoles) != len(expectedRoles) {
+		return false, nil
+	}
+	for _, role := range expectedRoles {
+		if !containsRole(tokenRoles, role) {
 			return false, nil
 		}
 	}
+	return true, nil
+}
 
-	// If we didn't find a matching token, it's not valid
-	return false, nil
+func systemRolesToStrings(roles []types.SystemRole) []string {
+	result := make([]string, 0, len(roles))
+	for _, r := range roles {
+		result = append(result, strings.ToLower(r.String()))
+	}
+	return result
 }
 
 func containsRole(roles []types.SystemRole, role string) bool {
@@ -58,8 +71,31 @@ func containsRole(roles []types.SystemRole, role string) bool {
 	return false
 }
 
+// TokenOptions customises the join tokens generated for a cluster. The zero
+// value generates tokens the way GenerateToken does.
+type TokenOptions struct {
+	// TTL is the token lifetime. Zero means key.TeleportKubeTokenValidity.
+	TTL time.Duration
+	// Labels are added to the token metadata. The `cluster`, `roles` and
+	// `management-cluster` labels are reserved and cannot be overridden.
+	Labels map[string]string
+}
+
 func (t *Teleport) GenerateToken(ctx context.Context, registerName string, roles []string) (string, error) {
-	tokenValidity := time.Now().Add(key.TeleportKubeTokenValidity)
+	return t.GenerateTokenWithOptions(ctx, registerName, roles, TokenOptions{})
+}
+
+func (t *Teleport) GenerateTokenWithOptions(ctx context.Context, registerName string, roles []string, opts TokenOptions) (string, error) {
+	teleportClient, err := t.Clients.Client()
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = key.TeleportKubeTokenValidity
+	}
+	tokenValidity := time.Now().Add(ttl)
 	tokenRoles := key.RolesToSystemRoles(roles)
 
 	token, err := types.NewProvisionToken(t.TokenGenerator.Generate(), tokenRoles, tokenValidity)
@@ -69,31 +105,114 @@ func (t *Teleport) GenerateToken(ctx context.Context, registerName string, roles
 	// Set cluster label to token
 	{
 		m := token.GetMetadata()
-		m.Labels = map[string]string{
-			"cluster": registerName,
-			"roles":   key.RolesToString(roles),
-		}
+		m.Labels = t.tokenLabels(registerName, roles, opts.Labels)
 		token.SetMetadata(m)
-		if err := t.TeleportClient.UpsertToken(ctx, token); err != nil {
+		if err := teleportClient.UpsertToken(ctx, token); err != nil {
 			return "", microerror.Mask(err)
 		}
+		t.Tokens.Upsert(token)
 	}
+	metrics.TokenGenerated(roles)
 	return token.GetName(), nil
 }
 
+// tokenLabels returns the labels of a join token of the cluster: the extra
+// labels, overridden by the reserved ones.
+func (t *Teleport) tokenLabels(registerName string, roles []string, extra map[string]string) map[string]string {
+	labels := make(map[string]string, len(extra)+3)
+	for k, v := range extra {
+		labels[k] = v
+	}
+	labels[key.TokenClusterLabel] = registerName
+	labels[key.TokenRolesLabel] = key.RolesToString(roles)
+	labels[key.TokenManagementClusterLabel] = t.Config().ManagementClusterName
+	return labels
+}
+
+// EnsureTokenLabels sets the labels of the cluster's join token with the
+// given roles to the reserved and extra labels, keeping its secret name and
+// expiry. It reports whether the token had to be updated.
+func (t *Teleport) EnsureTokenLabels(ctx context.Context, registerName, name string, roles []string, extra map[string]string) (bool, error) {
+	token, err := t.Tokens.Get(ctx, name)
+	if err != nil {
+		return false, microerror.Mask(err)
+	}
+	labels := t.tokenLabels(registerName, roles, extra)
+	if maps.Equal(token.GetMetadata().Labels, labels) {
+		return false, nil
+	}
+
+	teleportClient, err := t.Clients.Client()
+	if err != nil {
+		return false, microerror.Mask(err)
+	}
+	token = token.Clone()
+	m := token.GetMetadata()
+	m.Labels = labels
+	token.SetMetadata(m)
+	if err := teleportClient.UpsertToken(ctx, token); err != nil {
+		return false, microerror.Mask(err)
+	}
+	t.Tokens.Upsert(token)
+	return true, nil
+}
+
+// GetTokenExpiry returns the expiry of the named token, or the zero time if
+// the token does not exist in Teleport.
+func (t *Teleport) GetTokenExpiry(ctx context.Context, name string) (time.Time, error) {
+	token, err := t.Tokens.Get(ctx, name)
+	if trace.IsNotFound(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, microerror.Mask(err)
+	}
+	return token.Expiry(), nil
+}
+
+// DeleteToken deletes every join token of the cluster from Teleport.
 func (t *Teleport) DeleteToken(ctx context.Context, log logr.Logger, registerName string) error {
-	tokens, err := t.TeleportClient.GetTokens(ctx)
+	teleportClient, err := t.Clients.Client()
 	if err != nil {
-		return err
+		return microerror.Mask(err)
+	}
+	tokens, err := t.Tokens.ForCluster(ctx, registerName)
+	if err != nil {
+		return microerror.Mask(err)
 	}
 	for _, token := range tokens {
-		if token.GetMetadata().Labels["cluster"] == registerName {
-			if err := t.TeleportClient.DeleteToken(ctx, token.GetName()); err != nil {
-				return microerror.Mask(err)
-			}
-			log.Info("Deleted teleport node/kube join token for the cluster", "registerName", registerName)
-			return nil
+		if err := t.deleteToken(ctx, teleportClient, token); err != nil {
+			return microerror.Mask(err)
 		}
 	}
+	if len(tokens) > 0 {
+		log.Info("Deleted teleport join tokens for the cluster", "registerName", registerName, "count", len(tokens))
+	}
+	return nil
+}
+
+// RetireToken deletes a join token that was kept valid after a rotation. A
+// token that is already gone is not an error.
+func (t *Teleport) RetireToken(ctx context.Context, name string) error {
+	teleportClient, err := t.Clients.Client()
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	token, err := t.Tokens.Get(ctx, name)
+	if trace.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return microerror.Mask(err)
+	}
+	return t.deleteToken(ctx, teleportClient, token)
+}
+
+// deleteToken deletes a join token from Teleport and from the cache. A token
+// that is already gone is not an error.
+func (t *Teleport) deleteToken(ctx context.Context, teleportClient Client, token types.ProvisionToken) error {
+	if err := teleportClient.DeleteToken(ctx, token.GetName()); err != nil && !trace.IsNotFound(err) {
+		return microerror.Mask(err)
+	}
+	t.Tokens.Delete(token.GetName())
+	metrics.TokenDeleted(systemRolesToStrings(token.GetRoles()))
 	return nil
 }
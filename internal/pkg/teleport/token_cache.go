@@ -0,0 +1,192 @@
+package teleport
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+	"github.com/gravitational/teleport/api/types"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+const DefaultTokenResyncInterval = 5 * time.Minute
+
+// TokenCache keeps the Teleport join tokens in memory, indexed by name and by
+// their `cluster` label, so that validity checks do not list every token on
+// the auth server for every cluster. It is a manager Runnable that relists
+// the tokens every ResyncInterval. Tokens created or deleted by the operator
+// are written through; a name that is not cached is looked up in Teleport,
+// so tokens created elsewhere are found before the next resync.
+type TokenCache struct {
+	Log            logr.Logger
+	ResyncInterval time.Duration
+
+	clients *ClientProvider
+
+	mu        sync.RWMutex
+	synced    bool
+	byName    map[string]types.ProvisionToken
+	byCluster map[string]map[string]struct{}
+}
+
+func NewTokenCache(clients *ClientProvider) *TokenCache {
+	c := &TokenCache{
+		Log:            logr.Discard(),
+		ResyncInterval: DefaultTokenResyncInterval,
+		clients:        clients,
+	}
+	c.reset()
+	return c
+}
+
+// Start implements manager.Runnable.
+func (c *TokenCache) Start(ctx context.Context) error {
+	for {
+		if err := c.Resync(ctx); err != nil && !IsNotConnected(err) {
+			c.Log.Error(err, "Failed to resync the Teleport join token cache")
+		}
+
+		timer := time.NewTimer(c.ResyncInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+func (c *TokenCache) NeedLeaderElection() bool {
+	return false
+}
+
+// Resync replaces the cache content with the tokens currently in Teleport.
+func (c *TokenCache) Resync(ctx context.Context) error {
+	teleportClient, err := c.clients.Client()
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	tokens, err := teleportClient.GetTokens(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+	for _, token := range tokens {
+		c.add(token)
+	}
+	c.synced = true
+	return nil
+}
+
+// Invalidate drops all cached tokens. The next lookup by cluster relists
+// them from Teleport.
+func (c *TokenCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+}
+
+// Get returns the named token, looking it up in Teleport if it is not
+// cached. It returns a trace.NotFound error if the token does not exist.
+func (c *TokenCache) Get(ctx context.Context, name string) (types.ProvisionToken, error) {
+	c.mu.RLock()
+	token, ok := c.byName[name]
+	c.mu.RUnlock()
+	if ok {
+		return token, nil
+	}
+
+	teleportClient, err := c.clients.Client()
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	token, err = teleportClient.GetToken(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	c.Upsert(token)
+	return token, nil
+}
+
+// ForCluster returns the tokens labelled with the given register name. The
+// cache is synced first if it has not been yet.
+func (c *TokenCache) ForCluster(ctx context.Context, registerName string) ([]types.ProvisionToken, error) {
+	c.mu.RLock()
+	synced := c.synced
+	c.mu.RUnlock()
+	if !synced {
+		if err := c.Resync(ctx); err != nil {
+			return nil, microerror.Mask(err)
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tokens := make([]types.ProvisionToken, 0, len(c.byCluster[registerName]))
+	for name := range c.byCluster[registerName] {
+		tokens = append(tokens, c.byName[name])
+	}
+	return tokens, nil
+}
+
+// List returns every cached token. Callers wanting an up-to-date view call
+// Resync first.
+func (c *TokenCache) List() []types.ProvisionToken {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tokens := make([]types.ProvisionToken, 0, len(c.byName))
+	for _, token := range c.byName {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// Upsert adds or replaces a token, after it was written to Teleport.
+func (c *TokenCache) Upsert(token types.ProvisionToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(token.GetName())
+	c.add(token)
+}
+
+// Delete removes a token, after it was deleted from Teleport.
+func (c *TokenCache) Delete(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(name)
+}
+
+func (c *TokenCache) reset() {
+	c.synced = false
+	c.byName = map[string]types.ProvisionToken{}
+	c.byCluster = map[string]map[string]struct{}{}
+}
+
+func (c *TokenCache) add(token types.ProvisionToken) {
+	c.byName[token.GetName()] = token
+	registerName := token.GetMetadata().Labels[key.TokenClusterLabel]
+	if c.byCluster[registerName] == nil {
+		c.byCluster[registerName] = map[string]struct{}{}
+	}
+	c.byCluster[registerName][token.GetName()] = struct{}{}
+}
+
+func (c *TokenCache) remove(name string) {
+	token, ok := c.byName[name]
+	if !ok {
+		return
+	}
+	delete(c.byName, name)
+	registerName := token.GetMetadata().Labels[key.TokenClusterLabel]
+	delete(c.byCluster[registerName], name)
+	if len(c.byCluster[registerName]) == 0 {
+		delete(c.byCluster, registerName)
+	}
+}
@@ -0,0 +1,97 @@
+package teleport
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gravitational/teleport/api/types"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+// countingClient counts the token reads that reach Teleport.
+type countingClient struct {
+	*test.FakeTeleportClient
+	gets  atomic.Int32
+	lists atomic.Int32
+}
+
+func (c *countingClient) GetToken(ctx context.Context, name string) (types.ProvisionToken, error) {
+	c.gets.Add(1)
+	return c.FakeTeleportClient.GetToken(ctx, name)
+}
+
+func (c *countingClient) GetTokens(ctx context.Context) ([]types.ProvisionToken, error) {
+	c.lists.Add(1)
+	return c.FakeTeleportClient.GetTokens(ctx)
+}
+
+func Test_TokenCache(t *testing.T) {
+	ctx := context.TODO()
+	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
+
+	teleportClient := &countingClient{FakeTeleportClient: test.NewTeleportClient(test.FakeTeleportClientConfig{
+		Tokens: []types.ProvisionToken{
+			test.NewToken("node-token", test.ClusterName, []string{key.RoleNode}),
+			test.NewToken("kube-token", test.ClusterName, []string{key.RoleKube}),
+			test.NewToken("other-token", "other-cluster", []string{key.RoleKube}),
+		},
+	})}
+	tele := New(test.NamespaceName, &config.Config{}, test.NewMockTokenGenerator("new-token"))
+	tele.Clients.SetClient(teleportClient, nil)
+
+	// The first lookup by cluster lists the tokens once.
+	tokens, err := tele.Tokens.ForCluster(ctx, registerName)
+	test.CheckError(t, false, err)
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens for %s, actual %d", registerName, len(tokens))
+	}
+
+	// Validity checks are then served from the cache.
+	for i := 0; i < 10; i++ {
+		valid, err := tele.IsTokenValid(ctx, registerName, "kube-token", key.RoleKube)
+		test.CheckError(t, false, err)
+		if !valid {
+			t.Fatalf("expected kube-token to be valid")
+		}
+	}
+	if lists, gets := teleportClient.lists.Load(), teleportClient.gets.Load(); lists != 1 || gets != 0 {
+		t.Fatalf("expected 1 list and 0 gets, actual %d lists and %d gets", lists, gets)
+	}
+
+	// A token created outside the operator is looked up by name.
+	err = teleportClient.FakeTeleportClient.UpsertToken(ctx, test.NewToken("external-token", test.ClusterName, []string{key.RoleKube}))
+	test.CheckError(t, false, err)
+	valid, err := tele.IsTokenValid(ctx, registerName, "external-token", key.RoleKube)
+	test.CheckError(t, false, err)
+	if !valid || teleportClient.gets.Load() != 1 {
+		t.Fatalf("expected external-token to be looked up once and be valid, actual valid %t after %d gets", valid, teleportClient.gets.Load())
+	}
+
+	// Tokens the operator generates and deletes are written through.
+	name, err := tele.GenerateToken(ctx, registerName, []string{key.RoleApp})
+	test.CheckError(t, false, err)
+	valid, err = tele.IsTokenValid(ctx, registerName, name, key.RoleApp)
+	test.CheckError(t, false, err)
+	if !valid || teleportClient.gets.Load() != 1 {
+		t.Fatalf("expected generated token to be served from the cache, actual valid %t after %d gets", valid, teleportClient.gets.Load())
+	}
+
+	tele.Tokens.Delete("node-token")
+	tokens, err = tele.Tokens.ForCluster(ctx, registerName)
+	test.CheckError(t, false, err)
+	if len(tokens) != 3 {
+		t.Fatalf("expected 3 tokens for %s after delete, actual %d", registerName, len(tokens))
+	}
+
+	// Invalidating forces the next lookup by cluster to list again.
+	tele.Tokens.Invalidate()
+	tokens, err = tele.Tokens.ForCluster(ctx, registerName)
+	test.CheckError(t, false, err)
+	if len(tokens) != 4 || teleportClient.lists.Load() != 2 {
+		t.Fatalf("expected 4 tokens after relisting, actual %d after %d lists", len(tokens), teleportClient.lists.Load())
+	}
+}
@@ -0,0 +1,251 @@
+package teleport
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/go-logr/logr"
+	"github.com/gravitational/teleport/api/types"
+	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/metrics"
+)
+
+const DefaultTokenJanitorInterval = 1 * time.Hour
+
+// neverExpires stands in for the expiry of tokens without one.
+var neverExpires = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// TokenJanitor deletes the join tokens the operator no longer needs:
+// superseded tokens of a cluster that were replaced by newer ones, and
+// orphaned tokens of clusters that no longer exist. The Cluster reconciler
+// deletes superseded tokens right after storing new ones; as a manager
+// Runnable the janitor also sweeps all tokens every Interval to catch what
+// was left behind. In DryRun mode, it only logs and counts the tokens it
+// would delete.
+type TokenJanitor struct {
+	Log      logr.Logger
+	Interval time.Duration
+	DryRun   bool
+
+	teleport *Teleport
+}
+
+func NewTokenJanitor(t *Teleport) *TokenJanitor {
+	return &TokenJanitor{
+		Log:      logr.Discard(),
+		Interval: DefaultTokenJanitorInterval,
+		teleport: t,
+	}
+}
+
+// Start implements manager.Runnable. The first sweep runs after one
+// Interval, once the clusters had a chance to be reconciled.
+func (j *TokenJanitor) Start(ctx context.Context) error {
+	for {
+		timer := time.NewTimer(j.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		if err := j.Sweep(ctx); err != nil && !IsNotConnected(err) {
+			j.Log.Error(err, "Failed to sweep Teleport join tokens")
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Only the
+// leader deletes tokens.
+func (j *TokenJanitor) NeedLeaderElection() bool {
+	return true
+}
+
+// DeleteSuperseded deletes every token of the cluster except the current
+// ones. It must only be called by the reconciler of that cluster, once the
+// current tokens are stored. It returns the number of tokens deleted.
+func (j *TokenJanitor) DeleteSuperseded(ctx context.Context, log logr.Logger, registerName string, current ...string) (int, error) {
+	tokens, err := j.teleport.Tokens.ForCluster(ctx, registerName)
+	if err != nil {
+		return 0, microerror.Mask(err)
+	}
+	var superseded []types.ProvisionToken
+	for _, token := range tokens {
+		if !slices.Contains(current, token.GetName()) {
+			superseded = append(superseded, token)
+		}
+	}
+	return j.delete(ctx, log, superseded, metrics.TokenReasonSuperseded)
+}
+
+// Sweep relists the tokens in Teleport and deletes those of the operator's
+// clusters that are orphaned or superseded. The current tokens of a cluster
+// are the ones recorded in its TeleportCluster status.
+func (j *TokenJanitor) Sweep(ctx context.Context) error {
+	if err := j.teleport.Tokens.Resync(ctx); err != nil {
+		return microerror.Mask(err)
+	}
+
+	clusters := &capi.ClusterList{}
+	if err := j.teleport.Client.List(ctx, clusters); err != nil {
+		return microerror.Mask(err)
+	}
+	teleportClusters := &v1alpha1.TeleportClusterList{}
+	if err := j.teleport.Client.List(ctx, teleportClusters); err != nil {
+		return microerror.Mask(err)
+	}
+
+	// Map the register name of every existing cluster to the status of its
+	// join tokens, if it has been reconciled yet. Clusters that have not
+	// been are resolved the way the reconciler will register them.
+	managementClusterName := j.teleport.Config().ManagementClusterName
+	byKey := map[client.ObjectKey]*v1alpha1.TeleportCluster{}
+	for i := range teleportClusters.Items {
+		teleportCluster := &teleportClusters.Items[i]
+		byKey[client.ObjectKeyFromObject(teleportCluster)] = teleportCluster
+	}
+	live := map[string]*v1alpha1.TeleportClusterStatus{}
+	for i := range clusters.Items {
+		cluster := &clusters.Items[i]
+		teleportCluster := byKey[client.ObjectKeyFromObject(cluster)]
+		if teleportCluster != nil && teleportCluster.Status.RegisterName != "" {
+			live[teleportCluster.Status.RegisterName] = &teleportCluster.Status
+		} else {
+			live[j.teleport.registerName(cluster, teleportCluster)] = nil
+		}
+	}
+
+	byCluster := map[string][]types.ProvisionToken{}
+	for _, token := range j.teleport.Tokens.List() {
+		registerName := token.GetMetadata().Labels[key.TokenClusterLabel]
+		if !isOwnedToken(token, managementClusterName, live) {
+			continue
+		}
+		byCluster[registerName] = append(byCluster[registerName], token)
+	}
+
+	for registerName, tokens := range byCluster {
+		log := j.Log.WithValues("registerName", registerName)
+		status, ok := live[registerName]
+		if !ok {
+			if _, err := j.delete(ctx, log, tokens, metrics.TokenReasonOrphaned); err != nil {
+				return microerror.Mask(err)
+			}
+			continue
+		}
+		if status == nil {
+			continue
+		}
+		if _, err := j.delete(ctx, log, supersededTokens(tokens, status), metrics.TokenReasonSuperseded); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+	return nil
+}
+
+func (j *TokenJanitor) delete(ctx context.Context, log logr.Logger, tokens []types.ProvisionToken, reason string) (int, error) {
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+	teleportClient, err := j.teleport.Clients.Client()
+	if err != nil {
+		return 0, microerror.Mask(err)
+	}
+
+	deleted := 0
+	for _, token := range tokens {
+		// Token names are secrets, so they are never logged.
+		tokenLog := log.WithValues("reason", reason, "roles", token.GetMetadata().Labels[key.TokenRolesLabel], "expiresAt", token.Expiry())
+		if j.DryRun {
+			tokenLog.Info("Would delete teleport join token (dry run)")
+			metrics.TokenCollected(reason, true)
+			continue
+		}
+		if err := j.teleport.deleteToken(ctx, teleportClient, token); err != nil {
+			return deleted, microerror.Mask(err)
+		}
+		metrics.TokenCollected(reason, false)
+		tokenLog.Info("Deleted teleport join token")
+		deleted++
+	}
+	return deleted, nil
+}
+
+// supersededTokens returns the tokens replaced by one of the current tokens
+// in status, leaving out the retiring ones. A token is only superseded by a current token with the same
+// roles that expires no earlier, so that a token just generated by a
+// concurrent reconcile, and not yet recorded in the status, is kept.
+func supersededTokens(tokens []types.ProvisionToken, status *v1alpha1.TeleportClusterStatus) []types.ProvisionToken {
+	var current []string
+	for _, tokenStatus := range []*v1alpha1.JoinTokenStatus{status.NodeJoinToken, status.KubeJoinToken} {
+		if tokenStatus != nil {
+			current = append(current, tokenStatus.Name)
+		}
+	}
+	// Retiring tokens are retired by the Cluster reconciler.
+	retiring := make([]string, 0, len(status.RetiringJoinTokens))
+	for _, tokenStatus := range status.RetiringJoinTokens {
+		retiring = append(retiring, tokenStatus.Name)
+	}
+
+	latest := map[string]time.Time{}
+	for _, token := range tokens {
+		if !slices.Contains(current, token.GetName()) {
+			continue
+		}
+		roles := rolesKey(token)
+		expiry := token.Expiry()
+		if expiry.IsZero() {
+			// Tokens that never expire, like kubernetes join tokens,
+			// supersede every other token with the same roles.
+			expiry = neverExpires
+		}
+		if expiry.After(latest[roles]) {
+			latest[roles] = expiry
+		}
+	}
+
+	var superseded []types.ProvisionToken
+	for _, token := range tokens {
+		if slices.Contains(current, token.GetName()) || slices.Contains(retiring, token.GetName()) {
+			continue
+		}
+		expiry, ok := latest[rolesKey(token)]
+		if ok && !token.Expiry().After(expiry) {
+			superseded = append(superseded, token)
+		}
+	}
+	return superseded
+}
+
+// isOwnedToken reports whether the token was generated by the operator of
+// this management cluster. Tokens generated before the management-cluster
+// label was introduced are only recognised when they are labelled with the
+// exact register name of one of the live clusters: a register name prefix
+// would also match clusters of other management clusters sharing Teleport,
+// so such tokens are never collected as orphans.
+func isOwnedToken(token types.ProvisionToken, managementClusterName string, live map[string]*v1alpha1.TeleportClusterStatus) bool {
+	if managementClusterName == "" {
+		return false
+	}
+	labels := token.GetMetadata().Labels
+	if owner, ok := labels[key.TokenManagementClusterLabel]; ok {
+		return owner == managementClusterName
+	}
+	_, ok := live[labels[key.TokenClusterLabel]]
+	return ok
+}
+
+// rolesKey identifies the set of roles a token grants, whatever their order.
+func rolesKey(token types.ProvisionToken) string {
+	roles := systemRolesToStrings(token.GetRoles())
+	slices.Sort(roles)
+	return key.RolesToString(roles)
+}
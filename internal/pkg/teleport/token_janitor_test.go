@@ -0,0 +1,199 @@
+package teleport
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/api/types"
+
+	"github.com/giantswarm/teleport-operator/api/v1alpha1"
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+)
+
+func Test_TokenJanitor_Sweep(t *testing.T) {
+	now := time.Now()
+	registerName := key.GetRegisterName(test.ManagementClusterName, test.ClusterName)
+
+	foreignToken := test.NewToken("foreign-token", "other-cluster", []string{key.RoleKube})
+	metadata := foreignToken.GetMetadata()
+	metadata.Labels[key.TokenClusterLabel] = "other-management-cluster-other-cluster"
+	metadata.Labels[key.TokenManagementClusterLabel] = "other-management-cluster"
+	foreignToken.SetMetadata(metadata)
+
+	// Tokens of clusters whose TeleportCluster status is not populated yet,
+	// registered under a name other than the prefixed cluster name.
+	ownedToken := func(name, registerName string) types.ProvisionToken {
+		token := test.NewToken(name, registerName, []string{key.RoleKube})
+		metadata := token.GetMetadata()
+		metadata.Labels[key.TokenClusterLabel] = registerName
+		metadata.Labels[key.TokenManagementClusterLabel] = test.ManagementClusterName
+		token.SetMetadata(metadata)
+		return token
+	}
+
+	newTokens := func() []types.ProvisionToken {
+		return []types.ProvisionToken{
+			test.NewToken("node-token", test.ClusterName, []string{key.RoleNode}, now.Add(24*time.Hour)),
+			test.NewToken("kube-token", test.ClusterName, []string{key.RoleKube}, now.Add(720*time.Hour)),
+			test.NewToken("old-node-token", test.ClusterName, []string{key.RoleNode}, now.Add(time.Hour)),
+			test.NewToken("old-kube-token", test.ClusterName, []string{key.RoleKube}, now.Add(10*time.Hour)),
+			test.NewToken("pending-node-token", test.ClusterName, []string{key.RoleNode}, now.Add(25*time.Hour)),
+			test.NewToken("retiring-node-token", test.ClusterName, []string{key.RoleNode}, now.Add(2*time.Hour)),
+			ownedToken("orphaned-token", key.GetRegisterName(test.ManagementClusterName, "deleted-cluster")),
+			test.NewToken("legacy-orphaned-token", "deleted-cluster", []string{key.RoleKube}),
+			test.NewToken("unreconciled-token", "new-cluster", []string{key.RoleKube}),
+			ownedToken("management-cluster-token", test.ManagementClusterName),
+			ownedToken("overridden-token", "custom-register-name"),
+			foreignToken,
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		dryRun         bool
+		expectedTokens []string
+	}{
+		{
+			name:   "case 0: Delete superseded and orphaned tokens, keeping retiring ones, unlabelled orphans and those of clusters not reconciled yet",
+			dryRun: false,
+			expectedTokens: []string{
+				"foreign-token",
+				"kube-token",
+				"legacy-orphaned-token",
+				"management-cluster-token",
+				"node-token",
+				"overridden-token",
+				"pending-node-token",
+				"retiring-node-token",
+				"unreconciled-token",
+			},
+		},
+		{
+			name:   "case 1: Keep all tokens in dry-run mode",
+			dryRun: true,
+			expectedTokens: []string{
+				"foreign-token",
+				"kube-token",
+				"legacy-orphaned-token",
+				"management-cluster-token",
+				"node-token",
+				"old-kube-token",
+				"old-node-token",
+				"orphaned-token",
+				"overridden-token",
+				"pending-node-token",
+				"retiring-node-token",
+				"unreconciled-token",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			teleportCluster := test.NewTeleportCluster(test.ClusterName, test.NamespaceName, v1alpha1.TeleportClusterSpec{})
+			teleportCluster.Status = v1alpha1.TeleportClusterStatus{
+				RegisterName:  registerName,
+				NodeJoinToken: NewJoinTokenStatus("node-token", []string{key.RoleNode}, now.Add(24*time.Hour)),
+				KubeJoinToken: NewJoinTokenStatus("kube-token", []string{key.RoleKube}, now.Add(720*time.Hour)),
+				RetiringJoinTokens: []v1alpha1.RetiringJoinTokenStatus{
+					(&ClusterSettings{TokenGracePeriod: time.Hour}).NewRetiringJoinTokenStatus("retiring-node-token", []string{key.RoleNode}, now.Add(2*time.Hour), now),
+				},
+			}
+			fakeClient, err := test.NewFakeK8sClientFromObjects(
+				test.NewCluster(test.ClusterName, test.NamespaceName, nil, time.Time{}),
+				test.NewCluster("new-cluster", test.NamespaceName, nil, time.Time{}),
+				test.NewCluster(test.ManagementClusterName, test.NamespaceName, nil, time.Time{}),
+				test.NewCluster("overridden", test.NamespaceName, nil, time.Time{}),
+				test.NewTeleportCluster("overridden", test.NamespaceName, v1alpha1.TeleportClusterSpec{RegisterName: "custom-register-name"}),
+				teleportCluster,
+			)
+			if err != nil {
+				t.Fatalf("failed to create fake client: %v", err)
+			}
+
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{Tokens: newTokens()})
+			tele := New(test.NamespaceName, &config.Config{ManagementClusterName: test.ManagementClusterName}, test.NewMockTokenGenerator(test.NewTokenName))
+			tele.Client = fakeClient
+			tele.Clients.SetClient(teleportClient, nil)
+			tele.Janitor.DryRun = tc.dryRun
+
+			ctx := context.TODO()
+			err = tele.Janitor.Sweep(ctx)
+			test.CheckError(t, false, err)
+
+			tokens, err := teleportClient.GetTokens(ctx)
+			test.CheckError(t, false, err)
+			var names []string
+			for _, token := range tokens {
+				names = append(names, token.GetName())
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tc.expectedTokens, ",") {
+				t.Fatalf("expected tokens %v, actual %v", tc.expectedTokens, names)
+			}
+
+			// The cache must agree with Teleport.
+			cached := tele.Tokens.List()
+			if len(cached) != len(tokens) {
+				t.Fatalf("expected %d cached tokens, actual %d", len(tokens), len(cached))
+			}
+		})
+	}
+}
+
+func Test_TokenJanitor_Sweep_PrefixedManagementCluster(t *testing.T) {
+	now := time.Now()
+	ctx := context.TODO()
+
+	// Management clusters "gauss" and "gauss-2" share Teleport. The
+	// unlabelled tokens of gauss-2 start with the "gauss-" register name
+	// prefix, so they must not be taken for orphans of gauss.
+	newToken := func(name, registerName string, expiry time.Time) types.ProvisionToken {
+		token := test.NewToken(name, registerName, []string{key.RoleKube}, expiry)
+		metadata := token.GetMetadata()
+		metadata.Labels[key.TokenClusterLabel] = registerName
+		token.SetMetadata(metadata)
+		return token
+	}
+	teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{Tokens: []types.ProvisionToken{
+		newToken("kube-token", "gauss-foo", now.Add(720*time.Hour)),
+		newToken("old-kube-token", "gauss-foo", now.Add(time.Hour)),
+		newToken("gauss-2-kube-token", "gauss-2-foo", now.Add(720*time.Hour)),
+		newToken("old-gauss-2-kube-token", "gauss-2-foo", now.Add(time.Hour)),
+	}})
+
+	teleportCluster := test.NewTeleportCluster("foo", test.NamespaceName, v1alpha1.TeleportClusterSpec{})
+	teleportCluster.Status = v1alpha1.TeleportClusterStatus{
+		RegisterName:  "gauss-foo",
+		KubeJoinToken: NewJoinTokenStatus("kube-token", []string{key.RoleKube}, now.Add(720*time.Hour)),
+	}
+	fakeClient, err := test.NewFakeK8sClientFromObjects(
+		test.NewCluster("foo", test.NamespaceName, nil, time.Time{}),
+		teleportCluster,
+	)
+	if err != nil {
+		t.Fatalf("failed to create fake client: %v", err)
+	}
+
+	tele := New(test.NamespaceName, &config.Config{ManagementClusterName: "gauss"}, test.NewMockTokenGenerator(test.NewTokenName))
+	tele.Client = fakeClient
+	tele.Clients.SetClient(teleportClient, nil)
+	test.CheckError(t, false, tele.Janitor.Sweep(ctx))
+
+	tokens, err := teleportClient.GetTokens(ctx)
+	test.CheckError(t, false, err)
+	var names []string
+	for _, token := range tokens {
+		names = append(names, token.GetName())
+	}
+	sort.Strings(names)
+	expected := []string{"gauss-2-kube-token", "kube-token", "old-gauss-2-kube-token"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected tokens %v, actual %v", expected, names)
+	}
+}
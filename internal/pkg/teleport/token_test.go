@@ -62,11 +62,12 @@ func Test_GenerateToken(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			teleport := New(test.NamespaceName, &config.Config{}, test.NewMockTokenGenerator(test.TokenName))
-			teleport.TeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
 				FailsList:   tc.failsList,
 				FailsDelete: tc.failsDelete,
 				FailsUpsert: tc.failsUpsert,
 			})
+			teleport.Clients.SetClient(teleportClient, nil)
 
 			ctx := context.TODO()
 			tokenName, err := teleport.GenerateToken(ctx, tc.registerName, tc.tokenType)
@@ -76,7 +77,7 @@ func Test_GenerateToken(t *testing.T) {
 				return
 			}
 
-			generatedToken, err := teleport.TeleportClient.GetToken(ctx, tokenName)
+			generatedToken, err := teleportClient.GetToken(ctx, tokenName)
 			test.CheckError(t, false, err)
 			if err == nil {
 				expectedExpiryTime := time.Now().Add(tc.expectedExpiry)
@@ -113,7 +114,7 @@ func Test_IsTokenValid(t *testing.T) {
 		tokenName      string
 		tokenType      string
 		tokens         []types.ProvisionToken
-		failsList      bool
+		failsGet       bool
 		expectError    bool
 		expectedResult bool
 	}{
@@ -142,11 +143,11 @@ func Test_IsTokenValid(t *testing.T) {
 			expectedResult: false,
 		},
 		{
-			name:         "case 3: Service should fail when token list cannot be retrieved",
+			name:         "case 3: Service should fail when the token cannot be retrieved",
 			registerName: key.GetRegisterName(test.ManagementClusterName, test.ClusterName),
 			tokenName:    test.TokenName,
 			tokenType:    test.TokenTypeKube,
-			failsList:    true,
+			failsGet:     true,
 			expectError:  true,
 		},
 		{
@@ -170,10 +171,11 @@ func Test_IsTokenValid(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			teleport := New(test.NamespaceName, &config.Config{}, token.NewGenerator())
-			teleport.TeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{
-				Tokens:    tc.tokens,
-				FailsList: tc.failsList,
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
+				Tokens:   tc.tokens,
+				FailsGet: tc.failsGet,
 			})
+			teleport.Clients.SetClient(teleportClient, nil)
 
 			ctx := context.TODO()
 			isValid, err := teleport.IsTokenValid(ctx, tc.registerName, tc.tokenName, tc.tokenType)
@@ -224,6 +226,16 @@ func Test_DeleteToken(t *testing.T) {
 			failsDelete:  true,
 			expectError:  true,
 		},
+		{
+			name:         "case 4: Delete every token of the cluster",
+			registerName: key.GetRegisterName(test.ManagementClusterName, test.ClusterName),
+			token:        test.NewToken(test.NewTokenName, test.ClusterName, []string{"node"}),
+			tokens: []types.ProvisionToken{
+				test.NewToken(test.TokenName, test.ClusterName, []string{"kube"}),
+				test.NewToken(test.NewTokenName, test.ClusterName, []string{"node"}),
+			},
+			expectDeleted: true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -234,15 +246,16 @@ func Test_DeleteToken(t *testing.T) {
 			log := ctrl.Log.WithName("test")
 
 			teleport := New(test.NamespaceName, &config.Config{}, token.NewGenerator())
-			teleport.TeleportClient = test.NewTeleportClient(test.FakeTeleportClientConfig{
+			teleportClient := test.NewTeleportClient(test.FakeTeleportClientConfig{
 				FailsDelete: tc.failsDelete,
 				Tokens:      tc.tokens,
 			})
+			teleport.Clients.SetClient(teleportClient, nil)
 
 			err := teleport.DeleteToken(ctx, log, tc.registerName)
 			test.CheckError(t, tc.expectError, err)
 			if err == nil {
-				storedToken, err = teleport.TeleportClient.GetToken(ctx, tc.token.GetName())
+				storedToken, err = teleportClient.GetToken(ctx, tc.token.GetName())
 
 				if tc.expectDeleted && err == nil {
 					t.Fatalf("token %v was not deleted", storedToken)
@@ -250,6 +263,9 @@ func Test_DeleteToken(t *testing.T) {
 				if !tc.expectDeleted && err != nil {
 					t.Fatalf("token %v was unexpectedly deleted", tc.token)
 				}
+				if tokens, _ := teleportClient.GetTokens(ctx); tc.expectDeleted && len(tokens) != 0 {
+					t.Fatalf("expected all tokens of the cluster to be deleted, actual %d left", len(tokens))
+				}
 			}
 		})
 	}
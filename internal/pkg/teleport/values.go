@@ -0,0 +1,227 @@
+package teleport
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/giantswarm/microerror"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+// ValuesPatch is a values document with the values the operator manages
+// patched in. Keys the operator does not manage are kept as they are.
+type ValuesPatch struct {
+	// Values is the patched values document.
+	Values string
+	// ManagedPaths are the paths of the values the operator manages, sorted:
+	// the root keys, and the keys of the nested blocks prefixed with their
+	// root key, e.g. `teleport-kube-agent.authToken`.
+	ManagedPaths []string
+	// DriftedPaths are the managed paths whose values were added, changed or
+	// removed by the patch, sorted.
+	DriftedPaths []string
+}
+
+// Changes reports whether writing the patch would change the ConfigMap's
+// values or its managed paths annotation.
+func (p *ValuesPatch) Changes(configMap *corev1.ConfigMap) bool {
+	return len(p.DriftedPaths) > 0 || configMap.GetAnnotations()[key.ManagedValuesAnnotation] != strings.Join(p.ManagedPaths, ",")
+}
+
+// GetManagedValuesPaths returns the paths of the values the operator manages
+// in the ConfigMap, as recorded in its annotation. It returns nil for a
+// ConfigMap without the annotation, e.g. one written before the annotation
+// was introduced.
+func GetManagedValuesPaths(configMap *corev1.ConfigMap) []string {
+	s, ok := configMap.GetAnnotations()[key.ManagedValuesAnnotation]
+	if !ok {
+		return nil
+	}
+	paths := []string{}
+	for _, path := range strings.Split(s, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// PatchValues patches the values of the desired document into the current
+// one. Values are compared semantically, so formatting does not count as
+// drift. The previously managed paths that are no longer desired are
+// removed. The current document is returned unchanged if nothing
+// drifted. The rootKeys are the keys of the nested blocks, see
+// key.ValuesLayouts.RootKeys.
+func PatchValues(current, desired string, managed []string, rootKeys []string) (*ValuesPatch, error) {
+	currentRoot, err := parseValuesNode(current)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	desiredRoot, err := parseValuesNode(desired)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	desiredPaths := valuesPaths(desiredRoot, rootKeys)
+	patch := &ValuesPatch{Values: current}
+	for _, path := range managed {
+		if _, ok := desiredPaths[path]; !ok && removeValuesPath(currentRoot, path, rootKeys) {
+			patch.DriftedPaths = append(patch.DriftedPaths, path)
+		}
+	}
+	// Paths are set in document order, so that values patched into an empty
+	// document render as the desired one.
+	for _, path := range orderedValuesPaths(desiredRoot, rootKeys) {
+		patch.ManagedPaths = append(patch.ManagedPaths, path)
+		value := desiredPaths[path]
+		if existing := lookupValuesPath(currentRoot, path, rootKeys); existing != nil && equalValues(existing, value) {
+			continue
+		}
+		setValuesPath(currentRoot, path, value, rootKeys)
+		patch.DriftedPaths = append(patch.DriftedPaths, path)
+	}
+	slices.Sort(patch.ManagedPaths)
+	slices.Sort(patch.DriftedPaths)
+
+	if len(patch.DriftedPaths) > 0 {
+		var b bytes.Buffer
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(currentRoot); err != nil {
+			return nil, microerror.Mask(fmt.Errorf("failed to render YAML: %w", err))
+		}
+		if err := enc.Close(); err != nil {
+			return nil, microerror.Mask(fmt.Errorf("failed to render YAML: %w", err))
+		}
+		patch.Values = b.String()
+	}
+	return patch, nil
+}
+
+// parseValuesNode parses a values document into its root mapping. An empty
+// document yields an empty mapping.
+func parseValuesNode(values string) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(values), &doc); err != nil {
+		return nil, microerror.Mask(fmt.Errorf("failed to parse YAML: %w", err))
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, microerror.Mask(fmt.Errorf("malformed values: expected a mapping at the root"))
+	}
+	return root, nil
+}
+
+// orderedValuesPaths returns the paths of the values of a document in
+// document order: its root keys, and the keys of the nested blocks instead of
+// the blocks themselves.
+func orderedValuesPaths(root *yaml.Node, rootKeys []string) []string {
+	var paths []string
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i].Value, root.Content[i+1]
+		if !slices.Contains(rootKeys, k) || v.Kind != yaml.MappingNode {
+			paths = append(paths, k)
+			continue
+		}
+		for j := 0; j+1 < len(v.Content); j += 2 {
+			paths = append(paths, k+"."+v.Content[j].Value)
+		}
+	}
+	return paths
+}
+
+func valuesPaths(root *yaml.Node, rootKeys []string) map[string]*yaml.Node {
+	paths := map[string]*yaml.Node{}
+	for _, path := range orderedValuesPaths(root, rootKeys) {
+		paths[path] = lookupValuesPath(root, path, rootKeys)
+	}
+	return paths
+}
+
+// valuesParent returns the mapping holding path and the key of path in it.
+// With create, a missing nested block is added.
+func valuesParent(root *yaml.Node, path string, rootKeys []string, create bool) (*yaml.Node, string) {
+	rootKey, k, ok := strings.Cut(path, ".")
+	if !ok || !slices.Contains(rootKeys, rootKey) {
+		return root, path
+	}
+	nested := mappingValue(root, rootKey)
+	if nested != nil && nested.Kind == yaml.MappingNode {
+		return nested, k
+	}
+	if !create {
+		return nil, k
+	}
+	block := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingValue(root, rootKey, block)
+	return block, k
+}
+
+func lookupValuesPath(root *yaml.Node, path string, rootKeys []string) *yaml.Node {
+	parent, k := valuesParent(root, path, rootKeys, false)
+	if parent == nil {
+		return nil
+	}
+	return mappingValue(parent, k)
+}
+
+func setValuesPath(root *yaml.Node, path string, value *yaml.Node, rootKeys []string) {
+	parent, k := valuesParent(root, path, rootKeys, true)
+	setMappingValue(parent, k, value)
+}
+
+// removeValuesPath removes path from the document and reports whether it
+// was present.
+func removeValuesPath(root *yaml.Node, path string, rootKeys []string) bool {
+	parent, k := valuesParent(root, path, rootKeys, false)
+	if parent == nil {
+		return false
+	}
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == k {
+			parent.Content = slices.Delete(parent.Content, i, i+2)
+			return true
+		}
+	}
+	return false
+}
+
+func mappingValue(mapping *yaml.Node, k string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == k {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(mapping *yaml.Node, k string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == k {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}, value)
+}
+
+// equalValues reports whether two values decode to the same data.
+func equalValues(a, b *yaml.Node) bool {
+	var av, bv interface{}
+	if err := a.Decode(&av); err != nil {
+		return false
+	}
+	if err := b.Decode(&bv); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
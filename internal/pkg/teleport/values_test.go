@@ -0,0 +1,121 @@
+package teleport
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+func Test_PatchValues(t *testing.T) {
+	dual, err := key.GetConfigmapDataFromTemplate("tok", key.JoinMethodToken, "proxy:443", "kube", "", []string{key.RoleKube}, nil, nil, key.DefaultValuesLayouts(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nested, err := key.GetConfigmapDataFromTemplate("tok", key.JoinMethodToken, "proxy:443", "kube", "", []string{key.RoleKube}, nil, nil, key.DefaultValuesLayouts(), "0.11.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nestedPaths := []string{
+		"teleport-kube-agent.authToken",
+		"teleport-kube-agent.kubeClusterName",
+		"teleport-kube-agent.proxyAddr",
+		"teleport-kube-agent.roles",
+	}
+	dualPaths := append([]string{"authToken", "kubeClusterName", "proxyAddr", "roles"}, nestedPaths...)
+
+	testCases := []struct {
+		name           string
+		current        string
+		desired        string
+		managed        []string
+		expectedValues string
+		expectedDrift  []string
+		expectError    bool
+	}{
+		{
+			name:           "case 0: Render the desired values into an empty document",
+			desired:        dual,
+			expectedValues: dual,
+			expectedDrift:  dualPaths,
+		},
+		{
+			name:           "case 1: Keep values that did not drift",
+			current:        nested,
+			desired:        nested,
+			managed:        nestedPaths,
+			expectedValues: nested,
+		},
+		{
+			name:           "case 2: Ignore formatting and key order",
+			current:        "teleport-kube-agent:\n  kubeClusterName: kube\n  roles: 'kube'\n  proxyAddr: proxy:443\n  authToken: tok\n",
+			desired:        nested,
+			managed:        nestedPaths,
+			expectedValues: "teleport-kube-agent:\n  kubeClusterName: kube\n  roles: 'kube'\n  proxyAddr: proxy:443\n  authToken: tok\n",
+		},
+		{
+			name:           "case 3: Keep values the operator does not manage",
+			current:        "# Set by the platform team.\nresources:\n  limits:\n    memory: 1Gi\nteleport-kube-agent:\n  roles: \"kube\"\n  authToken: \"old\"\n  highAvailability:\n    replicaCount: 2\n  proxyAddr: \"proxy:443\"\n  kubeClusterName: \"kube\"\n",
+			desired:        nested,
+			managed:        nestedPaths,
+			expectedValues: "# Set by the platform team.\nresources:\n  limits:\n    memory: 1Gi\nteleport-kube-agent:\n  roles: \"kube\"\n  authToken: \"tok\"\n  highAvailability:\n    replicaCount: 2\n  proxyAddr: \"proxy:443\"\n  kubeClusterName: \"kube\"\n",
+			expectedDrift:  []string{"teleport-kube-agent.authToken"},
+		},
+		{
+			name:           "case 4: Restore edited and deleted managed values",
+			current:        "teleport-kube-agent:\n  roles: \"kube,app\"\n  authToken: \"tok\"\n  kubeClusterName: \"kube\"\n",
+			desired:        nested,
+			managed:        nestedPaths,
+			expectedValues: "teleport-kube-agent:\n  roles: \"kube\"\n  authToken: \"tok\"\n  kubeClusterName: \"kube\"\n  proxyAddr: \"proxy:443\"\n",
+			expectedDrift:  []string{"teleport-kube-agent.proxyAddr", "teleport-kube-agent.roles"},
+		},
+		{
+			name:           "case 5: Remove managed values that are no longer rendered",
+			current:        "priorityClassName: \"high\"\n" + dual,
+			desired:        nested,
+			managed:        dualPaths,
+			expectedValues: "priorityClassName: \"high\"\n" + nested,
+			expectedDrift:  []string{"authToken", "kubeClusterName", "proxyAddr", "roles"},
+		},
+		{
+			name:           "case 6: Only patch the desired values without managed paths",
+			current:        "priorityClassName: \"high\"\n" + dual,
+			desired:        nested,
+			expectedValues: "priorityClassName: \"high\"\n" + dual,
+		},
+		{
+			name:        "case 7: Fail on values that are not a mapping",
+			current:     "- roles\n",
+			desired:     nested,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			patch, err := PatchValues(tc.current, tc.desired, tc.managed, key.DefaultValuesLayouts().RootKeys())
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if patch.Values != tc.expectedValues {
+				t.Fatalf("expected values:\n%s\nactual:\n%s", tc.expectedValues, patch.Values)
+			}
+			if !reflect.DeepEqual(patch.DriftedPaths, tc.expectedDrift) {
+				t.Fatalf("expected drifted paths %v, actual %v", tc.expectedDrift, patch.DriftedPaths)
+			}
+			expectedManaged := nestedPaths
+			if tc.desired == dual {
+				expectedManaged = dualPaths
+			}
+			if !reflect.DeepEqual(patch.ManagedPaths, expectedManaged) {
+				t.Fatalf("expected managed paths %v, actual %v", expectedManaged, patch.ManagedPaths)
+			}
+		})
+	}
+}
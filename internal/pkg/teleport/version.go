@@ -0,0 +1,116 @@
+package teleport
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+)
+
+// AgentTeleportVersion is the Teleport version the kube agents are pinned to
+// with `teleportVersionOverride`, checked against Teleport's version skew
+// rules: an agent must not be newer than the auth server, nor more than one
+// major version behind it.
+type AgentTeleportVersion struct {
+	// Version is the version to render, empty to keep the chart's bundled
+	// version.
+	Version string
+	// ServerVersion is the version of the Teleport auth server, empty if
+	// unknown.
+	ServerVersion string
+	// ServerVersionUnknown is set while the operator has not learned the
+	// server version from a ping yet, so Version could not be checked
+	// against it, or derived from it.
+	ServerVersionUnknown bool
+	// Reason is the reason of the key.TeleportVersionCompatibleCondition.
+	Reason string
+	// Message explains Reason.
+	Message string
+}
+
+// Clamped reports whether the configured version violated the version skew
+// rules and was replaced with the server version.
+func (v *AgentTeleportVersion) Clamped() bool {
+	return v.Reason == key.TeleportVersionNewerThanServerReason || v.Reason == key.TeleportVersionTooOldReason
+}
+
+// ResolveAgentTeleportVersion checks the configured Teleport version against
+// the server version. A version newer than the server, or more than one
+// major version behind it, is clamped to the server version. Without a
+// configured version, the server version is used if fromServer is set.
+// Versions that are not semver cannot be checked and are kept as they are.
+func ResolveAgentTeleportVersion(configured, serverVersion string, fromServer bool) AgentTeleportVersion {
+	v := AgentTeleportVersion{Version: configured, ServerVersion: serverVersion}
+	server, serverErr := semver.NewVersion(strings.TrimPrefix(serverVersion, "v"))
+
+	if configured == "" {
+		if fromServer && serverErr == nil {
+			v.Version = serverVersion
+			v.Reason = key.TeleportVersionFromServerReason
+			v.Message = fmt.Sprintf("Using the Teleport server version %s", serverVersion)
+			return v
+		}
+		v.Reason = key.TeleportVersionCompatibleReason
+		v.Message = "No Teleport version is configured, the chart's bundled version is used"
+		return v
+	}
+
+	agent, err := semver.NewVersion(strings.TrimPrefix(configured, "v"))
+	switch {
+	case serverVersion == "":
+		v.Reason = key.TeleportVersionUncheckedReason
+		v.Message = fmt.Sprintf("Teleport version %s is not checked, the server version is unknown", configured)
+		return v
+	case err != nil || serverErr != nil:
+		v.Reason = key.TeleportVersionUncheckedReason
+		v.Message = fmt.Sprintf("Teleport version %s cannot be compared with the server version %s", configured, serverVersion)
+		return v
+	}
+
+	switch {
+	case agent.GreaterThan(server):
+		v.Version = serverVersion
+		v.Reason = key.TeleportVersionNewerThanServerReason
+		v.Message = fmt.Sprintf("Teleport version %s is newer than the server version %s, using %s", configured, serverVersion, serverVersion)
+	case agent.Major()+1 < server.Major():
+		v.Version = serverVersion
+		v.Reason = key.TeleportVersionTooOldReason
+		v.Message = fmt.Sprintf("Teleport version %s is more than one major version behind the server version %s, using %s", configured, serverVersion, serverVersion)
+	default:
+		v.Reason = key.TeleportVersionCompatibleReason
+		v.Message = fmt.Sprintf("Teleport version %s is compatible with the server version %s", configured, serverVersion)
+	}
+	return v
+}
+
+// AgentTeleportVersion resolves the configured Teleport version against the
+// version of the connected Teleport server, see ResolveAgentTeleportVersion.
+// The server is pinged if its version is not known yet; if that fails, the
+// last known server version is used.
+func (t *Teleport) AgentTeleportVersion(ctx context.Context) AgentTeleportVersion {
+	cfg := t.Config()
+	serverVersion, err := t.Clients.ServerVersion(ctx)
+	if err != nil {
+		return t.LastAgentTeleportVersion()
+	}
+	return ResolveAgentTeleportVersion(cfg.TeleportVersion, serverVersion, cfg.TeleportVersionFromServer)
+}
+
+// LastAgentTeleportVersion resolves the configured Teleport version against
+// the last known server version, without pinging the server.
+func (t *Teleport) LastAgentTeleportVersion() AgentTeleportVersion {
+	cfg := t.Config()
+	serverVersion, known := t.Clients.LastServerVersion()
+	v := ResolveAgentTeleportVersion(cfg.TeleportVersion, serverVersion, cfg.TeleportVersionFromServer)
+	v.ServerVersionUnknown = !known
+	return v
+}
+
+// TeleportVersionOverride returns the version to render as the kube agents'
+// teleportVersionOverride, resolved against the last known server version.
+func (t *Teleport) TeleportVersionOverride() string {
+	return t.LastAgentTeleportVersion().Version
+}
@@ -0,0 +1,122 @@
+package teleport
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/teleport-operator/internal/pkg/config"
+	"github.com/giantswarm/teleport-operator/internal/pkg/key"
+	"github.com/giantswarm/teleport-operator/internal/pkg/test"
+	"github.com/giantswarm/teleport-operator/internal/pkg/token"
+)
+
+func Test_ResolveAgentTeleportVersion(t *testing.T) {
+	testCases := []struct {
+		name            string
+		configured      string
+		serverVersion   string
+		fromServer      bool
+		expectedVersion string
+		expectedReason  string
+	}{
+		{"case 0: Keep a version equal to the server's", "18.7.6", "18.7.6", false, "18.7.6", key.TeleportVersionCompatibleReason},
+		{"case 1: Keep a version one major behind the server's", "v17.0.0", "18.7.6", false, "v17.0.0", key.TeleportVersionCompatibleReason},
+		{"case 2: Clamp a version newer than the server's", "18.8.0", "18.7.6", false, "18.7.6", key.TeleportVersionNewerThanServerReason},
+		{"case 3: Clamp a version two majors behind the server's", "16.4.0", "18.7.6", false, "18.7.6", key.TeleportVersionTooOldReason},
+		{"case 4: Keep a version while the server's is unknown", "18.8.0", "", false, "18.8.0", key.TeleportVersionUncheckedReason},
+		{"case 5: Keep a version that is not semver", "master-abc", "18.7.6", false, "master-abc", key.TeleportVersionUncheckedReason},
+		{"case 6: Keep the chart's version without a configured one", "", "18.7.6", false, "", key.TeleportVersionCompatibleReason},
+		{"case 7: Derive the version from the server's", "", "18.7.6", true, "18.7.6", key.TeleportVersionFromServerReason},
+		{"case 8: Derive nothing while the server's is unknown", "", "", true, "", key.TeleportVersionCompatibleReason},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := ResolveAgentTeleportVersion(tc.configured, tc.serverVersion, tc.fromServer)
+			if v.Version != tc.expectedVersion || v.Reason != tc.expectedReason {
+				t.Fatalf("expected %q/%s, actual %q/%s (%s)", tc.expectedVersion, tc.expectedReason, v.Version, v.Reason, v.Message)
+			}
+			if clamped := tc.expectedReason == key.TeleportVersionNewerThanServerReason || tc.expectedReason == key.TeleportVersionTooOldReason; v.Clamped() != clamped {
+				t.Fatalf("expected clamped %v, actual %v", clamped, v.Clamped())
+			}
+		})
+	}
+}
+
+func Test_RenderConfigMapValues_ClampedTeleportVersion(t *testing.T) {
+	ctx := context.TODO()
+	tele := New(test.NamespaceName, &config.Config{
+		AppName:         test.AppName,
+		ProxyAddr:       test.ProxyAddr,
+		TeleportVersion: test.TeleportVersionForNestedNew,
+	}, token.NewGenerator())
+	tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{ServerVersion: test.TeleportVersionForNested}), &config.IdentityConfig{LastRead: time.Now()})
+
+	// The server version is only known once the client has been pinged.
+	if v := tele.TeleportVersionOverride(); v != test.TeleportVersionForNestedNew {
+		t.Fatalf("expected the configured version before the first ping, actual %q", v)
+	}
+	if v := tele.AgentTeleportVersion(ctx); !v.Clamped() || v.ServerVersion != test.TeleportVersionForNested {
+		t.Fatalf("expected the version to be clamped to the server version, actual %+v", v)
+	}
+
+	values, err := tele.RenderConfigMapValues(test.ClusterName, test.TokenName, key.JoinMethodToken, []string{key.RoleKube}, nil, nil, tele.TeleportVersionOverride(), test.AppVersionNested)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(values, `teleportVersionOverride: "`+test.TeleportVersionForNested+`"`) {
+		t.Fatalf("expected the server version as teleportVersionOverride, actual:\n%s", values)
+	}
+
+	// A reconnect keeps the last known server version until the new client
+	// answers a ping, so the version stays clamped.
+	tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{FailsPing: true}), &config.IdentityConfig{LastRead: time.Now()})
+	if v, known := tele.Clients.LastServerVersion(); v != test.TeleportVersionForNested || !known {
+		t.Fatalf("expected the last known server version after a reconnect, actual %q", v)
+	}
+	if v := tele.AgentTeleportVersion(ctx); !v.Clamped() || v.Version != test.TeleportVersionForNested {
+		t.Fatalf("expected the version to stay clamped while the server does not answer, actual %+v", v)
+	}
+	if v := tele.TeleportVersionOverride(); v != test.TeleportVersionForNested {
+		t.Fatalf("expected the clamped version after a reconnect, actual %q", v)
+	}
+}
+
+func Test_ClusterTeleportVersion_ServerVersionUnknown(t *testing.T) {
+	ctx := context.TODO()
+	tele := New(test.NamespaceName, &config.Config{
+		AppName:         test.AppName,
+		ProxyAddr:       test.ProxyAddr,
+		TeleportVersion: test.TeleportVersionForNestedNew,
+	}, token.NewGenerator())
+	tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{FailsPing: true, ServerVersion: test.TeleportVersionForNested}), &config.IdentityConfig{LastRead: time.Now()})
+	cluster := test.NewCluster(test.ClusterName, test.NamespaceName, nil, time.Time{})
+	configMap := test.NewConfigMap(test.ClusterName, test.AppName, test.NamespaceName, test.TokenName, []string{key.RoleKube})
+
+	// Until the server version is known, the cluster keeps the version in
+	// its values rather than the unchecked configured one.
+	if v := tele.AgentTeleportVersion(ctx); !v.ServerVersionUnknown || v.Reason != key.TeleportVersionUncheckedReason {
+		t.Fatalf("expected an unchecked version, actual %+v", v)
+	}
+	version, err := tele.ClusterTeleportVersion(ctx, nil, cluster, configMap)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != test.TeleportVersion {
+		t.Fatalf("expected the version in the values %q, actual %q", test.TeleportVersion, version)
+	}
+
+	tele.Clients.SetClient(test.NewTeleportClient(test.FakeTeleportClientConfig{ServerVersion: test.TeleportVersionForNested}), &config.IdentityConfig{LastRead: time.Now()})
+	if _, err := tele.Clients.ServerVersion(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	version, err = tele.ClusterTeleportVersion(ctx, nil, cluster, configMap)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != test.TeleportVersionForNested {
+		t.Fatalf("expected the version clamped to the server version %q, actual %q", test.TeleportVersionForNested, version)
+	}
+}
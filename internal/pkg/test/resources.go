@@ -6,6 +6,7 @@ import (
 	"time"
 
 	appv1alpha1 "github.com/giantswarm/apiextensions-application/api/v1alpha1"
+	apidefaults "github.com/gravitational/teleport/api/defaults"
 	teleportTypes "github.com/gravitational/teleport/api/types"
 	corev1 "k8s.io/api/core/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
@@ -18,6 +19,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
 
+	teleportv1alpha1 "github.com/giantswarm/teleport-operator/api/v1alpha1"
 	"github.com/giantswarm/teleport-operator/internal/pkg/key"
 	"github.com/giantswarm/teleport-operator/internal/pkg/token"
 )
@@ -200,6 +202,8 @@ func NewToken(tokenName, clusterName string, roles []string, expiry ...time.Time
 			newToken.Spec.Roles = append(newToken.Spec.Roles, teleportTypes.RoleApp)
 		case key.RoleNode:
 			newToken.Spec.Roles = append(newToken.Spec.Roles, teleportTypes.RoleNode)
+		case key.RoleDatabase:
+			newToken.Spec.Roles = append(newToken.Spec.Roles, teleportTypes.RoleDatabase)
 		}
 	}
 	return newToken
@@ -221,10 +225,29 @@ func NewCluster(name, namespace string, finalizers []string, deletionTimestamp t
 	return cluster
 }
 
-func NewKubeServer(clusterName, hostId, hostName string) teleportTypes.KubeServer {
+func NewTeleportCluster(name, namespace string, spec teleportv1alpha1.TeleportClusterSpec) *teleportv1alpha1.TeleportCluster {
+	return &teleportv1alpha1.TeleportCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: spec,
+	}
+}
+
+func NewKubeServer(clusterName, hostId, hostName string, heartbeat ...time.Time) teleportTypes.KubeServer {
+	var heartbeatTime time.Time
+	if len(heartbeat) > 0 {
+		heartbeatTime = heartbeat[0]
+	} else {
+		heartbeatTime = time.Now()
+	}
+	expiryTime := heartbeatTime.Add(apidefaults.ServerAnnounceTTL)
+
 	return &teleportTypes.KubernetesServerV3{
 		Metadata: teleportTypes.Metadata{
-			Name: clusterName,
+			Name:    clusterName,
+			Expires: &expiryTime,
 		},
 		Spec: teleportTypes.KubernetesServerSpecV3{
 			HostID:   hostId,
@@ -251,6 +274,40 @@ func NewHelmRelease(name, namespace string) *unstructured.Unstructured {
 	return hr
 }
 
+// NewInfrastructureCluster returns a CAPI infrastructure cluster of the given
+// kind and version with the given spec, and the reference to it for the
+// Cluster's spec.infrastructureRef.
+func NewInfrastructureCluster(kind, version, name, namespace string, spec map[string]interface{}) (*unstructured.Unstructured, capi.ContractVersionedObjectReference) {
+	infraCluster := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	infraCluster.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "infrastructure.cluster.x-k8s.io",
+		Version: version,
+		Kind:    kind,
+	})
+	infraCluster.SetName(name)
+	infraCluster.SetNamespace(namespace)
+	return infraCluster, capi.ContractVersionedObjectReference{
+		APIGroup: "infrastructure.cluster.x-k8s.io",
+		Kind:     kind,
+		Name:     name,
+	}
+}
+
+// NewAWSClusterRoleIdentity returns a cluster-scoped AWSClusterRoleIdentity
+// assuming the given role.
+func NewAWSClusterRoleIdentity(name, roleARN string) *unstructured.Unstructured {
+	identity := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"roleARN": roleARN},
+	}}
+	identity.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "infrastructure.cluster.x-k8s.io",
+		Version: "v1beta2",
+		Kind:    "AWSClusterRoleIdentity",
+	})
+	identity.SetName(name)
+	return identity
+}
+
 func NewApp(name, namespace string) *appv1alpha1.App {
 	return &appv1alpha1.App{
 		ObjectMeta: metav1.ObjectMeta{
@@ -270,6 +327,19 @@ func newFakeRESTMapper() *apimeta.DefaultRESTMapper {
 		Version: "v2",
 		Kind:    "HelmRelease",
 	}, apimeta.RESTScopeNamespace)
+	for kind, version := range map[string]string{
+		"AWSCluster":        "v1beta2",
+		"AzureCluster":      "v1beta1",
+		"GCPCluster":        "v1beta1",
+		"GCPManagedCluster": "v1beta1",
+	} {
+		rm.Add(schema.GroupVersionKind{Group: "infrastructure.cluster.x-k8s.io", Version: version, Kind: kind}, apimeta.RESTScopeNamespace)
+	}
+	rm.Add(schema.GroupVersionKind{
+		Group:   "infrastructure.cluster.x-k8s.io",
+		Version: "v1beta2",
+		Kind:    "AWSClusterRoleIdentity",
+	}, apimeta.RESTScopeRoot)
 	return rm
 }
 
@@ -278,13 +348,17 @@ func NewFakeK8sClientFromObjects(objects ...client.Object) (client.Client, error
 	schemeBuilder := runtime.SchemeBuilder{}
 	schemeBuilder.Register(capi.AddToScheme)
 	schemeBuilder.Register(appv1alpha1.AddToScheme)
+	schemeBuilder.Register(teleportv1alpha1.AddToScheme)
 
 	err := schemeBuilder.AddToScheme(scheme.Scheme)
 	if err != nil {
 		return nil, err
 	}
 
-	builder := clientfake.NewClientBuilder().WithScheme(scheme.Scheme).WithRESTMapper(newFakeRESTMapper())
+	builder := clientfake.NewClientBuilder().
+		WithScheme(scheme.Scheme).
+		WithRESTMapper(newFakeRESTMapper()).
+		WithStatusSubresource(&capi.Cluster{}, &teleportv1alpha1.TeleportCluster{}, &teleportv1alpha1.TeleportVersionRollout{})
 	if len(objects) > 0 {
 		builder = builder.WithObjects(objects...)
 	}
@@ -295,13 +369,17 @@ func NewFakeK8sClient(runtimeObjects []runtime.Object) (client.Client, error) {
 	schemeBuilder := runtime.SchemeBuilder{}
 	schemeBuilder.Register(capi.AddToScheme)
 	schemeBuilder.Register(appv1alpha1.AddToScheme)
+	schemeBuilder.Register(teleportv1alpha1.AddToScheme)
 
 	err := schemeBuilder.AddToScheme(scheme.Scheme)
 	if err != nil {
 		return nil, err
 	}
 
-	fakeK8sClientBuilder := clientfake.NewClientBuilder().WithScheme(scheme.Scheme).WithRESTMapper(newFakeRESTMapper())
+	fakeK8sClientBuilder := clientfake.NewClientBuilder().
+		WithScheme(scheme.Scheme).
+		WithRESTMapper(newFakeRESTMapper()).
+		WithStatusSubresource(&capi.Cluster{}, &teleportv1alpha1.TeleportCluster{}, &teleportv1alpha1.TeleportVersionRollout{})
 	if runtimeObjects != nil {
 		fakeK8sClientBuilder.WithRuntimeObjects(runtimeObjects...)
 	}
@@ -2,10 +2,11 @@ package test
 
 import (
 	"context"
-	"fmt"
+	"sync"
 
 	"github.com/gravitational/teleport/api/client/proto"
 	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/trace"
 	"github.com/pkg/errors"
 )
 
@@ -17,8 +18,13 @@ type FakeTeleportClientConfig struct {
 	FailsUpsert bool
 	FailsDelete bool
 	Tokens      []types.ProvisionToken
+	KubeServers []types.KubeServer
+	// ServerVersion is the Teleport version reported by Ping.
+	ServerVersion string
 }
 
+// FakeTeleportClient is an in-memory Client. It is safe for concurrent use,
+// like the real one, so that tests can run parallel reconciles against it.
 type FakeTeleportClient struct {
 	failsPing   bool
 	failsGet    bool
@@ -26,7 +32,12 @@ type FakeTeleportClient struct {
 	failsCreate bool
 	failsUpsert bool
 	failsDelete bool
+
+	serverVersion string
+
+	mu          sync.RWMutex
 	tokens      map[string]types.ProvisionToken
+	kubeServers []types.KubeServer
 }
 
 func NewTeleportClient(config FakeTeleportClientConfig) *FakeTeleportClient {
@@ -45,6 +56,9 @@ func NewTeleportClient(config FakeTeleportClientConfig) *FakeTeleportClient {
 		failsUpsert: config.FailsDelete,
 		failsDelete: config.FailsDelete,
 		tokens:      tokens,
+		kubeServers: config.KubeServers,
+
+		serverVersion: config.ServerVersion,
 	}
 }
 
@@ -53,24 +67,28 @@ func (c *FakeTeleportClient) Ping(ctx context.Context) (proto.PingResponse, erro
 	if c.failsPing {
 		err = errors.New("mock teleport client failed ping")
 	}
-	return proto.PingResponse{}, err
+	return proto.PingResponse{ServerVersion: c.serverVersion}, err
 }
 
 func (c *FakeTeleportClient) GetToken(ctx context.Context, name string) (types.ProvisionToken, error) {
 	if c.failsGet {
 		return nil, errors.New("mock teleport client failed to get token")
 	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	token, ok := c.tokens[name]
 	if ok {
 		return token, nil
 	}
-	return nil, fmt.Errorf("mock teleport client: token with name %s does not exist", name)
+	return nil, trace.NotFound("mock teleport client: token with name %s does not exist", name)
 }
 
 func (c *FakeTeleportClient) GetTokens(ctx context.Context) ([]types.ProvisionToken, error) {
 	if c.failsList {
 		return nil, errors.New("mock teleport client failed to get tokens")
 	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	var tokens []types.ProvisionToken
 	for _, token := range c.tokens {
 		tokens = append(tokens, token)
@@ -82,6 +100,8 @@ func (c *FakeTeleportClient) CreateToken(ctx context.Context, token types.Provis
 	if c.failsCreate {
 		return errors.New("mock teleport client failed to create token")
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.tokens[token.GetName()] = token
 	return nil
 }
@@ -90,6 +110,8 @@ func (c *FakeTeleportClient) UpsertToken(ctx context.Context, token types.Provis
 	if c.failsUpsert {
 		return errors.New("mock teleport client failed to upsert token")
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.tokens[token.GetName()] = token
 	return nil
 }
@@ -98,6 +120,14 @@ func (c *FakeTeleportClient) DeleteToken(ctx context.Context, name string) error
 	if c.failsDelete {
 		return errors.New("mock teleport client failed to delete token")
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.tokens, name)
 	return nil
 }
+
+func (c *FakeTeleportClient) GetKubernetesServers(ctx context.Context) ([]types.KubeServer, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]types.KubeServer(nil), c.kubeServers...), nil
+}
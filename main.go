@@ -20,6 +20,7 @@ import (
 	"context"
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -32,6 +33,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -39,6 +41,7 @@ import (
 
 	capi "sigs.k8s.io/cluster-api/api/core/v1beta2"
 
+	teleportv1alpha1 "github.com/giantswarm/teleport-operator/api/v1alpha1"
 	"github.com/giantswarm/teleport-operator/internal/controller"
 	"github.com/giantswarm/teleport-operator/internal/pkg/config"
 	"github.com/giantswarm/teleport-operator/internal/pkg/teleport"
@@ -56,6 +59,7 @@ func init() {
 	utilruntime.Must(capi.AddToScheme(scheme))
 	utilruntime.Must(appv1alpha1.AddToScheme(scheme))
 	utilruntime.Must(corev1.AddToScheme(scheme))
+	utilruntime.Must(teleportv1alpha1.AddToScheme(scheme))
 
 	//+kubebuilder:scaffold:scheme
 }
@@ -65,6 +69,9 @@ func main() {
 	var enableTeleportBot bool
 	var probeAddr string
 	var namespace string
+	var maxConcurrentReconciles int
+	var tokenJanitorInterval time.Duration
+	var tokenJanitorDryRun bool
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -75,6 +82,12 @@ func main() {
 		"Enable teleport bot for teleport-operator. "+
 			"Enabling this will ensure teleport bot configmap is created and app.spec.extraConfig is updated.")
 	flag.StringVar(&namespace, "namespace", "", "Namespace where operator is deployed")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"Maximum number of Clusters reconciled in parallel.")
+	flag.DurationVar(&tokenJanitorInterval, "token-janitor-interval", teleport.DefaultTokenJanitorInterval,
+		"Interval between two sweeps of superseded and orphaned Teleport join tokens.")
+	flag.BoolVar(&tokenJanitorDryRun, "token-janitor-dry-run", false,
+		"Only log and count the Teleport join tokens the token janitor would delete.")
 
 	opts := zap.Options{
 		Development: true,
@@ -130,17 +143,78 @@ func main() {
 
 	tele := teleport.New(namespace, config, token.NewGenerator())
 	tele.Client = mgr.GetClient()
+	tele.Clients.Log = ctrl.Log.WithName("teleport").WithName("ClientProvider")
+	if err := mgr.Add(tele.Clients); err != nil {
+		setupLog.Error(err, "unable to add Teleport client provider")
+		os.Exit(1)
+	}
+	tele.Tokens.Log = ctrl.Log.WithName("teleport").WithName("TokenCache")
+	if err := mgr.Add(tele.Tokens); err != nil {
+		setupLog.Error(err, "unable to add Teleport token cache")
+		os.Exit(1)
+	}
+	tele.KubeServers.Log = ctrl.Log.WithName("teleport").WithName("KubeServerCache")
+	if err := mgr.Add(tele.KubeServers); err != nil {
+		setupLog.Error(err, "unable to add Teleport Kubernetes server cache")
+		os.Exit(1)
+	}
+	tele.Janitor.Log = ctrl.Log.WithName("teleport").WithName("TokenJanitor")
+	tele.Janitor.Interval = tokenJanitorInterval
+	tele.Janitor.DryRun = tokenJanitorDryRun
+	if err := mgr.Add(tele.Janitor); err != nil {
+		setupLog.Error(err, "unable to add Teleport token janitor")
+		os.Exit(1)
+	}
+
+	// The ConfigReconciler hot-reloads the operator ConfigMap and hands every
+	// Cluster over to the ClusterReconciler through this channel.
+	configChanges := make(chan event.GenericEvent)
+	if err = (&controller.ConfigReconciler{
+		Client:        mgr.GetClient(),
+		Log:           ctrl.Log.WithName("controllers").WithName("Config"),
+		Teleport:      tele,
+		Namespace:     namespace,
+		ClusterEvents: configChanges,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Config")
+		os.Exit(1)
+	}
+
+	if err = (&controller.IdentityReconciler{
+		Client:    mgr.GetClient(),
+		Log:       ctrl.Log.WithName("controllers").WithName("Identity"),
+		Teleport:  tele,
+		Namespace: namespace,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Identity")
+		os.Exit(1)
+	}
+
 	if err = (&controller.ClusterReconciler{
-		Client:       mgr.GetClient(),
-		Log:          ctrl.Log.WithName("controllers").WithName("Cluster"),
-		Scheme:       mgr.GetScheme(),
-		Teleport:     tele,
-		IsBotEnabled: enableTeleportBot,
-		Namespace:    namespace,
+		Client:                  mgr.GetClient(),
+		Log:                     ctrl.Log.WithName("controllers").WithName("Cluster"),
+		Scheme:                  mgr.GetScheme(),
+		Teleport:                tele,
+		Recorder:                mgr.GetEventRecorder("teleport-operator"),
+		IsBotEnabled:            enableTeleportBot,
+		Namespace:               namespace,
+		ConfigChanges:           configChanges,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Cluster")
 		os.Exit(1)
 	}
+
+	if err = (&controller.RolloutReconciler{
+		Client:    mgr.GetClient(),
+		Log:       ctrl.Log.WithName("controllers").WithName("Rollout"),
+		Teleport:  tele,
+		Recorder:  mgr.GetEventRecorder("teleport-operator"),
+		Namespace: namespace,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Rollout")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {